@@ -102,3 +102,45 @@ func sign(signature []byte, priv ed25519.PrivateKey, hash crypto.Hash) []byte {
 func ExtractPublicKey(priv ed25519.PrivateKey) ed25519.PublicKey {
 	return ed25519.PublicKey(priv[32:])
 }
+
+// X25519PublicKey converts pub to the equivalent X25519 (Montgomery form)
+// public key, for use in Diffie-Hellman key exchange. It returns false if pub
+// is not a valid point.
+func X25519PublicKey(pub ed25519.PublicKey) ([32]byte, bool) {
+	if l := len(pub); l != ed25519.PublicKeySize {
+		panic("ed25519: bad public key length: " + strconv.Itoa(l))
+	}
+	var A edwards25519.ExtendedGroupElement
+	var publicKey [32]byte
+	copy(publicKey[:], pub)
+	if !A.FromBytes(&publicKey) {
+		return [32]byte{}, false
+	}
+	// u = (1 + y) / (1 - y)
+	var one, n, d, u edwards25519.FieldElement
+	edwards25519.FeOne(&one)
+	edwards25519.FeAdd(&n, &one, &A.Y)
+	edwards25519.FeSub(&d, &one, &A.Y)
+	edwards25519.FeInvert(&d, &d)
+	edwards25519.FeMul(&u, &n, &d)
+	var out [32]byte
+	edwards25519.FeToBytes(&out, &u)
+	return out, true
+}
+
+// X25519PrivateKey converts priv to the equivalent X25519 private key, for
+// use in Diffie-Hellman key exchange.
+func X25519PrivateKey(priv ed25519.PrivateKey) [32]byte {
+	if l := len(priv); l != ed25519.PrivateKeySize {
+		panic("ed25519: bad private key length: " + strconv.Itoa(l))
+	}
+	digest := sha512.Sum512(priv[:32])
+	var out [32]byte
+	copy(out[:], digest[:32])
+	// X25519 clamps the scalar itself, but clamp here too for compatibility
+	// with other implementations
+	out[0] &= 248
+	out[31] &= 127
+	out[31] |= 64
+	return out
+}
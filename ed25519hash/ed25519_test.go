@@ -7,6 +7,7 @@ import (
 	"testing"
 
 	"gitlab.com/NebulousLabs/Sia/crypto"
+	"golang.org/x/crypto/curve25519"
 	"lukechampine.com/us/ed25519hash/internal/edwards25519"
 )
 
@@ -78,3 +79,26 @@ func BenchmarkHashVerification(b *testing.B) {
 		Verify(pub, hash, signature)
 	}
 }
+
+func TestX25519(t *testing.T) {
+	for i := 0; i < 10; i++ {
+		pub, priv, _ := ed25519.GenerateKey(nil)
+		xpub, ok := X25519PublicKey(pub)
+		if !ok {
+			t.Fatal("failed to convert public key")
+		}
+		xpriv := X25519PrivateKey(priv)
+		derived, err := curve25519.X25519(xpriv[:], curve25519.Basepoint)
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(derived, xpub[:]) {
+			t.Fatal("converted keys do not match")
+		}
+	}
+	// invalid point
+	bad := make(ed25519.PublicKey, ed25519.PublicKeySize)
+	bad[0] = 2
+	if _, ok := X25519PublicKey(bad); ok {
+		t.Fatal("expected invalid point to be rejected")
+	}
+}
@@ -6,8 +6,10 @@ import (
 	"crypto/ed25519"
 	"encoding/hex"
 	"encoding/json"
+	"fmt"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -95,6 +97,55 @@ type HostSettings struct {
 	UploadBandwidthPrice   types.Currency     `json:"uploadBandwidthPrice"`
 	RevisionNumber         uint64             `json:"revisionNumber"`
 	Version                string             `json:"version"`
+
+	// Capabilities is nil if the host does not report its capabilities.
+	Capabilities *HostCapabilities `json:"capabilities,omitempty"`
+}
+
+// HostCapabilities lists the protocol features supported by a host.
+type HostCapabilities struct {
+	RPCs         []renterhost.Specifier `json:"rpcs"`
+	WriteActions []renterhost.Specifier `json:"writeActions"`
+	Ciphers      []renterhost.Specifier `json:"ciphers"`
+	// FreeReads indicates that the host serves Read RPCs without payment,
+	// even if the renter has not locked a contract.
+	FreeReads bool `json:"freeReads,omitempty"`
+}
+
+func containsSpecifier(ids []renterhost.Specifier, id renterhost.Specifier) bool {
+	for _, s := range ids {
+		if s == id {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsRPC reports whether the host supports the specified RPC. If the host
+// did not report its capabilities, all RPCs are assumed to be supported.
+func (hs HostSettings) SupportsRPC(id renterhost.Specifier) bool {
+	return hs.Capabilities == nil || containsSpecifier(hs.Capabilities.RPCs, id)
+}
+
+// SupportsWriteAction reports whether the host supports the specified Write
+// action type. If the host did not report its capabilities, all actions are
+// assumed to be supported.
+func (hs HostSettings) SupportsWriteAction(typ renterhost.Specifier) bool {
+	return hs.Capabilities == nil || containsSpecifier(hs.Capabilities.WriteActions, typ)
+}
+
+// SupportsCipher reports whether the host supports the specified cipher suite.
+// If the host did not report its capabilities, all cipher suites are assumed
+// to be supported.
+func (hs HostSettings) SupportsCipher(id renterhost.Specifier) bool {
+	return hs.Capabilities == nil || containsSpecifier(hs.Capabilities.Ciphers, id)
+}
+
+// SupportsFreeReads reports whether the host serves Read RPCs without a
+// contract. Unlike the other capabilities, this is not assumed if the host did
+// not report its capabilities.
+func (hs HostSettings) SupportsFreeReads() bool {
+	return hs.Capabilities != nil && hs.Capabilities.FreeReads
 }
 
 // ScannedHost groups a host's settings with its public key and other scan-
@@ -106,8 +157,15 @@ type ScannedHost struct {
 }
 
 // Scan dials the host with the given NetAddress and public key and requests
-// its settings.
-func Scan(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (host ScannedHost, err error) {
+// its settings. The settings are checked against DefaultSettingsCache: if the
+// host previously reported settings with a higher revision number, Scan
+// returns a *SettingsRollbackError. Otherwise, the settings are added to
+// DefaultSettingsCache.
+func Scan(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (ScannedHost, error) {
+	return DefaultSettingsCache.scan(ctx, addr, pubkey)
+}
+
+func scanSettings(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (host ScannedHost, err error) {
 	host.PublicKey = pubkey
 	dialStart := time.Now()
 	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", string(addr))
@@ -148,3 +206,123 @@ func Scan(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (h
 		return r.host, r.err
 	}
 }
+
+// A SettingsRollbackError is returned when a host reports settings with a
+// lower revision number than settings it previously reported.
+type SettingsRollbackError struct {
+	Host        HostPublicKey
+	OldRevision uint64
+	NewRevision uint64
+}
+
+// Error implements error.
+func (e *SettingsRollbackError) Error() string {
+	return fmt.Sprintf("host %v rolled back its settings from revision %v to %v", e.Host.ShortKey(), e.OldRevision, e.NewRevision)
+}
+
+type cachedSettings struct {
+	settings HostSettings
+	expires  time.Time
+}
+
+// A SettingsCache caches the settings reported by hosts, and ensures that
+// each host's settings revision number never decreases. It is safe for
+// concurrent use.
+//
+// Settings are only cached after being received over an authenticated
+// renter-host protocol session, so they are known to originate from the host.
+//
+// A host that legitimately resets its revision number (e.g. after being
+// restored from a backup) will be rejected until Forget is called.
+type SettingsCache struct {
+	ttl      time.Duration
+	mu       sync.Mutex
+	settings map[HostPublicKey]cachedSettings
+	// the highest revision number seen for each host; unlike settings, these
+	// do not expire
+	revisions map[HostPublicKey]uint64
+}
+
+// DefaultSettingsCache is the SettingsCache consulted by Scan. Since prices
+// are calculated from cached settings, the TTL is short: it is intended to
+// avoid redundant Settings RPCs when reconnecting, not to avoid them
+// altogether.
+var DefaultSettingsCache = NewSettingsCache(time.Minute)
+
+// Get returns the cached settings of the specified host, if they have not
+// expired.
+func (c *SettingsCache) Get(hostKey HostPublicKey) (HostSettings, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	cs, ok := c.settings[hostKey]
+	if !ok || time.Now().After(cs.expires) {
+		return HostSettings{}, false
+	}
+	return cs.settings, true
+}
+
+// Update adds the specified settings to the cache. If the host has previously
+// reported settings with a higher revision number, the cache is not modified
+// and a *SettingsRollbackError is returned.
+func (c *SettingsCache) Update(hostKey HostPublicKey, settings HostSettings) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if rev, ok := c.revisions[hostKey]; ok && settings.RevisionNumber < rev {
+		return &SettingsRollbackError{
+			Host:        hostKey,
+			OldRevision: rev,
+			NewRevision: settings.RevisionNumber,
+		}
+	}
+	c.revisions[hostKey] = settings.RevisionNumber
+	c.settings[hostKey] = cachedSettings{
+		settings: settings,
+		expires:  time.Now().Add(c.ttl),
+	}
+	return nil
+}
+
+// Forget removes the cached settings and revision number of the specified
+// host, so that its next settings are accepted regardless of their revision
+// number.
+func (c *SettingsCache) Forget(hostKey HostPublicKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.settings, hostKey)
+	delete(c.revisions, hostKey)
+}
+
+// Scan is like the package-level Scan function, but returns cached settings if
+// possible. Freshly-scanned settings are checked for rollbacks and added to
+// the cache.
+func (c *SettingsCache) Scan(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (ScannedHost, error) {
+	if settings, ok := c.Get(pubkey); ok {
+		return ScannedHost{
+			HostSettings: settings,
+			PublicKey:    pubkey,
+		}, nil
+	}
+	return c.scan(ctx, addr, pubkey)
+}
+
+// scan scans the host, checking its settings for rollbacks and adding them to
+// the cache.
+func (c *SettingsCache) scan(ctx context.Context, addr modules.NetAddress, pubkey HostPublicKey) (ScannedHost, error) {
+	host, err := scanSettings(ctx, addr, pubkey)
+	if err != nil {
+		return host, err
+	} else if err := c.Update(pubkey, host.HostSettings); err != nil {
+		return host, err
+	}
+	return host, nil
+}
+
+// NewSettingsCache returns an empty SettingsCache whose entries expire after
+// the specified duration.
+func NewSettingsCache(ttl time.Duration) *SettingsCache {
+	return &SettingsCache{
+		ttl:       ttl,
+		settings:  make(map[HostPublicKey]cachedSettings),
+		revisions: make(map[HostPublicKey]uint64),
+	}
+}
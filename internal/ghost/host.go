@@ -4,64 +4,87 @@ package ghost
 
 import (
 	"crypto/ed25519"
-	"log"
 	"net"
+	"sync"
+	"time"
 
 	"gitlab.com/NebulousLabs/Sia/crypto"
 	"gitlab.com/NebulousLabs/Sia/modules"
 	"gitlab.com/NebulousLabs/Sia/types"
 	"lukechampine.com/frand"
-	"lukechampine.com/us/ed25519hash"
 	"lukechampine.com/us/hostdb"
-	"lukechampine.com/us/renterhost"
+	"lukechampine.com/us/renterhost/server"
 )
 
-type hostContract struct {
-	proofDeadline types.BlockHeight
-	rev           types.FileContractRevision
-	sigs          [2]types.TransactionSignature
-	renterKey     types.SiaPublicKey
-	sectorRoots   []crypto.Hash
-	sectorData    map[crypto.Hash][renterhost.SectorSize]byte
+// sharedContractStore is a ContractStore that allows a contract to be locked by
+// multiple sessions at once. Tests frequently access the same contract from
+// multiple HostSets, which a real host would not permit.
+type sharedContractStore struct {
+	*server.EphemeralContractStore
 }
 
+func (cs sharedContractStore) LockContract(id types.FileContractID, timeout time.Duration) error {
+	_, err := cs.Contract(id)
+	return err
+}
+
+func (cs sharedContractStore) UnlockContract(id types.FileContractID) {}
+
 type Host struct {
 	addr        modules.NetAddress
-	secretKey   ed25519.PrivateKey
 	listener    net.Listener
-	contracts   map[types.FileContractID]*hostContract
-	blockHeight types.BlockHeight
-	logErrs     bool
+	srv         *server.Server
+	sectors     *server.EphemeralSectorStore
+	mu          sync.Mutex // protects settingsRev
+	settingsRev uint64
 }
 
 func (h *Host) PublicKey() hostdb.HostPublicKey {
-	return hostdb.HostKeyFromPublicKey(ed25519hash.ExtractPublicKey(h.secretKey))
+	return h.srv.PublicKey()
 }
 
 func (h *Host) Settings() hostdb.HostSettings {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	return hostdb.HostSettings{
 		NetAddress:         h.addr,
 		AcceptingContracts: true,
 		WindowSize:         144,
+		RevisionNumber:     h.settingsRev,
+		Capabilities:       h.srv.Capabilities(),
 		// ContractPrice:      types.SiacoinPrecision.Mul64(5),
 		// StoragePrice:       types.NewCurrency64(5),
 		// Collateral:         types.NewCurrency64(1),
 	}
 }
 
-func (h *Host) listen() error {
-	for {
-		conn, err := h.listener.Accept()
-		if err != nil {
-			return err
-		}
-		go func() {
-			err := h.handleConn(conn)
-			if err != nil && h.logErrs {
-				log.Println("ghost:", err)
-			}
-		}()
+// SetSettingsRevision sets the revision number of the host's settings.
+func (h *Host) SetSettingsRevision(rev uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.settingsRev = rev
+}
+
+// SetFreeReads sets whether the host serves Read RPCs without a contract. The
+// revision number of the host's settings is incremented, so that renters do
+// not reuse cached settings.
+func (h *Host) SetFreeReads(free bool) {
+	h.srv.SetFreeReads(free)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.settingsRev++
+}
+
+// CorruptSector flips a bit of the specified sector, without changing its
+// Merkle root. Renters that download the sector should reject the corrupted
+// data.
+func (h *Host) CorruptSector(root crypto.Hash) {
+	sector, err := h.sectors.Sector(root)
+	if err != nil {
+		return
 	}
+	sector[len(sector)/2] ^= 1
+	h.sectors.AddSector(root, sector)
 }
 
 func (h *Host) Close() error {
@@ -75,11 +98,12 @@ func New(addr string) (*Host, error) {
 		return nil, err
 	}
 	h := &Host{
-		addr:      modules.NetAddress(l.Addr().String()),
-		listener:  l,
-		secretKey: ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize)),
-		contracts: make(map[types.FileContractID]*hostContract),
+		addr:     modules.NetAddress(l.Addr().String()),
+		listener: l,
+		sectors:  server.NewEphemeralSectorStore(),
 	}
-	go h.listen()
+	key := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+	h.srv = server.New(key, h.Settings, sharedContractStore{server.NewEphemeralContractStore()}, h.sectors)
+	go h.srv.Serve(l)
 	return h, nil
 }
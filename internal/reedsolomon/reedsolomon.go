@@ -292,7 +292,8 @@ func (r *ReedSolomon) reconstruct(shards [][]byte, dataOnly bool) error {
 
 // SplitMulti splits data into blocks of shards, where each block has subsize
 // bytes. The shards must have sufficient capacity to hold the sharded data. The
-// length of the shards will be modified to fit their new contents.
+// length of the shards will be modified to fit their new contents. If data
+// does not fill the final block, the remainder is zeroed.
 func (r *ReedSolomon) SplitMulti(data []byte, shards [][]byte, subsize int) error {
 	chunkSize := r.DataShards * subsize
 	numChunks := len(data) / chunkSize
@@ -313,7 +314,11 @@ func (r *ReedSolomon) SplitMulti(data []byte, shards [][]byte, subsize int) erro
 	buf := bytes.NewBuffer(data)
 	for off := 0; buf.Len() > 0; off += subsize {
 		for i := 0; i < r.DataShards; i++ {
-			copy(shards[i][off:], buf.Next(subsize))
+			block := shards[i][off : off+subsize]
+			n := copy(block, buf.Next(subsize))
+			for j := range block[n:] {
+				block[n+j] = 0
+			}
 		}
 	}
 
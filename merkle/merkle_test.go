@@ -699,6 +699,48 @@ func TestBuildVerifyDiffProofTrim(t *testing.T) {
 	}
 }
 
+func TestBuildVerifyDiffProofUpdate(t *testing.T) {
+	const numSectors = 15
+	sectorRoots := make([]crypto.Hash, numSectors)
+	for i := range sectorRoots {
+		sectorRoots[i] = frand.Entropy256()
+	}
+	oldRoot := MetaRoot(sectorRoots)
+
+	var newSector15 [renterhost.SectorSize]byte
+	frand.Read(newSector15[:])
+	updateRoots := []crypto.Hash{frand.Entropy256(), frand.Entropy256(), frand.Entropy256()}
+	actions := []renterhost.RPCWriteAction{
+		{Type: renterhost.RPCWriteActionUpdate, A: 3, B: 64, Data: []byte{1, 2, 3}},
+		{Type: renterhost.RPCWriteActionSwap, A: 3, B: 9},
+		{Type: renterhost.RPCWriteActionAppend, Data: newSector15[:]},
+		{Type: renterhost.RPCWriteActionUpdate, A: 15, B: 0, Data: []byte{4, 5, 6}},
+		{Type: renterhost.RPCWriteActionUpdate, A: 3, B: 128, Data: []byte{7, 8, 9}},
+	}
+	treeHashes, leafHashes := BuildDiffProof(actions, sectorRoots)
+	if len(leafHashes) != 2 || leafHashes[0] != sectorRoots[3] || leafHashes[1] != sectorRoots[9] {
+		t.Fatal("BuildDiffProof produced wrong leaf hashes")
+	}
+
+	newRoot := MetaRoot([]crypto.Hash{
+		sectorRoots[0], sectorRoots[1], sectorRoots[2], updateRoots[2],
+		sectorRoots[4], sectorRoots[5], sectorRoots[6], sectorRoots[7],
+		sectorRoots[8], updateRoots[0], sectorRoots[10], sectorRoots[11],
+		sectorRoots[12], sectorRoots[13], sectorRoots[14], updateRoots[1],
+	})
+	if !VerifyDiffProofWithUpdates(actions, numSectors, treeHashes, leafHashes, oldRoot, newRoot, nil, updateRoots) {
+		t.Error("failed to verify proof produced by BuildDiffProof")
+	}
+	// verification should fail if the update roots are missing or wrong
+	if VerifyDiffProof(actions, numSectors, treeHashes, leafHashes, oldRoot, newRoot, nil) {
+		t.Error("VerifyDiffProof verified a proof without update roots")
+	}
+	updateRoots[0] = frand.Entropy256()
+	if VerifyDiffProofWithUpdates(actions, numSectors, treeHashes, leafHashes, oldRoot, newRoot, nil, updateRoots) {
+		t.Error("VerifyDiffProofWithUpdates verified a proof with an incorrect update root")
+	}
+}
+
 func BenchmarkBuildDiffProof(b *testing.B) {
 	const numSectors = 12
 	sectorRoots := make([]crypto.Hash, numSectors)
@@ -842,6 +884,32 @@ func BenchmarkReaderRoot(b *testing.B) {
 	}
 }
 
+func TestProofRoot(t *testing.T) {
+	var sector [renterhost.SectorSize]byte
+	frand.Read(sector[:])
+	for _, r := range []struct{ start, end int }{
+		{0, 1},
+		{0, SegmentsPerSector},
+		{10, 11},
+		{SegmentsPerSector - 1, SegmentsPerSector},
+		{SegmentsPerSector/2 - 3, SegmentsPerSector/2 + 7},
+	} {
+		proof := BuildProof(&sector, r.start, r.end, nil)
+		segments := sector[r.start*SegmentSize : r.end*SegmentSize]
+		if ProofRoot(proof, segments, r.start, r.end) != SectorRoot(&sector) {
+			t.Error("ProofRoot returned wrong root for unmodified segments")
+		}
+
+		// overwrite the segments; the same proof should produce the new root
+		modified := sector
+		frand.Read(modified[r.start*SegmentSize : r.end*SegmentSize])
+		segments = modified[r.start*SegmentSize : r.end*SegmentSize]
+		if ProofRoot(proof, segments, r.start, r.end) != SectorRoot(&modified) {
+			t.Error("ProofRoot returned wrong root for modified segments")
+		}
+	}
+}
+
 func TestRangeProofVerifier(t *testing.T) {
 	// same as TestBuildVerifyProof, but using RangeProofVerifier
 
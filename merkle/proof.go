@@ -105,7 +105,12 @@ func verifyProof(proof []crypto.Hash, subtreeRoot func(i, j int) crypto.Hash, st
 	if len(proof) != ProofSize(SegmentsPerSector, start, end) {
 		return false
 	}
+	return proofRoot(proof, subtreeRoot, start, end) == root
+}
 
+// proofRoot computes the Merkle root implied by a proof produced by
+// BuildProof. The proof must have the correct length.
+func proofRoot(proof []crypto.Hash, subtreeRoot func(i, j int) crypto.Hash, start, end int) crypto.Hash {
 	// we verify the proof by recursively enumerating subtrees, left to right,
 	// and calculating their Merkle root. If the subtree is inside the segment
 	// range, then we calculate its root by combining segRoots; if the subtree
@@ -137,7 +142,7 @@ func verifyProof(proof []crypto.Hash, subtreeRoot func(i, j int) crypto.Hash, st
 			return blake2b.SumPair(left, right)
 		}
 	}
-	return rec(0, SegmentsPerSector) == root
+	return rec(0, SegmentsPerSector)
 }
 
 // VerifyProof verifies a proof produced by BuildProof. Only sector-sized
@@ -160,6 +165,30 @@ func VerifyProof(proof []crypto.Hash, segments []byte, start, end int, root cryp
 	return verifyProof(proof, subtreeRoot, start, end, root)
 }
 
+// ProofRoot returns the Merkle root of the sector implied by a (valid) proof
+// produced by BuildProof and the segments it covers. Since the proof does not
+// depend on the contents of the segments, ProofRoot can be used to compute the
+// new Merkle root of a sector after overwriting the segments in [start, end).
+func ProofRoot(proof []crypto.Hash, segments []byte, start, end int) crypto.Hash {
+	if len(segments)%SegmentSize != 0 {
+		panic("ProofRoot: segments must be a multiple of SegmentSize")
+	} else if len(segments) != (end-start)*SegmentSize {
+		panic("ProofRoot: segments length does not match range")
+	} else if start < 0 || end > SegmentsPerSector || start > end || start == end {
+		panic("ProofRoot: illegal proof range")
+	} else if len(proof) != ProofSize(SegmentsPerSector, start, end) {
+		panic("ProofRoot: proof has wrong size")
+	}
+
+	var s appendStack
+	subtreeRoot := func(i, j int) crypto.Hash {
+		s.reset()
+		s.appendLeaves(segments[(i-start)*SegmentSize : (j-start)*SegmentSize])
+		return s.root()
+	}
+	return proofRoot(proof, subtreeRoot, start, end)
+}
+
 // BuildSectorRangeProof constructs a proof for the sector range [start, end).
 func BuildSectorRangeProof(sectorRoots []crypto.Hash, start, end int) []crypto.Hash {
 	if len(sectorRoots) == 0 {
@@ -240,6 +269,9 @@ func sectorsChanged(actions []renterhost.RPCWriteAction, numSectors int) []int {
 			sectorsChanged[int(action.A)] = struct{}{}
 			sectorsChanged[int(action.B)] = struct{}{}
 
+		case renterhost.RPCWriteActionUpdate:
+			sectorsChanged[int(action.A)] = struct{}{}
+
 		default:
 			panic("unknown or unsupported action type: " + action.Type.String())
 		}
@@ -256,7 +288,6 @@ func sectorsChanged(actions []renterhost.RPCWriteAction, numSectors int) []int {
 }
 
 // BuildDiffProof constructs a diff proof for the specified actions.
-// ActionUpdate is not supported.
 func BuildDiffProof(actions []renterhost.RPCWriteAction, sectorRoots []crypto.Hash) (treeHashes, leafHashes []crypto.Hash) {
 	proofIndices := sectorsChanged(actions, len(sectorRoots))
 	leafHashes = make([]crypto.Hash, len(proofIndices))
@@ -303,9 +334,18 @@ func PrecomputeAppendRoots(actions []renterhost.RPCWriteAction) []crypto.Hash {
 }
 
 // VerifyDiffProof verifies a proof produced by BuildDiffProof. ActionUpdate is
-// not supported. If appendRoots is non-nil, it is assumed to contain the
-// precomputed SectorRoots of all Append actions.
+// not supported; use VerifyDiffProofWithUpdates instead. If appendRoots is
+// non-nil, it is assumed to contain the precomputed SectorRoots of all Append
+// actions.
 func VerifyDiffProof(actions []renterhost.RPCWriteAction, numLeaves int, treeHashes, leafHashes []crypto.Hash, oldRoot, newRoot crypto.Hash, appendRoots []crypto.Hash) bool {
+	return VerifyDiffProofWithUpdates(actions, numLeaves, treeHashes, leafHashes, oldRoot, newRoot, appendRoots, nil)
+}
+
+// VerifyDiffProofWithUpdates is like VerifyDiffProof, but also supports
+// ActionUpdate. Since the new root of a sector modified by an Update action
+// cannot be computed from the action alone, updateRoots must contain the new
+// SectorRoot of each Update action, in order.
+func VerifyDiffProofWithUpdates(actions []renterhost.RPCWriteAction, numLeaves int, treeHashes, leafHashes []crypto.Hash, oldRoot, newRoot crypto.Hash, appendRoots, updateRoots []crypto.Hash) bool {
 	verifyMulti := func(proofIndices []int, treeHashes, leafHashes []crypto.Hash, numLeaves int, root crypto.Hash) bool {
 		var s proofStack
 		insertRange := func(i, j int) {
@@ -329,6 +369,16 @@ func VerifyDiffProof(actions []renterhost.RPCWriteAction, numLeaves int, treeHas
 		return s.root() == root
 	}
 
+	numUpdates := 0
+	for _, action := range actions {
+		if action.Type == renterhost.RPCWriteActionUpdate {
+			numUpdates++
+		}
+	}
+	if len(updateRoots) != numUpdates {
+		return false
+	}
+
 	// first use the original proof to construct oldRoot
 	proofIndices := sectorsChanged(actions, numLeaves)
 	if len(proofIndices) != len(leafHashes) {
@@ -339,7 +389,7 @@ func VerifyDiffProof(actions []renterhost.RPCWriteAction, numLeaves int, treeHas
 	}
 
 	// then modify the proof according to actions and construct the newRoot
-	newLeafHashes := modifyLeaves(leafHashes, actions, numLeaves, appendRoots)
+	newLeafHashes := modifyLeaves(leafHashes, actions, numLeaves, appendRoots, updateRoots)
 	newProofIndices := modifyProofRanges(proofIndices, actions, numLeaves)
 	numLeaves += len(newLeafHashes) - len(leafHashes)
 
@@ -371,7 +421,7 @@ func modifyProofRanges(proofIndices []int, actions []renterhost.RPCWriteAction,
 
 // modifyLeaves modifies the leaf hashes of a Merkle diff proof to verify a
 // post-modification Merkle diff proof for the specified actions.
-func modifyLeaves(leafHashes []crypto.Hash, actions []renterhost.RPCWriteAction, numSectors int, appendRoots []crypto.Hash) []crypto.Hash {
+func modifyLeaves(leafHashes []crypto.Hash, actions []renterhost.RPCWriteAction, numSectors int, appendRoots, updateRoots []crypto.Hash) []crypto.Hash {
 	// determine which sector index corresponds to each leaf hash
 	var indices []int
 	for _, action := range actions {
@@ -386,6 +436,8 @@ func modifyLeaves(leafHashes []crypto.Hash, actions []renterhost.RPCWriteAction,
 			}
 		case renterhost.RPCWriteActionSwap:
 			indices = append(indices, int(action.A), int(action.B))
+		case renterhost.RPCWriteActionUpdate:
+			indices = append(indices, int(action.A))
 
 		default:
 			panic("unknown or unsupported action type: " + action.Type.String())
@@ -418,6 +470,9 @@ func modifyLeaves(leafHashes []crypto.Hash, actions []renterhost.RPCWriteAction,
 			i, j := indexMap[int(action.A)], indexMap[int(action.B)]
 			leafHashes[i], leafHashes[j] = leafHashes[j], leafHashes[i]
 
+		case renterhost.RPCWriteActionUpdate:
+			leafHashes[indexMap[int(action.A)]], updateRoots = updateRoots[0], updateRoots[1:]
+
 		default:
 			panic("unknown or unsupported action type: " + action.Type.String())
 		}
@@ -0,0 +1,176 @@
+package renter
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renter/proto"
+	"lukechampine.com/us/renterhost"
+)
+
+// An AuditResult is the outcome of a single proof-of-storage audit.
+type AuditResult struct {
+	Host      hostdb.HostPublicKey
+	Contract  types.FileContractID
+	Timestamp time.Time
+	Sections  []renterhost.RPCReadRequestSection
+	Cost      types.Currency
+	// Passed is true if the host supplied valid proofs for every section.
+	// Failed is true if the host did not: either it sent invalid data, or it
+	// reported that it does not have the sector. If neither is true, the audit
+	// could not be completed (e.g. due to a network error, or because the host
+	// rejected the payment), and Err says why.
+	Passed bool
+	Failed bool
+	Err    error
+}
+
+// HostAuditStats summarizes the audits performed on a host.
+type HostAuditStats struct {
+	Passed      int
+	Failed      int
+	Errors      int
+	Cost        types.Currency
+	LastAudit   time.Time
+	LastFailure time.Time
+}
+
+// FailureRate returns the fraction of completed audits that the host failed.
+func (s HostAuditStats) FailureRate() float64 {
+	if s.Passed+s.Failed == 0 {
+		return 0
+	}
+	return float64(s.Failed) / float64(s.Passed+s.Failed)
+}
+
+// Healthy returns true if the host's FailureRate does not exceed
+// maxFailureRate. Hosts that have not completed any audits are healthy.
+func (s HostAuditStats) Healthy(maxFailureRate float64) bool {
+	return s.FailureRate() <= maxFailureRate
+}
+
+// An Auditor checks that hosts are still storing sector data by downloading
+// randomly-chosen segments, along with Merkle proofs of their inclusion in the
+// expected sectors. Each audit transfers only a few hundred bytes per segment,
+// so hosts can be audited continuously. The Auditor records the results of
+// each audit, which can then be used to inform host selection and repair.
+type Auditor struct {
+	mu    sync.Mutex
+	stats map[hostdb.HostPublicKey]HostAuditStats
+}
+
+// Audit downloads numSegments randomly-chosen segments of the sectors in roots
+// from the host, verifying each against the root of its sector. The roots
+// may be obtained from metafiles (see AuditRoots) or from the host itself via
+// (*proto.Session).SectorRoots.
+func (a *Auditor) Audit(s *proto.Session, roots []crypto.Hash, numSegments int) AuditResult {
+	return a.AuditContext(context.Background(), s, roots, numSegments)
+}
+
+// AuditContext is like Audit, but aborts the audit if ctx is cancelled.
+func (a *Auditor) AuditContext(ctx context.Context, s *proto.Session, roots []crypto.Hash, numSegments int) AuditResult {
+	r := AuditResult{
+		Host:      s.HostKey(),
+		Contract:  s.Revision().ID(),
+		Timestamp: time.Now(),
+	}
+	if len(roots) == 0 {
+		r.Err = errors.New("no sectors to audit")
+		return r
+	} else if numSegments <= 0 {
+		r.Err = errors.New("must audit at least one segment")
+		return r
+	} else if !s.Revision().IsValid() {
+		r.Err = errors.New("session has no locked contract")
+		return r
+	}
+	startFunds := s.Revision().RenterFunds()
+	r.Sections = make([]renterhost.RPCReadRequestSection, numSegments)
+	for i := range r.Sections {
+		r.Sections[i] = renterhost.RPCReadRequestSection{
+			MerkleRoot: roots[frand.Intn(len(roots))],
+			Offset:     uint32(frand.Intn(merkle.SegmentsPerSector) * merkle.SegmentSize),
+			Length:     merkle.SegmentSize,
+		}
+	}
+	// ReadSections verifies the Merkle proof of each section before passing it
+	// to our callback, so there's nothing else for us to check
+	r.Err = s.ReadSectionsContext(ctx, r.Sections, func([]byte) error { return nil })
+	if endFunds := s.Revision().RenterFunds(); endFunds.Cmp(startFunds) < 0 {
+		r.Cost = startFunds.Sub(endFunds)
+	}
+	r.Passed, r.Failed = auditOutcome(r.Err)
+	a.record(r)
+	return r
+}
+
+// auditOutcome determines whether an audit that returned err was passed or
+// failed. Only errors that indicate lost or corrupted data count as failures.
+func auditOutcome(err error) (passed, failed bool) {
+	switch c := proto.Classify(err); {
+	case c.Category == proto.CategoryNone:
+		return true, false
+	case c.Category == proto.CategoryProofInvalid,
+		c.Category == proto.CategoryHostRejected && c.Reason == proto.RejectSectorNotFound:
+		return false, true
+	default:
+		return false, false
+	}
+}
+
+func (a *Auditor) record(r AuditResult) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats := a.stats[r.Host]
+	switch {
+	case r.Passed:
+		stats.Passed++
+	case r.Failed:
+		stats.Failed++
+		stats.LastFailure = r.Timestamp
+	default:
+		stats.Errors++
+	}
+	stats.Cost = stats.Cost.Add(r.Cost)
+	stats.LastAudit = r.Timestamp
+	a.stats[r.Host] = stats
+}
+
+// Stats returns the audit statistics for the specified host.
+func (a *Auditor) Stats(host hostdb.HostPublicKey) HostAuditStats {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.stats[host]
+}
+
+// NewAuditor returns an Auditor with no recorded audits.
+func NewAuditor() *Auditor {
+	return &Auditor{
+		stats: make(map[hostdb.HostPublicKey]HostAuditStats),
+	}
+}
+
+// AuditRoots returns the unique sector roots referenced by the specified host
+// in m, suitable for passing to (*Auditor).Audit.
+func AuditRoots(m *MetaFile, hostKey hostdb.HostPublicKey) []crypto.Hash {
+	i := m.HostIndex(hostKey)
+	if i == -1 {
+		return nil
+	}
+	seen := make(map[crypto.Hash]struct{})
+	var roots []crypto.Hash
+	for _, s := range m.Shards[i] {
+		if _, ok := seen[s.MerkleRoot]; !ok {
+			seen[s.MerkleRoot] = struct{}{}
+			roots = append(roots, s.MerkleRoot)
+		}
+	}
+	return roots
+}
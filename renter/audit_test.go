@@ -0,0 +1,136 @@
+package renter
+
+import (
+	"crypto/ed25519"
+	"io"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/internal/ghost"
+	"lukechampine.com/us/renter/proto"
+	"lukechampine.com/us/renterhost"
+)
+
+type stubWallet struct{}
+
+func (stubWallet) Address() (_ types.UnlockHash, _ error) { return }
+func (stubWallet) FundTransaction(*types.Transaction, types.Currency) (_ []crypto.Hash, _ error) {
+	return
+}
+func (stubWallet) SignTransaction(txn *types.Transaction, toSign []crypto.Hash) error {
+	txn.TransactionSignatures = append(txn.TransactionSignatures, make([]types.TransactionSignature, len(toSign))...)
+	return nil
+}
+
+type stubTpool struct{}
+
+func (stubTpool) AcceptTransactionSet([]types.Transaction) (_ error)                    { return }
+func (stubTpool) UnconfirmedParents(types.Transaction) (_ []types.Transaction, _ error) { return }
+func (stubTpool) FeeEstimate() (_, _ types.Currency, _ error)                           { return }
+
+func TestAuditor(t *testing.T) {
+	host, err := ghost.New(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	s, err := proto.NewUnlockedSession(host.Settings().NetAddress, host.PublicKey(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	rev, _, err := s.FormContract(stubWallet{}, stubTpool{}, key, types.ZeroCurrency, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := s.Lock(rev.ID(), key, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	roots := make([]crypto.Hash, 3)
+	for i := range roots {
+		var sector [renterhost.SectorSize]byte
+		frand.Read(sector[:])
+		if roots[i], err = s.Append(&sector); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a := NewAuditor()
+	for i := 0; i < 3; i++ {
+		if r := a.Audit(s, roots, 4); !r.Passed || r.Err != nil {
+			t.Fatal("audit failed:", r.Err)
+		} else if len(r.Sections) != 4 {
+			t.Fatal("wrong number of sections audited")
+		}
+	}
+	if stats := a.Stats(host.PublicKey()); stats.Passed != 3 || stats.Failed != 0 || stats.Errors != 0 {
+		t.Fatalf("wrong stats: %+v", stats)
+	}
+
+	// auditing a sector that the host doesn't have should fail
+	if r := a.Audit(s, []crypto.Hash{frand.Entropy256()}, 1); !r.Failed {
+		t.Fatal("expected audit to fail, got", r.Err)
+	}
+	if stats := a.Stats(host.PublicKey()); stats.Failed != 1 || stats.LastFailure.IsZero() || stats.FailureRate() != 0.25 {
+		t.Fatalf("wrong stats: %+v", stats)
+	}
+
+	// invalid arguments should not be recorded
+	if r := a.Audit(s, nil, 1); r.Err == nil {
+		t.Fatal("expected error when auditing no sectors")
+	}
+	unlocked, err := proto.NewUnlockedSession(host.Settings().NetAddress, host.PublicKey(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer unlocked.Close()
+	if r := a.Audit(unlocked, roots, 1); r.Err == nil || r.Passed || r.Failed {
+		t.Fatal("expected error when auditing without a contract")
+	}
+	if stats := a.Stats(host.PublicKey()); stats.Passed+stats.Failed+stats.Errors != 4 {
+		t.Fatalf("wrong stats: %+v", stats)
+	}
+	if stats := a.Stats(hostdb.HostPublicKey("foo")); !stats.LastAudit.IsZero() {
+		t.Fatal("expected empty stats for unknown host")
+	}
+}
+
+func TestAuditOutcome(t *testing.T) {
+	tests := []struct {
+		err            error
+		passed, failed bool
+	}{
+		{nil, true, false},
+		{proto.ErrInvalidMerkleProof, false, true},
+		{&renterhost.RPCError{Description: "no sector with that Merkle root"}, false, true},
+		{&renterhost.RPCError{Description: "insufficient payment"}, false, false},
+		{&renterhost.RPCError{Description: "internal error"}, false, false},
+		{proto.ErrInsufficientFunds, false, false},
+		{io.ErrUnexpectedEOF, false, false},
+	}
+	for _, test := range tests {
+		if passed, failed := auditOutcome(test.err); passed != test.passed || failed != test.failed {
+			t.Errorf("auditOutcome(%v): expected (%v, %v), got (%v, %v)", test.err, test.passed, test.failed, passed, failed)
+		}
+	}
+}
+
+func TestAuditRoots(t *testing.T) {
+	hosts := []hostdb.HostPublicKey{"foo", "bar"}
+	m := NewMetaFile(0644, 0, hosts, 1)
+	roots := []crypto.Hash{frand.Entropy256(), frand.Entropy256()}
+	m.Shards[1] = []SectorSlice{
+		{MerkleRoot: roots[0]},
+		{MerkleRoot: roots[1]},
+		{MerkleRoot: roots[0]},
+	}
+	if got := AuditRoots(m, "bar"); len(got) != 2 || got[0] != roots[0] || got[1] != roots[1] {
+		t.Fatal("wrong roots:", got)
+	} else if got := AuditRoots(m, "baz"); got != nil {
+		t.Fatal("expected no roots for unknown host")
+	}
+}
@@ -0,0 +1,118 @@
+package renter
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"gitlab.com/NebulousLabs/encoding"
+	bolt "go.etcd.io/bbolt"
+	"lukechampine.com/us/renter/proto"
+)
+
+// ErrUnknownContract is returned by ContractStores when the requested contract
+// has no recorded revisions.
+var ErrUnknownContract = errors.New("no record of that contract")
+
+// database buckets
+var (
+	// bucketRevisions maps FileContractIDs to the most recent ContractRevision
+	// signed by both parties.
+	bucketRevisions = []byte("bucketRevisions")
+
+	// bucketPending maps FileContractIDs to a ContractRevision signed only by
+	// the renter.
+	bucketPending = []byte("bucketPending")
+)
+
+// BoltDBContractStore implements proto.ContractStore with a Bolt key-value
+// database.
+type BoltDBContractStore struct {
+	db *bolt.DB
+}
+
+// SetPendingRevision implements proto.ContractStore.
+func (s *BoltDBContractStore) SetPendingRevision(rev proto.ContractRevision) error {
+	id := rev.ID()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketPending).Put(id[:], encoding.Marshal(rev))
+	})
+}
+
+// SetRevision implements proto.ContractStore.
+func (s *BoltDBContractStore) SetRevision(rev proto.ContractRevision) error {
+	id := rev.ID()
+	return s.db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bucketRevisions).Put(id[:], encoding.Marshal(rev)); err != nil {
+			return err
+		}
+		return tx.Bucket(bucketPending).Delete(id[:])
+	})
+}
+
+// Revision implements proto.ContractStore.
+func (s *BoltDBContractStore) Revision(id types.FileContractID) (rev proto.ContractRevision, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketRevisions).Get(id[:])
+		if v == nil {
+			return ErrUnknownContract
+		}
+		return encoding.Unmarshal(v, &rev)
+	})
+	return
+}
+
+// PendingRevision implements proto.ContractStore.
+func (s *BoltDBContractStore) PendingRevision(id types.FileContractID) (rev proto.ContractRevision, exists bool, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(bucketPending).Get(id[:])
+		if v == nil {
+			return nil
+		}
+		exists = true
+		return encoding.Unmarshal(v, &rev)
+	})
+	return
+}
+
+// Contracts returns the IDs of all contracts with recorded revisions.
+func (s *BoltDBContractStore) Contracts() (ids []types.FileContractID, err error) {
+	err = s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRevisions).ForEach(func(k, _ []byte) error {
+			var id types.FileContractID
+			copy(id[:], k)
+			ids = append(ids, id)
+			return nil
+		})
+	})
+	return
+}
+
+// Close closes the store.
+func (s *BoltDBContractStore) Close() error {
+	return s.db.Close()
+}
+
+// NewBoltDBContractStore returns a new BoltDBContractStore.
+func NewBoltDBContractStore(filename string) (*BoltDBContractStore, error) {
+	db, err := bolt.Open(filename, 0666, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{bucketRevisions, bucketPending} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltDBContractStore{db: db}, nil
+}
+
+// ensure that BoltDBContractStore satisfies its intended interface
+var _ proto.ContractStore = (*BoltDBContractStore)(nil)
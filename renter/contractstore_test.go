@@ -0,0 +1,81 @@
+package renter
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.com/NebulousLabs/Sia/types"
+	"gitlab.com/NebulousLabs/encoding"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/renter/proto"
+)
+
+func TestBoltDBContractStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store, err := NewBoltDBContractStore(filepath.Join(dir, "contracts.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rev proto.ContractRevision
+	frand.Read(rev.Revision.ParentID[:])
+	rev.Revision.NewRevisionNumber = 1
+	rev.Revision.NewValidProofOutputs = []types.SiacoinOutput{{Value: types.SiacoinPrecision}}
+	rev.Signatures[0].Signature = frand.Bytes(64)
+	rev.Signatures[1].Signature = frand.Bytes(64)
+	if _, err := store.Revision(rev.ID()); err != ErrUnknownContract {
+		t.Fatal("expected ErrUnknownContract, got", err)
+	}
+	if err := store.SetRevision(rev); err != nil {
+		t.Fatal(err)
+	}
+
+	pending := rev
+	pending.Revision.NewRevisionNumber++
+	pending.Signatures[1].Signature = nil
+	if err := store.SetPendingRevision(pending); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen the store; revisions should persist
+	if err := store.Close(); err != nil {
+		t.Fatal(err)
+	}
+	store, err = NewBoltDBContractStore(filepath.Join(dir, "contracts.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if r, err := store.Revision(rev.ID()); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(encoding.Marshal(r), encoding.Marshal(rev)) {
+		t.Fatal("stored revision does not match")
+	}
+	if r, ok, err := store.PendingRevision(rev.ID()); err != nil {
+		t.Fatal(err)
+	} else if !ok {
+		t.Fatal("pending revision was not stored")
+	} else if r.Revision.NewRevisionNumber != pending.Revision.NewRevisionNumber {
+		t.Fatal("stored pending revision does not match")
+	}
+	if ids, err := store.Contracts(); err != nil {
+		t.Fatal(err)
+	} else if len(ids) != 1 || ids[0] != rev.ID() {
+		t.Fatal("wrong contract IDs:", ids)
+	}
+
+	// storing the signed revision should clear the pending revision
+	pending.Signatures[1].Signature = frand.Bytes(64)
+	if err := store.SetRevision(pending); err != nil {
+		t.Fatal(err)
+	} else if _, ok, _ := store.PendingRevision(rev.ID()); ok {
+		t.Fatal("pending revision should have been cleared")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"io"
 
 	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
 	"gitlab.com/NebulousLabs/Sia/modules"
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/merkle"
@@ -28,7 +29,12 @@ type ShardDownloader struct {
 	Downloader *proto.Session
 	Slices     []SectorSlice
 	Key        KeySeed
-	buf        bytes.Buffer
+	// Hashes, if non-nil, contains the integrity hash of the plaintext of each
+	// SectorSlice, which DownloadAndDecrypt verifies. Since each shard of an
+	// erasure-coded file contains only part of each chunk, Hashes can only be
+	// set for files with a MinShards of 1.
+	Hashes []crypto.Hash
+	buf    bytes.Buffer
 }
 
 type cryptWriter struct {
@@ -104,6 +110,7 @@ func (cw *cryptWriter) Write(p []byte) (int, error) {
 		s := slices[i]
 		if i == 0 {
 			s.SegmentIndex += uint32(rem / merkle.SegmentSize)
+			s.NumSegments -= uint32(rem / merkle.SegmentSize)
 		}
 		bb := b.Next(int(s.NumSegments) * merkle.SegmentSize)
 		cw.key.XORKeyStream(bb, s.Nonce[:], uint64(s.SegmentIndex))
@@ -113,14 +120,18 @@ func (cw *cryptWriter) Write(p []byte) (int, error) {
 }
 
 // CopySection downloads the requested section of the Shard, decrypts it, and
-// writes it to w.
+// writes it to w. Data is decrypted and written as soon as it has been
+// verified, rather than after the entire section has been received.
 func (d *ShardDownloader) CopySection(w io.Writer, offset, length int64) error {
 	sections, err := calcSections(d.Slices, offset, length)
 	if err != nil {
 		return err
 	}
 	cw := &cryptWriter{w, d.Slices, d.Key, offset}
-	return d.Downloader.Read(cw, sections)
+	return d.Downloader.ReadSections(sections, func(data []byte) error {
+		_, err := cw.Write(data)
+		return err
+	})
 }
 
 // DownloadAndDecrypt downloads the SectorSlice associated with chunkIndex.
@@ -147,6 +158,12 @@ func (d *ShardDownloader) DownloadAndDecrypt(chunkIndex int64) ([]byte, error) {
 	data := d.buf.Bytes()
 	// decrypt segments
 	d.Key.XORKeyStream(data, s.Nonce[:], uint64(s.SegmentIndex))
+	// verify plaintext
+	if chunkIndex < int64(len(d.Hashes)) && d.Hashes[chunkIndex] != (crypto.Hash{}) {
+		if ChunkHash(data, int64(len(data))) != d.Hashes[chunkIndex] {
+			return nil, errors.Wrapf(ErrIntegrityMismatch, "chunk %v", chunkIndex)
+		}
+	}
 	return data, nil
 }
 
@@ -174,9 +191,16 @@ func NewShardDownloader(m *MetaFile, c Contract, hkr HostKeyResolver) (*ShardDow
 	if err != nil {
 		return nil, errors.Wrapf(err, "%v: could not initiate download protocol with host", hostKey.ShortKey())
 	}
+	var hashes []crypto.Hash
+	if m.MinShards == 1 {
+		// each shard is a replica of the file, so its plaintext can be
+		// verified directly
+		hashes = m.ChunkHashes
+	}
 	return &ShardDownloader{
 		Downloader: d,
 		Key:        m.MasterKey,
 		Slices:     m.Shards[m.HostIndex(hostKey)],
+		Hashes:     hashes,
 	}, nil
 }
@@ -0,0 +1,361 @@
+package renter
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"gitlab.com/NebulousLabs/encoding"
+	bolt "go.etcd.io/bbolt"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter/proto"
+	"lukechampine.com/us/renterhost"
+)
+
+// LedgerPeriod is the granularity of the time buckets used by a
+// BoltDBLedger. All RPCs that begin within the same period are combined into
+// a single entry.
+const LedgerPeriod = time.Hour
+
+const (
+	// ledgerBatchSize is the number of RPCStats that a BoltDBLedger buffers
+	// before writing them to disk.
+	ledgerBatchSize = 100
+
+	// ledgerFlushInterval is the maximum amount of time that a BoltDBLedger
+	// buffers RPCStats before writing them to disk.
+	ledgerFlushInterval = 5 * time.Second
+)
+
+// database buckets
+var (
+	// bucketLedger maps (period, contract, RPC, host) tuples to LedgerEntries.
+	bucketLedger = []byte("bucketLedger")
+
+	// bucketLedgerRevisions maps (contract, revision number) pairs to the
+	// cost of the RPC that produced the revision.
+	bucketLedgerRevisions = []byte("bucketLedgerRevisions")
+)
+
+// A LedgerEntry summarizes the RPCs recorded by a ledger.
+type LedgerEntry struct {
+	RPCs       uint64
+	Errors     uint64
+	Uploaded   uint64
+	Downloaded uint64
+	Cost       types.Currency
+}
+
+// Add adds the totals of e2 to e.
+func (e *LedgerEntry) Add(e2 LedgerEntry) {
+	e.RPCs += e2.RPCs
+	e.Errors += e2.Errors
+	e.Uploaded += e2.Uploaded
+	e.Downloaded += e2.Downloaded
+	e.Cost = e.Cost.Add(e2.Cost)
+}
+
+// A LedgerQuery selects the entries of a ledger. Zero-valued fields match any
+// value. Only entries whose period overlaps [Start, End) are selected; that
+// is, Start is rounded down to the beginning of its period. If End is zero,
+// there is no upper bound.
+type LedgerQuery struct {
+	Host     hostdb.HostPublicKey
+	Contract types.FileContractID
+	RPC      renterhost.Specifier
+	Start    time.Time
+	End      time.Time
+}
+
+func (q LedgerQuery) matches(k ledgerKey) bool {
+	return (q.Host == "" || q.Host == k.host) &&
+		(q.Contract == types.FileContractID{} || q.Contract == k.contract) &&
+		(q.RPC == renterhost.Specifier{} || q.RPC == k.rpc)
+}
+
+// A LedgerRollup is the sum of the entries within a time interval.
+type LedgerRollup struct {
+	Start time.Time
+	LedgerEntry
+}
+
+type ledgerKey struct {
+	period   time.Time
+	contract types.FileContractID
+	rpc      renterhost.Specifier
+	host     hostdb.HostPublicKey
+}
+
+func (k ledgerKey) bytes() []byte {
+	b := make([]byte, 8+len(k.contract)+len(k.rpc)+len(k.host))
+	binary.BigEndian.PutUint64(b, uint64(k.period.Unix()))
+	n := 8
+	n += copy(b[n:], k.contract[:])
+	n += copy(b[n:], k.rpc[:])
+	copy(b[n:], k.host)
+	return b
+}
+
+func parseLedgerKey(b []byte) (k ledgerKey) {
+	k.period = time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+	n := 8
+	n += copy(k.contract[:], b[n:])
+	n += copy(k.rpc[:], b[n:])
+	k.host = hostdb.HostPublicKey(b[n:])
+	return
+}
+
+func revisionKey(id types.FileContractID, revNum uint64) []byte {
+	b := make([]byte, len(id)+8)
+	copy(b, id[:])
+	binary.BigEndian.PutUint64(b[len(id):], revNum)
+	return b
+}
+
+// BoltDBLedger implements proto.RPCStatsRecorder with a Bolt key-value
+// database, maintaining a persistent record of the spending and bandwidth of
+// each contract, host, and RPC type.
+//
+// Since each write to the database requires an fsync, RPCStats are buffered in
+// memory and written in batches: when ledgerBatchSize stats have accumulated,
+// when the oldest buffered stats are ledgerFlushInterval old, or when Flush or
+// Close is called. Consequently, the most recent RPCStats may be lost if the
+// process exits without calling Close.
+type BoltDBLedger struct {
+	db      *bolt.DB
+	flushMu sync.Mutex // serializes flushes
+	mu      sync.Mutex
+	pending []proto.RPCStats
+	err     error
+}
+
+// RecordRPCStats implements proto.RPCStatsRecorder.
+func (l *BoltDBLedger) RecordRPCStats(stats proto.RPCStats) {
+	l.mu.Lock()
+	l.pending = append(l.pending, stats)
+	n := len(l.pending)
+	l.mu.Unlock()
+	if n == 1 {
+		time.AfterFunc(ledgerFlushInterval, func() { l.Flush() })
+	} else if n >= ledgerBatchSize {
+		l.Flush()
+	}
+}
+
+// Flush writes any buffered RPCStats to disk.
+func (l *BoltDBLedger) Flush() error {
+	l.flushMu.Lock()
+	defer l.flushMu.Unlock()
+	l.mu.Lock()
+	pending := l.pending
+	l.pending = nil
+	l.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+	err := l.db.Update(func(tx *bolt.Tx) error {
+		for _, stats := range pending {
+			if err := putRPCStats(tx, stats); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		l.mu.Lock()
+		if l.err == nil {
+			l.err = err
+		}
+		l.mu.Unlock()
+	}
+	return err
+}
+
+func putRPCStats(tx *bolt.Tx, stats proto.RPCStats) error {
+	k := ledgerKey{
+		period:   stats.Timestamp.Truncate(LedgerPeriod),
+		contract: stats.Contract,
+		rpc:      stats.RPC,
+		host:     stats.Host,
+	}
+	entry := LedgerEntry{
+		RPCs:       1,
+		Uploaded:   stats.Uploaded,
+		Downloaded: stats.Downloaded,
+		Cost:       stats.Cost,
+	}
+	if stats.Err != nil {
+		entry.Errors = 1
+	}
+	b := tx.Bucket(bucketLedger)
+	key := k.bytes()
+	if v := b.Get(key); v != nil {
+		var prev LedgerEntry
+		if err := encoding.Unmarshal(v, &prev); err != nil {
+			return err
+		}
+		entry.Add(prev)
+	}
+	if err := b.Put(key, encoding.Marshal(entry)); err != nil {
+		return err
+	}
+	// only the portion of the cost paid from the contract is reflected in its
+	// revisions
+	var contractCost types.Currency
+	if stats.Cost.Cmp(stats.WalletCost) > 0 {
+		contractCost = stats.Cost.Sub(stats.WalletCost)
+	}
+	if stats.RevisionNumber == 0 || contractCost.IsZero() {
+		return nil
+	}
+	return tx.Bucket(bucketLedgerRevisions).Put(revisionKey(stats.Contract, stats.RevisionNumber), encoding.Marshal(contractCost))
+}
+
+// Err returns the first error encountered while writing RPCStats to disk, if
+// any. Since RecordRPCStats cannot return an error, callers should check Err
+// periodically to ensure that the ledger is complete.
+func (l *BoltDBLedger) Err() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.err
+}
+
+// forEach calls fn on each entry selected by q, in chronological order.
+func (l *BoltDBLedger) forEach(q LedgerQuery, fn func(period time.Time, e LedgerEntry)) error {
+	if err := l.Flush(); err != nil {
+		return err
+	}
+	return l.db.View(func(tx *bolt.Tx) error {
+		// the period containing q.Start is included, even if q.Start is not
+		// aligned to a period boundary
+		start := q.Start.Truncate(LedgerPeriod)
+		c := tx.Bucket(bucketLedger).Cursor()
+		key, v := c.First()
+		if start.Unix() > 0 {
+			key, v = c.Seek(ledgerKey{period: start}.bytes()[:8])
+		}
+		for ; key != nil; key, v = c.Next() {
+			k := parseLedgerKey(key)
+			if k.period.Before(start) {
+				continue
+			} else if !q.End.IsZero() && !k.period.Before(q.End) {
+				break
+			} else if !q.matches(k) {
+				continue
+			}
+			var e LedgerEntry
+			if err := encoding.Unmarshal(v, &e); err != nil {
+				return err
+			}
+			fn(k.period, e)
+		}
+		return nil
+	})
+}
+
+// Total returns the sum of the entries selected by q.
+func (l *BoltDBLedger) Total(q LedgerQuery) (LedgerEntry, error) {
+	var total LedgerEntry
+	err := l.forEach(q, func(_ time.Time, e LedgerEntry) {
+		total.Add(e)
+	})
+	return total, err
+}
+
+// Rollup returns the sum of the entries selected by q, grouped into intervals
+// of the specified duration, beginning at q.Start. The interval should be a
+// multiple of LedgerPeriod. Intervals without any entries are omitted.
+func (l *BoltDBLedger) Rollup(q LedgerQuery, interval time.Duration) ([]LedgerRollup, error) {
+	if interval <= 0 {
+		return nil, errors.New("interval must be positive")
+	} else if q.Start.IsZero() {
+		return nil, errors.New("rollup requires a start time")
+	}
+	var rollups []LedgerRollup
+	err := l.forEach(q, func(period time.Time, e LedgerEntry) {
+		start := q.Start.Add(period.Sub(q.Start) / interval * interval)
+		if len(rollups) == 0 || !rollups[len(rollups)-1].Start.Equal(start) {
+			rollups = append(rollups, LedgerRollup{Start: start})
+		}
+		rollups[len(rollups)-1].Add(e)
+	})
+	return rollups, err
+}
+
+// CheckRevisions returns an error if the costs recorded for the revisions
+// after from, up to and including to, do not sum to the drop in RenterFunds
+// between from and to. Both revisions must belong to the same contract.
+func (l *BoltDBLedger) CheckRevisions(from, to proto.ContractRevision) error {
+	if from.ID() != to.ID() {
+		return errors.New("revisions belong to different contracts")
+	} else if from.Revision.NewRevisionNumber > to.Revision.NewRevisionNumber {
+		return errors.New("revisions are out of order")
+	} else if from.RenterFunds().Cmp(to.RenterFunds()) < 0 {
+		return errors.New("renter funds increased between revisions")
+	} else if from.Revision.NewRevisionNumber == to.Revision.NewRevisionNumber {
+		if !from.RenterFunds().Equals(to.RenterFunds()) {
+			return errors.New("revisions have same revision number but different renter funds")
+		}
+		return nil
+	}
+	if err := l.Flush(); err != nil {
+		return err
+	}
+	var recorded types.Currency
+	err := l.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(bucketLedgerRevisions).Cursor()
+		start := revisionKey(from.ID(), from.Revision.NewRevisionNumber+1)
+		end := revisionKey(to.ID(), to.Revision.NewRevisionNumber)
+		for k, v := c.Seek(start); k != nil && string(k) <= string(end); k, v = c.Next() {
+			var cost types.Currency
+			if err := encoding.Unmarshal(v, &cost); err != nil {
+				return err
+			}
+			recorded = recorded.Add(cost)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if spent := from.RenterFunds().Sub(to.RenterFunds()); !recorded.Equals(spent) {
+		return errors.Errorf("ledger records %v H spent between revisions %v and %v, but renter funds decreased by %v H",
+			recorded, from.Revision.NewRevisionNumber, to.Revision.NewRevisionNumber, spent)
+	}
+	return nil
+}
+
+// Close flushes any buffered RPCStats and closes the ledger.
+func (l *BoltDBLedger) Close() error {
+	err := l.Flush()
+	if cerr := l.db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// NewBoltDBLedger returns a new BoltDBLedger.
+func NewBoltDBLedger(filename string) (*BoltDBLedger, error) {
+	db, err := bolt.Open(filename, 0666, &bolt.Options{Timeout: 3 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{bucketLedger, bucketLedgerRevisions} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &BoltDBLedger{db: db}, nil
+}
+
+// ensure that BoltDBLedger satisfies its intended interface
+var _ proto.RPCStatsRecorder = (*BoltDBLedger)(nil)
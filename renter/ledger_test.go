@@ -0,0 +1,172 @@
+package renter
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"gitlab.com/NebulousLabs/encoding"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter/proto"
+	"lukechampine.com/us/renterhost"
+)
+
+func TestBoltDBLedger(t *testing.T) {
+	dir, err := ioutil.TempDir("", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ledger, err := NewBoltDBLedger(filepath.Join(dir, "ledger.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var c1, c2 types.FileContractID
+	frand.Read(c1[:])
+	frand.Read(c2[:])
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	stats := []proto.RPCStats{
+		{Host: "foo", Contract: c1, RPC: renterhost.RPCReadID, Timestamp: start, Downloaded: 100, Cost: types.NewCurrency64(10), RevisionNumber: 2},
+		{Host: "foo", Contract: c1, RPC: renterhost.RPCReadID, Timestamp: start.Add(time.Minute), Downloaded: 100, Cost: types.NewCurrency64(10), RevisionNumber: 3},
+		{Host: "foo", Contract: c1, RPC: renterhost.RPCWriteID, Timestamp: start.Add(2 * time.Hour), Uploaded: 500, Cost: types.NewCurrency64(50), RevisionNumber: 4},
+		{Host: "foo", Contract: c1, RPC: renterhost.RPCReadID, Timestamp: start.Add(25 * time.Hour), Downloaded: 100, Cost: types.NewCurrency64(10), RevisionNumber: 5},
+		{Host: "bar", Contract: c2, RPC: renterhost.RPCReadID, Timestamp: start.Add(time.Hour), Downloaded: 100, Cost: types.NewCurrency64(20), RevisionNumber: 2},
+		{Host: "bar", Contract: c2, RPC: renterhost.RPCSettingsID, Timestamp: start.Add(time.Hour), Err: errors.New("foo")},
+	}
+	for _, s := range stats {
+		ledger.RecordRPCStats(s)
+	}
+	if err := ledger.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// reopen the ledger; entries should persist
+	if err := ledger.Close(); err != nil {
+		t.Fatal(err)
+	}
+	ledger, err = NewBoltDBLedger(filepath.Join(dir, "ledger.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ledger.Close()
+
+	tests := []struct {
+		q   LedgerQuery
+		exp LedgerEntry
+	}{
+		{LedgerQuery{}, LedgerEntry{RPCs: 6, Errors: 1, Uploaded: 500, Downloaded: 400, Cost: types.NewCurrency64(100)}},
+		{LedgerQuery{Host: "foo"}, LedgerEntry{RPCs: 4, Uploaded: 500, Downloaded: 300, Cost: types.NewCurrency64(80)}},
+		{LedgerQuery{Host: "foo", RPC: renterhost.RPCReadID}, LedgerEntry{RPCs: 3, Downloaded: 300, Cost: types.NewCurrency64(30)}},
+		{LedgerQuery{Host: "foo", RPC: renterhost.RPCReadID, End: start.Add(24 * time.Hour)}, LedgerEntry{RPCs: 2, Downloaded: 200, Cost: types.NewCurrency64(20)}},
+		{LedgerQuery{Contract: c2}, LedgerEntry{RPCs: 2, Errors: 1, Downloaded: 100, Cost: types.NewCurrency64(20)}},
+		{LedgerQuery{Start: start.Add(time.Hour), End: start.Add(3 * time.Hour)}, LedgerEntry{RPCs: 3, Errors: 1, Uploaded: 500, Downloaded: 100, Cost: types.NewCurrency64(70)}},
+		{LedgerQuery{Host: "baz"}, LedgerEntry{}},
+	}
+	for _, test := range tests {
+		total, err := ledger.Total(test.q)
+		if err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(encoding.Marshal(total), encoding.Marshal(test.exp)) {
+			t.Errorf("wrong total for %+v: expected %+v, got %+v", test.q, test.exp, total)
+		}
+	}
+
+	// daily rollups
+	rollups, err := ledger.Rollup(LedgerQuery{Host: "foo", Start: start}, 24*time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(rollups) != 2 {
+		t.Fatalf("expected 2 rollups, got %v", len(rollups))
+	} else if !rollups[0].Start.Equal(start) || !rollups[0].Cost.Equals64(70) {
+		t.Errorf("wrong first rollup: %+v", rollups[0])
+	} else if !rollups[1].Start.Equal(start.Add(24*time.Hour)) || !rollups[1].Cost.Equals64(10) {
+		t.Errorf("wrong second rollup: %+v", rollups[1])
+	}
+
+	// check revisions against the ledger
+	rev := func(id types.FileContractID, revNum uint64, funds uint64) proto.ContractRevision {
+		var r proto.ContractRevision
+		r.Revision.ParentID = id
+		r.Revision.NewRevisionNumber = revNum
+		r.Revision.NewValidProofOutputs = []types.SiacoinOutput{{Value: types.NewCurrency64(funds)}}
+		return r
+	}
+	if err := ledger.CheckRevisions(rev(c1, 1, 1000), rev(c1, 5, 920)); err != nil {
+		t.Error(err)
+	}
+	if err := ledger.CheckRevisions(rev(c1, 3, 980), rev(c1, 4, 930)); err != nil {
+		t.Error(err)
+	}
+	if err := ledger.CheckRevisions(rev(c1, 1, 1000), rev(c1, 5, 900)); err == nil {
+		t.Error("expected mismatch to be detected")
+	}
+	if err := ledger.CheckRevisions(rev(c1, 1, 1000), rev(c2, 2, 980)); err == nil {
+		t.Error("expected revisions of different contracts to be rejected")
+	}
+	if err := ledger.CheckRevisions(rev(c2, 1, 1000), rev(c2, 2, 980)); err != nil {
+		t.Error(err)
+	}
+
+	// renewing a contract costs both contract funds and wallet funds; only the
+	// former should be reflected in the revisions
+	ledger.RecordRPCStats(proto.RPCStats{
+		Host:           "bar",
+		Contract:       c2,
+		RPC:            renterhost.RPCRenewClearContractID,
+		Timestamp:      start.Add(30 * time.Hour),
+		Cost:           types.NewCurrency64(105),
+		WalletCost:     types.NewCurrency64(100),
+		RevisionNumber: math.MaxUint64,
+	})
+	if total, err := ledger.Total(LedgerQuery{RPC: renterhost.RPCRenewClearContractID}); err != nil {
+		t.Fatal(err)
+	} else if total.RPCs != 1 || !total.Cost.Equals64(105) {
+		t.Errorf("wrong total for renewal: %+v", total)
+	}
+	if err := ledger.CheckRevisions(rev(c2, 2, 980), rev(c2, math.MaxUint64, 975)); err != nil {
+		t.Error(err)
+	}
+
+	// a WalletCost greater than Cost should not be reflected in the revisions
+	ledger.RecordRPCStats(proto.RPCStats{
+		Host:           "bar",
+		Contract:       c2,
+		RPC:            renterhost.RPCFormContractID,
+		Timestamp:      start.Add(31 * time.Hour),
+		Cost:           types.NewCurrency64(5),
+		WalletCost:     types.NewCurrency64(10),
+		RevisionNumber: 1,
+	})
+	if err := ledger.Flush(); err != nil {
+		t.Fatal(err)
+	} else if err := ledger.CheckRevisions(rev(c2, 0, 1000), rev(c2, 1, 1000)); err != nil {
+		t.Error(err)
+	}
+
+	// a query starting partway through a period should include that period
+	if total, err := ledger.Total(LedgerQuery{Start: start.Add(30*time.Hour + 30*time.Minute)}); err != nil {
+		t.Fatal(err)
+	} else if total.RPCs != 2 || !total.Cost.Equals64(110) {
+		t.Errorf("wrong total for unaligned query: %+v", total)
+	}
+}
+
+func TestLedgerKey(t *testing.T) {
+	k := ledgerKey{
+		period: time.Unix(1234567, 0),
+		rpc:    renterhost.RPCReadID,
+		host:   hostdb.HostPublicKey("ed25519:foo"),
+	}
+	frand.Read(k.contract[:])
+	if k2 := parseLedgerKey(k.bytes()); !k2.period.Equal(k.period) || k2.contract != k.contract || k2.rpc != k.rpc || k2.host != k.host {
+		t.Fatal("key did not survive roundtrip")
+	}
+}
@@ -0,0 +1,216 @@
+package renter
+
+import (
+	"io"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/us/internal/reedsolomon"
+	"lukechampine.com/us/merkle"
+)
+
+// lrCode implements a locally repairable code. The m data shards are divided
+// into equal-sized groups, and each group is protected by a local parity
+// shard, which is the XOR of the group's data shards. The data shards are
+// additionally protected by Reed-Solomon-encoded global parity shards. A
+// single missing data shard (or local parity shard) can thus be reconstructed
+// from the other members of its group, rather than from m shards.
+//
+// The shards are ordered as follows: first the data shards, then the global
+// parity shards, then the local parity shards.
+type lrCode struct {
+	rs     *reedsolomon.ReedSolomon
+	m, n   int
+	groups int
+}
+
+// group returns the indices of the data shards in group g, followed by the
+// index of the group's local parity shard.
+func (lrc lrCode) group(g int) []int {
+	size := lrc.m / lrc.groups
+	indices := make([]int, 0, size+1)
+	for i := g * size; i < (g+1)*size; i++ {
+		indices = append(indices, i)
+	}
+	return append(indices, lrc.n-lrc.groups+g)
+}
+
+// groupOf returns the group containing shard i, or -1 if shard i is a global
+// parity shard.
+func (lrc lrCode) groupOf(i int) int {
+	switch {
+	case i < lrc.m:
+		return i / (lrc.m / lrc.groups)
+	case i >= lrc.n-lrc.groups:
+		return i - (lrc.n - lrc.groups)
+	default:
+		return -1
+	}
+}
+
+// repairLocal reconstructs each missing shard that is the only missing member
+// of its group. If dataOnly is true, missing local parity shards are ignored.
+func (lrc lrCode) repairLocal(shards [][]byte, shardSize int, dataOnly bool) {
+	for g := 0; g < lrc.groups; g++ {
+		missing := -1
+		for _, i := range lrc.group(g) {
+			if len(shards[i]) == 0 {
+				if missing != -1 {
+					missing = -1
+					break
+				}
+				missing = i
+			}
+		}
+		if missing == -1 || (dataOnly && missing >= lrc.m) {
+			continue
+		}
+		shards[missing] = shards[missing][:shardSize]
+		lrc.xorGroup(shards, g, missing)
+	}
+}
+
+// xorGroup sets shards[dst] to the XOR of the other members of group g.
+func (lrc lrCode) xorGroup(shards [][]byte, g, dst int) {
+	out := shards[dst]
+	for i := range out {
+		out[i] = 0
+	}
+	for _, i := range lrc.group(g) {
+		if i == dst {
+			continue
+		}
+		for j, b := range shards[i] {
+			out[j] ^= b
+		}
+	}
+}
+
+func (lrc lrCode) Encode(data []byte, shards [][]byte) {
+	if err := lrc.rs.SplitMulti(data, shards, merkle.SegmentSize); err != nil {
+		panic(err)
+	}
+	if err := lrc.rs.Encode(shards[:lrc.n-lrc.groups]); err != nil {
+		panic(err)
+	}
+	for g := 0; g < lrc.groups; g++ {
+		lrc.xorGroup(shards, g, lrc.n-lrc.groups+g)
+	}
+}
+
+func (lrc lrCode) Reconstruct(shards [][]byte) error {
+	shardSize := checkShards(shards, lrc.n)
+	if shardSize == 0 {
+		return reedsolomon.ErrShardNoData
+	}
+	lrc.repairLocal(shards, shardSize, false)
+	if err := lrc.rs.Reconstruct(shards[:lrc.n-lrc.groups]); err != nil {
+		return err
+	}
+	// all data shards are now present, so any remaining local parity shards
+	// can be recomputed
+	for g := 0; g < lrc.groups; g++ {
+		if i := lrc.n - lrc.groups + g; len(shards[i]) == 0 {
+			shards[i] = shards[i][:shardSize]
+			lrc.xorGroup(shards, g, i)
+		}
+	}
+	return nil
+}
+
+func (lrc lrCode) Recover(w io.Writer, shards [][]byte, off, n int) error {
+	shardSize := checkShards(shards, lrc.n)
+	if shardSize == 0 {
+		return reedsolomon.ErrShardNoData
+	}
+	lrc.repairLocal(shards, shardSize, true)
+	if err := lrc.rs.ReconstructData(shards[:lrc.n-lrc.groups]); err != nil {
+		return err
+	}
+	return lrc.rs.JoinMulti(w, shards, merkle.SegmentSize, off, n)
+}
+
+// RepairSet implements LocalRepairer. Data shards and local parity shards are
+// repaired from the other members of their group; global parity shards
+// require all of the data shards.
+func (lrc lrCode) RepairSet(i int) []int {
+	g := lrc.groupOf(i)
+	if g == -1 {
+		set := make([]int, lrc.m)
+		for j := range set {
+			set[j] = j
+		}
+		return set
+	}
+	var set []int
+	for _, j := range lrc.group(g) {
+		if j != i {
+			set = append(set, j)
+		}
+	}
+	return set
+}
+
+// CanRecover implements LocalRepairer.
+func (lrc lrCode) CanRecover(present []bool) bool {
+	have := append([]bool(nil), present...)
+	for g := 0; g < lrc.groups; g++ {
+		missing := -1
+		for _, i := range lrc.group(g) {
+			if !have[i] {
+				if missing != -1 {
+					missing = -1
+					break
+				}
+				missing = i
+			}
+		}
+		if missing != -1 {
+			have[missing] = true
+		}
+	}
+	var n int
+	for _, ok := range have[:lrc.n-lrc.groups] {
+		if ok {
+			n++
+		}
+	}
+	return n >= lrc.m
+}
+
+// NewLRCode returns an m-of-n locally repairable ErasureCoder whose data
+// shards are divided into the specified number of groups. Each group has one
+// local parity shard, and the remaining n-m-groups shards are global parity
+// shards. It panics if m is not divisible by groups, or if there is not at
+// least one global parity shard.
+func NewLRCode(m, n, groups int) ErasureCoder {
+	lrc, err := newLRCode(m, n, groups)
+	if err != nil {
+		panic(err)
+	}
+	return lrc
+}
+
+func newLRCode(m, n, groups int) (lrCode, error) {
+	if groups <= 0 || m%groups != 0 {
+		return lrCode{}, errors.Errorf("lrc code cannot divide %v data shards into %v groups", m, groups)
+	} else if n-m-groups < 1 {
+		return lrCode{}, errors.Errorf("lrc code requires at least one global parity shard (got %v-of-%v with %v groups)", m, n, groups)
+	}
+	rs, err := reedsolomon.New(m, n-m-groups)
+	if err != nil {
+		return lrCode{}, err
+	}
+	return lrCode{
+		rs:     rs,
+		m:      m,
+		n:      n,
+		groups: groups,
+	}, nil
+}
+
+func newLRCodeFunc(m, n int, params []int) (ErasureCoder, error) {
+	if len(params) != 1 {
+		return nil, errors.New("lrc code requires exactly one parameter (the number of groups)")
+	}
+	return newLRCode(m, n, params[0])
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/aead/chacha20/chacha"
 	"github.com/pkg/errors"
 	"gitlab.com/NebulousLabs/Sia/crypto"
+	"golang.org/x/crypto/blake2b"
 	"lukechampine.com/frand"
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/merkle"
@@ -26,14 +27,20 @@ import (
 const (
 	// MetaFileVersion is the current version of the metafile format. It is
 	// incremented after each change to the format.
-	MetaFileVersion = 2
+	MetaFileVersion = 5
 
 	// SectorSliceSize is the encoded size of a SectorSlice.
 	SectorSliceSize = 64
 
-	indexFilename = "index"
+	indexFilename  = "index"
+	hashesFilename = "hashes"
+	keyFilename    = "key"
 )
 
+// ErrIntegrityMismatch indicates that a chunk's plaintext, after decryption
+// and erasure decoding, does not match the hash recorded in its metafile.
+var ErrIntegrityMismatch = errors.New("plaintext does not match integrity hash")
+
 // assert that SectorSliceSize is accurate
 var _ [SectorSliceSize]struct{} = [unsafe.Sizeof(SectorSlice{})]struct{}{}
 
@@ -41,6 +48,10 @@ var _ [SectorSliceSize]struct{} = [unsafe.Sizeof(SectorSlice{})]struct{}{}
 type MetaFile struct {
 	MetaIndex
 	Shards [][]SectorSlice
+	// ChunkHashes contains the integrity hash of each chunk's plaintext (see
+	// ChunkHash). Chunks without a corresponding hash, or whose hash is zero,
+	// are not verified. ChunkHashes is only stored in version 3 metafiles.
+	ChunkHashes []crypto.Hash
 }
 
 // A MetaIndex contains the traditional file metadata for a MetaFile, along with
@@ -54,6 +65,12 @@ type MetaIndex struct {
 	MasterKey KeySeed     // seed from which shard encryption keys are derived
 	MinShards int         // number of shards required to recover file
 	Hosts     []hostdb.HostPublicKey
+	FileHash  crypto.Hash     // BLAKE2b hash of plaintext; zero if unknown
+	Code      ErasureCodeSpec // erasure code used to encode shards
+	// Attributes holds user-defined metadata, such as a content type or
+	// application-specific checksum. Attributes are only stored in version 5
+	// metafiles.
+	Attributes map[string][]byte
 }
 
 // A SectorSlice uniquely identifies a contiguous slice of data stored on a
@@ -114,13 +131,23 @@ func (s *KeySeed) XORKeyStream(msg []byte, nonce []byte, startIndex uint64) {
 // Validate performs basic sanity checks on a MetaIndex.
 func (m *MetaIndex) Validate() error {
 	switch {
-	case m.Version != MetaFileVersion:
+	case m.Version < 2 || m.Version > MetaFileVersion:
 		return errors.Errorf("incompatible version (%v, want %v)", m.Version, MetaFileVersion)
+	case m.Version < 4 && m.Code.Name != "":
+		return errors.Errorf("version %v does not support erasure code %q", m.Version, m.Code.Name)
+	case m.Version < 5 && len(m.Attributes) > 0:
+		return errors.Errorf("version %v does not support attributes", m.Version)
 	case m.MinShards == 0:
 		return errors.Errorf("MinShards cannot be 0")
 	case m.MinShards > len(m.Hosts):
 		return errors.Errorf("MinShards (%v) must not exceed number of hosts (%v)", m.Version, len(m.Hosts))
 	}
+	if _, err := NewErasureCode(m.Code, m.MinShards, len(m.Hosts)); err != nil {
+		return errors.Wrap(err, "invalid erasure code")
+	}
+	if _, ok := m.Attributes[""]; ok {
+		return errors.New("attribute names must not be empty")
+	}
 	return nil
 }
 
@@ -143,9 +170,63 @@ func (m *MetaIndex) MinChunkSize() int64 {
 }
 
 // ErasureCode returns the erasure code used to encode and decode the shards
-// of m.
+// of m. It panics if m.Code does not identify a valid erasure code; Validate
+// can be used to check this beforehand.
 func (m *MetaIndex) ErasureCode() ErasureCoder {
-	return NewRSCode(m.MinShards, len(m.Hosts))
+	ec, err := NewErasureCode(m.Code, m.MinShards, len(m.Hosts))
+	if err != nil {
+		panic(err)
+	}
+	return ec
+}
+
+// CanRecover reports whether the data of m can be recovered from the shards
+// marked present. Unless the erasure code is a LocalRepairer, any MinShards
+// shards are sufficient.
+func (m *MetaIndex) CanRecover(present []bool) bool {
+	if lr, ok := m.ErasureCode().(LocalRepairer); ok {
+		return lr.CanRecover(present)
+	}
+	var n int
+	for _, ok := range present {
+		if ok {
+			n++
+		}
+	}
+	return n >= m.MinShards
+}
+
+// ChunkHash returns the integrity hash of a chunk's plaintext. The hash covers
+// the full chunk, i.e. the plaintext padded with zeros to chunkSize bytes,
+// where chunkSize is the chunk's NumSegments multiplied by MinChunkSize.
+func ChunkHash(plaintext []byte, chunkSize int64) crypto.Hash {
+	h, _ := blake2b.New256(nil)
+	h.Write(plaintext)
+	var zeros [merkle.SegmentSize]byte
+	for rem := chunkSize - int64(len(plaintext)); rem > 0; rem -= int64(len(zeros)) {
+		if rem < int64(len(zeros)) {
+			h.Write(zeros[:rem])
+		} else {
+			h.Write(zeros[:])
+		}
+	}
+	var sum crypto.Hash
+	h.Sum(sum[:0])
+	return sum
+}
+
+// VerifyChunk checks the plaintext of the specified chunk against its
+// integrity hash, if known. If plaintext is shorter than the chunk, it is
+// padded with zeros.
+func (m *MetaFile) VerifyChunk(chunkIndex int, plaintext []byte) error {
+	if chunkIndex >= len(m.ChunkHashes) || m.ChunkHashes[chunkIndex] == (crypto.Hash{}) {
+		return nil
+	}
+	chunkSize := int64(m.Shards[0][chunkIndex].NumSegments) * m.MinChunkSize()
+	if ChunkHash(plaintext, chunkSize) != m.ChunkHashes[chunkIndex] {
+		return errors.Wrapf(ErrIntegrityMismatch, "chunk %v", chunkIndex)
+	}
+	return nil
 }
 
 // HostIndex returns the index of the shard that references data stored on the
@@ -195,9 +276,17 @@ func NewMetaFile(mode os.FileMode, size int64, hosts []hostdb.HostPublicKey, min
 // WriteMetaFile creates a gzipped tar archive containing m's index and shards,
 // and writes it to filename. The write is atomic.
 func WriteMetaFile(filename string, m *MetaFile) error {
+	return writeMetaArchive(filename, m, nil)
+}
+
+// writeMetaArchive writes m to filename. If key is non-nil, it is included in
+// the archive.
+func writeMetaArchive(filename string, m *MetaFile, key *WrappedKey) error {
 	// validate before writing
 	if err := validateShards(m.Shards); err != nil {
 		return errors.Wrap(err, "invalid shards")
+	} else if err := validateHashes(m.Shards, m.ChunkHashes); err != nil {
+		return errors.Wrap(err, "invalid hashes")
 	}
 
 	f, err := os.Create(filename + "_tmp")
@@ -221,6 +310,38 @@ func WriteMetaFile(filename string, m *MetaFile) error {
 		return errors.Wrap(err, "could not write index")
 	}
 
+	// write hashes
+	if m.Version >= 3 {
+		err = tw.WriteHeader(&tar.Header{
+			Name: hashesFilename,
+			Size: int64(len(m.ChunkHashes)) * crypto.HashSize,
+			Mode: 0666,
+		})
+		if err != nil {
+			return errors.Wrap(err, "could not write hashes header")
+		}
+		for _, h := range m.ChunkHashes {
+			if _, err = tw.Write(h[:]); err != nil {
+				return errors.Wrap(err, "could not write hashes")
+			}
+		}
+	}
+
+	// write key
+	if key != nil {
+		b := key.marshal()
+		err = tw.WriteHeader(&tar.Header{
+			Name: keyFilename,
+			Size: int64(len(b)),
+			Mode: 0666,
+		})
+		if err != nil {
+			return errors.Wrap(err, "could not write key header")
+		} else if _, err = tw.Write(b); err != nil {
+			return errors.Wrap(err, "could not write key")
+		}
+	}
+
 	// write shards
 	encSlice := make([]byte, SectorSliceSize)
 	for i, hostKey := range m.Hosts {
@@ -261,42 +382,76 @@ func WriteMetaFile(filename string, m *MetaFile) error {
 
 // ReadMetaFile reads a metafile archive into memory.
 func ReadMetaFile(filename string) (*MetaFile, error) {
+	m, key, err := readMetaArchive(filename)
+	if err != nil {
+		return nil, err
+	} else if key != nil {
+		return nil, errors.New("archive is a shared file; use ReadSharedFile")
+	}
+	return m, nil
+}
+
+// readMetaArchive reads a metafile archive into memory, along with its key, if
+// present.
+func readMetaArchive(filename string) (*MetaFile, *WrappedKey, error) {
 	f, err := os.Open(filename)
 	if err != nil {
-		return nil, errors.Wrap(err, "could not open archive")
+		return nil, nil, errors.Wrap(err, "could not open archive")
 	}
 	defer f.Close()
 	zip, err := gzip.NewReader(f)
 	if err != nil {
-		return nil, errors.Wrap(err, "could not read gzip header")
+		return nil, nil, errors.Wrap(err, "could not read gzip header")
 	}
 	tr := tar.NewReader(zip)
 
 	m := &MetaFile{}
+	var key *WrappedKey
 	shards := make(map[hostdb.HostPublicKey][]SectorSlice)
 	for {
 		hdr, err := tr.Next()
 		if err == io.EOF {
 			if m.Version == 0 {
-				return nil, errors.New("archive is missing an index")
+				return nil, nil, errors.New("archive is missing an index")
+			} else if err := m.Validate(); err != nil {
+				return nil, nil, errors.Wrap(err, "invalid index")
 			}
 			break
 		} else if err != nil {
-			return nil, errors.Wrap(err, "could not read archive entry")
+			return nil, nil, errors.Wrap(err, "could not read archive entry")
 		}
 
 		if hdr.Name == indexFilename {
 			// read index
 			if err = json.NewDecoder(tr).Decode(&m.MetaIndex); err != nil {
-				return nil, errors.Wrap(err, "could not decode index")
+				return nil, nil, errors.Wrap(err, "could not decode index")
+			}
+		} else if hdr.Name == hashesFilename {
+			// read hashes
+			m.ChunkHashes = make([]crypto.Hash, hdr.Size/crypto.HashSize)
+			for i := range m.ChunkHashes {
+				if _, err := io.ReadFull(tr, m.ChunkHashes[i][:]); err != nil {
+					return nil, nil, errors.Wrap(err, "could not read hashes")
+				}
 			}
+		} else if hdr.Name == keyFilename {
+			// read key
+			if hdr.Size != wrappedKeySize {
+				return nil, nil, errors.Errorf("invalid key size (%v bytes)", hdr.Size)
+			}
+			buf := make([]byte, wrappedKeySize)
+			if _, err := io.ReadFull(tr, buf); err != nil {
+				return nil, nil, errors.Wrap(err, "could not read key")
+			}
+			key = new(WrappedKey)
+			key.unmarshal(buf)
 		} else {
 			// read shard
 			shard := make([]SectorSlice, hdr.Size/SectorSliceSize)
 			buf := make([]byte, SectorSliceSize)
 			for i := range shard {
 				if _, err := io.ReadFull(tr, buf); err != nil {
-					return nil, errors.Wrap(err, "could not read shard")
+					return nil, nil, errors.Wrap(err, "could not read shard")
 				}
 				copy(shard[i].MerkleRoot[:], buf[:32])
 				shard[i].SegmentIndex = binary.LittleEndian.Uint32(buf[32:36])
@@ -310,28 +465,30 @@ func ReadMetaFile(filename string) (*MetaFile, error) {
 		}
 	}
 	if err := zip.Close(); err != nil {
-		return nil, errors.Wrap(err, "archive is corrupted")
+		return nil, nil, errors.Wrap(err, "archive is corrupted")
 	}
 
 	// now that we have the index and all shards in memory, order the shards
 	// according the Hosts list in the index
 	if len(shards) != len(m.Hosts) {
-		return nil, errors.Errorf("invalid metafile: number of shards (%v) does not match number of hosts (%v)", len(shards), len(m.Hosts))
+		return nil, nil, errors.Errorf("invalid metafile: number of shards (%v) does not match number of hosts (%v)", len(shards), len(m.Hosts))
 	}
 	m.Shards = make([][]SectorSlice, len(m.Hosts))
 	for hpk, shard := range shards {
 		i := m.HostIndex(hpk)
 		if i == -1 {
-			return nil, errors.Errorf("invalid shard filename: host %q not present in index", hpk)
+			return nil, nil, errors.Errorf("invalid shard filename: host %q not present in index", hpk)
 		}
 		m.Shards[i] = shard
 	}
 
 	if err := validateShards(m.Shards); err != nil {
-		return nil, errors.Wrap(err, "invalid shards")
+		return nil, nil, errors.Wrap(err, "invalid shards")
+	} else if err := validateHashes(m.Shards, m.ChunkHashes); err != nil {
+		return nil, nil, errors.Wrap(err, "invalid hashes")
 	}
 
-	return m, nil
+	return m, key, nil
 }
 
 // ReadMetaIndex reads the index of a metafile without reading any shards.
@@ -420,6 +577,8 @@ func readMetaFileShards(filename string) (MetaIndex, int, error) {
 				return MetaIndex{}, 0, errors.Wrap(err, "could not decode index")
 			}
 			haveIndex = true
+		} else if hdr.Name == hashesFilename || hdr.Name == keyFilename {
+			continue // skip entry
 		} else {
 			// read shard contents, adding each length value
 			numSlices := int(hdr.FileInfo().Size() / SectorSliceSize)
@@ -468,3 +627,16 @@ func validateShards(shards [][]SectorSlice) error {
 	}
 	return nil
 }
+
+// validateHashes checks that a set of chunk hashes does not reference chunks
+// that are not present in shards.
+func validateHashes(shards [][]SectorSlice, hashes []crypto.Hash) error {
+	var numChunks int
+	if len(shards) > 0 {
+		numChunks = len(shards[0])
+	}
+	if len(hashes) > numChunks {
+		return errors.Errorf("number of hashes (%v) exceeds number of chunks (%v)", len(hashes), numChunks)
+	}
+	return nil
+}
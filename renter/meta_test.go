@@ -2,12 +2,16 @@ package renter
 
 import (
 	"bytes"
+	"crypto/ed25519"
 	"os"
 	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
 	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519hash"
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/merkle"
 	"lukechampine.com/us/renterhost"
@@ -67,3 +71,178 @@ func BenchmarkWriteMetaFile(b *testing.B) {
 		}
 	}
 }
+
+func TestMetaFileHashes(t *testing.T) {
+	hpk := hostdb.HostKeyFromPublicKey(make([]byte, 32))
+	m := NewMetaFile(0660, 3*merkle.SegmentSize+10, []hostdb.HostPublicKey{hpk}, 1)
+	m.Shards[0] = []SectorSlice{{NumSegments: 2}, {NumSegments: 2}}
+	chunks := [][]byte{frand.Bytes(2 * merkle.SegmentSize), frand.Bytes(merkle.SegmentSize + 10)}
+	for _, c := range chunks {
+		m.ChunkHashes = append(m.ChunkHashes, ChunkHash(c, 2*merkle.SegmentSize))
+	}
+	path := filepath.Join(os.TempDir(), t.Name()+".usa")
+	defer os.RemoveAll(path)
+	if err := WriteMetaFile(path, m); err != nil {
+		t.Fatal(err)
+	}
+	m2, err := ReadMetaFile(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(m2.ChunkHashes) != 2 || m2.ChunkHashes[0] != m.ChunkHashes[0] || m2.ChunkHashes[1] != m.ChunkHashes[1] {
+		t.Fatal("hashes were not preserved")
+	} else if ok, err := MetaFileFullyUploaded(path); err != nil || !ok {
+		t.Fatal("expected file to be fully uploaded", err)
+	}
+
+	// the final chunk is implicitly padded with zeros
+	if err := m2.VerifyChunk(0, chunks[0]); err != nil {
+		t.Fatal(err)
+	} else if err := m2.VerifyChunk(1, chunks[1]); err != nil {
+		t.Fatal(err)
+	} else if err := m2.VerifyChunk(1, append(chunks[1], make([]byte, merkle.SegmentSize-10)...)); err != nil {
+		t.Fatal(err)
+	}
+	chunks[0][0] ^= 1
+	if err := m2.VerifyChunk(0, chunks[0]); errors.Cause(err) != ErrIntegrityMismatch {
+		t.Fatal("expected ErrIntegrityMismatch, got", err)
+	}
+	// chunks without hashes are not verified
+	m2.ChunkHashes[0] = crypto.Hash{}
+	if err := m2.VerifyChunk(0, chunks[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	// version 2 metafiles do not store hashes
+	m.Version = 2
+	if err := WriteMetaFile(path, m); err != nil {
+		t.Fatal(err)
+	} else if m2, err := ReadMetaFile(path); err != nil {
+		t.Fatal(err)
+	} else if m2.Version != 2 || m2.ChunkHashes != nil {
+		t.Fatal("version 2 metafile should not contain hashes")
+	} else if err := m2.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMetaFileErasureCode(t *testing.T) {
+	hosts := make([]hostdb.HostPublicKey, 8)
+	for i := range hosts {
+		hosts[i] = hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+	}
+	m := NewMetaFile(0660, 0, hosts, 4)
+	if _, ok := m.ErasureCode().(rsCode); !ok {
+		t.Fatal("default erasure code should be Reed-Solomon")
+	}
+	m.Code = ErasureCodeSpec{Name: "lrc", Params: []int{2}}
+	path := filepath.Join(os.TempDir(), t.Name()+".usa")
+	defer os.RemoveAll(path)
+	if err := WriteMetaFile(path, m); err != nil {
+		t.Fatal(err)
+	}
+	index, err := ReadMetaIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if index.Code.Name != "lrc" || len(index.Code.Params) != 1 || index.Code.Params[0] != 2 {
+		t.Fatal("erasure code was not preserved:", index.Code)
+	} else if _, ok := index.ErasureCode().(LocalRepairer); !ok {
+		t.Fatal("erasure code should be locally repairable")
+	}
+	// only a subset of 4-shard combinations suffice
+	if !index.CanRecover([]bool{true, true, true, true, false, false, false, false}) {
+		t.Fatal("data shards should be sufficient")
+	} else if index.CanRecover([]bool{false, false, true, true, false, false, true, true}) {
+		t.Fatal("group 1 and local parity shards should be insufficient")
+	}
+
+	// unknown codes are rejected
+	m.Code = ErasureCodeSpec{Name: "foo"}
+	if err := WriteMetaFile(path, m); err != nil {
+		t.Fatal(err)
+	} else if _, err := ReadMetaFile(path); err == nil {
+		t.Fatal("expected unknown erasure code to be rejected")
+	}
+	// older versions do not support erasure codes
+	m.Code = ErasureCodeSpec{Name: "lrc", Params: []int{2}}
+	m.Version = 3
+	if err := m.Validate(); err == nil {
+		t.Fatal("expected version 3 metafile with erasure code to be rejected")
+	}
+}
+
+func TestMetaFileAttributes(t *testing.T) {
+	hpk := hostdb.HostKeyFromPublicKey(make([]byte, 32))
+	m := NewMetaFile(0660, 0, []hostdb.HostPublicKey{hpk}, 1)
+	m.Attributes = map[string][]byte{
+		"content-type": []byte("text/plain"),
+		"checksum":     frand.Bytes(32),
+	}
+	path := filepath.Join(os.TempDir(), t.Name()+".usa")
+	defer os.RemoveAll(path)
+	if err := WriteMetaFile(path, m); err != nil {
+		t.Fatal(err)
+	}
+	index, err := ReadMetaIndex(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(index.Attributes) != len(m.Attributes) {
+		t.Fatal("wrong number of attributes:", len(index.Attributes))
+	}
+	for k, v := range m.Attributes {
+		if !bytes.Equal(index.Attributes[k], v) {
+			t.Fatalf("attribute %q was not preserved", k)
+		}
+	}
+
+	// older versions do not support attributes
+	m.Version = 4
+	if err := m.Validate(); err == nil {
+		t.Fatal("expected version 4 metafile with attributes to be rejected")
+	}
+	m.Version = MetaFileVersion
+	m.Attributes[""] = nil
+	if err := m.Validate(); err == nil {
+		t.Fatal("expected empty attribute name to be rejected")
+	}
+}
+
+func TestSharedFile(t *testing.T) {
+	hpk := hostdb.HostKeyFromPublicKey(make([]byte, 32))
+	m := NewMetaFile(0660, merkle.SegmentSize, []hostdb.HostPublicKey{hpk}, 1)
+	m.Shards[0] = []SectorSlice{{NumSegments: 1}}
+	m.ChunkHashes = []crypto.Hash{frand.Entropy256()}
+
+	// share with an ed25519 key
+	priv := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+	pub, ok := ed25519hash.X25519PublicKey(priv.Public().(ed25519.PublicKey))
+	if !ok {
+		t.Fatal("could not convert public key")
+	}
+	path := filepath.Join(os.TempDir(), t.Name()+".usa")
+	defer os.RemoveAll(path)
+	if err := WriteSharedFile(path, m, pub); err != nil {
+		t.Fatal(err)
+	}
+
+	// the master key should not be readable without the recipient's key
+	if index, err := ReadMetaIndex(path); err != nil {
+		t.Fatal(err)
+	} else if index.MasterKey != (KeySeed{}) {
+		t.Fatal("shared file should not contain master key")
+	} else if _, err := ReadMetaFile(path); err == nil {
+		t.Fatal("expected ReadMetaFile to reject shared file")
+	} else if _, err := ReadSharedFile(path, frand.Entropy256()); err == nil {
+		t.Fatal("expected ReadSharedFile to fail with wrong key")
+	}
+
+	m2, err := ReadSharedFile(path, ed25519hash.X25519PrivateKey(priv))
+	if err != nil {
+		t.Fatal(err)
+	} else if m2.MasterKey != m.MasterKey {
+		t.Fatal("master key was not recovered")
+	} else if m2.Mode != 0440 {
+		t.Fatalf("expected read-only mode, got %v", m2.Mode)
+	} else if len(m2.Shards[0]) != 1 || m2.ChunkHashes[0] != m.ChunkHashes[0] {
+		t.Fatal("shared file does not match original")
+	}
+}
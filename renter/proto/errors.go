@@ -0,0 +1,241 @@
+package proto
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/us/renterhost"
+)
+
+// An ErrorCategory is a broad classification of an error returned by a
+// Session, indicating how the caller should respond to it.
+type ErrorCategory int
+
+// Error categories.
+const (
+	// CategoryNone is the category of a nil error.
+	CategoryNone ErrorCategory = iota
+
+	// CategoryNetwork indicates a transient failure of the connection to the
+	// host, e.g. a timeout or reset. The Session is closed, but the RPC may
+	// succeed if retried on a new Session.
+	CategoryNetwork
+
+	// CategoryHostRejected indicates that the host refused the request, or
+	// that the host cannot satisfy it (e.g. because its prices are too high).
+	// The ErrorClass's Reason field provides more detail.
+	CategoryHostRejected
+
+	// CategoryContractExhausted indicates that the contract does not contain
+	// enough renter funds to pay for the RPC. The contract should be renewed.
+	CategoryContractExhausted
+
+	// CategoryContractFinalized indicates that the contract has reached its
+	// maximum revision number, and can no longer be revised.
+	CategoryContractFinalized
+
+	// CategoryProofInvalid indicates that the host supplied an invalid proof or
+	// signature, or otherwise violated the protocol. The host should not be
+	// trusted.
+	CategoryProofInvalid
+
+	// CategoryLocal indicates an error on the renter's side, such as misuse of
+	// the API or a failure of the local ContractStore. Retrying is unlikely to
+	// help.
+	CategoryLocal
+)
+
+// String implements fmt.Stringer.
+func (c ErrorCategory) String() string {
+	switch c {
+	case CategoryNone:
+		return "none"
+	case CategoryNetwork:
+		return "network"
+	case CategoryHostRejected:
+		return "host rejected"
+	case CategoryContractExhausted:
+		return "contract exhausted"
+	case CategoryContractFinalized:
+		return "contract finalized"
+	case CategoryProofInvalid:
+		return "proof invalid"
+	case CategoryLocal:
+		return "local"
+	default:
+		return fmt.Sprintf("ErrorCategory(%d)", int(c))
+	}
+}
+
+// A RejectReason describes why a host rejected a request.
+type RejectReason int
+
+// Reject reasons.
+const (
+	RejectUnknown RejectReason = iota
+	RejectContractLocked
+	RejectNoContractLocked
+	RejectContractFinalized
+	RejectInsufficientPayment
+	RejectInsufficientCollateral
+	RejectInvalidSignature
+	RejectSectorNotFound
+	RejectUnsupported
+	RejectPrices // the host's prices exceed the renter's PriceLimits
+	RejectInternal
+)
+
+// String implements fmt.Stringer.
+func (r RejectReason) String() string {
+	switch r {
+	case RejectUnknown:
+		return "unknown"
+	case RejectContractLocked:
+		return "contract locked"
+	case RejectNoContractLocked:
+		return "no contract locked"
+	case RejectContractFinalized:
+		return "contract finalized"
+	case RejectInsufficientPayment:
+		return "insufficient payment"
+	case RejectInsufficientCollateral:
+		return "insufficient collateral"
+	case RejectInvalidSignature:
+		return "invalid signature"
+	case RejectSectorNotFound:
+		return "sector not found"
+	case RejectUnsupported:
+		return "unsupported"
+	case RejectPrices:
+		return "prices exceed limits"
+	case RejectInternal:
+		return "internal error"
+	default:
+		return fmt.Sprintf("RejectReason(%d)", int(r))
+	}
+}
+
+// rejectReasons maps fragments of the error descriptions sent by hosts to
+// RejectReasons. Hosts do not send structured errors, so this is necessarily
+// a best-effort mapping.
+var rejectReasons = []struct {
+	reason RejectReason
+	descs  []string
+}{
+	{RejectContractLocked, []string{"locked by another party", "another contract is already locked"}},
+	{RejectNoContractLocked, []string{"no contract locked", "contract is not locked"}},
+	{RejectContractFinalized, []string{"cannot be revised further"}},
+	{RejectInsufficientPayment, []string{"pays host", "insufficient payment", "insufficient funds"}},
+	{RejectInsufficientCollateral, []string{"host collateral", "insufficient collateral"}},
+	{RejectInvalidSignature, []string{"signature is invalid", "bad signature", "invalid signature"}},
+	{RejectSectorNotFound, []string{"no sector with that Merkle root", "could not find the desired sector", "sector not found"}},
+	{RejectUnsupported, []string{"invalid or unknown RPC", "unknown action type"}},
+	{RejectInternal, []string{"internal error"}},
+}
+
+func rejectReason(re *renterhost.RPCError) RejectReason {
+	for _, r := range rejectReasons {
+		for _, desc := range r.descs {
+			if strings.Contains(re.Description, desc) {
+				return r.reason
+			}
+		}
+	}
+	return RejectUnknown
+}
+
+// An ErrorClass is the classification of an error, as returned by Classify.
+type ErrorClass struct {
+	Category ErrorCategory
+	// Reason is set if the error was sent by the host, or if the Session
+	// refused to contact the host.
+	Reason RejectReason
+}
+
+// Temporary returns true if the RPC that produced the error may succeed if
+// retried, possibly on a new Session.
+func (c ErrorClass) Temporary() bool {
+	switch c.Category {
+	case CategoryNetwork:
+		return true
+	case CategoryHostRejected:
+		return c.Reason == RejectContractLocked || c.Reason == RejectInternal
+	default:
+		return false
+	}
+}
+
+// String implements fmt.Stringer.
+func (c ErrorClass) String() string {
+	if c.Category == CategoryHostRejected {
+		return c.Category.String() + " (" + c.Reason.String() + ")"
+	}
+	return c.Category.String()
+}
+
+// A misbehaviorError indicates that the host violated the protocol.
+type misbehaviorError struct {
+	msg string
+}
+
+func (e *misbehaviorError) Error() string { return e.msg }
+
+// errHostMisbehaved returns an error that Classify reports as
+// CategoryProofInvalid.
+func errHostMisbehaved(format string, args ...interface{}) error {
+	return &misbehaviorError{fmt.Sprintf(format, args...)}
+}
+
+func isNetworkError(err error) bool {
+	var ne net.Error // includes context.DeadlineExceeded
+	return errors.As(err, &ne) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.ErrClosedPipe) ||
+		errors.Is(err, context.Canceled) ||
+		errors.Is(err, renterhost.ErrNonceExhausted) ||
+		errors.Is(err, renterhost.ErrMuxClosed) ||
+		// a corrupted message is indistinguishable from a network failure
+		strings.Contains(err.Error(), "message authentication failed")
+}
+
+// Classify classifies an error returned by a Session (or by a type that uses a
+// Session, such as renterutil.HostSet), allowing the caller to decide whether
+// to retry the RPC, replace the host, or give up.
+func Classify(err error) ErrorClass {
+	if err == nil {
+		return ErrorClass{Category: CategoryNone}
+	}
+	var re *renterhost.RPCError
+	if errors.As(err, &re) {
+		c := ErrorClass{Category: CategoryHostRejected, Reason: rejectReason(re)}
+		if c.Reason == RejectContractFinalized {
+			c.Category = CategoryContractFinalized
+		}
+		return c
+	}
+	var me *misbehaviorError
+	var pe *PriceError
+	switch {
+	case errors.Is(err, ErrContractFinalized):
+		return ErrorClass{Category: CategoryContractFinalized}
+	case errors.Is(err, ErrInsufficientFunds):
+		return ErrorClass{Category: CategoryContractExhausted}
+	case errors.Is(err, ErrInvalidMerkleProof), errors.As(err, &me):
+		return ErrorClass{Category: CategoryProofInvalid}
+	case errors.Is(err, ErrContractLocked):
+		return ErrorClass{Category: CategoryHostRejected, Reason: RejectContractLocked}
+	case errors.Is(err, ErrUnsupportedRPC), errors.Is(err, ErrUnsupportedWriteAction):
+		return ErrorClass{Category: CategoryHostRejected, Reason: RejectUnsupported}
+	case errors.As(err, &pe):
+		return ErrorClass{Category: CategoryHostRejected, Reason: RejectPrices}
+	case isNetworkError(err):
+		return ErrorClass{Category: CategoryNetwork}
+	default:
+		return ErrorClass{Category: CategoryLocal}
+	}
+}
@@ -0,0 +1,260 @@
+package proto
+
+import (
+	"context"
+	"crypto/ed25519"
+	"sync"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/wallet"
+)
+
+// A BatchWallet is a Wallet that can also report its unspent outputs and the
+// unlock conditions of its addresses. This allows many contracts to be funded
+// by a single parent transaction.
+type BatchWallet interface {
+	Wallet
+	UnspentOutputs(limbo bool) []wallet.UnspentOutput
+	AddressInfo(addr types.UnlockHash) (wallet.SeedAddressInfo, bool)
+}
+
+// A FormContractResult is the outcome of forming a contract with one host in
+// a batch.
+type FormContractResult struct {
+	Host         hostdb.HostPublicKey
+	Contract     ContractRevision
+	Transactions []types.Transaction
+	Err          error
+}
+
+// A FormContractsBatch is the outcome of FormContracts.
+type FormContractsBatch struct {
+	// Parent is the transaction that splits the wallet's funds into one output
+	// per host. It is included in the transaction set of each contract.
+	Parent  types.Transaction
+	Results []FormContractResult
+	// Limbo is the total value of the Parent outputs that fund failed
+	// contracts. (Hosts that exceed the price limits do not receive an
+	// output.) FormContracts does not broadcast anything; instead, Parent is
+	// broadcast by the caller as part of each formed contract's transaction
+	// set. Once Parent is confirmed, the outputs in Limbo belong to the wallet
+	// again. If every contract failed, Parent need not be broadcast, and Limbo
+	// is zero.
+	Limbo types.Currency
+}
+
+// Formed returns the results of the contracts that were successfully formed.
+func (b FormContractsBatch) Formed() []FormContractResult {
+	var formed []FormContractResult
+	for _, r := range b.Results {
+		if r.Err == nil {
+			formed = append(formed, r)
+		}
+	}
+	return formed
+}
+
+// FormContracts forms a contract with each of the specified hosts. The
+// contract with hosts[i] will have renterPayouts[i] coins in the renter
+// output. All of the contracts are funded by a single parent transaction,
+// which splits the wallet's outputs using wallet.DistributeFunds, and the
+// contracts are negotiated in parallel. Hosts whose ContractPrice exceeds
+// limits are skipped, and do not receive a parent output. If ctx is cancelled,
+// any negotiations still in progress are aborted.
+//
+// FormContracts only returns an error if the parent transaction could not be
+// created; errors from individual hosts are reported in the returned
+// FormContractsBatch.
+func FormContracts(ctx context.Context, w BatchWallet, tpool TransactionPool, key ed25519.PrivateKey, hosts []hostdb.ScannedHost, renterPayouts []types.Currency, startHeight, endHeight types.BlockHeight, limits PriceLimits) (_ FormContractsBatch, err error) {
+	defer wrapErr(&err, "FormContracts")
+	if err := ctx.Err(); err != nil {
+		return FormContractsBatch{}, err
+	} else if len(hosts) != len(renterPayouts) {
+		return FormContractsBatch{}, errors.New("number of hosts and payouts must match")
+	} else if len(hosts) == 0 {
+		return FormContractsBatch{}, errors.New("no hosts specified")
+	} else if endHeight < startHeight {
+		return FormContractsBatch{}, errors.New("end height must be greater than start height")
+	}
+	_, maxFee, err := tpool.FeeEstimate()
+	if err != nil {
+		return FormContractsBatch{}, errors.Wrap(err, "could not estimate transaction fee")
+	}
+	fee := maxFee.Mul64(estTxnSize)
+
+	// construct each contract, and determine the largest amount that any
+	// contract requires
+	type pending struct {
+		fc         types.FileContract
+		uc         types.UnlockConditions
+		refundAddr types.UnlockHash
+		cost       types.Currency
+		output     int // index of the parent output, or -1 if not funded
+	}
+	batch := FormContractsBatch{
+		Results: make([]FormContractResult, len(hosts)),
+	}
+	contracts := make([]pending, len(hosts))
+	var per types.Currency
+	var funded int
+	for i, host := range hosts {
+		batch.Results[i].Host = host.PublicKey
+		if err := limits.Check(host.HostSettings, RPCUsage{Contracts: 1}); err != nil {
+			batch.Results[i].Err = err
+			contracts[i].output = -1
+			continue
+		}
+		refundAddr, err := w.Address()
+		if err != nil {
+			return FormContractsBatch{}, errors.Wrap(err, "could not get an address to use")
+		}
+		fc, uc := newContract(host, key, refundAddr, renterPayouts[i], startHeight, endHeight)
+		cost := renterPayouts[i].Add(host.ContractPrice).Add(types.Tax(startHeight, fc.Payout)).Add(fee)
+		contracts[i] = pending{fc, uc, refundAddr, cost, funded}
+		funded++
+		if cost.Cmp(per) > 0 {
+			per = cost
+		}
+	}
+	if funded == 0 {
+		return FormContractsBatch{}, errors.New("no hosts are within price limits")
+	}
+
+	// fund a parent transaction with one output per contract, each worth per
+	outputs := confirmedOutputs(w)
+	ins, parentFee, change := wallet.DistributeFunds(outputs, funded, per, maxFee)
+	if ins == nil {
+		return FormContractsBatch{}, wallet.ErrInsufficientFunds
+	}
+	splitAddr, err := w.Address()
+	if err != nil {
+		return FormContractsBatch{}, errors.Wrap(err, "could not get an address to use")
+	}
+	splitInfo, ok := w.AddressInfo(splitAddr)
+	if !ok {
+		return FormContractsBatch{}, errors.New("missing unlock conditions for address")
+	}
+	parent := types.Transaction{
+		MinerFees: []types.Currency{parentFee},
+	}
+	var toSign []crypto.Hash
+	for _, o := range ins {
+		info, ok := w.AddressInfo(o.UnlockHash)
+		if !ok {
+			return FormContractsBatch{}, errors.New("missing unlock conditions for address")
+		}
+		parent.SiacoinInputs = append(parent.SiacoinInputs, types.SiacoinInput{
+			ParentID:         o.ID,
+			UnlockConditions: info.UnlockConditions,
+		})
+		parent.TransactionSignatures = append(parent.TransactionSignatures, wallet.StandardTransactionSignature(crypto.Hash(o.ID)))
+		toSign = append(toSign, crypto.Hash(o.ID))
+	}
+	for i := 0; i < funded; i++ {
+		parent.SiacoinOutputs = append(parent.SiacoinOutputs, types.SiacoinOutput{
+			UnlockHash: splitAddr,
+			Value:      per,
+		})
+	}
+	if !change.IsZero() {
+		changeAddr, err := w.Address()
+		if err != nil {
+			return FormContractsBatch{}, errors.Wrap(err, "could not get an address to use")
+		}
+		parent.SiacoinOutputs = append(parent.SiacoinOutputs, types.SiacoinOutput{
+			UnlockHash: changeAddr,
+			Value:      change,
+		})
+	}
+	if err := w.SignTransaction(&parent, toSign); err != nil {
+		return FormContractsBatch{}, errors.Wrap(err, "failed to sign parent transaction")
+	}
+	grandparents, err := tpool.UnconfirmedParents(parent)
+	if err != nil {
+		return FormContractsBatch{}, err
+	}
+	// NOTE: use a full slice expression so that the goroutines below cannot
+	// append to the same backing array
+	parents := append(grandparents, parent)
+	parents = parents[:len(parents):len(parents)]
+
+	// negotiate each contract in parallel
+	batch.Parent = parent
+	var wg sync.WaitGroup
+	for i := range contracts {
+		if contracts[i].output == -1 {
+			continue
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			c := contracts[i]
+			outputID := parent.SiacoinOutputID(uint64(c.output))
+			txn := types.Transaction{
+				SiacoinInputs: []types.SiacoinInput{{
+					ParentID:         outputID,
+					UnlockConditions: splitInfo.UnlockConditions,
+				}},
+				FileContracts:         []types.FileContract{c.fc},
+				MinerFees:             []types.Currency{fee},
+				TransactionSignatures: []types.TransactionSignature{wallet.StandardTransactionSignature(crypto.Hash(outputID))},
+			}
+			if refund := per.Sub(c.cost); !refund.IsZero() {
+				txn.SiacoinOutputs = []types.SiacoinOutput{{
+					UnlockHash: c.refundAddr,
+					Value:      refund,
+				}}
+			}
+			r := &batch.Results[i]
+			r.Err = func() (err error) {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				s, err := NewUnlockedSession(hosts[i].NetAddress, hosts[i].PublicKey, 0)
+				if err != nil {
+					return err
+				}
+				defer s.Close()
+				defer s.interruptOnCancel(ctx, &err)()
+				s.host = hosts[i]
+				r.Contract, r.Transactions, err = s.negotiateContract(w, key, c.uc, txn, []crypto.Hash{crypto.Hash(outputID)}, parents)
+				return err
+			}()
+		}(i)
+	}
+	wg.Wait()
+
+	var formed int
+	for _, r := range batch.Results {
+		if r.Err == nil {
+			formed++
+		}
+	}
+	if formed > 0 {
+		batch.Limbo = per.Mul64(uint64(funded - formed))
+	}
+	return batch, nil
+}
+
+// confirmedOutputs returns the confirmed outputs of w that have not been spent
+// by limbo transactions.
+func confirmedOutputs(w BatchWallet) []wallet.UnspentOutput {
+	confirmed := w.UnspentOutputs(false)
+	spendable := make(map[types.SiacoinOutputID]struct{})
+	for _, o := range w.UnspentOutputs(true) {
+		spendable[o.ID] = struct{}{}
+	}
+	outputs := confirmed[:0]
+	for _, o := range confirmed {
+		if _, ok := spendable[o.ID]; ok {
+			outputs = append(outputs, o)
+		}
+	}
+	return outputs
+}
+
+// ensure that HotWallet satisfies the BatchWallet interface
+var _ BatchWallet = (*wallet.HotWallet)(nil)
@@ -1,6 +1,7 @@
 package proto
 
 import (
+	"context"
 	"crypto/ed25519"
 	"math/big"
 	"time"
@@ -33,17 +34,72 @@ func FormContract(w Wallet, tpool TransactionPool, key ed25519.PrivateKey, host
 
 // FormContract forms a contract with a host. The resulting contract will have
 // renterPayout coins in the renter output.
-func (s *Session) FormContract(w Wallet, tpool TransactionPool, key ed25519.PrivateKey, renterPayout types.Currency, startHeight, endHeight types.BlockHeight) (_ ContractRevision, _ []types.Transaction, err error) {
+func (s *Session) FormContract(w Wallet, tpool TransactionPool, key ed25519.PrivateKey, renterPayout types.Currency, startHeight, endHeight types.BlockHeight) (ContractRevision, []types.Transaction, error) {
+	return s.FormContractContext(context.Background(), w, tpool, key, renterPayout, startHeight, endHeight)
+}
+
+// FormContractContext is like FormContract, but aborts the RPC if ctx is
+// cancelled.
+func (s *Session) FormContractContext(ctx context.Context, w Wallet, tpool TransactionPool, key ed25519.PrivateKey, renterPayout types.Currency, startHeight, endHeight types.BlockHeight) (_ ContractRevision, _ []types.Transaction, err error) {
 	defer wrapErr(&err, "FormContract")
+	if err := ctx.Err(); err != nil {
+		return ContractRevision{}, nil, err
+	}
+	var walletCost types.Currency
+	var newID types.FileContractID
+	defer s.collectContractStats(renterhost.RPCFormContractID, &err, &walletCost, &newID)()
+	defer s.interruptOnCancel(ctx, &err)()
 	if endHeight < startHeight {
 		return ContractRevision{}, nil, errors.New("end height must be greater than start height")
+	} else if err := s.checkSupported(renterhost.RPCFormContractID); err != nil {
+		return ContractRevision{}, nil, err
+	} else if err := s.limits.Check(s.host.HostSettings, RPCUsage{Contracts: 1}); err != nil {
+		return ContractRevision{}, nil, err
 	}
 	// get a renter address for the file contract's valid/missed outputs
 	refundAddr, err := w.Address()
 	if err != nil {
 		return ContractRevision{}, nil, errors.Wrap(err, "could not get an address to use")
 	}
+	fc, uc := newContract(s.host, key, refundAddr, renterPayout, startHeight, endHeight)
 
+	// Calculate how much the renter needs to pay. On top of the renterPayout,
+	// the renter is responsible for paying host.ContractPrice, the siafund
+	// tax, and a transaction fee.
+	_, maxFee, err := tpool.FeeEstimate()
+	if err != nil {
+		return ContractRevision{}, nil, errors.Wrap(err, "could not estimate transaction fee")
+	}
+	fee := maxFee.Mul64(estTxnSize)
+	totalCost := renterPayout.Add(s.host.ContractPrice).Add(types.Tax(startHeight, fc.Payout)).Add(fee)
+
+	// create and fund a transaction containing fc
+	txn := types.Transaction{
+		FileContracts: []types.FileContract{fc},
+		MinerFees:     []types.Currency{fee},
+	}
+	toSign, err := w.FundTransaction(&txn, totalCost)
+	if err != nil {
+		return ContractRevision{}, nil, err
+	}
+
+	// include any unconfirmed parent transactions
+	parents, err := tpool.UnconfirmedParents(txn)
+	if err != nil {
+		return ContractRevision{}, nil, err
+	}
+	rev, txnSet, err := s.negotiateContract(w, key, uc, txn, toSign, parents)
+	if err != nil {
+		return ContractRevision{}, nil, err
+	}
+	walletCost = totalCost.Sub(renterPayout)
+	newID = rev.ID()
+	return rev, txnSet, nil
+}
+
+// newContract creates a file contract with the specified host. The contract
+// pays renterPayout to refundAddr.
+func newContract(host hostdb.ScannedHost, key ed25519.PrivateKey, refundAddr types.UnlockHash, renterPayout types.Currency, startHeight, endHeight types.BlockHeight) (types.FileContract, types.UnlockConditions) {
 	// create unlock conditions
 	uc := types.UnlockConditions{
 		PublicKeys: []types.SiaPublicKey{
@@ -51,7 +107,7 @@ func (s *Session) FormContract(w Wallet, tpool TransactionPool, key ed25519.Priv
 				Algorithm: types.SignatureEd25519,
 				Key:       []byte(ed25519hash.ExtractPublicKey(key)),
 			},
-			s.host.PublicKey.SiaPublicKey(),
+			host.PublicKey.SiaPublicKey(),
 		},
 		SignaturesRequired: 2,
 	}
@@ -60,21 +116,21 @@ func (s *Session) FormContract(w Wallet, tpool TransactionPool, key ed25519.Priv
 	// Note that it's okay to estimate the collateral: the host only cares if
 	// we exceed MaxCollateral, and we only care about the tax we pay on it.
 	var hostCollateral types.Currency
-	blockBytes := s.host.UploadBandwidthPrice.Add(s.host.StoragePrice).Add(s.host.DownloadBandwidthPrice).Mul64(uint64(endHeight - startHeight))
+	blockBytes := host.UploadBandwidthPrice.Add(host.StoragePrice).Add(host.DownloadBandwidthPrice).Mul64(uint64(endHeight - startHeight))
 	if !blockBytes.IsZero() {
 		bytes := renterPayout.Div(blockBytes)
-		hostCollateral = s.host.Collateral.Mul(bytes).Mul64(uint64(endHeight - startHeight))
+		hostCollateral = host.Collateral.Mul(bytes).Mul64(uint64(endHeight - startHeight))
 	}
 	// hostCollateral can't be greater than MaxCollateral, and (due to a host-
 	// side bug) it can't be zero either.
-	if hostCollateral.Cmp(s.host.MaxCollateral) > 0 {
-		hostCollateral = s.host.MaxCollateral
+	if hostCollateral.Cmp(host.MaxCollateral) > 0 {
+		hostCollateral = host.MaxCollateral
 	} else if hostCollateral.IsZero() {
 		hostCollateral = types.NewCurrency64(1)
 	}
 
 	// calculate payouts
-	hostPayout := s.host.ContractPrice.Add(hostCollateral)
+	hostPayout := host.ContractPrice.Add(hostCollateral)
 	payout := taxAdjustedPayout(renterPayout.Add(hostPayout))
 
 	// create file contract
@@ -82,7 +138,7 @@ func (s *Session) FormContract(w Wallet, tpool TransactionPool, key ed25519.Priv
 		FileSize:       0,
 		FileMerkleRoot: crypto.Hash{}, // no proof possible without data
 		WindowStart:    endHeight,
-		WindowEnd:      endHeight + s.host.WindowSize,
+		WindowEnd:      endHeight + host.WindowSize,
 		Payout:         payout,
 		UnlockHash:     uc.UnlockHash(),
 		RevisionNumber: 0,
@@ -90,47 +146,30 @@ func (s *Session) FormContract(w Wallet, tpool TransactionPool, key ed25519.Priv
 			// outputs need to account for tax
 			{Value: renterPayout, UnlockHash: refundAddr},
 			// collateral is returned to host
-			{Value: hostPayout, UnlockHash: s.host.UnlockHash},
+			{Value: hostPayout, UnlockHash: host.UnlockHash},
 		},
 		MissedProofOutputs: []types.SiacoinOutput{
 			// same as above
 			{Value: renterPayout, UnlockHash: refundAddr},
 			// same as above
-			{Value: hostPayout, UnlockHash: s.host.UnlockHash},
+			{Value: hostPayout, UnlockHash: host.UnlockHash},
 			// once we start doing revisions, we'll move some coins to the host and some to the void
 			{Value: types.ZeroCurrency, UnlockHash: types.UnlockHash{}},
 		},
 	}
+	return fc, uc
+}
 
-	// Calculate how much the renter needs to pay. On top of the renterPayout,
-	// the renter is responsible for paying host.ContractPrice, the siafund
-	// tax, and a transaction fee.
-	_, maxFee, err := tpool.FeeEstimate()
-	if err != nil {
-		return ContractRevision{}, nil, errors.Wrap(err, "could not estimate transaction fee")
-	}
-	fee := maxFee.Mul64(estTxnSize)
-	totalCost := renterPayout.Add(s.host.ContractPrice).Add(types.Tax(startHeight, fc.Payout)).Add(fee)
+// negotiateContract calls the FormContract RPC, sending the funded (but
+// unsigned) txn and its parents to the host. The inputs of txn identified by
+// toSign are signed by w.
+func (s *Session) negotiateContract(w Wallet, key ed25519.PrivateKey, uc types.UnlockConditions, txn types.Transaction, toSign []crypto.Hash, parents []types.Transaction) (_ ContractRevision, _ []types.Transaction, err error) {
+	fc := txn.FileContracts[0]
 
-	// create and fund a transaction containing fc
-	txn := types.Transaction{
-		FileContracts: []types.FileContract{fc},
-		MinerFees:     []types.Currency{fee},
-	}
-	toSign, err := w.FundTransaction(&txn, totalCost)
-	if err != nil {
-		return ContractRevision{}, nil, err
-	}
 	// the host expects the contract to have no TransactionSignatures
 	addedSignatures := txn.TransactionSignatures
 	txn.TransactionSignatures = nil
 
-	// include any unconfirmed parent transactions
-	parents, err := tpool.UnconfirmedParents(txn)
-	if err != nil {
-		return ContractRevision{}, nil, err
-	}
-
 	// send request
 	s.extendDeadline(120 * time.Second)
 	req := &renterhost.RPCFormContractRequest{
@@ -180,6 +219,17 @@ func (s *Session) FormContract(w Wallet, tpool TransactionPool, key ed25519.Priv
 		Signature:      ed25519hash.Sign(key, renterhost.HashRevision(initRevision)),
 	}
 
+	if s.store != nil {
+		pending := ContractRevision{
+			Revision:   initRevision,
+			Signatures: [2]types.TransactionSignature{renterRevisionSig, {}},
+		}
+		if err := s.store.SetPendingRevision(pending); err != nil {
+			s.sess.WriteResponse(nil, errors.New("internal error"))
+			return ContractRevision{}, nil, errors.Wrap(err, "couldn't store pending revision")
+		}
+	}
+
 	// Send signatures.
 	renterSigs := &renterhost.RPCFormContractSignatures{
 		ContractSignatures: addedSignatures,
@@ -197,10 +247,16 @@ func (s *Session) FormContract(w Wallet, tpool TransactionPool, key ed25519.Priv
 	txn.TransactionSignatures = append(txn.TransactionSignatures, hostSigs.ContractSignatures...)
 	signedTxnSet := append(resp.Parents, append(parents, txn)...)
 
-	return ContractRevision{
+	rev := ContractRevision{
 		Revision:   initRevision,
 		Signatures: [2]types.TransactionSignature{renterRevisionSig, hostSigs.RevisionSignature},
-	}, signedTxnSet, nil
+	}
+	if s.store != nil {
+		if err := s.store.SetRevision(rev); err != nil {
+			return ContractRevision{}, nil, errors.Wrap(err, "couldn't store revision")
+		}
+	}
+	return rev, signedTxnSet, nil
 }
 
 // NOTE: due to a bug in the transaction validation code, calculating payouts
@@ -0,0 +1,100 @@
+package proto
+
+import (
+	"crypto/ed25519"
+	"net"
+	"time"
+
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renterhost"
+)
+
+// A Mux is a connection to a host that can carry multiple Sessions at once.
+// Each Session runs its RPCs independently, so (for example) Sessions locking
+// different contracts can Read concurrently, and a Session without a contract
+// can fetch the host's Settings without waiting for them. If the host does not
+// support multiplexing, the Mux carries only one Session.
+type Mux struct {
+	mux     *renterhost.Mux
+	hostKey hostdb.HostPublicKey
+	height  types.BlockHeight
+}
+
+// Multiplexed returns whether the host supports multiplexing. If it does not,
+// only one Session can be created.
+func (m *Mux) Multiplexed() bool {
+	return m.mux.Multiplexed()
+}
+
+// NewUnlockedSession initiates a new Session on the Mux, without locking an
+// associated contract or requesting the host's settings.
+func (m *Mux) NewUnlockedSession() (_ *Session, err error) {
+	defer wrapErrWithReplace(&err, "NewUnlockedSession")
+	st, err := m.mux.OpenStream()
+	if err != nil {
+		return nil, err
+	}
+	st.SetDeadline(time.Now().Add(60 * time.Second))
+	sc := newStatsConn(st)
+	start := time.Now()
+	s, err := st.RenterSession(sc)
+	if err != nil {
+		return nil, err
+	}
+	return newUnlockedSession(s, sc, m.hostKey, m.height, time.Since(start)), nil
+}
+
+// NewSession initiates a new Session on the Mux, locking the specified
+// contract and requesting the host's settings.
+func (m *Mux) NewSession(id types.FileContractID, key ed25519.PrivateKey) (_ *Session, err error) {
+	defer wrapErrWithReplace(&err, "NewSession")
+	s, err := m.NewUnlockedSession()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.Lock(id, key, 10*time.Second); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if _, err := s.CachedSettings(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close closes the Mux and its underlying connection. Sessions should be
+// closed beforehand in order to terminate them gracefully.
+func (m *Mux) Close() error {
+	return m.mux.Close()
+}
+
+// NewMux initiates a new multiplexed connection with the specified host.
+func NewMux(hostIP modules.NetAddress, hostKey hostdb.HostPublicKey, currentHeight types.BlockHeight) (_ *Mux, err error) {
+	defer wrapErrWithReplace(&err, "NewMux")
+	conn, err := net.DialTimeout("tcp", string(hostIP), 60*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(60 * time.Second))
+	return NewMuxFromConn(conn, hostKey, currentHeight)
+}
+
+// NewMuxFromConn initiates a new multiplexed connection on top of the
+// provided conn. The conn should have a deadline appropriate for the
+// renter-host protocol handshake.
+func NewMuxFromConn(conn net.Conn, hostKey hostdb.HostPublicKey, currentHeight types.BlockHeight) (_ *Mux, err error) {
+	defer wrapErr(&err, "NewMuxFromConn")
+	m, err := renterhost.NewRenterMux(conn, hostKey.Ed25519())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &Mux{
+		mux:     m,
+		hostKey: hostKey,
+		height:  currentHeight,
+	}, nil
+}
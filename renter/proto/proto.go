@@ -2,6 +2,7 @@
 package proto // import "lukechampine.com/us/renter/proto"
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/pkg/errors"
@@ -51,6 +52,13 @@ type RPCStats struct {
 	Uploaded   uint64
 	Downloaded uint64
 	Cost       types.Currency
+	// WalletCost is the portion of Cost that was paid from the renter's
+	// wallet, rather than from the locked contract, e.g. the contract fee and
+	// transaction fee paid when forming or renewing a contract.
+	WalletCost types.Currency
+	// RevisionNumber is the revision number of the locked contract at the
+	// moment the RPC method returns, or zero if no contract is locked.
+	RevisionNumber uint64
 }
 
 // A RPCStatsRecorder records RPCStats, as reported by a Session.
@@ -58,6 +66,111 @@ type RPCStatsRecorder interface {
 	RecordRPCStats(stats RPCStats)
 }
 
+// PriceLimits specifies the maximum prices that a Session is willing to pay a
+// host. A zero value means that the corresponding price is not limited.
+type PriceLimits struct {
+	ContractPrice          types.Currency
+	BaseRPCPrice           types.Currency
+	SectorAccessPrice      types.Currency
+	StoragePrice           types.Currency
+	UploadBandwidthPrice   types.Currency
+	DownloadBandwidthPrice types.Currency
+}
+
+// RPCUsage describes the resources consumed by an RPC, for the purpose of
+// calculating its price.
+type RPCUsage struct {
+	Contracts      uint64
+	RPCs           uint64
+	SectorAccesses uint64
+	Storage        uint64 // in byte-blocks
+	Upload         uint64 // in bytes
+	Download       uint64 // in bytes
+}
+
+// Price returns the price of the resources in u, according to settings.
+func (u RPCUsage) Price(settings hostdb.HostSettings) types.Currency {
+	return settings.ContractPrice.Mul64(u.Contracts).
+		Add(settings.BaseRPCPrice.Mul64(u.RPCs)).
+		Add(settings.SectorAccessPrice.Mul64(u.SectorAccesses)).
+		Add(settings.StoragePrice.Mul64(u.Storage)).
+		Add(settings.UploadBandwidthPrice.Mul64(u.Upload)).
+		Add(settings.DownloadBandwidthPrice.Mul64(u.Download))
+}
+
+// Check returns a *PriceError if an RPC consuming the resources in usage
+// would cost more at the prices in settings than at the limit prices. Only
+// the total price of the RPC is considered, so a host may exceed the limit for
+// a resource that the RPC does not use, or exceed one limit while undercutting
+// another. Unlimited prices are taken from settings.
+func (pl PriceLimits) Check(settings hostdb.HostSettings, usage RPCUsage) error {
+	// compute the price of the RPC if the host charged the limit prices
+	limited := settings
+	limits := []struct {
+		field        string
+		price, limit types.Currency
+		used         uint64
+		limited      *types.Currency
+	}{
+		{"ContractPrice", settings.ContractPrice, pl.ContractPrice, usage.Contracts, &limited.ContractPrice},
+		{"BaseRPCPrice", settings.BaseRPCPrice, pl.BaseRPCPrice, usage.RPCs, &limited.BaseRPCPrice},
+		{"SectorAccessPrice", settings.SectorAccessPrice, pl.SectorAccessPrice, usage.SectorAccesses, &limited.SectorAccessPrice},
+		{"StoragePrice", settings.StoragePrice, pl.StoragePrice, usage.Storage, &limited.StoragePrice},
+		{"UploadBandwidthPrice", settings.UploadBandwidthPrice, pl.UploadBandwidthPrice, usage.Upload, &limited.UploadBandwidthPrice},
+		{"DownloadBandwidthPrice", settings.DownloadBandwidthPrice, pl.DownloadBandwidthPrice, usage.Download, &limited.DownloadBandwidthPrice},
+	}
+	for _, l := range limits {
+		if !l.limit.IsZero() {
+			*l.limited = l.limit
+		}
+	}
+	price, limit := usage.Price(settings), usage.Price(limited)
+	if price.Cmp(limit) <= 0 {
+		return nil
+	}
+	// report the first price used by the RPC that exceeds its limit, if any;
+	// otherwise, report the total
+	for _, l := range limits {
+		if l.used > 0 && !l.limit.IsZero() && l.price.Cmp(l.limit) > 0 {
+			return &PriceError{Field: l.field, Price: l.price, Limit: l.limit}
+		}
+	}
+	return &PriceError{Field: "total price", Price: price, Limit: limit}
+}
+
+// A PriceError is returned when a host's price exceeds a PriceLimits field.
+// Field is the name of the offending field, e.g. "StoragePrice", or "total
+// price" if no single field is to blame.
+type PriceError struct {
+	Field string
+	Price types.Currency
+	Limit types.Currency
+}
+
+// Error implements error.
+func (e *PriceError) Error() string {
+	return fmt.Sprintf("host's %v (%v H) exceeds limit of %v H", e.Field, e.Price, e.Limit)
+}
+
+// A ContractStore durably records contract revisions as they are signed. A
+// Session consults its ContractStore before and after each RPC that revises
+// the contract, so that the renter always knows which revisions it has signed,
+// even if the process crashes in the middle of an RPC.
+type ContractStore interface {
+	// SetPendingRevision records a revision that has been signed by the renter,
+	// but not (yet) by the host. It is called before the renter's signature is
+	// sent to the host, so the host's signature in rev is empty.
+	SetPendingRevision(rev ContractRevision) error
+	// SetRevision records a revision that has been signed by both parties,
+	// superseding any pending revision of the same contract.
+	SetRevision(rev ContractRevision) error
+	// Revision returns the most recent revision of the contract that has been
+	// signed by both parties.
+	Revision(id types.FileContractID) (ContractRevision, error)
+	// PendingRevision returns the pending revision of the contract, if any.
+	PendingRevision(id types.FileContractID) (ContractRevision, bool, error)
+}
+
 // A ContractRevision contains the most recent revision to a file contract and
 // its signatures.
 type ContractRevision struct {
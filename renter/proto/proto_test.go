@@ -1,11 +1,17 @@
 package proto
 
 import (
+	"context"
 	"io"
+	"net"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"gitlab.com/NebulousLabs/Sia/types"
 	"lukechampine.com/frand"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renterhost"
 )
 
 func TestReplaceError(t *testing.T) {
@@ -44,3 +50,112 @@ func BenchmarkTaxAdjustedPayout(b *testing.B) {
 		taxAdjustedPayout(target)
 	}
 }
+
+func TestPriceLimits(t *testing.T) {
+	limits := PriceLimits{
+		StoragePrice:           types.NewCurrency64(10),
+		DownloadBandwidthPrice: types.NewCurrency64(10),
+	}
+	settings := hostdb.HostSettings{
+		ContractPrice:          types.SiacoinPrecision, // unlimited
+		StoragePrice:           types.NewCurrency64(10),
+		DownloadBandwidthPrice: types.NewCurrency64(10),
+	}
+	usage := RPCUsage{Storage: 1, Download: 1}
+	if err := limits.Check(settings, usage); err != nil {
+		t.Fatal(err)
+	}
+	settings.DownloadBandwidthPrice = types.NewCurrency64(11)
+	if pe, ok := limits.Check(settings, usage).(*PriceError); !ok || pe.Field != "DownloadBandwidthPrice" {
+		t.Fatal("expected PriceError for DownloadBandwidthPrice, got", pe)
+	}
+	// only the total price of the RPC matters
+	if err := limits.Check(settings, RPCUsage{Storage: 1}); err != nil {
+		t.Fatal("RPC does not use download bandwidth, but got", err)
+	}
+	settings.StoragePrice = types.NewCurrency64(9)
+	if err := limits.Check(settings, usage); err != nil {
+		t.Fatal("RPC costs no more than the limit prices, but got", err)
+	}
+
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	// simulate the host raising its prices
+	renter.SetPriceLimits(limits)
+	renter.host.StoragePrice = types.NewCurrency64(11)
+	sector := [renterhost.SectorSize]byte{0: 1}
+	_, err := renter.Append(&sector)
+	if pe, ok := errors.Cause(err).(*PriceError); !ok || pe.Field != "StoragePrice" {
+		t.Fatal("expected PriceError for StoragePrice, got", err)
+	} else if renter.Revision().NumSectors() != 0 {
+		t.Fatal("contract should not have been revised")
+	}
+
+	// refreshing the settings should restore the host's actual prices
+	if _, err := renter.Settings(); err != nil {
+		t.Fatal(err)
+	} else if _, err := renter.Append(&sector); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	rl := NewRateLimiter(1e6, 0)
+	// the first 100ms worth of data is allowed immediately
+	if d := throttle([]*RateLimiter{rl}, 1e5, true); d != 0 {
+		t.Fatal("expected burst to be allowed immediately, got", d)
+	}
+	// subsequent data must wait
+	if d := throttle([]*RateLimiter{rl}, 1e5, true); d < 90*time.Millisecond || d > 100*time.Millisecond {
+		t.Fatal("expected ~100ms wait, got", d)
+	}
+	// downloads are not limited
+	if d := throttle([]*RateLimiter{rl}, 1e9, false); d != 0 {
+		t.Fatal("expected unlimited download, got", d)
+	}
+	// the most restrictive limiter wins
+	rl2 := NewRateLimiter(1e5, 0)
+	if d := throttleEstimate([]*RateLimiter{rl, rl2}, 1e5+1e4, 0); d < 900*time.Millisecond {
+		t.Fatal("expected estimate of at least 900ms, got", d)
+	}
+	if up, down := rl2.Limits(); up != 1e5 || down != 0 {
+		t.Fatal("wrong limits:", up, down)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	rpcErr := func(desc string) error {
+		return wrapResponseErr(&renterhost.RPCError{Description: desc}, "couldn't read response", "host rejected request")
+	}
+	tests := []struct {
+		err error
+		exp ErrorClass
+	}{
+		{nil, ErrorClass{Category: CategoryNone}},
+		{errors.Wrap(io.ErrUnexpectedEOF, "couldn't read response"), ErrorClass{Category: CategoryNetwork}},
+		{errors.WithMessage(context.DeadlineExceeded, "Read"), ErrorClass{Category: CategoryNetwork}},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, ErrorClass{Category: CategoryNetwork}},
+		{rpcErr("another contract is already locked"), ErrorClass{Category: CategoryHostRejected, Reason: RejectContractLocked}},
+		{rpcErr("no sector with that Merkle root"), ErrorClass{Category: CategoryHostRejected, Reason: RejectSectorNotFound}},
+		{rpcErr("revision pays host 1 H, expected at least 2 H"), ErrorClass{Category: CategoryHostRejected, Reason: RejectInsufficientPayment}},
+		{rpcErr("EOF"), ErrorClass{Category: CategoryHostRejected, Reason: RejectUnknown}},
+		{rpcErr("contract cannot be revised further"), ErrorClass{Category: CategoryContractFinalized, Reason: RejectContractFinalized}},
+		{errors.WithMessage(ErrContractLocked, "Lock"), ErrorClass{Category: CategoryHostRejected, Reason: RejectContractLocked}},
+		{errors.WithMessage(&PriceError{Field: "StoragePrice"}, "Write"), ErrorClass{Category: CategoryHostRejected, Reason: RejectPrices}},
+		{errors.WithMessage(ErrInsufficientFunds, "Write"), ErrorClass{Category: CategoryContractExhausted}},
+		{errors.WithMessage(ErrContractFinalized, "Read"), ErrorClass{Category: CategoryContractFinalized}},
+		{errors.WithMessage(ErrInvalidMerkleProof, "Read"), ErrorClass{Category: CategoryProofInvalid}},
+		{errors.WithMessage(errHostMisbehaved("host sent wrong amount of sector data"), "Read"), ErrorClass{Category: CategoryProofInvalid}},
+		{errors.WithMessage(ErrNoContractLocked, "Read"), ErrorClass{Category: CategoryLocal}},
+	}
+	for _, tt := range tests {
+		if c := Classify(tt.err); c != tt.exp {
+			t.Errorf("expected Classify(%v) = %v, got %v", tt.err, tt.exp, c)
+		}
+	}
+	if !Classify(io.EOF).Temporary() || Classify(ErrInvalidMerkleProof).Temporary() {
+		t.Error("wrong Temporary result")
+	}
+}
@@ -0,0 +1,148 @@
+package proto
+
+import (
+	"sync"
+	"time"
+)
+
+// A tokenBucket limits the rate of a stream of bytes. Transfers may exceed the
+// available tokens, in which case the bucket goes into debt and subsequent
+// transfers must wait for it to be repaid.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   int64 // bytes per second; zero means unlimited
+	tokens float64
+	last   time.Time
+}
+
+// burst returns the maximum number of tokens the bucket can hold: 100ms worth,
+// but at least enough for a minimum-size protocol message.
+func (tb *tokenBucket) burst() float64 {
+	b := float64(tb.rate) / 10
+	if b < 4096 {
+		b = 4096
+	}
+	return b
+}
+
+func (tb *tokenBucket) refill(now time.Time) {
+	tb.tokens += now.Sub(tb.last).Seconds() * float64(tb.rate)
+	if max := tb.burst(); tb.tokens > max {
+		tb.tokens = max
+	}
+	tb.last = now
+}
+
+// take removes n tokens from the bucket, returning how long the caller must
+// wait before the bucket is out of debt.
+func (tb *tokenBucket) take(n int) time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.rate == 0 {
+		return 0
+	}
+	tb.refill(time.Now())
+	tb.tokens -= float64(n)
+	if tb.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-tb.tokens / float64(tb.rate) * float64(time.Second))
+}
+
+// estimate returns the minimum time required to transfer n bytes, including
+// any outstanding debt.
+func (tb *tokenBucket) estimate(n uint64) time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.rate == 0 {
+		return 0
+	}
+	tb.refill(time.Now())
+	debt := float64(n) - tb.tokens
+	if debt <= 0 {
+		return 0
+	}
+	return time.Duration(debt / float64(tb.rate) * float64(time.Second))
+}
+
+func (tb *tokenBucket) setRate(rate int64) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.rate = rate
+	tb.tokens = tb.burst()
+	tb.last = time.Now()
+}
+
+func (tb *tokenBucket) getRate() int64 {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return tb.rate
+}
+
+// A RateLimiter limits the upload and download throughput of the Sessions
+// that use it. A RateLimiter may be shared by any number of Sessions, in which
+// case their combined throughput is limited. It is safe for concurrent use.
+type RateLimiter struct {
+	up, down tokenBucket
+}
+
+// SetLimits sets the upload and download limits, in bytes per second. A limit
+// of zero means that the corresponding direction is not limited.
+func (rl *RateLimiter) SetLimits(upload, download int64) {
+	rl.up.setRate(upload)
+	rl.down.setRate(download)
+}
+
+// Limits returns the upload and download limits, in bytes per second.
+func (rl *RateLimiter) Limits() (upload, download int64) {
+	return rl.up.getRate(), rl.down.getRate()
+}
+
+// NewRateLimiter returns a RateLimiter with the specified upload and download
+// limits, in bytes per second. A limit of zero means that the corresponding
+// direction is not limited.
+func NewRateLimiter(upload, download int64) *RateLimiter {
+	rl := new(RateLimiter)
+	rl.SetLimits(upload, download)
+	return rl
+}
+
+// GlobalRateLimiter is used by every Session, limiting the throughput of the
+// entire process. By default, it is unlimited.
+var GlobalRateLimiter = NewRateLimiter(0, 0)
+
+// maxThrottledChunk is the largest write that is checked against a
+// RateLimiter at once; larger writes are split so that they are paced
+// smoothly rather than in a single burst.
+const maxThrottledChunk = 32 << 10
+
+// throttle returns how long to wait before transferring n bytes in the
+// specified direction, given the limits of each RateLimiter in rls.
+func throttle(rls []*RateLimiter, n int, upload bool) time.Duration {
+	var wait time.Duration
+	for _, rl := range rls {
+		tb := &rl.down
+		if upload {
+			tb = &rl.up
+		}
+		if d := tb.take(n); d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
+
+// throttleEstimate returns the minimum time required to transfer up and down
+// bytes, given the limits of each RateLimiter in rls.
+func throttleEstimate(rls []*RateLimiter, up, down uint64) time.Duration {
+	var upWait, downWait time.Duration
+	for _, rl := range rls {
+		if d := rl.up.estimate(up); d > upWait {
+			upWait = d
+		}
+		if d := rl.down.estimate(down); d > downWait {
+			downWait = d
+		}
+	}
+	return upWait + downWait
+}
@@ -1,6 +1,7 @@
 package proto
 
 import (
+	"context"
 	"crypto/ed25519"
 	"math"
 	"time"
@@ -32,26 +33,46 @@ func RenewContract(w Wallet, tpool TransactionPool, id types.FileContractID, key
 // RenewContract negotiates a new file contract and initial revision for data
 // already stored with a host. The old contract is "cleared," reverting its
 // filesize to zero.
-func (s *Session) RenewContract(w Wallet, tpool TransactionPool, renterPayout types.Currency, startHeight, endHeight types.BlockHeight) (_ ContractRevision, _ []types.Transaction, err error) {
+func (s *Session) RenewContract(w Wallet, tpool TransactionPool, renterPayout types.Currency, startHeight, endHeight types.BlockHeight) (ContractRevision, []types.Transaction, error) {
+	return s.RenewContractContext(context.Background(), w, tpool, renterPayout, startHeight, endHeight)
+}
+
+// RenewContractContext is like RenewContract, but aborts the RPC if ctx is
+// cancelled.
+func (s *Session) RenewContractContext(ctx context.Context, w Wallet, tpool TransactionPool, renterPayout types.Currency, startHeight, endHeight types.BlockHeight) (_ ContractRevision, _ []types.Transaction, err error) {
 	defer wrapErr(&err, "RenewContract")
+	if err := ctx.Err(); err != nil {
+		return ContractRevision{}, nil, err
+	}
+	var walletCost types.Currency
+	defer s.collectContractStats(renterhost.RPCRenewClearContractID, &err, &walletCost, nil)()
+	defer s.interruptOnCancel(ctx, &err)()
 	if endHeight < startHeight {
 		return ContractRevision{}, nil, errors.New("end height must be greater than start height")
-	}
-	// get a renter address for the file contract's valid/missed outputs
-	refundAddr, err := w.Address()
-	if err != nil {
-		return ContractRevision{}, nil, errors.Wrap(err, "could not get an address to use")
+	} else if err := s.checkSupported(renterhost.RPCRenewClearContractID); err != nil {
+		return ContractRevision{}, nil, err
 	}
 
 	// calculate "base" price and collateral -- the storage cost and collateral
 	// contribution for the amount of data already in contract. If the contract
 	// height did not increase, basePrice and baseCollateral are zero.
 	currentRevision := s.rev.Revision
+	usage := RPCUsage{Contracts: 1}
 	var basePrice, baseCollateral types.Currency
 	if contractEnd := endHeight + s.host.WindowSize; contractEnd > currentRevision.NewWindowEnd {
 		timeExtension := uint64(contractEnd - currentRevision.NewWindowEnd)
 		basePrice = s.host.StoragePrice.Mul64(currentRevision.NewFileSize).Mul64(timeExtension)
 		baseCollateral = s.host.Collateral.Mul64(currentRevision.NewFileSize).Mul64(timeExtension)
+		usage.Storage = currentRevision.NewFileSize * timeExtension
+	}
+	if err := s.limits.Check(s.host.HostSettings, usage); err != nil {
+		return ContractRevision{}, nil, err
+	}
+
+	// get a renter address for the file contract's valid/missed outputs
+	refundAddr, err := w.Address()
+	if err != nil {
+		return ContractRevision{}, nil, errors.Wrap(err, "could not get an address to use")
 	}
 
 	// estimate collateral for new contract
@@ -204,11 +225,26 @@ func (s *Session) RenewContract(w Wallet, tpool TransactionPool, renterPayout ty
 		Signature:      ed25519hash.Sign(s.key, renterhost.HashRevision(initRevision)),
 	}
 
+	finalRevisionSig := ed25519hash.Sign(s.key, renterhost.HashRevision(finalOldRevision))
+	if err := s.storePendingRevision(finalOldRevision, finalRevisionSig); err != nil {
+		s.sess.WriteResponse(nil, errors.New("internal error"))
+		return ContractRevision{}, nil, err
+	} else if s.store != nil {
+		pending := ContractRevision{
+			Revision:   initRevision,
+			Signatures: [2]types.TransactionSignature{renterRevisionSig, {}},
+		}
+		if err := s.store.SetPendingRevision(pending); err != nil {
+			s.sess.WriteResponse(nil, errors.New("internal error"))
+			return ContractRevision{}, nil, errors.Wrap(err, "couldn't store pending revision")
+		}
+	}
+
 	// Send signatures.
 	renterSigs := &renterhost.RPCRenewAndClearContractSignatures{
 		ContractSignatures:     addedSignatures,
 		RevisionSignature:      renterRevisionSig,
-		FinalRevisionSignature: ed25519hash.Sign(s.key, renterhost.HashRevision(finalOldRevision)),
+		FinalRevisionSignature: finalRevisionSig,
 	}
 	if err := s.sess.WriteResponse(renterSigs, nil); err != nil {
 		return ContractRevision{}, nil, err
@@ -222,8 +258,23 @@ func (s *Session) RenewContract(w Wallet, tpool TransactionPool, renterPayout ty
 	txn.TransactionSignatures = append(txn.TransactionSignatures, hostSigs.ContractSignatures...)
 	signedTxnSet := append(resp.Parents, append(parents, txn)...)
 
-	return ContractRevision{
+	// the old contract can no longer be revised
+	s.rev.Revision = finalOldRevision
+	s.rev.Signatures[0].Signature = finalRevisionSig
+	s.rev.Signatures[1].Signature = hostSigs.FinalRevisionSignature
+	if err := s.storeRevision(); err != nil {
+		return ContractRevision{}, nil, err
+	}
+
+	rev := ContractRevision{
 		Revision:   initRevision,
 		Signatures: [2]types.TransactionSignature{renterRevisionSig, hostSigs.RevisionSignature},
-	}, signedTxnSet, nil
+	}
+	if s.store != nil {
+		if err := s.store.SetRevision(rev); err != nil {
+			return ContractRevision{}, nil, errors.Wrap(err, "couldn't store revision")
+		}
+	}
+	walletCost = renterCost.Sub(renterPayout)
+	return rev, signedTxnSet, nil
 }
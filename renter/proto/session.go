@@ -2,6 +2,8 @@ package proto
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/ed25519"
 	"encoding/binary"
 	"encoding/json"
@@ -11,6 +13,7 @@ import (
 	"math/bits"
 	"net"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
@@ -45,6 +48,14 @@ var (
 	// question has reached its maximum revision number, meaning the contract
 	// can no longer be revised.
 	ErrContractFinalized = errors.New("contract cannot be revised further")
+
+	// ErrUnsupportedRPC is returned by RPCs that the host has reported it does
+	// not support. The RPC is refused without contacting the host.
+	ErrUnsupportedRPC = errors.New("RPC not supported by host")
+
+	// ErrUnsupportedWriteAction is returned by the Write RPC when the host has
+	// reported that it does not support one of the requested actions.
+	ErrUnsupportedWriteAction = errors.New("write action not supported by host")
 )
 
 // wrapResponseErr formats RPC response errors nicely, wrapping them in either
@@ -58,24 +69,57 @@ func wrapResponseErr(err error, readCtx, rejectCtx string) error {
 	return errors.Wrap(err, readCtx)
 }
 
+// A statsConn counts the bytes transferred over a conn, throttling them
+// according to its RateLimiters.
 type statsConn struct {
 	net.Conn
-	r, w uint64
+	r, w     uint64
+	limiters []*RateLimiter
 }
 
 func (sc *statsConn) Read(p []byte) (int, error) {
 	n, err := sc.Conn.Read(p)
 	sc.r += uint64(n)
+	if n > 0 {
+		time.Sleep(throttle(sc.limiters, n, false))
+	}
 	return n, err
 }
 
 func (sc *statsConn) Write(p []byte) (int, error) {
-	n, err := sc.Conn.Write(p)
-	sc.w += uint64(n)
-	return n, err
+	var written int
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > maxThrottledChunk {
+			chunk = chunk[:maxThrottledChunk]
+		}
+		time.Sleep(throttle(sc.limiters, len(chunk), true))
+		n, err := sc.Conn.Write(chunk)
+		sc.w += uint64(n)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+func newStatsConn(conn net.Conn) *statsConn {
+	return &statsConn{
+		Conn:     conn,
+		limiters: []*RateLimiter{NewRateLimiter(0, 0), GlobalRateLimiter},
+	}
 }
 
 // A Session is an ongoing exchange of RPCs via the renter-host protocol.
+//
+// Each RPC method has a Context variant (e.g. ReadContext) that aborts the RPC
+// as soon as its context is cancelled. Since an aborted RPC may leave the
+// connection in the middle of a message, the Session is closed. Revision
+// continues to report the most recent revision signed by both parties; however,
+// the host may have received a newer revision signed only by the renter, so the
+// contract should be resynchronized via Lock before it is revised again.
 type Session struct {
 	sess        *renterhost.Session
 	conn        *statsConn
@@ -85,6 +129,9 @@ type Session struct {
 	readDeadline  time.Duration
 	writeDeadline time.Duration
 	stats         RPCStatsRecorder
+	store         ContractStore
+	limits        PriceLimits
+	settings      *hostdb.SettingsCache
 
 	host   hostdb.ScannedHost
 	height types.BlockHeight
@@ -95,12 +142,21 @@ type Session struct {
 // HostKey returns the public key of the host.
 func (s *Session) HostKey() hostdb.HostPublicKey { return s.host.PublicKey }
 
+// Capabilities returns the capabilities reported in the host's most recent
+// settings, or nil if the host did not report them. RPCs that the host does not
+// support are refused with ErrUnsupportedRPC.
+func (s *Session) Capabilities() *hostdb.HostCapabilities { return s.host.Capabilities }
+
 // Revision returns the most recent revision of the locked contract.
 func (s *Session) Revision() ContractRevision { return s.rev }
 
 // IsClosed returns whether the Session is closed.
 func (s *Session) IsClosed() bool { return s.sess.IsClosed() }
 
+// SetTranscript causes the Session to record the plaintext of each protocol
+// message in t. See renterhost.Transcript.
+func (s *Session) SetTranscript(t *renterhost.Transcript) { s.sess.SetTranscript(t) }
+
 // SetLatency sets the latency deadline for RPCs.
 func (s *Session) SetLatency(d time.Duration) { s.latency = d }
 
@@ -125,13 +181,100 @@ func (s *Session) extendBandwidthDeadline(up, down uint64) {
 	if down < renterhost.MinMessageSize {
 		down = renterhost.MinMessageSize
 	}
-	s.extendDeadline(s.writeDeadline*time.Duration(up) + s.readDeadline*time.Duration(down))
+	throttled := throttleEstimate(s.conn.limiters, up, down)
+	s.extendDeadline(throttled + s.writeDeadline*time.Duration(up) + s.readDeadline*time.Duration(down))
+}
+
+// interruptOnCancel arranges for the Session's connection to be closed if ctx
+// is cancelled before the returned function is called. If the connection was
+// interrupted, the returned function closes the Session and replaces *err with
+// ctx.Err().
+func (s *Session) interruptOnCancel(ctx context.Context, err *error) (done func()) {
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	stop := make(chan struct{})
+	interrupted := make(chan bool, 1)
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.conn.Close()
+			interrupted <- true
+		case <-stop:
+			interrupted <- false
+		}
+	}()
+	return func() {
+		close(stop)
+		if <-interrupted {
+			s.sess.Close()
+			*err = ctx.Err()
+		}
+	}
+}
+
+// SetRateLimits limits the upload and download throughput of the Session, in
+// bytes per second. A limit of zero means that the corresponding direction is
+// not limited. The Session is also subject to GlobalRateLimiter and any
+// RateLimiters added via AddRateLimiter.
+func (s *Session) SetRateLimits(upload, download int64) {
+	s.conn.limiters[0].SetLimits(upload, download)
+}
+
+// AddRateLimiter causes the Session to obey the limits of rl, which may be
+// shared with other Sessions.
+func (s *Session) AddRateLimiter(rl *RateLimiter) {
+	s.conn.limiters = append(s.conn.limiters, rl)
 }
 
 // SetRPCStatsRecorder sets the RPCStatsRecorder for the Session.
 func (s *Session) SetRPCStatsRecorder(stats RPCStatsRecorder) { s.stats = stats }
 
+// SetPriceLimits sets the maximum prices that the Session will pay the host.
+// RPCs that would pay a price exceeding these limits return a *PriceError.
+func (s *Session) SetPriceLimits(limits PriceLimits) { s.limits = limits }
+
+// SetContractStore sets the ContractStore for the Session. If set, the store
+// is updated with each revision of the locked contract.
+func (s *Session) SetContractStore(store ContractStore) { s.store = store }
+
+// SetSettingsCache sets the SettingsCache for the Session, replacing
+// DefaultSettingsCache. If cache is nil, settings are not cached, and are
+// only checked for rollbacks within the Session.
+func (s *Session) SetSettingsCache(cache *hostdb.SettingsCache) { s.settings = cache }
+
+// storePendingRevision records rev, signed only by the renter, in the
+// Session's ContractStore.
+func (s *Session) storePendingRevision(rev types.FileContractRevision, renterSig []byte) error {
+	if s.store == nil {
+		return nil
+	}
+	pending := ContractRevision{
+		Revision:   rev,
+		Signatures: s.rev.Signatures,
+	}
+	pending.Signatures[0].Signature = renterSig
+	pending.Signatures[1].Signature = nil
+	return errors.Wrap(s.store.SetPendingRevision(pending), "couldn't store pending revision")
+}
+
+// storeRevision records the current revision in the Session's ContractStore.
+func (s *Session) storeRevision() error {
+	if s.store == nil {
+		return nil
+	}
+	return errors.Wrap(s.store.SetRevision(s.rev), "couldn't store revision")
+}
+
 func (s *Session) collectStats(id renterhost.Specifier, err *error) (record func()) {
+	return s.collectContractStats(id, err, nil, nil)
+}
+
+// collectContractStats is like collectStats, but additionally records the
+// cost paid from the renter's wallet to form or renew a contract. If the RPC
+// succeeds, *walletCost is added to the cost of the RPC, and if contract is
+// non-nil, the stats are attributed to *contract.
+func (s *Session) collectContractStats(id renterhost.Specifier, err *error, walletCost *types.Currency, contract *types.FileContractID) (record func()) {
 	if s.stats == nil {
 		return func() {}
 	}
@@ -151,8 +294,18 @@ func (s *Session) collectStats(id renterhost.Specifier, err *error) (record func
 		stats.Elapsed = time.Since(stats.Timestamp)
 		stats.Uploaded = s.conn.w - oldW
 		stats.Downloaded = s.conn.r - oldR
-		if s.rev.IsValid() && startFunds.Cmp(s.rev.RenterFunds()) > 0 {
-			stats.Cost = startFunds.Sub(s.rev.RenterFunds())
+		if s.rev.IsValid() {
+			if startFunds.Cmp(s.rev.RenterFunds()) > 0 {
+				stats.Cost = startFunds.Sub(s.rev.RenterFunds())
+			}
+			stats.RevisionNumber = s.rev.Revision.NewRevisionNumber
+		}
+		if *err == nil && walletCost != nil {
+			stats.Cost = stats.Cost.Add(*walletCost)
+			stats.WalletCost = *walletCost
+		}
+		if *err == nil && contract != nil {
+			stats.Contract = *contract
 		}
 		s.stats.RecordRPCStats(stats)
 	}
@@ -172,6 +325,15 @@ func (s *Session) call(rpcID renterhost.Specifier, req, resp renterhost.Protocol
 func (s *Session) isLocked() bool    { return s.rev.IsValid() }
 func (s *Session) isRevisable() bool { return s.rev.Revision.NewRevisionNumber < math.MaxUint64 }
 
+// checkSupported returns ErrUnsupportedRPC if the host's most recent settings
+// report that it does not support the specified RPC.
+func (s *Session) checkSupported(id renterhost.Specifier) error {
+	if !s.host.SupportsRPC(id) {
+		return ErrUnsupportedRPC
+	}
+	return nil
+}
+
 func (s *Session) sufficientFunds(price types.Currency) bool {
 	if !s.rev.IsValid() {
 		// all calls to sufficientFunds should be guarded with isLocked checks
@@ -195,9 +357,21 @@ func (s *Session) sufficientFunds(price types.Currency) bool {
 // Lock returns ErrContractFinalized if the contract can no longer be revised.
 // The contract will still be available via the Revision method, but invoking
 // other RPCs may result in errors or panics.
-func (s *Session) Lock(id types.FileContractID, key ed25519.PrivateKey, timeout time.Duration) (err error) {
+func (s *Session) Lock(id types.FileContractID, key ed25519.PrivateKey, timeout time.Duration) error {
+	return s.LockContext(context.Background(), id, key, timeout)
+}
+
+// LockContext is like Lock, but aborts the RPC if ctx is cancelled.
+func (s *Session) LockContext(ctx context.Context, id types.FileContractID, key ed25519.PrivateKey, timeout time.Duration) (err error) {
 	defer wrapErr(&err, "Lock")
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := s.checkSupported(renterhost.RPCLockID); err != nil {
+		return err
+	}
 	defer s.collectStats(renterhost.RPCLockID, &err)()
+	defer s.interruptOnCancel(ctx, &err)()
 	req := &renterhost.RPCLockRequest{
 		ContractID: id,
 		Signature:  s.sess.SignChallenge(key),
@@ -211,22 +385,32 @@ func (s *Session) Lock(id types.FileContractID, key ed25519.PrivateKey, timeout
 	s.sess.SetChallenge(resp.NewChallenge)
 	// verify claimed revision
 	if len(resp.Signatures) != 2 {
-		return errors.Errorf("host returned wrong number of signatures (expected 2, got %v)", len(resp.Signatures))
+		return errHostMisbehaved("host returned wrong number of signatures (expected 2, got %v)", len(resp.Signatures))
 	}
 	revHash := renterhost.HashRevision(resp.Revision)
 	if !ed25519hash.Verify(ed25519hash.ExtractPublicKey(key), revHash, resp.Signatures[0].Signature) {
-		return errors.New("renter's signature on claimed revision is invalid")
+		return errHostMisbehaved("renter's signature on claimed revision is invalid")
 	} else if !ed25519hash.Verify(s.host.PublicKey.Ed25519(), revHash, resp.Signatures[1].Signature) {
-		return errors.New("host's signature on claimed revision is invalid")
+		return errHostMisbehaved("host's signature on claimed revision is invalid")
 	}
 	if !resp.Acquired {
 		return ErrContractLocked
 	}
+	// if we have a record of a more recent revision, the host is attempting to
+	// roll back the contract
+	if s.store != nil {
+		if stored, err := s.store.Revision(id); err == nil && stored.Revision.NewRevisionNumber > resp.Revision.NewRevisionNumber {
+			return errHostMisbehaved("host returned outdated revision (expected revision number %v, got %v)", stored.Revision.NewRevisionNumber, resp.Revision.NewRevisionNumber)
+		}
+	}
 	s.rev = ContractRevision{
 		Revision:   resp.Revision,
 		Signatures: [2]types.TransactionSignature{resp.Signatures[0], resp.Signatures[1]},
 	}
 	s.key = key
+	if err := s.storeRevision(); err != nil {
+		return err
+	}
 
 	if s.rev.Revision.NewRevisionNumber == math.MaxUint64 {
 		return ErrContractFinalized
@@ -243,6 +427,8 @@ func (s *Session) Unlock() (err error) {
 	defer s.collectStats(renterhost.RPCUnlockID, &err)()
 	if s.key == nil {
 		return errors.New("no contract locked")
+	} else if err := s.checkSupported(renterhost.RPCUnlockID); err != nil {
+		return err
 	}
 	s.extendBandwidthDeadline(renterhost.MinMessageSize, renterhost.MinMessageSize)
 	if err := s.sess.WriteRequest(renterhost.RPCUnlockID, nil); err != nil {
@@ -253,25 +439,84 @@ func (s *Session) Unlock() (err error) {
 	return nil
 }
 
-// Settings calls the Settings RPC, returning the host's reported settings.
-func (s *Session) Settings() (_ hostdb.HostSettings, err error) {
+// Settings calls the Settings RPC, returning the host's reported settings. If
+// the host reports settings with a lower revision number than it has
+// previously reported, Settings returns a *hostdb.SettingsRollbackError.
+func (s *Session) Settings() (hostdb.HostSettings, error) {
+	return s.SettingsContext(context.Background())
+}
+
+// SettingsContext is like Settings, but aborts the RPC if ctx is cancelled.
+func (s *Session) SettingsContext(ctx context.Context) (_ hostdb.HostSettings, err error) {
 	defer wrapErr(&err, "Settings")
+	if err := ctx.Err(); err != nil {
+		return hostdb.HostSettings{}, err
+	}
 	defer s.collectStats(renterhost.RPCSettingsID, &err)()
+	defer s.interruptOnCancel(ctx, &err)()
 	s.extendBandwidthDeadline(renterhost.MinMessageSize, renterhost.MinMessageSize)
 	var resp renterhost.RPCSettingsResponse
+	var settings hostdb.HostSettings
 	if err := s.call(renterhost.RPCSettingsID, nil, &resp); err != nil {
 		return hostdb.HostSettings{}, err
-	} else if err := json.Unmarshal(resp.Settings, &s.host.HostSettings); err != nil {
+	} else if err := json.Unmarshal(resp.Settings, &settings); err != nil {
 		return hostdb.HostSettings{}, errors.Wrap(err, "couldn't unmarshal json")
+	} else if settings.RevisionNumber < s.host.RevisionNumber {
+		return hostdb.HostSettings{}, &hostdb.SettingsRollbackError{
+			Host:        s.host.PublicKey,
+			OldRevision: s.host.RevisionNumber,
+			NewRevision: settings.RevisionNumber,
+		}
+	} else if s.settings != nil {
+		if err := s.settings.Update(s.host.PublicKey, settings); err != nil {
+			return hostdb.HostSettings{}, err
+		}
 	}
-	return s.host.HostSettings, nil
+	s.useSettings(settings)
+	return settings, nil
+}
+
+// useSettings sets the settings used by the Session to calculate prices. Each
+// RPC checks its price against the Session's PriceLimits using the current
+// settings, so if the host raises its prices, subsequent RPCs will be refused.
+func (s *Session) useSettings(settings hostdb.HostSettings) {
+	s.host.HostSettings = settings
+}
+
+// CachedSettings returns the host's settings from the Session's
+// SettingsCache, if they are present and have not expired. Otherwise, it calls
+// the Settings RPC.
+func (s *Session) CachedSettings() (hostdb.HostSettings, error) {
+	return s.CachedSettingsContext(context.Background())
+}
+
+// CachedSettingsContext is like CachedSettings, but aborts the RPC if ctx is
+// cancelled.
+func (s *Session) CachedSettingsContext(ctx context.Context) (hostdb.HostSettings, error) {
+	if s.settings != nil {
+		if settings, ok := s.settings.Get(s.host.PublicKey); ok && settings.RevisionNumber >= s.host.RevisionNumber {
+			s.useSettings(settings)
+			return settings, nil
+		}
+	}
+	return s.SettingsContext(ctx)
 }
 
 // SectorRoots calls the SectorRoots RPC, returning the requested range of
 // sector Merkle roots of the currently-locked contract.
-func (s *Session) SectorRoots(offset, n int) (_ []crypto.Hash, err error) {
+func (s *Session) SectorRoots(offset, n int) ([]crypto.Hash, error) {
+	return s.SectorRootsContext(context.Background(), offset, n)
+}
+
+// SectorRootsContext is like SectorRoots, but aborts the RPC if ctx is
+// cancelled.
+func (s *Session) SectorRootsContext(ctx context.Context, offset, n int) (_ []crypto.Hash, err error) {
 	defer wrapErr(&err, "SectorRoots")
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 	defer s.collectStats(renterhost.RPCSectorRootsID, &err)()
+	defer s.interruptOnCancel(ctx, &err)()
 
 	if !s.isLocked() {
 		return nil, ErrNoContractLocked
@@ -281,6 +526,8 @@ func (s *Session) SectorRoots(offset, n int) (_ []crypto.Hash, err error) {
 		return nil, errors.New("requested range is out-of-bounds")
 	} else if n == 0 {
 		return nil, nil
+	} else if err := s.checkSupported(renterhost.RPCSectorRootsID); err != nil {
+		return nil, err
 	}
 
 	// calculate price
@@ -289,6 +536,9 @@ func (s *Session) SectorRoots(offset, n int) (_ []crypto.Hash, err error) {
 	if downloadBandwidth < renterhost.MinMessageSize {
 		downloadBandwidth = renterhost.MinMessageSize
 	}
+	if err := s.limits.Check(s.host.HostSettings, RPCUsage{RPCs: 1, Download: downloadBandwidth}); err != nil {
+		return nil, err
+	}
 	bandwidthPrice := s.host.DownloadBandwidthPrice.Mul64(downloadBandwidth)
 	price := s.host.BaseRPCPrice.Add(bandwidthPrice)
 	if !s.sufficientFunds(price) {
@@ -300,6 +550,11 @@ func (s *Session) SectorRoots(offset, n int) (_ []crypto.Hash, err error) {
 	rev.NewRevisionNumber++
 	newValid, newMissed := updateRevisionOutputs(&rev, price, types.ZeroCurrency)
 
+	renterSig := ed25519hash.Sign(s.key, renterhost.HashRevision(rev))
+	if err := s.storePendingRevision(rev, renterSig); err != nil {
+		return nil, err
+	}
+
 	s.extendBandwidthDeadline(renterhost.MinMessageSize, downloadBandwidth)
 	req := &renterhost.RPCSectorRootsRequest{
 		RootOffset: uint64(offset),
@@ -308,7 +563,7 @@ func (s *Session) SectorRoots(offset, n int) (_ []crypto.Hash, err error) {
 		NewRevisionNumber:    rev.NewRevisionNumber,
 		NewValidProofValues:  newValid,
 		NewMissedProofValues: newMissed,
-		Signature:            ed25519hash.Sign(s.key, renterhost.HashRevision(rev)),
+		Signature:            renterSig,
 	}
 	var resp renterhost.RPCSectorRootsResponse
 	if err := s.sess.WriteRequest(renterhost.RPCSectorRootsID, req); err != nil {
@@ -322,51 +577,106 @@ func (s *Session) SectorRoots(offset, n int) (_ []crypto.Hash, err error) {
 	s.rev.Revision = rev
 	s.rev.Signatures[0].Signature = req.Signature
 	s.rev.Signatures[1].Signature = resp.Signature
+	if err := s.storeRevision(); err != nil {
+		return nil, err
+	}
 	if !merkle.VerifySectorRangeProof(resp.MerkleProof, resp.SectorRoots, offset, offset+n, s.rev.NumSectors(), rev.NewFileMerkleRoot) {
 		return nil, ErrInvalidMerkleProof
 	}
 	return resp.SectorRoots, nil
 }
 
-// helper type for ensuring that we always write in multiples of SegmentSize,
-// which is required by e.g. (renter.KeySeed).XORKeyStream
-type segWriter struct {
-	w   io.Writer
-	buf [merkle.SegmentSize * 64]byte
-	len int
-}
-
-func (sw *segWriter) Write(p []byte) (int, error) {
-	lenp := len(p)
-	for len(p) > 0 {
-		n := copy(sw.buf[sw.len:], p)
-		sw.len += n
-		p = p[n:]
-		segs := sw.buf[:sw.len-(sw.len%merkle.SegmentSize)]
-		if _, err := sw.w.Write(segs); err != nil {
-			return 0, err
+// maxReadSectionSize is the maximum length of a section requested by Read.
+// Larger sections are split into multiple sections, each with its own Merkle
+// proof. The host sends each proof after the data it covers, so data can only
+// be verified (and rejected) a whole section at a time; splitting bounds the
+// amount of unverified data that Read must buffer.
+const maxReadSectionSize = 1 << 20 // 1 MiB
+
+// maxSplitSections is the maximum number of sections that splitSections will
+// produce. Hosts limit the size of Read requests, so we stop splitting once a
+// request contains this many sections.
+const maxSplitSections = 64
+
+// splitSections splits any sections longer than maxLen, which must be a
+// multiple of merkle.SegmentSize.
+func splitSections(sections []renterhost.RPCReadRequestSection, maxLen uint32) []renterhost.RPCReadRequestSection {
+	split := make([]renterhost.RPCReadRequestSection, 0, len(sections))
+	for i, sec := range sections {
+		for sec.Length > maxLen && len(split)+len(sections)-i < maxSplitSections {
+			split = append(split, renterhost.RPCReadRequestSection{
+				MerkleRoot: sec.MerkleRoot,
+				Offset:     sec.Offset,
+				Length:     maxLen,
+			})
+			sec.Offset += maxLen
+			sec.Length -= maxLen
 		}
-		sw.len = copy(sw.buf[:], sw.buf[len(segs):sw.len])
+		split = append(split, sec)
 	}
-	return lenp, nil
+	return split
 }
 
 // Read calls the Read RPC, writing the requested sections of sector data to w.
-// Merkle proofs are always requested.
+// Merkle proofs are always requested, and data is only written to w after it
+// has been verified. Sector data is hashed as it arrives, but it can only be
+// verified once the host has sent the Merkle proof that follows it, so large
+// sections are split into sub-sections of up to 1 MiB, each verified
+// separately. (If the request would contain more than 64 sections, the last
+// sections are left unsplit.) If the host sends invalid data, the Session is
+// closed.
 //
-// Note that sector data is streamed to w before it has been validated. Callers
-// MUST check the returned error, and discard any data written to w if the error
-// is non-nil. Failure to do so may allow an attacker to inject malicious data.
-func (s *Session) Read(w io.Writer, sections []renterhost.RPCReadRequestSection) (err error) {
+// If Read returns an error, some of the requested sections may have been
+// written to w.
+func (s *Session) Read(w io.Writer, sections []renterhost.RPCReadRequestSection) error {
+	return s.ReadContext(context.Background(), w, sections)
+}
+
+// ReadContext is like Read, but aborts the RPC if ctx is cancelled.
+func (s *Session) ReadContext(ctx context.Context, w io.Writer, sections []renterhost.RPCReadRequestSection) error {
+	return s.ReadSectionsContext(ctx, sections, func(data []byte) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+// ReadSections is like Read, but calls fn with the data of each section, in
+// order, as soon as it has been verified. Large sections are delivered in
+// multiple calls, one per sub-section. The data passed to fn is only valid until fn returns. If fn
+// returns an error, the RPC is aborted.
+func (s *Session) ReadSections(sections []renterhost.RPCReadRequestSection, fn func(data []byte) error) error {
+	return s.ReadSectionsContext(context.Background(), sections, fn)
+}
+
+// ReadSectionsContext is like ReadSections, but aborts the RPC if ctx is
+// cancelled.
+func (s *Session) ReadSectionsContext(ctx context.Context, sections []renterhost.RPCReadRequestSection, fn func(data []byte) error) error {
+	return s.read(ctx, splitSections(sections, maxReadSectionSize), fn)
+}
+
+// read implements the Read RPC, calling fn with the data of each section after
+// it has been verified.
+func (s *Session) read(ctx context.Context, sections []renterhost.RPCReadRequestSection, fn func([]byte) error) (err error) {
 	defer wrapErr(&err, "Read")
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	defer s.collectStats(renterhost.RPCReadID, &err)()
+	defer s.interruptOnCancel(ctx, &err)()
 
-	if !s.isLocked() {
+	// if we haven't locked a contract, we can still read from a host that
+	// offers free reads
+	free := !s.isLocked() && s.host.SupportsFreeReads()
+	if !s.isLocked() && !free {
 		return ErrNoContractLocked
-	} else if !s.isRevisable() {
+	} else if !free && !s.isRevisable() {
 		return ErrContractFinalized
 	} else if len(sections) == 0 {
 		return nil
+	} else if err := s.checkSupported(renterhost.RPCReadID); err != nil {
+		return err
+	} else if free {
+		return s.readFree(sections, fn)
 	}
 
 	// calculate price
@@ -385,6 +695,14 @@ func (s *Session) Read(w io.Writer, sections []renterhost.RPCReadRequestSection)
 	if bandwidth < renterhost.MinMessageSize {
 		bandwidth = renterhost.MinMessageSize
 	}
+	usage := RPCUsage{
+		RPCs:           1,
+		SectorAccesses: uint64(len(sectorAccesses)),
+		Download:       bandwidth,
+	}
+	if err := s.limits.Check(s.host.HostSettings, usage); err != nil {
+		return err
+	}
 	bandwidthPrice := s.host.DownloadBandwidthPrice.Mul64(bandwidth)
 	price := s.host.BaseRPCPrice.Add(sectorAccessPrice).Add(bandwidthPrice)
 	if !s.sufficientFunds(price) {
@@ -396,6 +714,9 @@ func (s *Session) Read(w io.Writer, sections []renterhost.RPCReadRequestSection)
 	rev.NewRevisionNumber++
 	newValid, newMissed := updateRevisionOutputs(&rev, price, types.ZeroCurrency)
 	renterSig := ed25519hash.Sign(s.key, renterhost.HashRevision(rev))
+	if err := s.storePendingRevision(rev, renterSig); err != nil {
+		return err
+	}
 
 	// send request
 	uploadBandwidth := 4096 + 4096*uint64(len(sections))
@@ -417,63 +738,95 @@ func (s *Session) Read(w io.Writer, sections []renterhost.RPCReadRequestSection)
 	// host will now stream back responses; ensure we send RPCLoopReadStop
 	// before returning
 	defer s.sess.WriteResponse(&renterhost.RPCReadStop, nil)
-	var hostSig []byte
+	hostSig, err := s.readSections(sections, fn)
+	if err != nil {
+		return err
+	}
+	if len(hostSig) == 0 {
+		// the host is required to send a signature; if they haven't sent one
+		// yet, they should send an empty ReadResponse containing just the
+		// signature.
+		var resp renterhost.RPCReadResponse
+		if err := s.sess.ReadResponse(&resp, 4096); err != nil {
+			return wrapResponseErr(err, "couldn't read signature", "host rejected Read request")
+		}
+		hostSig = resp.Signature
+	}
+
+	s.rev.Revision = rev
+	s.rev.Signatures[0].Signature = renterSig
+	s.rev.Signatures[1].Signature = hostSig
+
+	return s.storeRevision()
+}
+
+// readSections reads the host's responses to a Read request, passing the data
+// for each section to fn. It returns the host's signature, if one was sent.
+func (s *Session) readSections(sections []renterhost.RPCReadRequestSection, fn func([]byte) error) (hostSig []byte, err error) {
+	var buf bytes.Buffer
 	for _, sec := range sections {
 		// NOTE: normally, we would call ReadResponse here to read an AEAD RPC
 		// message, verify the tag and decrypt, and then pass the data to
 		// merkle.VerifyProof. As an optimization, we instead stream the message
-		// through a Merkle proof verifier before verifying the AEAD tag.
-		// Security therefore depends on the caller of Read discarding any data
-		// written to w in the event that verification fails.
+		// through a Merkle proof verifier while buffering it. The buffered data
+		// is only passed to fn after both the AEAD tag and the Merkle proof
+		// have been verified.
 		msgReader, err := s.sess.RawResponse(4096 + uint64(sec.Length))
 		if err != nil {
-			return wrapResponseErr(err, "couldn't read sector data", "host rejected Read request")
+			return nil, wrapResponseErr(err, "couldn't read sector data", "host rejected Read request")
 		}
 		// Read the signature, which may or may not be present.
 		lenbuf := make([]byte, 8)
 		if _, err := io.ReadFull(msgReader, lenbuf); err != nil {
-			return errors.Wrap(err, "couldn't read signature len")
+			return nil, errors.Wrap(err, "couldn't read signature len")
 		}
 		if n := binary.LittleEndian.Uint64(lenbuf); n > 0 {
 			hostSig = make([]byte, n)
 			if _, err := io.ReadFull(msgReader, hostSig); err != nil {
-				return errors.Wrap(err, "couldn't read signature")
+				return nil, errors.Wrap(err, "couldn't read signature")
 			}
 		}
-		// stream the sector data into w and the proof verifier
+		// stream the sector data into buf and the proof verifier
 		if _, err := io.ReadFull(msgReader, lenbuf); err != nil {
-			return errors.Wrap(err, "couldn't read data len")
+			return nil, errors.Wrap(err, "couldn't read data len")
 		} else if binary.LittleEndian.Uint64(lenbuf) != uint64(sec.Length) {
-			return errors.New("host sent wrong amount of sector data")
+			return nil, errHostMisbehaved("host sent wrong amount of sector data")
 		}
 		proofStart := int(sec.Offset) / merkle.SegmentSize
 		proofEnd := int(sec.Offset+sec.Length) / merkle.SegmentSize
 		rpv := merkle.NewRangeProofVerifier(proofStart, proofEnd)
-		tee := io.TeeReader(io.LimitReader(msgReader, int64(sec.Length)), &segWriter{w: w})
+		buf.Reset()
+		tee := io.TeeReader(io.LimitReader(msgReader, int64(sec.Length)), &buf)
 		// the proof verifier Reads one segment at a time, so bufio is crucial
 		// for performance here
 		if _, err := rpv.ReadFrom(bufio.NewReaderSize(tee, 1<<16)); err != nil {
-			return errors.Wrap(err, "couldn't stream sector data")
+			return nil, errors.Wrap(err, "couldn't stream sector data")
 		}
 		// read the Merkle proof
 		if _, err := io.ReadFull(msgReader, lenbuf); err != nil {
-			return errors.Wrap(err, "couldn't read proof len")
+			return nil, errors.Wrap(err, "couldn't read proof len")
 		}
 		if binary.LittleEndian.Uint64(lenbuf) != uint64(merkle.ProofSize(merkle.SegmentsPerSector, proofStart, proofEnd)) {
-			return errors.New("invalid proof size")
+			return nil, errHostMisbehaved("invalid proof size")
 		}
 		proof := make([]crypto.Hash, binary.LittleEndian.Uint64(lenbuf))
 		for i := range proof {
 			if _, err := io.ReadFull(msgReader, proof[i][:]); err != nil {
-				return errors.Wrap(err, "couldn't read Merkle proof")
+				return nil, errors.Wrap(err, "couldn't read Merkle proof")
 			}
 		}
 		// verify the message tag and the Merkle proof
 		if err := msgReader.VerifyTag(); err != nil {
-			return err
+			return nil, err
 		}
 		if !rpv.Verify(proof, sec.MerkleRoot) {
-			return ErrInvalidMerkleProof
+			// the host is sending us bad data; don't bother reading the rest
+			s.conn.Close()
+			s.sess.Close()
+			return nil, ErrInvalidMerkleProof
+		}
+		if err := fn(buf.Bytes()); err != nil {
+			return nil, err
 		}
 		// if the host sent a signature, exit the loop; they won't be sending
 		// any more data
@@ -481,29 +834,61 @@ func (s *Session) Read(w io.Writer, sections []renterhost.RPCReadRequestSection)
 			break
 		}
 	}
-	if len(hostSig) == 0 {
-		// the host is required to send a signature; if they haven't sent one
-		// yet, they should send an empty ReadResponse containing just the
-		// signature.
-		var resp renterhost.RPCReadResponse
-		if err := s.sess.ReadResponse(&resp, 4096); err != nil {
-			return wrapResponseErr(err, "couldn't read signature", "host rejected Read request")
-		}
-		hostSig = resp.Signature
+	return hostSig, nil
+}
+
+// readFree implements the Read RPC without a contract, for hosts that offer
+// free reads. No revision is sent, and the host does not sign one.
+func (s *Session) readFree(sections []renterhost.RPCReadRequestSection, fn func([]byte) error) error {
+	var bandwidth uint64
+	for _, sec := range sections {
+		proofHashes := 2 * bits.Len64(merkle.SegmentsPerSector)
+		bandwidth += uint64(sec.Length) + uint64(proofHashes)*crypto.HashSize
 	}
+	uploadBandwidth := 4096 + 4096*uint64(len(sections))
+	downloadBandwidth := bandwidth + 4096*uint64(len(sections))
+	s.extendBandwidthDeadline(uploadBandwidth, downloadBandwidth)
+	req := &renterhost.RPCReadRequest{
+		Sections:    sections,
+		MerkleProof: true,
+	}
+	if err := s.sess.WriteRequest(renterhost.RPCReadID, req); err != nil {
+		return err
+	}
+	defer s.sess.WriteResponse(&renterhost.RPCReadStop, nil)
+	_, err := s.readSections(sections, fn)
+	return err
+}
 
-	s.rev.Revision = rev
-	s.rev.Signatures[0].Signature = renterSig
-	s.rev.Signatures[1].Signature = hostSig
+// Write implements the Write RPC. A Merkle proof is always requested.
+//
+// Verifying the Merkle proof for an Update action requires the new Merkle root
+// of the updated sector, which cannot be computed from the action alone. Write
+// therefore rejects Update actions.
+func (s *Session) Write(actions []renterhost.RPCWriteAction) error {
+	return s.WriteContext(context.Background(), actions)
+}
 
-	return nil
+// WriteContext is like Write, but aborts the RPC if ctx is cancelled.
+func (s *Session) WriteContext(ctx context.Context, actions []renterhost.RPCWriteAction) error {
+	for _, action := range actions {
+		if action.Type == renterhost.RPCWriteActionUpdate {
+			return errors.New("Write: Update actions are not supported")
+		}
+	}
+	return s.write(ctx, actions, nil)
 }
 
-// Write implements the Write RPC, except for ActionUpdate. A Merkle proof is
-// always requested.
-func (s *Session) Write(actions []renterhost.RPCWriteAction) (err error) {
+// write implements the Write RPC. If next is non-nil, actions must consist
+// solely of Append actions with empty Data, and the data for each action is
+// streamed from next instead.
+func (s *Session) write(ctx context.Context, actions []renterhost.RPCWriteAction, next func() *[renterhost.SectorSize]byte) (err error) {
 	defer wrapErr(&err, "Write")
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	defer s.collectStats(renterhost.RPCWriteID, &err)()
+	defer s.interruptOnCancel(ctx, &err)()
 
 	if !s.isLocked() {
 		return ErrNoContractLocked
@@ -511,6 +896,13 @@ func (s *Session) Write(actions []renterhost.RPCWriteAction) (err error) {
 		return ErrContractFinalized
 	} else if len(actions) == 0 {
 		return nil
+	} else if err := s.checkSupported(renterhost.RPCWriteID); err != nil {
+		return err
+	}
+	for _, action := range actions {
+		if !s.host.SupportsWriteAction(action.Type) {
+			return errors.Wrapf(ErrUnsupportedWriteAction, "action %q", action.Type.String())
+		}
 	}
 	rev := s.rev.Revision
 
@@ -532,6 +924,7 @@ func (s *Session) Write(actions []renterhost.RPCWriteAction) (err error) {
 			panic("unknown/unsupported action type")
 		}
 	}
+	var storage uint64
 	var storagePrice, collateral types.Currency
 	if newFileSize > rev.NewFileSize {
 		storageDuration := uint64(rev.NewWindowEnd - s.height)
@@ -546,12 +939,22 @@ func (s *Session) Write(actions []renterhost.RPCWriteAction) (err error) {
 		addedSectors := (newFileSize - rev.NewFileSize) / renterhost.SectorSize
 		storagePrice = sectorStoragePrice.Mul64(addedSectors)
 		collateral = sectorCollateral.Mul64(addedSectors)
+		storage = renterhost.SectorSize * storageDuration * addedSectors
 	}
 
 	// estimate cost of Merkle proof
 	// TODO: calculate exact sizes
 	proofSize := merkle.DiffProofSize(actions, s.rev.NumSectors())
 	downloadBandwidth := uint64(proofSize) * crypto.HashSize
+	usage := RPCUsage{
+		RPCs:     1,
+		Storage:  storage,
+		Upload:   uploadBandwidth,
+		Download: downloadBandwidth,
+	}
+	if err := s.limits.Check(s.host.HostSettings, usage); err != nil {
+		return err
+	}
 	bandwidthPrice := s.host.UploadBandwidthPrice.Mul64(uploadBandwidth).Add(s.host.DownloadBandwidthPrice.Mul64(downloadBandwidth))
 
 	// check that enough funds are available
@@ -574,15 +977,6 @@ func (s *Session) Write(actions []renterhost.RPCWriteAction) (err error) {
 	// calculate new revision outputs
 	newValid, newMissed := updateRevisionOutputs(&rev, price, collateral)
 
-	// compute appended roots in parallel with I/O
-	precompChan := make(chan struct{})
-	go func() {
-		s.appendRoots = merkle.PrecomputeAppendRoots(actions)
-		close(precompChan)
-	}()
-	// ensure that the goroutine has exited before we return
-	defer func() { <-precompChan }()
-
 	// send request
 	uploadBandwidth += 4096 * uint64(len(actions))
 	s.extendBandwidthDeadline(uploadBandwidth, downloadBandwidth)
@@ -594,8 +988,41 @@ func (s *Session) Write(actions []renterhost.RPCWriteAction) (err error) {
 		NewValidProofValues:  newValid,
 		NewMissedProofValues: newMissed,
 	}
-	if err := s.sess.WriteRequest(renterhost.RPCWriteID, req); err != nil {
-		return err
+	precompChan := make(chan struct{})
+	if next == nil {
+		// compute appended roots in parallel with I/O
+		go func() {
+			s.appendRoots = merkle.PrecomputeAppendRoots(actions)
+			close(precompChan)
+		}()
+		// ensure that the goroutine has exited before we return
+		defer func() { <-precompChan }()
+		if err := s.sess.WriteRequest(renterhost.RPCWriteID, req); err != nil {
+			return err
+		}
+	} else {
+		// compute the root of each sector while the next one is being sent
+		s.appendRoots = make([]crypto.Hash, len(actions))
+		var wg sync.WaitGroup
+		var i int
+		streamNext := func() *[renterhost.SectorSize]byte {
+			wg.Wait() // the previous sector may be reused after next is called
+			sector := next()
+			wg.Add(1)
+			go func(i int) {
+				s.appendRoots[i] = merkle.SectorRoot(sector)
+				wg.Done()
+			}(i)
+			i++
+			return sector
+		}
+		req.Actions = nil
+		err := s.sess.WriteAppendRequest(req, len(actions), streamNext)
+		wg.Wait()
+		close(precompChan)
+		if err != nil {
+			return err
+		}
 	}
 
 	// read and verify Merkle proof
@@ -624,6 +1051,10 @@ func (s *Session) Write(actions []renterhost.RPCWriteAction) (err error) {
 	renterSig := &renterhost.RPCWriteResponse{
 		Signature: ed25519hash.Sign(s.key, renterhost.HashRevision(rev)),
 	}
+	if err := s.storePendingRevision(rev, renterSig.Signature); err != nil {
+		s.sess.WriteResponse(nil, errors.New("internal error"))
+		return err
+	}
 	if err := s.sess.WriteResponse(renterSig, nil); err != nil {
 		return errors.Wrap(err, "couldn't write signature response")
 	}
@@ -636,13 +1067,18 @@ func (s *Session) Write(actions []renterhost.RPCWriteAction) (err error) {
 	s.rev.Signatures[0].Signature = renterSig.Signature
 	s.rev.Signatures[1].Signature = hostSig.Signature
 
-	return nil
+	return s.storeRevision()
 }
 
 // Append calls the Write RPC with a single action, appending the provided
 // sector. It returns the Merkle root of the sector.
 func (s *Session) Append(sector *[renterhost.SectorSize]byte) (crypto.Hash, error) {
-	err := s.Write([]renterhost.RPCWriteAction{{
+	return s.AppendContext(context.Background(), sector)
+}
+
+// AppendContext is like Append, but aborts the RPC if ctx is cancelled.
+func (s *Session) AppendContext(ctx context.Context, sector *[renterhost.SectorSize]byte) (crypto.Hash, error) {
+	err := s.WriteContext(ctx, []renterhost.RPCWriteAction{{
 		Type: renterhost.RPCWriteActionAppend,
 		Data: sector[:],
 	}})
@@ -652,9 +1088,64 @@ func (s *Session) Append(sector *[renterhost.SectorSize]byte) (crypto.Hash, erro
 	return s.appendRoots[0], nil
 }
 
+// MaxAppendBatch is the maximum number of sectors that AppendMany will upload
+// in a single Write RPC. A Write request must fit within
+// renterhost.MaxWriteRequestSize, which also covers the action headers, the
+// revision fields, and the encryption overhead; reserving one sector's worth
+// of space for them leaves room for four sectors. Larger batches are split
+// into multiple RPCs, each with its own Merkle proof. Callers that buffer
+// sectors should flush them in batches of at most MaxAppendBatch.
+const MaxAppendBatch = renterhost.MaxWriteRequestSize/renterhost.SectorSize - 1
+
+// AppendMany appends n sectors, obtained by calling next, using as few Write
+// RPCs as possible. Each sector is streamed to the host as soon as next
+// returns it, so at most one sector needs to be held in memory at a time; the
+// sector returned by next may be reused as soon as next is called again.
+// AppendMany returns the Merkle roots of the appended sectors.
+//
+// If AppendMany returns an error, it also returns the roots of the sectors
+// that were committed to the contract before the error occurred. Sectors in
+// the failed batch are not included, even if the host stored them.
+func (s *Session) AppendMany(n int, next func() *[renterhost.SectorSize]byte) ([]crypto.Hash, error) {
+	return s.AppendManyContext(context.Background(), n, next)
+}
+
+// AppendManyContext is like AppendMany, but aborts the RPCs if ctx is
+// cancelled.
+func (s *Session) AppendManyContext(ctx context.Context, n int, next func() *[renterhost.SectorSize]byte) ([]crypto.Hash, error) {
+	roots := make([]crypto.Hash, 0, n)
+	for len(roots) < n {
+		batch := n - len(roots)
+		if batch > MaxAppendBatch {
+			batch = MaxAppendBatch
+		}
+		actions := make([]renterhost.RPCWriteAction, batch)
+		for i := range actions {
+			actions[i].Type = renterhost.RPCWriteActionAppend
+		}
+		revNum := s.rev.Revision.NewRevisionNumber
+		if err := s.write(ctx, actions, next); err != nil {
+			// the batch was committed if the host signed the new revision,
+			// even if we failed to store it afterwards
+			if s.rev.Revision.NewRevisionNumber != revNum {
+				roots = append(roots, s.appendRoots...)
+			}
+			return roots, err
+		}
+		roots = append(roots, s.appendRoots...)
+	}
+	return roots, nil
+}
+
 // DeleteSectors calls the Write RPC with a set of Swap and Trim actions that
 // delete the specified sectors.
 func (s *Session) DeleteSectors(roots []crypto.Hash) error {
+	return s.DeleteSectorsContext(context.Background(), roots)
+}
+
+// DeleteSectorsContext is like DeleteSectors, but aborts the RPCs if ctx is
+// cancelled.
+func (s *Session) DeleteSectorsContext(ctx context.Context, roots []crypto.Hash) error {
 	if len(roots) == 0 {
 		return nil
 	}
@@ -667,7 +1158,7 @@ func (s *Session) DeleteSectors(roots []crypto.Hash) error {
 		if offset+n > numRoots {
 			n = numRoots - offset
 		}
-		roots, err := s.SectorRoots(offset, n)
+		roots, err := s.SectorRootsContext(ctx, offset, n)
 		if err != nil {
 			return err
 		}
@@ -718,7 +1209,7 @@ func (s *Session) DeleteSectors(roots []crypto.Hash) error {
 	// NOTE: siad hosts will accept up to 20 MiB of data in the request,
 	// which should be sufficient to delete up to 2.5 TiB of sector data
 	// at a time.
-	return s.Write(actions)
+	return s.WriteContext(ctx, actions)
 }
 
 // Close gracefully terminates the session and closes the underlying connection.
@@ -727,9 +1218,15 @@ func (s *Session) Close() (err error) {
 	return s.sess.Close()
 }
 
+// DefaultSettingsCache is the SettingsCache used by new Sessions. Sessions
+// that share a SettingsCache can reuse settings received by one another,
+// avoiding a Settings RPC. It is the same cache consulted by hostdb.Scan.
+var DefaultSettingsCache = hostdb.DefaultSettingsCache
+
 // NewSession initiates a new renter-host protocol session with the specified
 // host. The supplied contract will be locked and synchronized with the host.
-// The host's settings will also be requested.
+// The host's settings will also be requested, unless they are present in
+// DefaultSettingsCache.
 func NewSession(hostIP modules.NetAddress, hostKey hostdb.HostPublicKey, id types.FileContractID, key ed25519.PrivateKey, currentHeight types.BlockHeight) (_ *Session, err error) {
 	defer wrapErrWithReplace(&err, "NewSession")
 	s, err := NewUnlockedSession(hostIP, hostKey, currentHeight)
@@ -740,7 +1237,7 @@ func NewSession(hostIP modules.NetAddress, hostKey hostdb.HostPublicKey, id type
 		s.Close()
 		return nil, err
 	}
-	if _, err := s.Settings(); err != nil {
+	if _, err := s.CachedSettings(); err != nil {
 		s.Close()
 		return nil, err
 	}
@@ -765,14 +1262,17 @@ func NewUnlockedSession(hostIP modules.NetAddress, hostKey hostdb.HostPublicKey,
 // for the renter-host protocol handshake.
 func NewUnlockedSessionFromConn(conn net.Conn, hostKey hostdb.HostPublicKey, currentHeight types.BlockHeight) (_ *Session, err error) {
 	defer wrapErr(&err, "NewUnlockedSessionFromConn")
-	sc := &statsConn{Conn: conn}
+	sc := newStatsConn(conn)
 	start := time.Now()
 	s, err := renterhost.NewRenterSession(sc, hostKey.Ed25519())
 	if err != nil {
 		sc.Close()
 		return nil, err
 	}
-	latency := time.Since(start)
+	return newUnlockedSession(s, sc, hostKey, currentHeight, time.Since(start)), nil
+}
+
+func newUnlockedSession(s *renterhost.Session, sc *statsConn, hostKey hostdb.HostPublicKey, currentHeight types.BlockHeight, latency time.Duration) *Session {
 	return &Session{
 		sess:   s,
 		conn:   sc,
@@ -784,7 +1284,8 @@ func NewUnlockedSessionFromConn(conn net.Conn, hostKey hostdb.HostPublicKey, cur
 		latency:       time.Second + latency*3,
 		readDeadline:  time.Millisecond,
 		writeDeadline: time.Millisecond,
-	}, nil
+		settings:      DefaultSettingsCache,
+	}
 }
 
 func updateRevisionOutputs(rev *types.FileContractRevision, cost, collateral types.Currency) (valid, missed []types.Currency) {
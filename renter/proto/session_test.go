@@ -2,15 +2,25 @@ package proto
 
 import (
 	"bytes"
+	"context"
 	"crypto/ed25519"
 	"io/ioutil"
+	"math"
+	"net"
 	"testing"
+	"time"
 
+	"github.com/pkg/errors"
 	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/modules"
 	"gitlab.com/NebulousLabs/Sia/types"
 	"gitlab.com/NebulousLabs/encoding"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/internal/ghost"
+	"lukechampine.com/us/merkle"
 	"lukechampine.com/us/renterhost"
+	"lukechampine.com/us/wallet"
 )
 
 func deepEqual(a, b interface{}) bool {
@@ -92,7 +102,8 @@ func TestSession(t *testing.T) {
 		t.Fatal("no stats collected")
 	} else if stats := tsr.stats[0]; stats.Host != host.PublicKey() ||
 		stats.RPC != renterhost.RPCWriteID ||
-		stats.Uploaded == 0 || stats.Downloaded == 0 {
+		stats.Uploaded == 0 || stats.Downloaded == 0 ||
+		stats.RevisionNumber != renter.Revision().Revision.NewRevisionNumber {
 		t.Fatal("bad stats:", stats)
 	}
 
@@ -143,6 +154,788 @@ func TestSession(t *testing.T) {
 	}
 }
 
+func TestAppendMany(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	// stream sectors from a single buffer, which is reused for each sector
+	const numSectors = MaxAppendBatch + 2
+	var sector [renterhost.SectorSize]byte
+	var expRoots []crypto.Hash
+	next := func() *[renterhost.SectorSize]byte {
+		frand.Read(sector[:])
+		expRoots = append(expRoots, merkle.SectorRoot(&sector))
+		return &sector
+	}
+	roots, err := renter.AppendMany(numSectors, next)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(roots) != numSectors || !deepEqual(roots, expRoots) {
+		t.Fatal("AppendMany returned wrong roots")
+	}
+	if renter.Revision().NumSectors() != numSectors {
+		t.Fatal("wrong number of sectors in contract")
+	} else if hostRoots, err := renter.SectorRoots(0, numSectors); err != nil {
+		t.Fatal(err)
+	} else if !deepEqual(hostRoots, expRoots) {
+		t.Fatal("host reported wrong sector roots")
+	}
+
+	// cancel the upload partway through the second batch; the roots of the
+	// first batch should still be returned
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	expRoots = nil
+	roots, err = renter.AppendManyContext(ctx, numSectors, func() *[renterhost.SectorSize]byte {
+		if len(expRoots) == MaxAppendBatch {
+			cancel()
+		}
+		return next()
+	})
+	if err == nil {
+		t.Fatal("expected AppendMany to fail")
+	} else if len(roots) != MaxAppendBatch || !deepEqual(roots, expRoots[:MaxAppendBatch]) {
+		t.Fatal("AppendMany should return the roots of the committed batch, got", len(roots))
+	} else if renter.Revision().NumSectors() != numSectors+MaxAppendBatch {
+		t.Fatal("wrong number of sectors in contract")
+	}
+}
+
+func TestWriteUpdate(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	// Write should reject Update actions
+	err := renter.Write([]renterhost.RPCWriteAction{{
+		Type: renterhost.RPCWriteActionUpdate,
+		A:    0,
+		B:    0,
+		Data: frand.Bytes(1000),
+	}})
+	if err == nil {
+		t.Fatal("expected Write to reject Update action")
+	}
+}
+
+func TestSplitSections(t *testing.T) {
+	root := frand.Entropy256()
+	sections := []renterhost.RPCReadRequestSection{
+		{MerkleRoot: root, Offset: 0, Length: 100},
+		{MerkleRoot: root, Offset: 64, Length: 250},
+	}
+	split := splitSections(sections, 100)
+	exp := []renterhost.RPCReadRequestSection{
+		{MerkleRoot: root, Offset: 0, Length: 100},
+		{MerkleRoot: root, Offset: 64, Length: 100},
+		{MerkleRoot: root, Offset: 164, Length: 100},
+		{MerkleRoot: root, Offset: 264, Length: 50},
+	}
+	if !deepEqual(split, exp) {
+		t.Fatalf("wrong split: expected %v, got %v", exp, split)
+	}
+
+	// splitting should stop once the request contains maxSplitSections
+	split = splitSections([]renterhost.RPCReadRequestSection{{Length: 1000}}, 1)
+	if len(split) != maxSplitSections {
+		t.Fatalf("expected %v sections, got %v", maxSplitSections, len(split))
+	}
+	var total uint32
+	for _, sec := range split {
+		total += sec.Length
+	}
+	if total != 1000 {
+		t.Fatal("split sections do not cover original section")
+	}
+}
+
+func TestReadSections(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	var sector [renterhost.SectorSize]byte
+	frand.Read(sector[:])
+	root, err := renter.Append(&sector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sections := []renterhost.RPCReadRequestSection{{
+		MerkleRoot: root,
+		Offset:     0,
+		Length:     renterhost.SectorSize,
+	}}
+
+	// the sector should be delivered in verified chunks
+	var chunks [][]byte
+	err = renter.ReadSections(sections, func(data []byte) error {
+		chunks = append(chunks, append([]byte(nil), data...))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(chunks) != renterhost.SectorSize/maxReadSectionSize {
+		t.Fatalf("expected %v chunks, got %v", renterhost.SectorSize/maxReadSectionSize, len(chunks))
+	} else if !bytes.Equal(bytes.Join(chunks, nil), sector[:]) {
+		t.Fatal("downloaded chunks do not match sector")
+	}
+
+	// corrupt the sector; the first chunk should fail verification, and the
+	// session should be closed without any data being written
+	host.CorruptSector(root)
+	var buf bytes.Buffer
+	err = renter.Read(&buf, sections)
+	if errors.Cause(err) != ErrInvalidMerkleProof {
+		t.Fatal("expected ErrInvalidMerkleProof, got", err)
+	} else if buf.Len() != 0 {
+		t.Fatalf("expected no data to be written, got %v bytes", buf.Len())
+	}
+	if _, err := renter.SectorRoots(0, 1); err == nil {
+		t.Fatal("expected session to be closed after receiving invalid data")
+	}
+}
+
+func TestFreeReads(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	var sector [renterhost.SectorSize]byte
+	frand.Read(sector[:])
+	root, err := renter.Append(&sector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sections := []renterhost.RPCReadRequestSection{{
+		MerkleRoot: root,
+		Offset:     0,
+		Length:     renterhost.SectorSize,
+	}}
+
+	// without a contract, reads should fail until the host enables free reads
+	s, err := NewUnlockedSession(host.Settings().NetAddress, host.PublicKey(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Settings(); err != nil {
+		t.Fatal(err)
+	} else if err := s.Read(ioutil.Discard, sections); errors.Cause(err) != ErrNoContractLocked {
+		t.Fatal("expected ErrNoContractLocked, got", err)
+	}
+	host.SetFreeReads(true)
+	if settings, err := s.Settings(); err != nil {
+		t.Fatal(err)
+	} else if !settings.SupportsFreeReads() {
+		t.Fatal("host should report free reads")
+	}
+	var buf bytes.Buffer
+	if err := s.Read(&buf, sections); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), sector[:]) {
+		t.Fatal("downloaded sector does not match uploaded sector")
+	}
+
+	// renters with a contract should still pay
+	revNum := renter.Revision().Revision.NewRevisionNumber
+	if err := renter.Read(ioutil.Discard, sections); err != nil {
+		t.Fatal(err)
+	} else if renter.Revision().Revision.NewRevisionNumber != revNum+1 {
+		t.Fatal("contract was not revised")
+	}
+}
+
+func TestSettingsCache(t *testing.T) {
+	host, err := ghost.New(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	newSession := func(cache *hostdb.SettingsCache) *Session {
+		s, err := NewUnlockedSession(host.Settings().NetAddress, host.PublicKey(), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.SetSettingsCache(cache)
+		return s
+	}
+	cache := hostdb.NewSettingsCache(time.Minute)
+
+	host.SetSettingsRevision(5)
+	s1 := newSession(cache)
+	defer s1.Close()
+	if _, err := s1.Settings(); err != nil {
+		t.Fatal(err)
+	} else if settings, ok := cache.Get(host.PublicKey()); !ok || settings.RevisionNumber != 5 {
+		t.Fatal("settings were not cached")
+	}
+
+	// a rollback should be detected by the Session and by the cache
+	host.SetSettingsRevision(3)
+	if _, err := s1.Settings(); err == nil {
+		t.Fatal("expected rollback to be detected")
+	} else if re, ok := errors.Cause(err).(*hostdb.SettingsRollbackError); !ok || re.OldRevision != 5 || re.NewRevision != 3 {
+		t.Fatal("expected SettingsRollbackError, got", err)
+	}
+	s2 := newSession(cache)
+	defer s2.Close()
+	if _, err := s2.Settings(); err == nil {
+		t.Fatal("expected rollback to be detected")
+	}
+	// without a cache, the rollback can't be detected
+	s3 := newSession(nil)
+	defer s3.Close()
+	if settings, err := s3.Settings(); err != nil {
+		t.Fatal(err)
+	} else if settings.RevisionNumber != 3 {
+		t.Fatal("wrong settings revision")
+	}
+
+	// CachedSettings should not need to contact the host
+	var tsr testStatsRecorder
+	s2.SetRPCStatsRecorder(&tsr)
+	if settings, err := s2.CachedSettings(); err != nil {
+		t.Fatal(err)
+	} else if settings.RevisionNumber != 5 {
+		t.Fatal("wrong settings revision")
+	} else if len(tsr.stats) != 0 {
+		t.Fatal("CachedSettings called the Settings RPC")
+	}
+
+	// once the host is forgotten, its settings should be accepted again
+	cache.Forget(host.PublicKey())
+	s4 := newSession(cache)
+	defer s4.Close()
+	if settings, err := s4.Settings(); err != nil {
+		t.Fatal(err)
+	} else if settings.RevisionNumber != 3 {
+		t.Fatal("wrong settings revision")
+	}
+
+	// hostdb.Scan should also detect rollbacks
+	defer hostdb.DefaultSettingsCache.Forget(host.PublicKey())
+	if _, err := hostdb.Scan(context.Background(), host.Settings().NetAddress, host.PublicKey()); err != nil {
+		t.Fatal(err)
+	}
+	host.SetSettingsRevision(2)
+	if _, err := hostdb.Scan(context.Background(), host.Settings().NetAddress, host.PublicKey()); err == nil {
+		t.Fatal("expected rollback to be detected")
+	} else if _, ok := errors.Cause(err).(*hostdb.SettingsRollbackError); !ok {
+		t.Fatal("expected SettingsRollbackError, got", err)
+	}
+}
+
+func TestCiphers(t *testing.T) {
+	defer func(pref []renterhost.Specifier) {
+		renterhost.RenterCipherPreference = pref
+	}(renterhost.RenterCipherPreference)
+
+	for _, c := range renterhost.SupportedCiphers() {
+		renterhost.RenterCipherPreference = []renterhost.Specifier{c}
+		func() {
+			renter, host := createTestingPair(t)
+			defer renter.Close()
+			defer host.Close()
+			if renter.sess.Cipher() != c {
+				t.Fatalf("expected %v to be selected, got %v", c, renter.sess.Cipher())
+			}
+
+			var sector [renterhost.SectorSize]byte
+			frand.Read(sector[:])
+			root, err := renter.Append(&sector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			err = renter.Read(&buf, []renterhost.RPCReadRequestSection{{
+				MerkleRoot: root,
+				Offset:     0,
+				Length:     renterhost.SectorSize,
+			}})
+			if err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(buf.Bytes(), sector[:]) {
+				t.Fatal("downloaded data does not match uploaded data")
+			}
+
+			// AppendMany streams its request when possible, and buffers it
+			// otherwise; both must produce the same result
+			const numSectors = 3
+			var expRoots []crypto.Hash
+			next := func() *[renterhost.SectorSize]byte {
+				frand.Read(sector[:])
+				expRoots = append(expRoots, merkle.SectorRoot(&sector))
+				return &sector
+			}
+			roots, err := renter.AppendMany(numSectors, next)
+			if err != nil {
+				t.Fatal(err)
+			} else if len(roots) != numSectors || !deepEqual(roots, expRoots) {
+				t.Fatal("AppendMany returned wrong roots")
+			}
+		}()
+	}
+}
+
+func TestMux(t *testing.T) {
+	host, err := ghost.New(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	m, err := NewMux(host.Settings().NetAddress, host.PublicKey(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Close()
+	if !m.Multiplexed() {
+		t.Fatal("expected host to support multiplexing")
+	}
+
+	// form two contracts, and upload a sector to each
+	var sessions []*Session
+	var sectors [][renterhost.SectorSize]byte
+	var roots []crypto.Hash
+	for i := 0; i < 2; i++ {
+		// use a different key for each contract, so that their IDs differ
+		key := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+		s, err := m.NewUnlockedSession()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer s.Close()
+		rev, _, err := s.FormContract(stubWallet{}, stubTpool{}, key, types.ZeroCurrency, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := s.Lock(rev.ID(), key, 0); err != nil {
+			t.Fatal(err)
+		}
+		var sector [renterhost.SectorSize]byte
+		frand.Read(sector[:])
+		root, err := s.Append(&sector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		sessions = append(sessions, s)
+		sectors = append(sectors, sector)
+		roots = append(roots, root)
+	}
+
+	// read from both contracts and request settings concurrently
+	errs := make(chan error, 3)
+	for i := range sessions {
+		go func(i int) {
+			var buf bytes.Buffer
+			err := sessions[i].Read(&buf, []renterhost.RPCReadRequestSection{{
+				MerkleRoot: roots[i],
+				Offset:     0,
+				Length:     renterhost.SectorSize,
+			}})
+			if err == nil && !bytes.Equal(buf.Bytes(), sectors[i][:]) {
+				err = errors.New("downloaded data does not match uploaded data")
+			}
+			if err == nil {
+				var sectorRoots []crypto.Hash
+				sectorRoots, err = sessions[i].SectorRoots(0, 1)
+				if err == nil && sectorRoots[0] != roots[i] {
+					err = errors.New("wrong sector root")
+				}
+			}
+			errs <- err
+		}(i)
+	}
+	go func() {
+		errs <- func() error {
+			s, err := m.NewUnlockedSession()
+			if err != nil {
+				return err
+			}
+			defer s.Close()
+			_, err = s.Settings()
+			return err
+		}()
+	}()
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// closing one Session should not affect the others
+	if err := sessions[0].Close(); err != nil {
+		t.Fatal(err)
+	} else if _, err := sessions[1].SectorRoots(0, 1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type stubBatchWallet struct {
+	stubWallet
+	outputs []wallet.UnspentOutput
+}
+
+func (w stubBatchWallet) UnspentOutputs(bool) []wallet.UnspentOutput { return w.outputs }
+func (stubBatchWallet) AddressInfo(types.UnlockHash) (wallet.SeedAddressInfo, bool) {
+	return wallet.SeedAddressInfo{}, true
+}
+
+func TestFormContracts(t *testing.T) {
+	var hosts []hostdb.ScannedHost
+	for i := 0; i < 4; i++ {
+		host, err := ghost.New(":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer host.Close()
+		hosts = append(hosts, hostdb.ScannedHost{
+			HostSettings: host.Settings(),
+			PublicKey:    host.PublicKey(),
+		})
+		if i == 3 {
+			// this host will be unreachable
+			host.Close()
+		}
+	}
+	// this host will exceed the price limits
+	expensive := hosts[0]
+	expensive.ContractPrice = types.SiacoinPrecision.Mul64(1000)
+	hosts = append(hosts, expensive)
+	limits := PriceLimits{ContractPrice: types.SiacoinPrecision}
+	payouts := []types.Currency{
+		types.SiacoinPrecision.Mul64(1),
+		types.SiacoinPrecision.Mul64(2),
+		types.SiacoinPrecision.Mul64(3),
+		types.SiacoinPrecision.Mul64(4),
+		types.SiacoinPrecision.Mul64(1),
+	}
+	w := stubBatchWallet{
+		outputs: []wallet.UnspentOutput{
+			{SiacoinOutput: types.SiacoinOutput{Value: types.SiacoinPrecision.Mul64(5)}, ID: types.SiacoinOutputID{1}},
+			{SiacoinOutput: types.SiacoinOutput{Value: types.SiacoinPrecision.Mul64(100)}, ID: types.SiacoinOutputID{2}},
+		},
+	}
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	batch, err := FormContracts(context.Background(), w, stubTpool{}, key, hosts, payouts, 0, 10, limits)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the parent should have one output per host within the price limits,
+	// plus change
+	per := batch.Parent.SiacoinOutputs[0].Value
+	if len(batch.Parent.SiacoinOutputs) != len(hosts) {
+		t.Fatal("wrong number of parent outputs:", len(batch.Parent.SiacoinOutputs))
+	} else if len(batch.Formed()) != 3 {
+		t.Fatal("expected 3 contracts to be formed, got", len(batch.Formed()))
+	} else if batch.Results[3].Err == nil {
+		t.Fatal("expected unreachable host to fail")
+	} else if _, ok := errors.Cause(batch.Results[4].Err).(*PriceError); !ok {
+		t.Fatal("expected PriceError for expensive host, got", batch.Results[4].Err)
+	} else if !batch.Limbo.Equals(per) {
+		t.Fatalf("expected %v H in limbo, got %v H", per, batch.Limbo)
+	}
+	for i, r := range batch.Formed() {
+		if r.Host != hosts[i].PublicKey || r.Contract.HostKey() != hosts[i].PublicKey {
+			t.Fatal("wrong host for contract", i)
+		} else if !r.Contract.RenterFunds().Equals(payouts[i]) {
+			t.Fatal("wrong renter payout for contract", i)
+		}
+		// the contract transaction should spend the corresponding parent
+		// output, and be preceded by the parent
+		txn := r.Transactions[len(r.Transactions)-1]
+		if len(txn.SiacoinInputs) != 1 || txn.SiacoinInputs[0].ParentID != batch.Parent.SiacoinOutputID(uint64(i)) {
+			t.Fatal("contract transaction does not spend parent output", i)
+		} else if r.Transactions[len(r.Transactions)-2].ID() != batch.Parent.ID() {
+			t.Fatal("contract transaction set does not include parent")
+		}
+		// only the most expensive contract (which failed) uses its entire
+		// parent output; the others should include a refund
+		if len(txn.SiacoinOutputs) != 1 || txn.SiacoinOutputs[0].Value.Add(payouts[i]).Cmp(per) > 0 {
+			t.Fatal("missing refund output for contract", i)
+		}
+	}
+
+	// mismatched arguments should be rejected
+	if _, err := FormContracts(context.Background(), w, stubTpool{}, key, hosts, payouts[:1], 0, 10, limits); err == nil {
+		t.Fatal("expected error for mismatched payouts")
+	}
+	// cancellation should be respected
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := FormContracts(ctx, w, stubTpool{}, key, hosts, payouts, 0, 10, limits); errors.Cause(err) != context.Canceled {
+		t.Fatal("expected context.Canceled, got", err)
+	}
+	// if no hosts are within the price limits, nothing should be funded
+	if _, err := FormContracts(context.Background(), w, stubTpool{}, key, hosts[4:], payouts[4:], 0, 10, limits); err == nil {
+		t.Fatal("expected error when all hosts exceed price limits")
+	}
+	// insufficient funds should be reported
+	w.outputs = w.outputs[:1]
+	if _, err := FormContracts(context.Background(), w, stubTpool{}, key, hosts, payouts, 0, 10, limits); errors.Cause(err) != wallet.ErrInsufficientFunds {
+		t.Fatal("expected ErrInsufficientFunds, got", err)
+	}
+}
+
+// failingBatchWallet refuses to sign contract transactions with the specified
+// renter payout.
+type failingBatchWallet struct {
+	stubBatchWallet
+	payout types.Currency
+}
+
+func (w failingBatchWallet) SignTransaction(txn *types.Transaction, toSign []crypto.Hash) error {
+	if len(txn.FileContracts) > 0 && txn.FileContracts[0].ValidProofOutputs[0].Value.Equals(w.payout) {
+		return errors.New("refusing to sign")
+	}
+	return w.stubBatchWallet.SignTransaction(txn, toSign)
+}
+
+func TestFormContractsPartialFailure(t *testing.T) {
+	var hosts []hostdb.ScannedHost
+	for i := 0; i < 3; i++ {
+		host, err := ghost.New(":0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer host.Close()
+		hosts = append(hosts, hostdb.ScannedHost{
+			HostSettings: host.Settings(),
+			PublicKey:    host.PublicKey(),
+		})
+	}
+	payouts := []types.Currency{
+		types.SiacoinPrecision.Mul64(1),
+		types.SiacoinPrecision.Mul64(2),
+		types.SiacoinPrecision.Mul64(3),
+	}
+	// the second contract fails after the host has added its inputs
+	w := failingBatchWallet{
+		stubBatchWallet: stubBatchWallet{
+			outputs: []wallet.UnspentOutput{
+				{SiacoinOutput: types.SiacoinOutput{Value: types.SiacoinPrecision.Mul64(100)}, ID: types.SiacoinOutputID{1}},
+			},
+		},
+		payout: payouts[1],
+	}
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	batch, err := FormContracts(context.Background(), w, stubTpool{}, key, hosts, payouts, 0, 10, PriceLimits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	per := batch.Parent.SiacoinOutputs[0].Value
+	if formed := batch.Formed(); len(formed) != 2 || formed[0].Host != hosts[0].PublicKey || formed[1].Host != hosts[2].PublicKey {
+		t.Fatal("expected contracts with first and third hosts to be formed, got", formed)
+	} else if batch.Results[1].Err == nil {
+		t.Fatal("expected second contract to fail")
+	} else if !batch.Limbo.Equals(per) {
+		t.Fatalf("expected %v H in limbo, got %v H", per, batch.Limbo)
+	}
+
+	// if every contract fails, nothing is in limbo
+	w.payout = payouts[0]
+	batch, err = FormContracts(context.Background(), w, stubTpool{}, key, hosts[:1], payouts[:1], 0, 10, PriceLimits{})
+	if err != nil {
+		t.Fatal(err)
+	} else if len(batch.Formed()) != 0 {
+		t.Fatal("expected no contracts to be formed")
+	} else if !batch.Limbo.IsZero() {
+		t.Fatalf("expected nothing in limbo, got %v H", batch.Limbo)
+	}
+}
+
+type testContractStore struct {
+	revs    map[types.FileContractID]ContractRevision
+	pending map[types.FileContractID]ContractRevision
+	err     error
+}
+
+func (cs *testContractStore) SetPendingRevision(rev ContractRevision) error {
+	if cs.err != nil {
+		return cs.err
+	}
+	cs.pending[rev.ID()] = rev
+	return nil
+}
+
+func (cs *testContractStore) SetRevision(rev ContractRevision) error {
+	if cs.err != nil {
+		return cs.err
+	}
+	cs.revs[rev.ID()] = rev
+	delete(cs.pending, rev.ID())
+	return nil
+}
+
+func (cs *testContractStore) Revision(id types.FileContractID) (ContractRevision, error) {
+	rev, ok := cs.revs[id]
+	if !ok {
+		return ContractRevision{}, errors.New("no record of that contract")
+	}
+	return rev, nil
+}
+
+func (cs *testContractStore) PendingRevision(id types.FileContractID) (ContractRevision, bool, error) {
+	rev, ok := cs.pending[id]
+	return rev, ok, nil
+}
+
+func TestContractStore(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	store := &testContractStore{
+		revs:    make(map[types.FileContractID]ContractRevision),
+		pending: make(map[types.FileContractID]ContractRevision),
+	}
+	renter.SetContractStore(store)
+	id, key := renter.Revision().ID(), renter.key
+	renter.Unlock()
+	if err := renter.Lock(id, key, 0); err != nil {
+		t.Fatal(err)
+	} else if rev, err := store.Revision(id); err != nil {
+		t.Fatal(err)
+	} else if !deepEqual(rev, renter.Revision()) {
+		t.Fatal("stored revision does not match locked revision")
+	}
+
+	// each paid RPC should update the store
+	sector := [renterhost.SectorSize]byte{0: 1}
+	root, err := renter.Append(&sector)
+	if err != nil {
+		t.Fatal(err)
+	} else if rev, _ := store.Revision(id); !deepEqual(rev, renter.Revision()) {
+		t.Fatal("stored revision does not match Write revision")
+	}
+	if _, err := renter.SectorRoots(0, 1); err != nil {
+		t.Fatal(err)
+	} else if rev, _ := store.Revision(id); !deepEqual(rev, renter.Revision()) {
+		t.Fatal("stored revision does not match SectorRoots revision")
+	}
+	err = renter.Read(ioutil.Discard, []renterhost.RPCReadRequestSection{{
+		MerkleRoot: root,
+		Offset:     0,
+		Length:     renterhost.SectorSize,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	} else if rev, _ := store.Revision(id); !deepEqual(rev, renter.Revision()) {
+		t.Fatal("stored revision does not match Read revision")
+	} else if _, ok, _ := store.PendingRevision(id); ok {
+		t.Fatal("pending revision should have been cleared")
+	}
+
+	// if the revision cannot be stored, the RPC should fail without revising
+	// the contract
+	oldRev := renter.Revision()
+	store.err = errors.New("store is broken")
+	if _, err := renter.Append(&sector); errors.Cause(err) != store.err {
+		t.Fatal("expected", store.err, "got", err)
+	} else if !deepEqual(oldRev, renter.Revision()) {
+		t.Fatal("revision should not have changed")
+	}
+
+	// the store should detect a host rolling back the contract
+	store.err = nil
+	stored := store.revs[id]
+	stored.Revision.NewRevisionNumber++
+	store.revs[id] = stored
+	renter.Unlock()
+	if err := renter.Lock(id, key, 0); err == nil {
+		t.Fatal("expected Lock to reject outdated revision")
+	}
+}
+
+func TestSessionContext(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	// a cancelled context should prevent the RPC from starting, without
+	// affecting the Session
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sector := [renterhost.SectorSize]byte{0: 1}
+	if _, err := renter.AppendContext(ctx, &sector); errors.Cause(err) != context.Canceled {
+		t.Fatal("expected", context.Canceled, "got", err)
+	} else if renter.IsClosed() {
+		t.Fatal("Session should not be closed")
+	} else if renter.Revision().NumSectors() != 0 {
+		t.Fatal("revision should not have changed")
+	}
+	if _, err := renter.Append(&sector); err != nil {
+		t.Fatal(err)
+	}
+
+	// create a host that completes the handshake, but never responds to RPCs
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	hostKey := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		if _, err := renterhost.NewHostSession(conn, hostKey); err != nil {
+			return
+		}
+		ioutil.ReadAll(conn)
+	}()
+	renter, err = NewUnlockedSession(modules.NetAddress(l.Addr().String()), hostdb.HostKeyFromPublicKey(hostKey.Public().(ed25519.PublicKey)), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer renter.Close()
+
+	// the RPC should be interrupted as soon as the context expires
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := renter.SettingsContext(ctx); errors.Cause(err) != context.DeadlineExceeded {
+		t.Fatal("expected", context.DeadlineExceeded, "got", err)
+	} else if time.Since(start) > time.Second {
+		t.Fatal("RPC was not interrupted promptly")
+	} else if !renter.IsClosed() {
+		t.Fatal("interrupted Session should be closed")
+	}
+}
+
+func TestSessionRateLimits(t *testing.T) {
+	renter, host := createTestingPair(t)
+	defer renter.Close()
+	defer host.Close()
+
+	// uploading a sector at 16 MiB/s should take at least 150ms
+	renter.SetRateLimits(16<<20, 0)
+	sector := [renterhost.SectorSize]byte{0: 1}
+	start := time.Now()
+	root, err := renter.Append(&sector)
+	if err != nil {
+		t.Fatal(err)
+	} else if time.Since(start) < 150*time.Millisecond {
+		t.Fatal("upload was not throttled:", time.Since(start))
+	}
+
+	// shared limiters should also be obeyed
+	renter.SetRateLimits(0, 0)
+	renter.AddRateLimiter(NewRateLimiter(0, 16<<20))
+	start = time.Now()
+	err = renter.Read(ioutil.Discard, []renterhost.RPCReadRequestSection{{
+		MerkleRoot: root,
+		Length:     renterhost.SectorSize,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	} else if time.Since(start) < 150*time.Millisecond {
+		t.Fatal("download was not throttled:", time.Since(start))
+	}
+}
+
 func TestRenew(t *testing.T) {
 	renter, host := createTestingPair(t)
 	defer renter.Close()
@@ -216,6 +1009,62 @@ func TestRenew(t *testing.T) {
 	}
 }
 
+type feeTpool struct {
+	stubTpool
+	fee types.Currency
+}
+
+func (tp feeTpool) FeeEstimate() (_, _ types.Currency, _ error) { return tp.fee, tp.fee, nil }
+
+func TestContractStats(t *testing.T) {
+	host, err := ghost.New(":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer host.Close()
+	s, err := NewUnlockedSession(host.Settings().NetAddress, host.PublicKey(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	var tsr testStatsRecorder
+	s.SetRPCStatsRecorder(&tsr)
+
+	// the transaction fee is paid from the renter's wallet, and should thus be
+	// recorded as the cost of forming and renewing
+	tpool := feeTpool{fee: types.NewCurrency64(1)}
+	fee := tpool.fee.Mul64(estTxnSize)
+	key := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	rev, _, err := s.FormContract(stubWallet{}, tpool, key, types.ZeroCurrency, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(tsr.stats) != 1 {
+		t.Fatal("expected 1 RPC to be recorded, got", len(tsr.stats))
+	} else if stats := tsr.stats[0]; stats.RPC != renterhost.RPCFormContractID ||
+		stats.Contract != rev.ID() ||
+		stats.RevisionNumber != 0 ||
+		!stats.Cost.Equals(fee) ||
+		!stats.WalletCost.Equals(fee) {
+		t.Fatal("bad stats:", stats)
+	}
+
+	if err := s.Lock(rev.ID(), key, 0); err != nil {
+		t.Fatal(err)
+	}
+	tsr.stats = nil
+	if _, _, err := s.RenewContract(stubWallet{}, tpool, types.ZeroCurrency, 0, 1); err != nil {
+		t.Fatal(err)
+	} else if len(tsr.stats) != 1 {
+		t.Fatal("expected 1 RPC to be recorded, got", len(tsr.stats))
+	} else if stats := tsr.stats[0]; stats.RPC != renterhost.RPCRenewClearContractID ||
+		stats.Contract != rev.ID() ||
+		stats.RevisionNumber != math.MaxUint64 ||
+		!stats.Cost.Equals(fee) ||
+		!stats.WalletCost.Equals(fee) {
+		t.Fatal("bad stats:", stats)
+	}
+}
+
 func BenchmarkWrite(b *testing.B) {
 	renter, host := createTestingPair(b)
 	defer renter.Close()
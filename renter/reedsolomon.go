@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"sync"
+
+	"github.com/pkg/errors"
 
 	"lukechampine.com/us/internal/reedsolomon"
 	"lukechampine.com/us/merkle"
@@ -16,7 +19,8 @@ type ErasureCoder interface {
 	// Encode encodes data into shards. The resulting shards do not constitute
 	// a single matrix, but a series of matrices, each with a shard size of
 	// merkletree.SegmentSize. The supplied shards must each have a capacity
-	// of at least len(data)/m. Encode may alter the len of the shards.
+	// of at least len(data)/m. Encode may alter the len of the shards. If
+	// data does not fill the final matrix, it is padded with zeros.
 	Encode(data []byte, shards [][]byte)
 	// Reconstruct recalculates any missing shards in the input. Missing
 	// shards must have the same capacity as a normal shard, but a length of
@@ -27,6 +31,70 @@ type ErasureCoder interface {
 	Recover(w io.Writer, shards [][]byte, off, n int) error
 }
 
+// A LocalRepairer is an ErasureCoder that can reconstruct a shard from fewer
+// than m other shards. In exchange, its data is not necessarily recoverable
+// from an arbitrary set of m shards.
+type LocalRepairer interface {
+	ErasureCoder
+	// RepairSet returns the indices of the shards required to reconstruct
+	// shard i.
+	RepairSet(i int) []int
+	// CanRecover reports whether the data shards can be recovered from the
+	// shards marked present.
+	CanRecover(present []bool) bool
+}
+
+// An ErasureCodeSpec identifies an erasure code and its parameters. The zero
+// value identifies the Reed-Solomon code.
+type ErasureCodeSpec struct {
+	Name   string
+	Params []int
+}
+
+// An ErasureCodeFunc returns an m-of-n ErasureCoder with the specified
+// parameters.
+type ErasureCodeFunc func(m, n int, params []int) (ErasureCoder, error)
+
+var erasureCodes = struct {
+	sync.RWMutex
+	m map[string]ErasureCodeFunc
+}{
+	m: map[string]ErasureCodeFunc{
+		"reedsolomon": newRSCodeFunc,
+		"simple":      newSimpleRedundancyFunc,
+		"lrc":         newLRCodeFunc,
+	},
+}
+
+// RegisterErasureCode makes an erasure code available under the specified
+// name. The built-in codes are "reedsolomon", "simple", and "lrc". It panics
+// if a code with the same name has already been registered.
+func RegisterErasureCode(name string, fn ErasureCodeFunc) {
+	erasureCodes.Lock()
+	defer erasureCodes.Unlock()
+	if _, ok := erasureCodes.m[name]; ok {
+		panic("erasure code " + name + " is already registered")
+	}
+	erasureCodes.m[name] = fn
+}
+
+// NewErasureCode returns the m-of-n ErasureCoder identified by spec.
+func NewErasureCode(spec ErasureCodeSpec, m, n int) (ErasureCoder, error) {
+	name := spec.Name
+	if name == "" {
+		name = "reedsolomon"
+	}
+	erasureCodes.RLock()
+	fn, ok := erasureCodes.m[name]
+	erasureCodes.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("unknown erasure code %q", name)
+	} else if m <= 0 || n < m {
+		return nil, errors.Errorf("invalid redundancy (%v-of-%v)", m, n)
+	}
+	return fn(m, n, spec.Params)
+}
+
 type rsCode struct {
 	enc  *reedsolomon.ReedSolomon
 	m, n int
@@ -93,6 +161,24 @@ func NewRSCode(m, n int) ErasureCoder {
 	}
 }
 
+func newRSCodeFunc(m, n int, params []int) (ErasureCoder, error) {
+	if len(params) != 0 {
+		return nil, errors.New("reedsolomon code does not take any parameters")
+	} else if n > 256 {
+		return nil, errors.Errorf("reedsolomon code supports at most 256 shards (got %v)", n)
+	}
+	return NewRSCode(m, n), nil
+}
+
+func newSimpleRedundancyFunc(m, n int, params []int) (ErasureCoder, error) {
+	if len(params) != 0 {
+		return nil, errors.New("simple code does not take any parameters")
+	} else if m != n {
+		return nil, errors.Errorf("simple code requires m == n (got %v-of-%v)", m, n)
+	}
+	return simpleRedundancy(m), nil
+}
+
 // simpleRedundancy implements the ErasureCoder interface when no
 // parity shards are desired
 type simpleRedundancy int
@@ -119,7 +205,11 @@ func (r simpleRedundancy) Encode(data []byte, shards [][]byte) {
 	buf := bytes.NewBuffer(data)
 	for off := 0; buf.Len() > 0; off += merkle.SegmentSize {
 		for i := range shards {
-			copy(shards[i][off:], buf.Next(merkle.SegmentSize))
+			seg := shards[i][off:][:merkle.SegmentSize]
+			n := copy(seg, buf.Next(merkle.SegmentSize))
+			for j := range seg[n:] {
+				seg[n+j] = 0
+			}
 		}
 	}
 }
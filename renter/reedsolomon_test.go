@@ -18,6 +18,8 @@ func encodeAlloc(rsc ErasureCoder, data []byte) [][]byte {
 		n, m = t.n, t.m
 	case simpleRedundancy:
 		n, m = int(t), int(t)
+	case lrCode:
+		n, m = t.n, t.m
 	}
 	shards := make([][]byte, n)
 	for i := range shards {
@@ -112,6 +114,101 @@ func TestReedSolomonPartial(t *testing.T) {
 	}
 }
 
+func TestLRC(t *testing.T) {
+	// 4-of-8 code with 2 groups, i.e. 2 local and 2 global parity shards
+	lrc := NewLRCode(4, 8, 2).(LocalRepairer)
+	chunkSize := 4 * merkle.SegmentSize
+	data := frand.Bytes(chunkSize * 4)
+	shards := encodeAlloc(lrc, data)
+	if !checkRecover(lrc, shards, data) {
+		t.Fatal("failed to recover shards")
+	}
+
+	// each data shard can be repaired from its group alone
+	for i := 0; i < 4; i++ {
+		set := lrc.RepairSet(i)
+		if len(set) != 2 {
+			t.Fatalf("repair set of shard %v should contain 2 shards, got %v", i, set)
+		}
+		partialShards := make([][]byte, len(shards))
+		for j := range partialShards {
+			partialShards[j] = make([]byte, 0, len(shards[j]))
+		}
+		partialShards[i] = partialShards[i][:0]
+		for _, j := range set {
+			partialShards[j] = append(partialShards[j], shards[j]...)
+		}
+		lrc.(lrCode).repairLocal(partialShards, len(shards[0]), false)
+		if !bytes.Equal(partialShards[i], shards[i]) {
+			t.Fatalf("failed to repair shard %v", i)
+		}
+	}
+
+	// delete 4 shards in a recoverable pattern
+	partialShards := make([][]byte, len(shards))
+	for i := range partialShards {
+		partialShards[i] = append([]byte(nil), shards[i]...)
+	}
+	for _, i := range []int{0, 1, 2, 6} {
+		partialShards[i] = partialShards[i][:0]
+	}
+	present := []bool{false, false, false, true, true, true, false, true}
+	if !lrc.CanRecover(present) {
+		t.Fatal("CanRecover should succeed")
+	} else if err := lrc.Reconstruct(partialShards); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(shards, partialShards) {
+		t.Fatal("failed to reconstruct shards")
+	}
+
+	// an LRC is not MDS: some sets of 4 shards are insufficient
+	present = []bool{true, true, false, false, false, false, true, true}
+	if lrc.CanRecover(present) {
+		t.Fatal("CanRecover should fail")
+	}
+	for i := range present {
+		if !present[i] {
+			partialShards[i] = partialShards[i][:0]
+		}
+	}
+	if checkRecover(lrc, partialShards, data) {
+		t.Fatal("Recover should have failed")
+	}
+}
+
+func TestErasureCodeRegistry(t *testing.T) {
+	tests := []struct {
+		spec ErasureCodeSpec
+		m, n int
+		ok   bool
+	}{
+		{ErasureCodeSpec{}, 3, 10, true},
+		{ErasureCodeSpec{Name: "reedsolomon"}, 10, 10, true},
+		{ErasureCodeSpec{Name: "reedsolomon", Params: []int{1}}, 3, 10, false},
+		{ErasureCodeSpec{Name: "simple"}, 3, 3, true},
+		{ErasureCodeSpec{Name: "simple"}, 3, 10, false},
+		{ErasureCodeSpec{Name: "lrc", Params: []int{2}}, 4, 8, true},
+		{ErasureCodeSpec{Name: "lrc", Params: []int{3}}, 4, 8, false},
+		{ErasureCodeSpec{Name: "lrc", Params: []int{2}}, 4, 6, false},
+		{ErasureCodeSpec{Name: "lrc"}, 4, 8, false},
+		{ErasureCodeSpec{Name: "foo"}, 3, 10, false},
+		{ErasureCodeSpec{}, 0, 10, false},
+	}
+	for _, test := range tests {
+		if _, err := NewErasureCode(test.spec, test.m, test.n); (err == nil) != test.ok {
+			t.Errorf("NewErasureCode(%v, %v, %v): unexpected error value %v", test.spec, test.m, test.n, err)
+		}
+	}
+
+	// custom codes can be registered
+	RegisterErasureCode(t.Name(), func(m, n int, params []int) (ErasureCoder, error) {
+		return NewRSCode(m, n), nil
+	})
+	if _, err := NewErasureCode(ErasureCodeSpec{Name: t.Name()}, 3, 10); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func BenchmarkReedSolomon(b *testing.B) {
 	makeShards := func(m, n int) ([]byte, [][]byte) {
 		chunkSize := m * merkle.SegmentSize
@@ -2,16 +2,20 @@ package renterutil
 
 import (
 	"bytes"
+	"hash"
 	"io"
 	"os"
+	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"gitlab.com/NebulousLabs/Sia/crypto"
+	"golang.org/x/crypto/blake2b"
 	"lukechampine.com/frand"
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/merkle"
 	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/proto"
 	"lukechampine.com/us/renterhost"
 )
 
@@ -22,6 +26,54 @@ type openMetaFile struct {
 	pendingChunks []pendingChunk
 	offset        int64
 	closed        bool
+	// fileHash hashes the file's plaintext, as long as it has only been
+	// written sequentially; otherwise it is nil
+	fileHash hash.Hash
+	// verified caches the most recently downloaded and verified chunks, so
+	// that small sequential reads do not download them repeatedly
+	verified chunkCache
+}
+
+// A chunkCache holds the plaintext of a contiguous run of verified chunks. The
+// chunks are identified by their first shard's SectorSlices, so the cache is
+// implicitly invalidated if the chunks are overwritten, truncated, or
+// migrated.
+type chunkCache struct {
+	mu     sync.Mutex
+	slices []renter.SectorSlice
+	data   []byte
+}
+
+// lookup returns the cached plaintext of slices, if present.
+func (c *chunkCache) lookup(slices []renter.SectorSlice, minChunkSize int64) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var off int64
+	for i := range c.slices {
+		if len(c.slices[i:]) < len(slices) {
+			break
+		}
+		match := true
+		for j := range slices {
+			if c.slices[i+j] != slices[j] {
+				match = false
+				break
+			}
+		}
+		if match {
+			return c.data[off:], true
+		}
+		off += int64(c.slices[i].NumSegments) * minChunkSize
+	}
+	return nil, false
+}
+
+// store replaces the contents of the cache.
+func (c *chunkCache) store(slices []renter.SectorSlice, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.slices = append(c.slices[:0], slices...)
+	c.data = data
 }
 
 type pendingWrite struct {
@@ -32,9 +84,16 @@ type pendingWrite struct {
 func (pw pendingWrite) end() int64 { return pw.offset + int64(len(pw.data)) }
 
 type pendingChunk struct {
-	offset     int64 // in segments
-	length     int64 // in segments
-	sliceIndex int   // index within (SectorBuilder).Slices()
+	offset int64 // in segments
+	length int64 // in segments
+	slices []sliceLoc
+	hash   crypto.Hash
+}
+
+// sliceLoc locates a shard of a pendingChunk within (PseudoFS).sectors.
+type sliceLoc struct {
+	sectorIndex int // index within the host's SectorBuilders
+	sliceIndex  int // index within (SectorBuilder).Slices()
 }
 
 func mergePendingWrites(pendingWrites []pendingWrite, pw pendingWrite) []pendingWrite {
@@ -91,16 +150,23 @@ func (f *openMetaFile) calcShardSize(offset int64, n int64) int64 {
 
 // use f.pendingChunks to lookup new slices for each shard, and overwrite f's
 // shards with these
-func (f *openMetaFile) commitPendingSlices(sectors map[hostdb.HostPublicKey]*renter.SectorBuilder) {
+func (f *openMetaFile) commitPendingSlices(sectors map[hostdb.HostPublicKey][]*renter.SectorBuilder) {
 	if len(f.pendingChunks) == 0 {
 		return
 	}
 
-	oldShards := f.m.Shards
-	newShards := make([][]renter.SectorSlice, len(oldShards))
-	for i := range newShards {
-		newShards[i] = oldShards[i][:0]
+	// copy the old shards, since a pending chunk may split an old slice in
+	// two, causing newShards to outgrow the original backing arrays
+	oldShards := make([][]renter.SectorSlice, len(f.m.Shards))
+	newShards := make([][]renter.SectorSlice, len(f.m.Shards))
+	for i := range oldShards {
+		oldShards[i] = append([]renter.SectorSlice(nil), f.m.Shards[i]...)
+		newShards[i] = make([]renter.SectorSlice, 0, len(oldShards[i])+len(f.pendingChunks))
 	}
+	// chunks that are partially overwritten no longer match their hashes
+	oldHashes := make([]crypto.Hash, len(oldShards[0]))
+	copy(oldHashes, f.m.ChunkHashes)
+	newHashes := make([]crypto.Hash, 0, len(oldHashes)+len(f.pendingChunks))
 	pending := f.pendingChunks
 	var offset int64
 	for len(oldShards[0])+len(pending) > 0 {
@@ -112,9 +178,11 @@ func (f *openMetaFile) commitPendingSlices(sectors map[hostdb.HostPublicKey]*ren
 			pc := pending[0]
 			pending = pending[1:]
 			for i, hostKey := range f.m.Hosts {
-				ss := sectors[hostKey].Slices()[pc.sliceIndex]
+				loc := pc.slices[i]
+				ss := sectors[hostKey][loc.sectorIndex].Slices()[loc.sliceIndex]
 				newShards[i] = append(newShards[i], ss)
 			}
+			newHashes = append(newHashes, pc.hash)
 			offset += pc.length
 			// consume old slices that we overwrote
 			overlap := pc.length
@@ -124,14 +192,15 @@ func (f *openMetaFile) commitPendingSlices(sectors map[hostdb.HostPublicKey]*ren
 					for i := range oldShards {
 						oldShards[i] = oldShards[i][1:]
 					}
+					oldHashes = oldHashes[1:]
 					overlap -= int64(ss.NumSegments)
 				} else {
 					// trim the beginning of this chunk
-					delta := ss.NumSegments - uint32(overlap)
 					for i := range oldShards {
-						oldShards[i][0].SegmentIndex += delta
-						oldShards[i][0].NumSegments -= delta
+						oldShards[i][0].SegmentIndex += uint32(overlap)
+						oldShards[i][0].NumSegments -= uint32(overlap)
 					}
+					oldHashes[0] = crypto.Hash{}
 					break
 				}
 			}
@@ -139,16 +208,26 @@ func (f *openMetaFile) commitPendingSlices(sectors map[hostdb.HostPublicKey]*ren
 		// consume an old slice
 		case len(oldShards[0]) > 0:
 			numSegments := int64(oldShards[0][0].NumSegments)
-			for i := range oldShards {
-				newShards[i] = append(newShards[i], oldShards[i][0])
-				oldShards[i] = oldShards[i][1:]
-			}
-			// truncate if we would overlap a pending chunk
 			if len(pending) > 0 && offset+numSegments > pending[0].offset {
+				// split the slice at the pending chunk; the remainder stays
+				// in oldShards and is trimmed when the chunk is consumed
 				numSegments = pending[0].offset - offset
-				for i := range newShards {
-					newShards[i][len(newShards[i])-1].NumSegments = uint32(numSegments)
+				for i := range oldShards {
+					ss := oldShards[i][0]
+					ss.NumSegments = uint32(numSegments)
+					newShards[i] = append(newShards[i], ss)
+					oldShards[i][0].SegmentIndex += uint32(numSegments)
+					oldShards[i][0].NumSegments -= uint32(numSegments)
 				}
+				newHashes = append(newHashes, crypto.Hash{})
+				oldHashes[0] = crypto.Hash{}
+			} else {
+				for i := range oldShards {
+					newShards[i] = append(newShards[i], oldShards[i][0])
+					oldShards[i] = oldShards[i][1:]
+				}
+				newHashes = append(newHashes, oldHashes[0])
+				oldHashes = oldHashes[1:]
 			}
 			offset += numSegments
 
@@ -158,7 +237,12 @@ func (f *openMetaFile) commitPendingSlices(sectors map[hostdb.HostPublicKey]*ren
 	}
 
 	f.m.Shards = newShards
+	f.m.ChunkHashes = newHashes
 	f.m.Filesize = f.filesize()
+	f.m.FileHash = crypto.Hash{}
+	if f.fileHash != nil {
+		f.fileHash.Sum(f.m.FileHash[:0])
+	}
 }
 
 func (fs *PseudoFS) commitChanges(f *openMetaFile) error {
@@ -227,34 +311,70 @@ func (fs *PseudoFS) fillSectors(f *openMetaFile) error {
 			}
 			i++
 		}
-		// encode the chunk
-		for i, hostKey := range f.m.Hosts {
-			// map lookup guaranteed to succeed by earlier check
-			shards[i] = fs.sectors[hostKey].SliceForAppend()
-		}
-		f.m.ErasureCode().Encode(pw.data, shards)
-
-		// append the shards to each sector
-		pc := pendingChunk{
-			offset: pw.offset / f.m.MinChunkSize(),
-			length: int64(len(shards[0])),
-		}
-		for shardIndex, hostKey := range f.m.Hosts {
-			pc.sliceIndex = fs.sectors[hostKey].Append(shards[shardIndex], f.m.MasterKey, renter.RandomNonce())
-			// TODO: may need a separate sliceIndex for each sector...
+		// encode the data as one or more chunks, splitting it wherever a
+		// host's sector is full
+		for offset, data := pw.offset, pw.data; len(data) > 0; {
+			n := int64(len(data))
+			for i, hostKey := range f.m.Hosts {
+				// map lookup guaranteed to succeed by earlier check
+				sectorIndex := fs.sectorFor(hostKey)
+				sb := fs.sectors[hostKey][sectorIndex]
+				if rem := int64(sb.Remaining()/merkle.SegmentSize) * f.m.MinChunkSize(); rem < n {
+					n = rem
+				}
+				shards[i] = sb.SliceForAppend()
+			}
+			chunk := data[:n]
+			f.m.ErasureCode().Encode(chunk, shards)
+
+			// append the shards to each sector
+			pc := pendingChunk{
+				offset: offset / f.m.MinChunkSize(),
+				length: int64(len(shards[0])) / merkle.SegmentSize,
+				slices: make([]sliceLoc, len(f.m.Hosts)),
+				hash:   renter.ChunkHash(chunk, int64(len(shards[0]))*int64(f.m.MinShards)),
+			}
+			for shardIndex, hostKey := range f.m.Hosts {
+				sectorIndex := fs.sectorFor(hostKey)
+				pc.slices[shardIndex] = sliceLoc{
+					sectorIndex: sectorIndex,
+					sliceIndex:  fs.sectors[hostKey][sectorIndex].Append(shards[shardIndex], f.m.MasterKey, renter.RandomNonce()),
+				}
+			}
+			f.pendingChunks = append(f.pendingChunks, pc)
+			offset += n
+			data = data[n:]
 		}
-		f.pendingChunks = append(f.pendingChunks, pc)
 	}
 
 	return nil
 }
 
+// sectorFor returns the index of the first of the host's SectorBuilders with
+// room for at least one segment, adding a new SectorBuilder if necessary.
+// maxWriteSize ensures that no more than proto.MaxAppendBatch SectorBuilders
+// are needed.
+func (fs *PseudoFS) sectorFor(hostKey hostdb.HostPublicKey) int {
+	for i, sb := range fs.sectors[hostKey] {
+		if sb.Remaining() >= merkle.SegmentSize {
+			return i
+		}
+	}
+	if len(fs.sectors[hostKey]) >= proto.MaxAppendBatch {
+		panic("developer error: pending writes exceed maximum batch size")
+	}
+	fs.sectors[hostKey] = append(fs.sectors[hostKey], new(renter.SectorBuilder))
+	return len(fs.sectors[hostKey]) - 1
+}
+
 // flushSectors uploads any non-empty sectors to their respective hosts, and
 // updates any metafiles with pending changes.
 func (fs *PseudoFS) flushSectors() error {
 	// reset sectors
-	for _, sb := range fs.sectors {
-		sb.Reset()
+	for _, sectors := range fs.sectors {
+		for _, sb := range sectors {
+			sb.Reset()
+		}
 	}
 
 	// construct sectors by concatenating uncommitted writes in all files
@@ -264,30 +384,38 @@ func (fs *PseudoFS) flushSectors() error {
 		}
 	}
 
-	// upload each sector in parallel
+	// upload each host's sectors in parallel; maxWriteSize ensures that they
+	// fit in a single batch, and thus a single Write RPC
 	errChan := make(chan *HostError)
 	var numHosts int
-	for hostKey, sb := range fs.sectors {
-		if sb.Len() == 0 {
+	for hostKey, sectors := range fs.sectors {
+		var numSectors int
+		for numSectors < len(sectors) && sectors[numSectors].Len() > 0 {
+			numSectors++
+		}
+		if numSectors == 0 {
 			continue
 		}
 		numHosts++
-		go func(hostKey hostdb.HostPublicKey, sb *renter.SectorBuilder) {
-			sector := sb.Finish()
-			h, err := fs.hosts.acquire(hostKey)
-			if err != nil {
-				errChan <- &HostError{hostKey, err}
+		go func(hostKey hostdb.HostPublicKey, sectors []*renter.SectorBuilder) {
+			var roots []crypto.Hash
+			err := fs.hosts.do(hostKey, func(h *proto.Session) (err error) {
+				var i int
+				roots, err = h.AppendMany(len(sectors), func() *[renterhost.SectorSize]byte {
+					i++
+					return sectors[i-1].Finish()
+				})
 				return
-			}
-			root, err := h.Append(sector)
-			fs.hosts.release(hostKey)
+			})
 			if err != nil {
 				errChan <- &HostError{hostKey, err}
 				return
 			}
-			sb.SetMerkleRoot(root)
+			for i, sb := range sectors {
+				sb.SetMerkleRoot(roots[i])
+			}
 			errChan <- nil
-		}(hostKey, sb)
+		}(hostKey, sectors[:numSectors])
 	}
 	var errs HostErrorSet
 	for i := 0; i < numHosts; i++ {
@@ -394,10 +522,84 @@ func (fs *PseudoFS) fileReadAt(f *openMetaFile, p []byte, off int64) (int, error
 	if (off+int64(len(p)))%f.m.MinChunkSize() != 0 {
 		end += merkle.SegmentSize
 	}
-	offset, length := start, end-start
+	// if any of the chunks overlapping [start, end) has an integrity hash,
+	// download them in full so that they can be verified
+	firstChunk, lastChunk, verify := -1, -1, false
+	var chunkStart, chunkEnd, segs int64
+	for i, ss := range f.m.Shards[0] {
+		if segs < end/merkle.SegmentSize && start/merkle.SegmentSize < segs+int64(ss.NumSegments) {
+			if firstChunk == -1 {
+				firstChunk, chunkStart = i, segs
+			}
+			lastChunk, chunkEnd = i, segs+int64(ss.NumSegments)
+			verify = verify || (i < len(f.m.ChunkHashes) && f.m.ChunkHashes[i] != crypto.Hash{})
+		}
+		segs += int64(ss.NumSegments)
+	}
+	if verify {
+		start, end = chunkStart*merkle.SegmentSize, chunkEnd*merkle.SegmentSize
+	}
+
+	// recover data shards directly into p, or, if we are verifying, recover
+	// the full chunks first
+	skip := int(off - (start/merkle.SegmentSize)*f.m.MinChunkSize())
+	if !verify {
+		shards, err := fs.downloadShards(f, start, end-start)
+		if err != nil {
+			return 0, err
+		}
+		err = f.m.ErasureCode().Recover(bytes.NewBuffer(p[:0]), shards, skip, len(p))
+		if err != nil {
+			return 0, errors.Wrap(err, "could not recover chunk")
+		}
+	} else {
+		chunks := f.m.Shards[0][firstChunk : lastChunk+1]
+		buf, ok := f.verified.lookup(chunks, f.m.MinChunkSize())
+		if !ok {
+			shards, err := fs.downloadShards(f, start, end-start)
+			if err != nil {
+				return 0, err
+			}
+			buf = make([]byte, (end-start)*int64(f.m.MinShards))
+			err = f.m.ErasureCode().Recover(bytes.NewBuffer(buf[:0]), shards, 0, len(buf))
+			if err != nil {
+				return 0, errors.Wrap(err, "could not recover chunk")
+			}
+			for i, rem := firstChunk, buf; len(rem) > 0; i++ {
+				chunkSize := int64(f.m.Shards[0][i].NumSegments) * f.m.MinChunkSize()
+				if err := f.m.VerifyChunk(i, rem[:chunkSize]); err != nil {
+					return 0, err
+				}
+				rem = rem[chunkSize:]
+			}
+			f.verified.store(chunks, buf)
+		}
+		copy(p, buf[skip:])
+	}
+
+	// apply any pending writes
+	//
+	// TODO: do this *before* downloading, and only download what we don't have
+	for _, pw := range f.pendingWrites {
+		if off <= pw.offset && pw.offset <= off+int64(len(p)) {
+			copy(p[pw.offset-off:], pw.data)
+		} else if off <= pw.end() && pw.end() <= off+int64(len(p)) {
+			copy(p, pw.data[off-pw.offset:])
+		}
+	}
+
+	if partial {
+		return lenp, io.EOF
+	}
+	return lenp, nil
+}
 
-	// download shards in parallel, stopping when we have any f.m.MinShards of
-	// them
+// downloadShards downloads the segments [offset, offset+length) of each of f's
+// shards (as needed to recover the data), returning them. Missing shards have
+// length 0.
+func (fs *PseudoFS) downloadShards(f *openMetaFile, offset, length int64) ([][]byte, error) {
+	// download shards in parallel, stopping when we have enough of them to
+	// recover the data (usually any f.m.MinShards)
 	shards := make([][]byte, len(f.m.Hosts))
 	for i := range shards {
 		shards[i] = make([]byte, 0, length)
@@ -406,97 +608,104 @@ func (fs *PseudoFS) fileReadAt(f *openMetaFile, p []byte, off int64) (int, error
 		shardIndex int
 		block      bool // wait to acquire
 	}
-	reqChan := make(chan req, f.m.MinShards)
-	respChan := make(chan *HostError, f.m.MinShards)
+	type resp struct {
+		shardIndex int
+		err        *HostError
+	}
+	respChan := make(chan resp, len(f.m.Hosts))
 	reqQueue := make([]req, len(f.m.Hosts))
 	// initialize queue in random order
 	for i, shardIndex := range frand.Perm(len(reqQueue)) {
 		reqQueue[i] = req{shardIndex, false}
 	}
-	for len(reqQueue) > len(f.m.Hosts)-f.m.MinShards {
-		go func() {
-			for req := range reqChan {
-				hostKey := f.m.Hosts[req.shardIndex]
-				s, err := fs.hosts.tryAcquire(hostKey)
-				if err == errHostAcquired && req.block {
-					s, err = fs.hosts.acquire(hostKey)
-				}
-				if err != nil {
-					respChan <- &HostError{hostKey, err}
-					continue
-				}
-				buf := bytes.NewBuffer(shards[req.shardIndex])
-				err = (&renter.ShardDownloader{
-					Downloader: s,
-					Key:        f.m.MasterKey,
-					Slices:     f.m.Shards[req.shardIndex],
-				}).CopySection(buf, offset, length)
-				fs.hosts.release(hostKey)
-				if err != nil {
-					respChan <- &HostError{hostKey, err}
-					continue
-				}
-				shards[req.shardIndex] = buf.Bytes()
-				respChan <- nil
+	download := func(req req) {
+		hostKey := f.m.Hosts[req.shardIndex]
+		s, err := fs.hosts.tryAcquire(hostKey)
+		if err == errHostAcquired && req.block {
+			s, err = fs.hosts.acquire(hostKey)
+		}
+		if err != nil {
+			respChan <- resp{req.shardIndex, &HostError{hostKey, err}}
+			return
+		}
+		buf := bytes.NewBuffer(shards[req.shardIndex])
+		err = (&renter.ShardDownloader{
+			Downloader: s,
+			Key:        f.m.MasterKey,
+			Slices:     f.m.Shards[req.shardIndex],
+		}).CopySection(buf, offset, length)
+		fs.hosts.releaseErr(hostKey, err)
+		if err != nil {
+			respChan <- resp{req.shardIndex, &HostError{hostKey, err}}
+			return
+		}
+		shards[req.shardIndex] = buf.Bytes()
+		respChan <- resp{req.shardIndex, nil}
+	}
+	// keep just enough downloads in flight that, if they all succeed, the
+	// data can be recovered
+	have := make([]bool, len(f.m.Hosts))
+	pending := make([]bool, len(f.m.Hosts))
+	var numPending int
+	fill := func() {
+		for len(reqQueue) > 0 {
+			haveOrPending := make([]bool, len(have))
+			for i := range have {
+				haveOrPending[i] = have[i] || pending[i]
 			}
-		}()
-		reqChan <- reqQueue[0]
-		reqQueue = reqQueue[1:]
+			if f.m.CanRecover(haveOrPending) {
+				return
+			}
+			pending[reqQueue[0].shardIndex] = true
+			numPending++
+			go download(reqQueue[0])
+			reqQueue = reqQueue[1:]
+		}
 	}
+	fill()
 
 	var goodShards int
 	var errs HostErrorSet
-	for goodShards < f.m.MinShards && goodShards+len(errs) < len(f.m.Hosts) {
-		err := <-respChan
-		if err == nil {
+	retried := make(map[int]bool)
+	for !f.m.CanRecover(have) && numPending > 0 {
+		r := <-respChan
+		pending[r.shardIndex] = false
+		numPending--
+		if err := r.err; err == nil {
+			have[r.shardIndex] = true
 			goodShards++
+		} else if err.Err == errHostAcquired {
+			// host could not be acquired without blocking; add it to the back
+			// of the queue, but next time, block
+			reqQueue = append(reqQueue, req{
+				shardIndex: r.shardIndex,
+				block:      true,
+			})
+		} else if i := r.shardIndex; proto.Classify(err.Err).Temporary() && !retried[i] {
+			// the failure may be transient; try this host once more,
+			// after the others
+			retried[i] = true
+			reqQueue = append(reqQueue, req{
+				shardIndex: i,
+				block:      true,
+			})
 		} else {
-			if err.Err == errHostAcquired {
-				// host could not be acquired without blocking; add it to the back
-				// of the queue, but next time, block
-				reqQueue = append(reqQueue, req{
-					shardIndex: f.m.HostIndex(err.HostKey),
-					block:      true,
-				})
-			} else {
-				// downloading from this host failed; don't try it again
-				errs = append(errs, err)
-			}
-			// try the next host in the queue
-			if len(reqQueue) > 0 {
-				reqChan <- reqQueue[0]
-				reqQueue = reqQueue[1:]
-			}
+			// downloading from this host failed; don't try it again
+			errs = append(errs, err)
 		}
+		// try the next host(s) in the queue, if necessary
+		fill()
 	}
-	close(reqChan)
-	if goodShards < f.m.MinShards {
-		return 0, errors.Wrapf(errs, "too many hosts did not supply their shard (needed %v, got %v)",
-			f.m.MinShards, goodShards)
-	}
-
-	// recover data shards directly into p
-	skip := int(off % f.m.MinChunkSize())
-	err := f.m.ErasureCode().Recover(bytes.NewBuffer(p[:0]), shards, skip, len(p))
-	if err != nil {
-		return 0, errors.Wrap(err, "could not recover chunk")
+	// wait for any remaining downloads; this only occurs if the erasure code
+	// is a renter.LocalRepairer
+	for ; numPending > 0; numPending-- {
+		<-respChan
 	}
-
-	// apply any pending writes
-	//
-	// TODO: do this *before* downloading, and only download what we don't have
-	for _, pw := range f.pendingWrites {
-		if off <= pw.offset && pw.offset <= off+int64(len(p)) {
-			copy(p[pw.offset-off:], pw.data)
-		} else if off <= pw.end() && pw.end() <= off+int64(len(p)) {
-			copy(p, pw.data[off-pw.offset:])
-		}
-	}
-
-	if partial {
-		return lenp, io.EOF
+	if !f.m.CanRecover(have) {
+		return nil, errors.Wrapf(errs, "too many hosts did not supply their shard (needed %v, got %v)",
+			f.m.MinShards, goodShards)
 	}
-	return lenp, nil
+	return shards, nil
 }
 
 func (fs *PseudoFS) maxWriteSize(f *openMetaFile, off int64, n int64) int64 {
@@ -509,9 +718,10 @@ func (fs *PseudoFS) maxWriteSize(f *openMetaFile, off int64, n int64) int64 {
 			}
 		}
 	}
-	var maxRem int64
+	// each host's pending data must fit in a single batch of sectors
+	maxRem := int64(proto.MaxAppendBatch * renterhost.SectorSize)
 	for _, hostKey := range f.m.Hosts {
-		if rem := renterhost.SectorSize - sectorSizes[hostKey]; rem > maxRem {
+		if rem := proto.MaxAppendBatch*renterhost.SectorSize - sectorSizes[hostKey]; rem < maxRem {
 			maxRem = rem
 		}
 	}
@@ -529,13 +739,20 @@ func (fs *PseudoFS) maxWriteSize(f *openMetaFile, off int64, n int64) int64 {
 }
 
 func (fs *PseudoFS) fileWriteAt(f *openMetaFile, p []byte, off int64) (int, error) {
+	if off != f.filesize() {
+		f.fileHash = nil
+	}
 	lenp := len(p)
 	for len(p) > 0 {
 		if n := fs.maxWriteSize(f, off, int64(len(p))); n <= 0 {
 			if err := fs.flushSectors(); err != nil {
+				f.fileHash = nil
 				return 0, err
 			}
 		} else {
+			if f.fileHash != nil {
+				f.fileHash.Write(p[:n])
+			}
 			f.pendingWrites = mergePendingWrites(f.pendingWrites, pendingWrite{
 				data:   append([]byte(nil), p[:n]...),
 				offset: off,
@@ -567,9 +784,13 @@ func (fs *PseudoFS) fileTruncate(f *openMetaFile, size int64) error {
 	}
 	f.pendingWrites = newPending
 
+	if size < f.filesize() {
+		f.fileHash = nil
+	}
 	if size < f.m.Filesize {
 		f.m.Filesize = size
 		// update shards
+		var cut bool
 		for shardIndex, slices := range f.m.Shards {
 			var n int64
 			for i, s := range slices {
@@ -582,6 +803,7 @@ func (fs *PseudoFS) fileTruncate(f *openMetaFile, size int64) error {
 					} else {
 						slices[i] = s
 						slices = slices[:i+1]
+						cut = true
 					}
 					break
 				}
@@ -589,6 +811,16 @@ func (fs *PseudoFS) fileTruncate(f *openMetaFile, size int64) error {
 			}
 			f.m.Shards[shardIndex] = slices
 		}
+		// update hashes; if the final chunk was cut short, it no longer
+		// matches its hash
+		n := len(f.m.Shards[0])
+		if n < len(f.m.ChunkHashes) {
+			f.m.ChunkHashes = f.m.ChunkHashes[:n]
+		}
+		if cut && n <= len(f.m.ChunkHashes) {
+			f.m.ChunkHashes[n-1] = crypto.Hash{}
+		}
+		f.m.FileHash = crypto.Hash{}
 	}
 
 	f.m.ModTime = time.Now()
@@ -629,7 +861,10 @@ func (fs *PseudoFS) fileFree(f *openMetaFile) error {
 		f.m.Shards[shardIndex] = nil
 	}
 
+	f.m.ChunkHashes = nil
 	f.m.Filesize = 0
+	f.m.FileHash = crypto.Hash{}
+	f.fileHash, _ = blake2b.New256(nil)
 	f.offset = 0
 	f.m.ModTime = time.Now()
 	return nil
@@ -7,12 +7,14 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/pkg/errors"
 	"gitlab.com/NebulousLabs/Sia/crypto"
+	"golang.org/x/crypto/blake2b"
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/renter"
 )
@@ -24,6 +26,10 @@ const metafileExt = ".usa"
 // descriptor.
 var ErrInvalidFileDescriptor = errors.New("invalid file descriptor")
 
+// ErrNoAttribute is returned when a file does not have the requested extended
+// attribute.
+var ErrNoAttribute = errors.New("no such attribute")
+
 // helper type to implement os.FileInfo for metafiles
 type pseudoFileInfo struct {
 	name string
@@ -45,7 +51,7 @@ type PseudoFS struct {
 	files          map[int]*openMetaFile
 	dirs           map[int]*os.File
 	hosts          *HostSet
-	sectors        map[hostdb.HostPublicKey]*renter.SectorBuilder
+	sectors        map[hostdb.HostPublicKey][]*renter.SectorBuilder
 	lastCommitTime time.Time
 	mu             sync.RWMutex
 }
@@ -93,6 +99,128 @@ func (fs *PseudoFS) Chmod(name string, mode os.FileMode) error {
 	return nil
 }
 
+// attributes returns the attributes of the named file.
+func (fs *PseudoFS) attributes(name string) (map[string][]byte, error) {
+	fs.mu.RLock()
+	for _, of := range fs.files {
+		if of.name == name {
+			attrs := of.m.Attributes
+			fs.mu.RUnlock()
+			return attrs, nil
+		}
+	}
+	fs.mu.RUnlock()
+
+	path := fs.path(name)
+	if isDir(path) {
+		return nil, ErrDirectory
+	}
+	index, err := renter.ReadMetaIndex(path + metafileExt)
+	if err != nil {
+		return nil, err
+	}
+	return index.Attributes, nil
+}
+
+// modifyAttributes calls fn on the attributes of the named file, and saves
+// the result.
+func (fs *PseudoFS) modifyAttributes(name string, fn func(attrs map[string][]byte) error) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	path := fs.path(name)
+	if isDir(path) {
+		return ErrDirectory
+	}
+	path += metafileExt
+
+	update := func(m *renter.MetaFile) error {
+		attrs := make(map[string][]byte, len(m.Attributes)+1)
+		for k, v := range m.Attributes {
+			attrs[k] = v
+		}
+		if err := fn(attrs); err != nil {
+			return err
+		}
+		m.Attributes = attrs
+		// attributes are not supported by older metafile versions
+		if m.Version < renter.MetaFileVersion {
+			m.Version = renter.MetaFileVersion
+		}
+		m.ModTime = time.Now()
+		return nil
+	}
+
+	// check for open file
+	for _, of := range fs.files {
+		if of.name == name {
+			return update(of.m)
+		}
+	}
+
+	m, err := renter.ReadMetaFile(path)
+	if err != nil {
+		return err
+	} else if err := update(m); err != nil {
+		return err
+	}
+	return renter.WriteMetaFile(path, m)
+}
+
+// GetXattr returns the value of the named file's extended attribute attr. If
+// the file does not have the attribute, GetXattr returns ErrNoAttribute.
+func (fs *PseudoFS) GetXattr(name, attr string) ([]byte, error) {
+	attrs, err := fs.attributes(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "getxattr %v", name)
+	}
+	val, ok := attrs[attr]
+	if !ok {
+		return nil, errors.Wrapf(ErrNoAttribute, "getxattr %v", name)
+	}
+	return append([]byte(nil), val...), nil
+}
+
+// SetXattr sets the value of the named file's extended attribute attr,
+// creating the attribute if necessary.
+func (fs *PseudoFS) SetXattr(name, attr string, val []byte) error {
+	if attr == "" {
+		return errors.Errorf("setxattr %v: attribute name must not be empty", name)
+	}
+	err := fs.modifyAttributes(name, func(attrs map[string][]byte) error {
+		attrs[attr] = append([]byte(nil), val...)
+		return nil
+	})
+	return errors.Wrapf(err, "setxattr %v", name)
+}
+
+// RemoveXattr removes the named file's extended attribute attr. If the file
+// does not have the attribute, RemoveXattr returns ErrNoAttribute.
+func (fs *PseudoFS) RemoveXattr(name, attr string) error {
+	err := fs.modifyAttributes(name, func(attrs map[string][]byte) error {
+		if _, ok := attrs[attr]; !ok {
+			return ErrNoAttribute
+		}
+		delete(attrs, attr)
+		return nil
+	})
+	return errors.Wrapf(err, "removexattr %v", name)
+}
+
+// ListXattr returns the names of the named file's extended attributes, in
+// sorted order.
+func (fs *PseudoFS) ListXattr(name string) ([]string, error) {
+	attrs, err := fs.attributes(name)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listxattr %v", name)
+	}
+	names := make([]string, 0, len(attrs))
+	for attr := range attrs {
+		names = append(names, attr)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
 // Create creates the named file with the specified redundancy and mode 0666
 // (before umask), truncating it if it already exists. The returned file has
 // mode O_RDWR.
@@ -223,6 +351,9 @@ func (fs *PseudoFS) OpenFile(name string, flag int, perm os.FileMode, minShards
 		name: name,
 		m:    m,
 	}
+	if m.Filesize == 0 {
+		of.fileHash, _ = blake2b.New256(nil)
+	}
 	if flag&os.O_APPEND == os.O_APPEND {
 		of.offset = m.Filesize
 	}
@@ -470,9 +601,9 @@ func (fs *PseudoFS) Close() error {
 // NewFileSystem returns a new pseudo-filesystem rooted at root, which must be a
 // directory containing only metafiles and other directories.
 func NewFileSystem(root string, hosts *HostSet) *PseudoFS {
-	sectors := make(map[hostdb.HostPublicKey]*renter.SectorBuilder)
+	sectors := make(map[hostdb.HostPublicKey][]*renter.SectorBuilder)
 	for hostKey := range hosts.sessions {
-		sectors[hostKey] = new(renter.SectorBuilder)
+		sectors[hostKey] = nil
 	}
 	return &PseudoFS{
 		root:           root,
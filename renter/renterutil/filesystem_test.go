@@ -5,6 +5,7 @@ import (
 	"crypto/ed25519"
 	"encoding/hex"
 	"io"
+	"io/ioutil"
 	"os"
 	"testing"
 
@@ -12,6 +13,8 @@ import (
 	"gitlab.com/NebulousLabs/Sia/crypto"
 	"gitlab.com/NebulousLabs/Sia/modules"
 	"gitlab.com/NebulousLabs/Sia/types"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/curve25519"
 	"lukechampine.com/frand"
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/internal/ghost"
@@ -127,6 +130,56 @@ func TestHostErrorSet(t *testing.T) {
 	}
 }
 
+func TestHostSetPriceLimits(t *testing.T) {
+	fs, cleanup := createTestingFS(t, 3)
+	defer cleanup()
+	hs := fs.hosts
+
+	// setting limits while Sessions are being initiated should not race
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			hs.SetPriceLimits(proto.PriceLimits{BaseRPCPrice: types.NewCurrency64(uint64(i + 1))})
+		}
+	}()
+	for hostKey := range hs.sessions {
+		if err := hs.do(hostKey, func(*proto.Session) error { return nil }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	<-done
+}
+
+func TestHostSetForgetSettings(t *testing.T) {
+	host, c := createHostWithContract(t)
+	defer host.Close()
+	hs := NewHostSet(testHKR{host.PublicKey(): host.Settings().NetAddress}, 0)
+	defer hs.Close()
+	hs.AddHost(c)
+	// always request fresh settings when reconnecting
+	hs.SetSettingsCache(hostdb.NewSettingsCache(0))
+	noop := func(*proto.Session) error { return nil }
+
+	host.SetSettingsRevision(5)
+	if err := hs.do(host.PublicKey(), noop); err != nil {
+		t.Fatal(err)
+	}
+
+	// simulate the host restarting with an older settings revision
+	host.SetSettingsRevision(1)
+	hs.sessions[host.PublicKey()].s.Close()
+	if err := hs.do(host.PublicKey(), noop); err == nil {
+		t.Fatal("expected rollback to be detected")
+	} else if _, ok := errors.Cause(err).(*hostdb.SettingsRollbackError); !ok {
+		t.Fatal("expected SettingsRollbackError, got", err)
+	}
+	hs.ForgetSettings(host.PublicKey())
+	if err := hs.do(host.PublicKey(), noop); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestFileSystemBasic(t *testing.T) {
 	if testing.Short() {
 		t.SkipNow()
@@ -534,6 +587,75 @@ func TestFileSystemRandomAccess(t *testing.T) {
 	}
 }
 
+func TestFileSystemOverwrite(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 3)
+	defer cleanup()
+
+	// create metafile
+	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	pf, err := fs.Create(metaName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// write exactly one full sector to each host
+	data := frand.Bytes(renterhost.SectorSize)
+	if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	oldMeta := *fs.files[pf.fd].m
+	oldMeta.Shards = make([][]renter.SectorSlice, len(fs.files[pf.fd].m.Shards))
+	for i := range oldMeta.Shards {
+		oldMeta.Shards[i] = append([]renter.SectorSlice(nil), fs.files[pf.fd].m.Shards[i]...)
+	}
+
+	// overwrite a small, unaligned range; the existing sectors must not be
+	// modified, since other metafiles (e.g. copies of this one) may reference
+	// them
+	copy(data[1000:], "foo bar baz")
+	if _, err := pf.WriteAt([]byte("foo bar baz"), 1000); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	oldPath := fs.path(metaName) + "-old" + metafileExt
+	defer os.Remove(oldPath)
+	if err := renter.WriteMetaFile(oldPath, &oldMeta); err != nil {
+		t.Fatal(err)
+	}
+	oldFile, err := fs.Open(metaName + "-old")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer oldFile.Close()
+	if oldData, err := ioutil.ReadAll(oldFile); err != nil {
+		t.Fatal(err)
+	} else if bytes.Equal(oldData, data) || !bytes.Equal(oldData[:1000], data[:1000]) || !bytes.Equal(oldData[1011:], data[1011:]) {
+		t.Fatal("original sectors were modified")
+	}
+
+	// check contents
+	p := make([]byte, len(data))
+	if _, err := pf.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(p, data) {
+		t.Error("contents do not match data")
+	}
+
+	// close and cleanup
+	if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.Remove(metaName); err != nil {
+		t.Fatal(err)
+	}
+}
+
 // https://github.com/lukechampine/us/issues/50
 func TestMisalignedWrite(t *testing.T) {
 	fs, cleanup := createTestingFS(t, 1)
@@ -576,6 +698,19 @@ func TestFileSystemDelete(t *testing.T) {
 		}
 		t.Fatal("couldn't connect to any hosts")
 	}
+	revisionNumbers := func() map[hostdb.HostPublicKey]uint64 {
+		t.Helper()
+		revs := make(map[hostdb.HostPublicKey]uint64)
+		for hostKey := range fs.hosts.sessions {
+			h, err := fs.hosts.acquire(hostKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			revs[hostKey] = h.Revision().Revision.NewRevisionNumber
+			fs.hosts.release(hostKey)
+		}
+		return revs
+	}
 
 	// create metafile
 	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
@@ -585,13 +720,21 @@ func TestFileSystemDelete(t *testing.T) {
 	}
 	defer pf.Close()
 
-	// write one full sector and one partial sector
-	if _, err := pf.Write(make([]byte, renterhost.SectorSize+1024)); err != nil {
+	// write one full batch of sectors and one partial sector; the batch should
+	// be uploaded to each host in a single Write RPC
+	const batchSize = proto.MaxAppendBatch * renterhost.SectorSize
+	oldRevs := revisionNumbers()
+	if _, err := pf.Write(make([]byte, batchSize+1024)); err != nil {
 		t.Fatal(err)
 	}
-	expectStoredSectors(1)
+	expectStoredSectors(proto.MaxAppendBatch)
+	for hostKey, rev := range revisionNumbers() {
+		if rev != oldRevs[hostKey]+1 {
+			t.Fatalf("expected 1 revision, got %v", rev-oldRevs[hostKey])
+		}
+	}
 
-	// Free the file; the full sector should be deleted, and the uncommitted
+	// Free the file; the full sectors should be deleted, and the uncommitted
 	// partial sector should be discarded
 	if err := pf.Free(); err != nil {
 		t.Fatal(err)
@@ -604,15 +747,16 @@ func TestFileSystemDelete(t *testing.T) {
 	}
 	expectStoredSectors(0)
 
-	// write another full sector and partial sector, but this time, flush the
+	// write another full batch and partial sector, but this time, flush the
 	// partial sector
-	if _, err := pf.Write(make([]byte, renterhost.SectorSize+1024)); err != nil {
+	if _, err := pf.Write(make([]byte, batchSize+1024)); err != nil {
 		t.Fatal(err)
 	} else if err := pf.Sync(); err != nil {
 		t.Fatal(err)
 	}
 
-	// Free the file; the full sector should be deleted, but not the partial sector.
+	// Free the file; the full sectors should be deleted, but not the partial
+	// sector.
 	if err := pf.Free(); err != nil {
 		t.Fatal(err)
 	}
@@ -754,6 +898,43 @@ func BenchmarkFileSystemRead(b *testing.B) {
 	}
 }
 
+func BenchmarkFileSystemReadSmall(b *testing.B) {
+	fs, cleanup := createTestingFS(b, 4)
+	defer cleanup()
+
+	// create metafile
+	metaName := b.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	pf, err := fs.Create(metaName, 2)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer pf.Close()
+	// upload initial data
+	data := make([]byte, renterhost.SectorSize)
+	if _, err := pf.Write(data); err != nil {
+		b.Fatal(err)
+	}
+	if err := pf.Sync(); err != nil {
+		b.Fatal(err)
+	}
+
+	// read the file sequentially in small increments; each verified chunk
+	// should only be downloaded once
+	buf := make([]byte, 4096)
+	b.ResetTimer()
+	b.SetBytes(int64(len(buf)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := pf.Read(buf); err == io.EOF {
+			if _, err := pf.Seek(0, io.SeekStart); err != nil {
+				b.Fatal(err)
+			}
+		} else if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func BenchmarkFileSystemReadAtP(b *testing.B) {
 	fs, cleanup := createTestingFS(b, 4)
 	defer cleanup()
@@ -784,3 +965,239 @@ func BenchmarkFileSystemReadAtP(b *testing.B) {
 		}
 	}
 }
+
+func TestFileSystemIntegrity(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 3)
+	defer cleanup()
+
+	// create metafile, writing two chunks; the first write is aligned to
+	// MinChunkSize, so it is not rewritten by the second
+	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	pf, err := fs.Create(metaName, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := frand.Bytes(2000)
+	for _, d := range [][]byte{data[:1024], data[1024:]} {
+		if _, err := pf.Write(d); err != nil {
+			t.Fatal(err)
+		} else if err := pf.Sync(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// metafile should contain a hash of each chunk, and of the whole file
+	metaPath := fs.path(metaName) + metafileExt
+	m, err := renter.ReadMetaFile(metaPath)
+	if err != nil {
+		t.Fatal(err)
+	} else if m.FileHash != blake2b.Sum256(data) {
+		t.Fatal("file hash does not match")
+	} else if len(m.ChunkHashes) != len(m.Shards[0]) || len(m.ChunkHashes) < 2 {
+		t.Fatal("wrong number of chunk hashes:", len(m.ChunkHashes))
+	}
+	for i, h := range m.ChunkHashes {
+		if h == (crypto.Hash{}) {
+			t.Fatal("missing hash for chunk", i)
+		}
+	}
+
+	// corrupt a hash; reads should fail
+	m.ChunkHashes[1][0] ^= 1
+	if err := renter.WriteMetaFile(metaPath, m); err != nil {
+		t.Fatal(err)
+	}
+	pf, err = fs.Open(metaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	if _, err := ioutil.ReadAll(pf); !errors.Is(err, renter.ErrIntegrityMismatch) {
+		t.Fatal("expected ErrIntegrityMismatch, got", err)
+	}
+	// data in other chunks can still be read
+	p := make([]byte, 100)
+	if _, err := pf.ReadAt(p, 0); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(p, data[:100]) {
+		t.Fatal("contents do not match data")
+	}
+
+	// migration should fail as well
+	pf.Seek(0, io.SeekStart)
+	err = NewMigrator(fs.hosts).AddFile(m, pf, func(*renter.MetaFile) error { return nil })
+	if !errors.Is(err, renter.ErrIntegrityMismatch) {
+		t.Fatal("expected ErrIntegrityMismatch, got", err)
+	}
+}
+
+func TestFileSystemShared(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	hosts := make([]*ghost.Host, 2)
+	hkr := make(testHKR)
+	hs := NewHostSet(hkr, 0)
+	for i := range hosts {
+		h, c := createHostWithContract(t)
+		defer h.Close()
+		hosts[i] = h
+		hkr[h.PublicKey()] = h.Settings().NetAddress
+		hs.AddHost(c)
+	}
+	fs := NewFileSystem(os.TempDir(), hs)
+	defer fs.Close()
+
+	// upload a file
+	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	pf, err := fs.Create(metaName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := frand.Bytes(1000)
+	if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	m, err := renter.ReadMetaFile(fs.path(metaName) + metafileExt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// share the file with a recipient, who imports it into their own
+	// filesystem
+	recipientPriv := frand.Entropy256()
+	recipientPub, err := curve25519.X25519(recipientPriv[:], curve25519.Basepoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var pub [32]byte
+	copy(pub[:], recipientPub)
+	sharedPath := fs.path(metaName) + ".shared"
+	defer os.Remove(sharedPath)
+	if err := renter.WriteSharedFile(sharedPath, m, pub); err != nil {
+		t.Fatal(err)
+	}
+	shared, err := renter.ReadSharedFile(sharedPath, recipientPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sharedName := metaName + "-imported"
+	defer os.Remove(fs.path(sharedName) + metafileExt)
+	if err := renter.WriteMetaFile(fs.path(sharedName)+metafileExt, shared); err != nil {
+		t.Fatal(err)
+	}
+
+	// the recipient has no contracts, so the hosts must offer free reads
+	freeSet := NewHostSet(hkr, 0)
+	for _, h := range hosts {
+		freeSet.AddFreeHost(h.PublicKey())
+	}
+	recipientFS := NewFileSystem(os.TempDir(), freeSet)
+	defer recipientFS.Close()
+	pf, err = recipientFS.Open(sharedName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ioutil.ReadAll(pf); err == nil {
+		t.Fatal("expected read to fail without free reads")
+	}
+	pf.Close()
+
+	for _, h := range hosts {
+		h.SetFreeReads(true)
+	}
+	pf, err = recipientFS.Open(sharedName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	if contents, err := ioutil.ReadAll(pf); err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(contents, data) {
+		t.Fatal("contents do not match data")
+	}
+}
+
+func TestFileSystemXattr(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	fs, cleanup := createTestingFS(t, 1)
+	defer cleanup()
+
+	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	defer os.Remove(fs.path(metaName) + metafileExt)
+	pf, err := fs.Create(metaName, 1)
+	if err != nil {
+		t.Fatal(err)
+	} else if _, err := pf.Write([]byte("hello, world!")); err != nil {
+		t.Fatal(err)
+	}
+
+	// set an attribute on the open file
+	if err := fs.SetXattr(metaName, "content-type", []byte("text/plain")); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// attributes should be readable from the index alone
+	index, err := renter.ReadMetaIndex(fs.path(metaName) + metafileExt)
+	if err != nil {
+		t.Fatal(err)
+	} else if string(index.Attributes["content-type"]) != "text/plain" {
+		t.Fatal("attribute was not saved:", index.Attributes)
+	}
+
+	// modify attributes of a file that is not open
+	fs = NewFileSystem(os.TempDir(), fs.hosts)
+	if err := fs.SetXattr(metaName, "owner", []byte("alice")); err != nil {
+		t.Fatal(err)
+	} else if err := fs.SetXattr(metaName, "", []byte("foo")); err == nil {
+		t.Fatal("expected empty attribute name to be rejected")
+	}
+	if names, err := fs.ListXattr(metaName); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 2 || names[0] != "content-type" || names[1] != "owner" {
+		t.Fatal("wrong attribute names:", names)
+	}
+	if val, err := fs.GetXattr(metaName, "owner"); err != nil {
+		t.Fatal(err)
+	} else if string(val) != "alice" {
+		t.Fatal("wrong attribute value:", string(val))
+	}
+	if err := fs.RemoveXattr(metaName, "owner"); err != nil {
+		t.Fatal(err)
+	} else if _, err := fs.GetXattr(metaName, "owner"); errors.Cause(err) != ErrNoAttribute {
+		t.Fatal("expected ErrNoAttribute, got", err)
+	} else if err := fs.RemoveXattr(metaName, "owner"); errors.Cause(err) != ErrNoAttribute {
+		t.Fatal("expected ErrNoAttribute, got", err)
+	}
+
+	// file contents should be unaffected
+	pf, err = fs.Open(metaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	if data, err := ioutil.ReadAll(pf); err != nil {
+		t.Fatal(err)
+	} else if string(data) != "hello, world!" {
+		t.Fatal("file contents were modified:", string(data))
+	}
+}
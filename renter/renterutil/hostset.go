@@ -77,9 +77,21 @@ func (mu *tryLock) Unlock() {
 type lockedHost struct {
 	reconnect func() error
 	s         *proto.Session
+	err       error // if set, the host can no longer be used
 	mu        tryLock
 }
 
+// unusable returns true if err indicates that a host, or its contract, can no
+// longer be used.
+func unusable(err error) bool {
+	switch proto.Classify(err).Category {
+	case proto.CategoryContractFinalized, proto.CategoryProofInvalid:
+		return true
+	default:
+		return false
+	}
+}
+
 // A HostSet is a collection of renter-host protocol sessions.
 type HostSet struct {
 	sessions      map[hostdb.HostPublicKey]*lockedHost
@@ -87,6 +99,13 @@ type HostSet struct {
 	currentHeight types.BlockHeight
 	lockTimeout   time.Duration
 	onConnect     func(s *proto.Session)
+	store         proto.ContractStore
+	settings      *hostdb.SettingsCache
+	limiter       *proto.RateLimiter
+
+	// limits may be set while Sessions are being initiated
+	limitsMu sync.Mutex
+	limits   proto.PriceLimits
 }
 
 // HasHost returns true if the specified host is in the set.
@@ -144,6 +163,37 @@ func (set *HostSet) release(host hostdb.HostPublicKey) {
 	lh.mu.Unlock()
 }
 
+// releaseErr is like release, but first examines err, which was returned by an
+// RPC on the host's Session. If err indicates that the host or its contract can
+// no longer be used, subsequent attempts to acquire the host fail immediately.
+func (set *HostSet) releaseErr(host hostdb.HostPublicKey, err error) {
+	lh := set.sessions[host]
+	if unusable(err) {
+		lh.err = err
+		lh.s.Close()
+	}
+	set.release(host)
+}
+
+// do acquires the specified host and calls fn with its Session. If fn fails
+// with a temporary error, such as a network failure, it is called once more,
+// on a new Session if necessary.
+func (set *HostSet) do(host hostdb.HostPublicKey, fn func(*proto.Session) error) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		var s *proto.Session
+		if s, err = set.acquire(host); err != nil {
+			return err
+		}
+		err = fn(s)
+		set.releaseErr(host, err)
+		if !proto.Classify(err).Temporary() {
+			break
+		}
+	}
+	return err
+}
+
 // SetLockTimeout sets the timeout used for all Lock RPCs in Sessions initiated
 // by the HostSet.
 func (set *HostSet) SetLockTimeout(timeout time.Duration) { set.lockTimeout = timeout }
@@ -151,12 +201,75 @@ func (set *HostSet) SetLockTimeout(timeout time.Duration) { set.lockTimeout = ti
 // SetOnConnect sets the function called on all newly-connected Sessions.
 func (set *HostSet) SetOnConnect(fn func(*proto.Session)) { set.onConnect = fn }
 
+// SetContractStore sets the ContractStore used by all Sessions initiated by the
+// HostSet.
+func (set *HostSet) SetContractStore(store proto.ContractStore) { set.store = store }
+
+// SetSettingsCache sets the SettingsCache used by all Sessions initiated by
+// the HostSet. Cached settings are reused when reconnecting to a host, rather
+// than requesting them again. By default, each HostSet has its own
+// SettingsCache.
+func (set *HostSet) SetSettingsCache(cache *hostdb.SettingsCache) { set.settings = cache }
+
+// ForgetSettings removes the specified host's settings from the HostSet's
+// SettingsCache, including its settings revision number. This allows the
+// HostSet to reconnect to a host that has rolled back its settings, e.g.
+// after being restored from a backup.
+func (set *HostSet) ForgetSettings(hostKey hostdb.HostPublicKey) {
+	if set.settings != nil {
+		set.settings.Forget(hostKey)
+	}
+}
+
+// SetPriceLimits sets the price limits of all Sessions initiated by the
+// HostSet. Sessions that are already connected are updated immediately.
+func (set *HostSet) SetPriceLimits(limits proto.PriceLimits) {
+	set.limitsMu.Lock()
+	set.limits = limits
+	set.limitsMu.Unlock()
+	// NOTE: a Session initiated concurrently may use the old limits, but it
+	// holds lh.mu while doing so, so it will be updated below
+	for _, lh := range set.sessions {
+		lh.mu.Lock()
+		if lh.s != nil {
+			lh.s.SetPriceLimits(limits)
+		}
+		lh.mu.Unlock()
+	}
+}
+
+// SetRateLimits limits the combined upload and download throughput of all
+// Sessions initiated by the HostSet, in bytes per second. A limit of zero
+// means that the corresponding direction is not limited. Sessions that are
+// already connected are affected immediately.
+func (set *HostSet) SetRateLimits(upload, download int64) {
+	set.limiter.SetLimits(upload, download)
+}
+
 // AddHost adds a host to the set for later use.
 func (set *HostSet) AddHost(c renter.Contract) {
+	set.addHost(c.HostKey, func(s *proto.Session) error {
+		return s.Lock(c.ID, c.RenterKey, set.lockTimeout)
+	})
+}
+
+// AddFreeHost adds a host to the set without a contract. Such hosts can only
+// be downloaded from, and only if they offer free reads; this allows files
+// shared by other renters to be downloaded without forming contracts.
+func (set *HostSet) AddFreeHost(hostKey hostdb.HostPublicKey) {
+	set.addHost(hostKey, nil)
+}
+
+// addHost adds a host to the set, calling lock (if non-nil) after each new
+// Session is initiated.
+func (set *HostSet) addHost(hostKey hostdb.HostPublicKey, lock func(*proto.Session) error) {
 	lh := new(lockedHost)
 	// lazy connection function
 	var lastSeen time.Time
 	lh.reconnect = func() error {
+		if lh.err != nil {
+			return lh.err
+		}
 		if lh.s != nil && !lh.s.IsClosed() {
 			// if it hasn't been long since the last reconnect, assume the
 			// connection is still open
@@ -180,28 +293,50 @@ func (set *HostSet) AddHost(c renter.Contract) {
 			// end (just in case) and fallthrough to the reconnection logic
 			lh.s.Close()
 		}
-		hostIP, err := set.hkr.ResolveHostKey(c.HostKey)
+		hostIP, err := set.hkr.ResolveHostKey(hostKey)
 		if err != nil {
 			return errors.Wrap(err, "could not resolve host key")
 		}
 		// create and lock the session manually so that we can use our custom
 		// lock timeout
-		lh.s, err = proto.NewUnlockedSession(hostIP, c.HostKey, set.currentHeight)
+		lh.s, err = proto.NewUnlockedSession(hostIP, hostKey, set.currentHeight)
 		if err != nil {
 			return err
 		}
-		if err := lh.s.Lock(c.ID, c.RenterKey, set.lockTimeout); err != nil {
+		if set.store != nil {
+			lh.s.SetContractStore(set.store)
+		}
+		set.limitsMu.Lock()
+		lh.s.SetPriceLimits(set.limits)
+		set.limitsMu.Unlock()
+		lh.s.SetSettingsCache(set.settings)
+		lh.s.AddRateLimiter(set.limiter)
+		if lock != nil {
+			if err := lock(lh.s); err != nil {
+				lh.s.Close()
+				if unusable(err) {
+					lh.err = err
+				}
+				return err
+			}
+		}
+		settings, err := lh.s.CachedSettings()
+		if err == nil && lock == nil && !settings.SupportsFreeReads() {
+			// the cached settings may predate the host offering free reads
+			settings, err = lh.s.Settings()
+		}
+		if err != nil {
 			lh.s.Close()
 			return err
-		} else if _, err := lh.s.Settings(); err != nil {
+		} else if lock == nil && !settings.SupportsFreeReads() {
 			lh.s.Close()
-			return err
+			return errors.New("host does not offer free reads")
 		}
 		set.onConnect(lh.s)
 		lastSeen = time.Now()
 		return nil
 	}
-	set.sessions[c.HostKey] = lh
+	set.sessions[hostKey] = lh
 }
 
 // NewHostSet creates an empty HostSet using the provided resolver and current
@@ -213,5 +348,7 @@ func NewHostSet(hkr renter.HostKeyResolver, currentHeight types.BlockHeight) *Ho
 		sessions:      make(map[hostdb.HostPublicKey]*lockedHost),
 		lockTimeout:   10 * time.Second,
 		onConnect:     func(*proto.Session) {},
+		settings:      hostdb.NewSettingsCache(time.Minute),
+		limiter:       proto.NewRateLimiter(0, 0),
 	}
 }
@@ -1,19 +1,22 @@
 package renterutil
 
 import (
-	"errors"
 	"io"
 	"io/ioutil"
 	"sync"
 	"time"
 
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"golang.org/x/crypto/blake2b"
 	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/merkle"
 	"lukechampine.com/us/renter"
+	"lukechampine.com/us/renter/proto"
 	"lukechampine.com/us/renterhost"
 )
 
-func replaceHosts(oldHosts []hostdb.HostPublicKey, hs *HostSet) []hostdb.HostPublicKey {
+func replaceHosts(oldHosts []hostdb.HostPublicKey, hs *HostSet, usable func(hostdb.HostPublicKey) bool) []hostdb.HostPublicKey {
 	isOld := func(h hostdb.HostPublicKey) bool {
 		for i := range oldHosts {
 			if oldHosts[i] == h {
@@ -25,9 +28,9 @@ func replaceHosts(oldHosts []hostdb.HostPublicKey, hs *HostSet) []hostdb.HostPub
 
 	r := append([]hostdb.HostPublicKey(nil), oldHosts...)
 	for host := range hs.sessions {
-		if !isOld(host) {
+		if !isOld(host) && usable(host) {
 			for i := range r {
-				if !hs.HasHost(r[i]) {
+				if !usable(r[i]) {
 					r[i] = host
 					break
 				}
@@ -39,17 +42,66 @@ func replaceHosts(oldHosts []hostdb.HostPublicKey, hs *HostSet) []hostdb.HostPub
 
 // A Migrator facilitates migrating metafiles from one set of hosts to another.
 type Migrator struct {
-	hosts   *HostSet
-	shards  map[hostdb.HostPublicKey]*renter.SectorBuilder
+	hosts          *HostSet
+	auditor        *renter.Auditor
+	maxFailureRate float64
+	// each host has up to proto.MaxAppendBatch sectors, which are uploaded
+	// together when the Migrator is flushed
+	shards  map[hostdb.HostPublicKey][]*renter.SectorBuilder
 	onFlush []func() error
 }
 
+// sectorFor returns a SectorBuilder for the specified host with at least n
+// bytes remaining, or nil if no such SectorBuilder is available.
+func (m *Migrator) sectorFor(hostKey hostdb.HostPublicKey, n int) *renter.SectorBuilder {
+	for _, s := range m.shards[hostKey] {
+		if s.Remaining() >= n {
+			return s
+		}
+	}
+	if len(m.shards[hostKey]) < proto.MaxAppendBatch {
+		s := new(renter.SectorBuilder)
+		m.shards[hostKey] = append(m.shards[hostKey], s)
+		return s
+	}
+	return nil
+}
+
+// usable returns true if data can be migrated to (or left on) the specified
+// host.
+func (m *Migrator) usable(hostKey hostdb.HostPublicKey) bool {
+	if !m.hosts.HasHost(hostKey) {
+		return false
+	}
+	return m.auditor == nil || m.auditor.Stats(hostKey).Healthy(m.maxFailureRate)
+}
+
+// SetAuditor sets the Auditor consulted by the Migrator. Hosts whose audit
+// failure rate exceeds maxFailureRate are treated as if they were absent from
+// the Migrator's HostSet: files stored on them are migrated elsewhere, and they
+// are not chosen as replacements.
+func (m *Migrator) SetAuditor(a *renter.Auditor, maxFailureRate float64) {
+	m.auditor = a
+	m.maxFailureRate = maxFailureRate
+}
+
+// hasRoom returns true if sectorFor would succeed. Unlike sectorFor, it does
+// not add a SectorBuilder.
+func (m *Migrator) hasRoom(hostKey hostdb.HostPublicKey, n int) bool {
+	for _, s := range m.shards[hostKey] {
+		if s.Remaining() >= n {
+			return true
+		}
+	}
+	return len(m.shards[hostKey]) < proto.MaxAppendBatch
+}
+
 func (m *Migrator) canFit(shardLen int, oldHosts, newHosts []hostdb.HostPublicKey) bool {
 	for i := range newHosts {
 		if oldHosts[i] == newHosts[i] {
 			continue // not uploading to this host
 		}
-		if m.shards[newHosts[i]].Remaining() < shardLen {
+		if !m.hasRoom(newHosts[i], shardLen) {
 			return false
 		}
 	}
@@ -57,9 +109,9 @@ func (m *Migrator) canFit(shardLen int, oldHosts, newHosts []hostdb.HostPublicKe
 }
 
 // NeedsMigrate returns true if at least one of the hosts of f is not present in
-// the Migrator's HostSet.
+// the Migrator's HostSet, or has failed too many audits.
 func (m *Migrator) NeedsMigrate(f *renter.MetaFile) bool {
-	newHosts := replaceHosts(f.Hosts, m.hosts)
+	newHosts := replaceHosts(f.Hosts, m.hosts, m.usable)
 	for i := range newHosts {
 		if newHosts[i] != f.Hosts[i] {
 			return true
@@ -72,8 +124,12 @@ func (m *Migrator) NeedsMigrate(f *renter.MetaFile) bool {
 // set. Since the Migrator buffers data internally, the migration may not be
 // complete until the Flush method has been called. onFinish is called on the
 // new metafile when the file has been fully migrated.
+//
+// If f contains integrity hashes, the data read from source is verified
+// against them, and AddFile returns an error wrapping
+// renter.ErrIntegrityMismatch if they do not match.
 func (m *Migrator) AddFile(f *renter.MetaFile, source io.Reader, onFinish func(*renter.MetaFile) error) error {
-	newHosts := replaceHosts(f.Hosts, m.hosts)
+	newHosts := replaceHosts(f.Hosts, m.hosts, m.usable)
 	newShards := make([][]renter.SectorSlice, len(newHosts))
 
 	chunk := make([]byte, f.MaxChunkSize())
@@ -81,8 +137,9 @@ func (m *Migrator) AddFile(f *renter.MetaFile, source io.Reader, onFinish func(*
 	for i := range shards {
 		shards[i] = make([]byte, 0, renterhost.SectorSize)
 	}
+	fileHash, _ := blake2b.New256(nil)
 	remaining := f.Filesize
-	for _, ss := range f.Shards[0] {
+	for chunkIndex, ss := range f.Shards[0] {
 		// read next chunk
 		chunkSize := int64(ss.NumSegments*merkle.SegmentSize) * int64(f.MinShards)
 		if chunkSize > remaining {
@@ -93,6 +150,11 @@ func (m *Migrator) AddFile(f *renter.MetaFile, source io.Reader, onFinish func(*
 			return err
 		}
 		remaining -= int64(n)
+		// verify
+		if err := f.VerifyChunk(chunkIndex, chunk[:n]); err != nil {
+			return err
+		}
+		fileHash.Write(chunk[:n])
 		// erasure-encode
 		f.ErasureCode().Encode(chunk[:n], shards)
 		// make room if necessary
@@ -102,25 +164,23 @@ func (m *Migrator) AddFile(f *renter.MetaFile, source io.Reader, onFinish func(*
 			}
 		}
 		// append to sector builders
+		sectors := make([]*renter.SectorBuilder, len(newHosts))
 		sliceIndices := make([]int, len(newHosts))
 		for i, hostKey := range newHosts {
 			if hostKey == f.Hosts[i] {
 				continue // no migration necessary
 			}
-			s := m.shards[hostKey]
-			s.Append(shards[i], f.MasterKey, renter.RandomNonce())
-			sliceIndices[i] = len(s.Slices()) - 1
+			s := m.sectorFor(hostKey, len(shards[i]))
+			sliceIndices[i] = s.Append(shards[i], f.MasterKey, renter.RandomNonce())
+			sectors[i] = s
 		}
-		// append to newShards when this sector is flushed (which should be on
-		// the next iteration, unless we've reached the end of the file)
+		// append to newShards when the sectors are flushed
 		m.onFlush = append(m.onFlush, func() error {
 			for i, hostKey := range newHosts {
 				if hostKey == f.Hosts[i] {
 					continue // no migration necessary
 				}
-				s := m.shards[hostKey]
-				sliceIndex := sliceIndices[i]
-				newShards[i] = append(newShards[i], s.Slices()[sliceIndex])
+				newShards[i] = append(newShards[i], sectors[i].Slices()[sliceIndices[i]])
 			}
 			return nil
 		})
@@ -131,6 +191,12 @@ func (m *Migrator) AddFile(f *renter.MetaFile, source io.Reader, onFinish func(*
 	if n, _ := io.CopyN(ioutil.Discard, source, 1); n != 0 {
 		return errors.New("source stream is larger than file being migrated")
 	}
+	if f.FileHash != (crypto.Hash{}) && remaining == 0 {
+		var sum crypto.Hash
+		if fileHash.Sum(sum[:0]); sum != f.FileHash {
+			return errors.Wrap(renter.ErrIntegrityMismatch, "file")
+		}
+	}
 
 	m.onFlush = append(m.onFlush, func() error {
 		for i, hostKey := range newHosts {
@@ -152,31 +218,38 @@ func (m *Migrator) Flush() error {
 	var wg sync.WaitGroup
 	var mu sync.Mutex
 	var errs HostErrorSet
-	for hostKey, s := range m.shards {
-		if s.Len() == 0 {
+	for hostKey, shard := range m.shards {
+		var sectors []*renter.SectorBuilder
+		for _, s := range shard {
+			if s.Len() > 0 {
+				sectors = append(sectors, s)
+			}
+		}
+		if len(sectors) == 0 {
 			continue
 		}
 		wg.Add(1)
-		go func(hostKey hostdb.HostPublicKey, s *renter.SectorBuilder) {
+		go func(hostKey hostdb.HostPublicKey, sectors []*renter.SectorBuilder) {
 			defer wg.Done()
-			h, err := m.hosts.acquire(hostKey)
-			if err != nil {
-				mu.Lock()
-				errs = append(errs, &HostError{hostKey, err})
-				mu.Unlock()
+			var roots []crypto.Hash
+			err := m.hosts.do(hostKey, func(h *proto.Session) (err error) {
+				var i int
+				roots, err = h.AppendMany(len(sectors), func() *[renterhost.SectorSize]byte {
+					i++
+					return sectors[i-1].Finish()
+				})
 				return
-			}
-			sector := s.Finish()
-			root, err := h.Append(sector)
-			m.hosts.release(hostKey)
+			})
 			if err != nil {
 				mu.Lock()
 				errs = append(errs, &HostError{hostKey, err})
 				mu.Unlock()
 				return
 			}
-			s.SetMerkleRoot(root)
-		}(hostKey, s)
+			for i, root := range roots {
+				sectors[i].SetMerkleRoot(root)
+			}
+		}(hostKey, sectors)
 	}
 	wg.Wait()
 	if len(errs) > 0 {
@@ -190,8 +263,10 @@ func (m *Migrator) Flush() error {
 	}
 	m.onFlush = m.onFlush[:0]
 
-	for _, s := range m.shards {
-		s.Reset()
+	for _, shard := range m.shards {
+		for _, s := range shard {
+			s.Reset()
+		}
 	}
 
 	return nil
@@ -199,12 +274,8 @@ func (m *Migrator) Flush() error {
 
 // NewMigrator creates a Migrator that migrates files to the specified host set.
 func NewMigrator(hosts *HostSet) *Migrator {
-	shards := make(map[hostdb.HostPublicKey]*renter.SectorBuilder)
-	for hostKey := range hosts.sessions {
-		shards[hostKey] = new(renter.SectorBuilder)
-	}
 	return &Migrator{
 		hosts:  hosts,
-		shards: shards,
+		shards: make(map[hostdb.HostPublicKey][]*renter.SectorBuilder),
 	}
 }
@@ -8,7 +8,9 @@ import (
 	"path/filepath"
 	"testing"
 
+	"gitlab.com/NebulousLabs/Sia/crypto"
 	"lukechampine.com/frand"
+	"lukechampine.com/us/hostdb"
 	"lukechampine.com/us/renter"
 )
 
@@ -127,3 +129,105 @@ func TestMigrate(t *testing.T) {
 		}
 	}
 }
+
+func TestMigrateAuditFailures(t *testing.T) {
+	if testing.Short() {
+		t.SkipNow()
+	}
+
+	// create two HostSets, where the second has one additional host
+	hkr := make(testHKR)
+	hs1 := NewHostSet(hkr, 0)
+	hs2 := NewHostSet(hkr, 0)
+	var hostKeys []hostdb.HostPublicKey
+	for i := 0; i < 3; i++ {
+		h, c := createHostWithContract(t)
+		defer h.Close()
+		hkr[h.PublicKey()] = h.Settings().NetAddress
+		if i < 2 {
+			hs1.AddHost(c)
+		}
+		hs2.AddHost(c)
+		hostKeys = append(hostKeys, h.PublicKey())
+	}
+
+	// upload a file to the first two hosts
+	fs1 := NewFileSystem(os.TempDir(), hs1)
+	defer fs1.Close()
+	metaName := t.Name() + "-" + hex.EncodeToString(frand.Bytes(6))
+	pf, err := fs1.Create(metaName, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	data := []byte("one two three four five")
+	if _, err := pf.Write(data); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Sync(); err != nil {
+		t.Fatal(err)
+	} else if err := pf.Close(); err != nil {
+		t.Fatal(err)
+	}
+	metaPath := filepath.Join(fs1.root, metaName) + ".usa"
+	m, err := renter.ReadMetaFile(metaPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// all of the file's hosts are present, so no migration is necessary
+	migrator := NewMigrator(hs2)
+	if migrator.NeedsMigrate(m) {
+		t.Fatal("migrator should not require migration")
+	}
+
+	// fail an audit of the first host
+	a := renter.NewAuditor()
+	s, err := hs2.acquire(hostKeys[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := a.Audit(s, []crypto.Hash{frand.Entropy256()}, 1)
+	hs2.release(hostKeys[0])
+	if !r.Failed {
+		t.Fatal("expected audit to fail, got", r.Err)
+	}
+
+	// the file should now be migrated away from the first host, to the third
+	migrator.SetAuditor(a, 0)
+	if !migrator.NeedsMigrate(m) {
+		t.Fatal("migrator should require migration")
+	}
+	pf, err = fs1.Open(metaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	err = migrator.AddFile(m, pf, func(newM *renter.MetaFile) error {
+		return renter.WriteMetaFile(metaPath, newM)
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err := migrator.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if m, err = renter.ReadMetaFile(metaPath); err != nil {
+		t.Fatal(err)
+	} else if m.HostIndex(hostKeys[0]) != -1 || m.HostIndex(hostKeys[2]) == -1 {
+		t.Fatal("file was not migrated to the correct hosts:", m.Hosts)
+	}
+
+	// download from the new hosts
+	fs2 := NewFileSystem(os.TempDir(), hs2)
+	defer fs2.Close()
+	pf, err = fs2.Open(metaName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pf.Close()
+	read, err := ioutil.ReadAll(pf)
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(read, data) {
+		t.Fatal("contents do not match data")
+	}
+}
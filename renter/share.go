@@ -0,0 +1,130 @@
+package renter
+
+import (
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/curve25519"
+	"lukechampine.com/frand"
+)
+
+// Shared files
+//
+// A shared file is a metafile archive whose MasterKey has been removed and
+// replaced by a WrappedKey: the MasterKey, encrypted such that only the holder
+// of a particular X25519 private key can decrypt it. Shared files contain no
+// contract information (metafiles never do), so a recipient can only download
+// the file if it has its own contracts with the file's hosts, or if the hosts
+// offer free reads (see hostdb.HostCapabilities). An ed25519 key can be used as
+// the recipient key by converting it with ed25519hash.X25519PublicKey and
+// ed25519hash.X25519PrivateKey.
+
+const (
+	// tagSize is the size of a Poly1305 authentication tag.
+	tagSize = 16
+
+	wrappedKeySize = 32 + chacha20poly1305.NonceSizeX + 32 + tagSize
+)
+
+// A WrappedKey is a KeySeed encrypted for a specific recipient.
+type WrappedKey struct {
+	Ephemeral  [32]byte // sender's ephemeral X25519 public key
+	Nonce      [chacha20poly1305.NonceSizeX]byte
+	Ciphertext [32 + tagSize]byte
+}
+
+func (wk *WrappedKey) marshal() []byte {
+	b := make([]byte, 0, wrappedKeySize)
+	b = append(b, wk.Ephemeral[:]...)
+	b = append(b, wk.Nonce[:]...)
+	b = append(b, wk.Ciphertext[:]...)
+	return b
+}
+
+func (wk *WrappedKey) unmarshal(b []byte) {
+	n := copy(wk.Ephemeral[:], b)
+	n += copy(wk.Nonce[:], b[n:])
+	copy(wk.Ciphertext[:], b[n:])
+}
+
+// wrappingKey derives the key used to wrap a KeySeed from the X25519 shared
+// secret and the public keys of both parties.
+func wrappingKey(secret []byte, ephemeral, recipient [32]byte) []byte {
+	buf := make([]byte, 0, len(secret)+64)
+	buf = append(buf, secret...)
+	buf = append(buf, ephemeral[:]...)
+	buf = append(buf, recipient[:]...)
+	key := blake2b.Sum256(buf)
+	return key[:]
+}
+
+// WrapKey encrypts seed such that it can only be decrypted by the holder of the
+// X25519 private key corresponding to recipient.
+func WrapKey(seed KeySeed, recipient [32]byte) (WrappedKey, error) {
+	var wk WrappedKey
+	ephemeralPriv := frand.Entropy256()
+	ephemeral, err := curve25519.X25519(ephemeralPriv[:], curve25519.Basepoint)
+	if err != nil {
+		return WrappedKey{}, errors.Wrap(err, "could not generate ephemeral key")
+	}
+	copy(wk.Ephemeral[:], ephemeral)
+	secret, err := curve25519.X25519(ephemeralPriv[:], recipient[:])
+	if err != nil {
+		return WrappedKey{}, errors.Wrap(err, "invalid recipient key")
+	}
+	aead, _ := chacha20poly1305.NewX(wrappingKey(secret, wk.Ephemeral, recipient))
+	frand.Read(wk.Nonce[:])
+	aead.Seal(wk.Ciphertext[:0], wk.Nonce[:], seed[:], wk.Ephemeral[:])
+	return wk, nil
+}
+
+// Unwrap decrypts the wrapped KeySeed using the recipient's X25519 private key.
+func (wk WrappedKey) Unwrap(priv [32]byte) (KeySeed, error) {
+	secret, err := curve25519.X25519(priv[:], wk.Ephemeral[:])
+	if err != nil {
+		return KeySeed{}, errors.Wrap(err, "invalid ephemeral key")
+	}
+	pub, err := curve25519.X25519(priv[:], curve25519.Basepoint)
+	if err != nil {
+		return KeySeed{}, errors.Wrap(err, "invalid private key")
+	}
+	var recipient [32]byte
+	copy(recipient[:], pub)
+	aead, _ := chacha20poly1305.NewX(wrappingKey(secret, wk.Ephemeral, recipient))
+	var seed KeySeed
+	if _, err := aead.Open(seed[:0], wk.Nonce[:], wk.Ciphertext[:], wk.Ephemeral[:]); err != nil {
+		return KeySeed{}, errors.New("key was not wrapped for this recipient")
+	}
+	return seed, nil
+}
+
+// WriteSharedFile writes a copy of m to filename that can only be read by the
+// holder of the X25519 private key corresponding to recipient. The copy's
+// MasterKey is wrapped with WrapKey. Like WriteMetaFile, the write is atomic.
+func WriteSharedFile(filename string, m *MetaFile, recipient [32]byte) error {
+	wk, err := WrapKey(m.MasterKey, recipient)
+	if err != nil {
+		return err
+	}
+	shared := *m
+	shared.MasterKey = KeySeed{}
+	return writeMetaArchive(filename, &shared, &wk)
+}
+
+// ReadSharedFile reads a shared file written by WriteSharedFile, unwrapping its
+// MasterKey with priv. The returned MetaFile is read-only: its write permission
+// bits are cleared.
+func ReadSharedFile(filename string, priv [32]byte) (*MetaFile, error) {
+	m, wk, err := readMetaArchive(filename)
+	if err != nil {
+		return nil, err
+	} else if wk == nil {
+		return nil, errors.New("archive is not a shared file")
+	}
+	m.MasterKey, err = wk.Unwrap(priv)
+	if err != nil {
+		return nil, err
+	}
+	m.Mode &^= 0222
+	return m, nil
+}
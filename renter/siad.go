@@ -0,0 +1,374 @@
+package renter
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"golang.org/x/crypto/blake2b"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renterhost"
+)
+
+// siad compatibility
+//
+// siad stores file metadata in a "siafile": a JSON header, followed by a table
+// of host public keys, followed by a fixed-size binary record for each chunk.
+// Each chunk record lists the pieces of the chunk, i.e. the Merkle roots of
+// the sectors storing the chunk's erasure-coded shards. A piece always fills
+// an entire sector, so a siafile corresponds to a MetaFile whose slices each
+// span a full sector.
+//
+// Not every siafile can be represented as a MetaFile. The file must be
+// encrypted with XChaCha20, rather than Threefish (the siad default); it must
+// use siad's segmented Reed-Solomon code, which is equivalent to ours (the
+// legacy, unsegmented code is only equivalent for files with one data piece);
+// it must not use siad's partial chunk uploads; and each piece index must be
+// stored on the same host in every chunk, since a MetaFile stores each shard
+// on a single host.
+//
+// Conversely, only MetaFiles that were imported from siad can be exported.
+// siad derives the encryption nonce of each piece from the master key, and
+// pads each piece to a full sector, whereas us chooses nonces randomly and
+// packs multiple slices into each sector. Since a MetaFile only stores the
+// derived nonces, the master key's nonce must be supplied separately.
+
+// ErrIncompatibleSiaFile is returned when converting between a siafile and a
+// MetaFile that uses features not supported by the other format.
+var ErrIncompatibleSiaFile = errors.New("incompatible with siad")
+
+const (
+	siadPageSize      = 4096
+	siadChunkOverhead = 16 + 1 + 2 // extension info, stuck flag, piece count
+	siadPieceSize     = 4 + 4 + 32 // piece index, host table offset, Merkle root
+	siadMasterKeySize = 32 + 24    // XChaCha20 key and nonce
+	siadUniqueIDSize  = 20         // hex-encoded
+	siadHostKeyPrefix = 16 + 8 + 1 // algorithm, key length, used flag
+)
+
+var (
+	siadCipherXChaCha20  = [8]byte{7: 4}
+	siadECReedSolomon    = [4]byte{3: 1}
+	siadECReedSolomonSeg = [4]byte{3: 2}
+	siadCipherNames      = map[[8]byte]string{{7: 1}: "plaintext", {7: 2}: "twofish-gcm", {7: 3}: "threefish512", {7: 4}: "XChaCha20"}
+)
+
+// siadMetadata contains the fields of a siafile header that are relevant to
+// MetaFiles. siad ignores missing fields, and recomputes its cached fields
+// (health, redundancy, etc.) as needed.
+type siadMetadata struct {
+	UniqueID            string      `json:"uniqueid"`
+	PagesPerChunk       uint8       `json:"pagesperchunk"`
+	Version             [16]byte    `json:"version"`
+	FileSize            int64       `json:"filesize"`
+	PieceSize           uint64      `json:"piecesize"`
+	MasterKey           []byte      `json:"masterkey"`
+	MasterKeyType       [8]byte     `json:"masterkeytype"`
+	DisablePartialChunk bool        `json:"disablepartialchunk"`
+	HasPartialChunk     bool        `json:"haspartialchunk"`
+	ModTime             time.Time   `json:"modtime"`
+	ChangeTime          time.Time   `json:"changetime"`
+	AccessTime          time.Time   `json:"accesstime"`
+	CreateTime          time.Time   `json:"createtime"`
+	Mode                os.FileMode `json:"mode"`
+	ChunkOffset         int64       `json:"chunkoffset"`
+	PubKeyTableOffset   int64       `json:"pubkeytableoffset"`
+	ErasureCodeType     [4]byte     `json:"erasurecodetype"`
+	ErasureCodeParams   [8]byte     `json:"erasurecodeparams"`
+}
+
+// siadPieceNonce returns the nonce that siad uses to encrypt the specified
+// piece.
+func siadPieceNonce(nonce [24]byte, chunkIndex, pieceIndex uint64) (pieceNonce [24]byte) {
+	buf := make([]byte, 24+8+8)
+	copy(buf, nonce[:])
+	binary.LittleEndian.PutUint64(buf[24:], chunkIndex)
+	binary.LittleEndian.PutUint64(buf[32:], pieceIndex)
+	h := blake2b.Sum256(buf)
+	copy(pieceNonce[:], h[:])
+	return
+}
+
+// ReadSiaFile reads a siad siafile and converts it to a MetaFile. It also
+// returns the nonce of the siafile's master key, which is needed to convert
+// the MetaFile back into a siafile. If the siafile uses features that
+// MetaFiles do not support, the returned error wraps ErrIncompatibleSiaFile.
+func ReadSiaFile(filename string) (_ *MetaFile, nonce [24]byte, err error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, nonce, errors.Wrap(err, "could not read siafile")
+	}
+	var md siadMetadata
+	if err := json.NewDecoder(bytes.NewReader(b)).Decode(&md); err != nil {
+		return nil, nonce, errors.Wrap(err, "could not decode siafile metadata")
+	}
+	dataPieces := int(binary.LittleEndian.Uint32(md.ErasureCodeParams[:4]))
+	numPieces := dataPieces + int(binary.LittleEndian.Uint32(md.ErasureCodeParams[4:]))
+	switch {
+	case md.MasterKeyType != siadCipherXChaCha20:
+		name, ok := siadCipherNames[md.MasterKeyType]
+		if !ok {
+			name = "unknown"
+		}
+		return nil, nonce, errors.Wrapf(ErrIncompatibleSiaFile, "%v cipher is not supported; only XChaCha20 is", name)
+	case md.ErasureCodeType == siadECReedSolomon && dataPieces > 1:
+		return nil, nonce, errors.Wrap(ErrIncompatibleSiaFile, "legacy Reed-Solomon code is only supported for files with one data piece")
+	case md.ErasureCodeType != siadECReedSolomon && md.ErasureCodeType != siadECReedSolomonSeg:
+		return nil, nonce, errors.Wrapf(ErrIncompatibleSiaFile, "unknown erasure code type %v", md.ErasureCodeType)
+	case md.PieceSize != renterhost.SectorSize:
+		return nil, nonce, errors.Wrapf(ErrIncompatibleSiaFile, "piece size (%v bytes) must equal the sector size", md.PieceSize)
+	case md.HasPartialChunk:
+		return nil, nonce, errors.Wrap(ErrIncompatibleSiaFile, "partial chunks are not supported")
+	case len(md.MasterKey) != siadMasterKeySize:
+		return nil, nonce, errors.Errorf("invalid master key length (%v bytes)", len(md.MasterKey))
+	case dataPieces == 0 || numPieces > 256:
+		return nil, nonce, errors.Errorf("invalid erasure code parameters (%v-of-%v)", dataPieces, numPieces)
+	case md.PagesPerChunk == 0:
+		return nil, nonce, errors.New("invalid chunk size")
+	case md.PubKeyTableOffset < 0 || md.PubKeyTableOffset > md.ChunkOffset || md.ChunkOffset > int64(len(b)):
+		return nil, nonce, errors.New("invalid header offsets")
+	}
+
+	// read host table
+	var table []hostdb.HostPublicKey
+	for rem := b[md.PubKeyTableOffset:md.ChunkOffset]; len(rem) > 0; {
+		if len(rem) < siadHostKeyPrefix {
+			return nil, nonce, errors.New("invalid host table")
+		}
+		var spk types.SiaPublicKey
+		copy(spk.Algorithm[:], rem[:16])
+		keyLen := binary.LittleEndian.Uint64(rem[16:24])
+		if keyLen > uint64(len(rem)-siadHostKeyPrefix) {
+			return nil, nonce, errors.New("invalid host table")
+		}
+		spk.Key = rem[24:][:keyLen]
+		table = append(table, hostdb.HostKeyFromSiaPublicKey(spk))
+		rem = rem[siadHostKeyPrefix+keyLen:]
+	}
+
+	// read chunks
+	chunkSize := int64(dataPieces) * renterhost.SectorSize
+	numChunks := int(md.FileSize / chunkSize)
+	if md.FileSize%chunkSize != 0 {
+		numChunks++
+	}
+	recordSize := int64(md.PagesPerChunk) * siadPageSize
+	chunks := make([][][]siadPiece, numChunks)
+	for i := range chunks {
+		off := md.ChunkOffset + int64(i)*recordSize
+		if off+siadChunkOverhead > int64(len(b)) {
+			return nil, nonce, errors.Errorf("siafile is missing chunk %v", i)
+		}
+		rec := b[off:]
+		if int64(len(rec)) > recordSize {
+			rec = rec[:recordSize]
+		}
+		n := int(binary.LittleEndian.Uint16(rec[17:19]))
+		rec = rec[siadChunkOverhead:]
+		if len(rec) < n*siadPieceSize {
+			return nil, nonce, errors.Errorf("chunk %v is truncated", i)
+		}
+		chunks[i] = make([][]siadPiece, numPieces)
+		for ; n > 0; n-- {
+			pieceIndex := binary.LittleEndian.Uint32(rec[0:4])
+			var p siadPiece
+			p.hostIndex = binary.LittleEndian.Uint32(rec[4:8])
+			copy(p.root[:], rec[8:40])
+			if pieceIndex >= uint32(numPieces) || p.hostIndex >= uint32(len(table)) {
+				return nil, nonce, errors.Errorf("chunk %v contains an invalid piece", i)
+			}
+			chunks[i][pieceIndex] = append(chunks[i][pieceIndex], p)
+			rec = rec[siadPieceSize:]
+		}
+	}
+
+	// assign a host to each shard
+	hostIndices := make([]uint32, numPieces)
+	assigned := make(map[uint32]bool)
+	for j := range hostIndices {
+		found := false
+		for h := range table {
+			if !assigned[uint32(h)] && siadHostStoresPiece(chunks, j, uint32(h)) {
+				hostIndices[j] = uint32(h)
+				assigned[uint32(h)] = true
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, nonce, errors.Wrapf(ErrIncompatibleSiaFile, "piece %v is not stored on the same host in every chunk", j)
+		}
+	}
+
+	var key KeySeed
+	copy(key[:], md.MasterKey[:32])
+	copy(nonce[:], md.MasterKey[32:])
+	m := &MetaFile{
+		MetaIndex: MetaIndex{
+			Version:   MetaFileVersion,
+			Filesize:  md.FileSize,
+			Mode:      md.Mode,
+			ModTime:   md.ModTime,
+			MasterKey: key,
+			MinShards: dataPieces,
+			Hosts:     make([]hostdb.HostPublicKey, numPieces),
+		},
+		Shards: make([][]SectorSlice, numPieces),
+	}
+	for j := range m.Shards {
+		m.Hosts[j] = table[hostIndices[j]]
+		m.Shards[j] = make([]SectorSlice, numChunks)
+		for i := range m.Shards[j] {
+			for _, p := range chunks[i][j] {
+				if p.hostIndex == hostIndices[j] {
+					m.Shards[j][i] = SectorSlice{
+						MerkleRoot:   p.root,
+						SegmentIndex: 0,
+						NumSegments:  merkle.SegmentsPerSector,
+						Nonce:        siadPieceNonce(nonce, uint64(i), uint64(j)),
+					}
+					break
+				}
+			}
+		}
+	}
+	return m, nonce, nil
+}
+
+// A siadPiece is a piece of a siafile chunk.
+type siadPiece struct {
+	hostIndex uint32
+	root      [32]byte
+}
+
+// siadHostStoresPiece reports whether the specified host stores the specified
+// piece of every chunk.
+func siadHostStoresPiece(chunks [][][]siadPiece, pieceIndex int, hostIndex uint32) bool {
+	for _, c := range chunks {
+		found := false
+		for _, p := range c[pieceIndex] {
+			found = found || p.hostIndex == hostIndex
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteSiaFile converts m to a siad siafile and writes it to filename. nonce
+// must be the nonce returned by ReadSiaFile. If m cannot be represented as a
+// siafile, the returned error wraps ErrIncompatibleSiaFile. Like
+// WriteMetaFile, the write is atomic.
+func WriteSiaFile(filename string, m *MetaFile, nonce [24]byte) error {
+	if err := validateShards(m.Shards); err != nil {
+		return errors.Wrap(err, "invalid shards")
+	}
+	chunkSize := int64(m.MinShards) * renterhost.SectorSize
+	numChunks := int(m.Filesize / chunkSize)
+	if m.Filesize%chunkSize != 0 {
+		numChunks++
+	}
+	switch {
+	case m.Code.Name != "" && m.Code.Name != "reedsolomon":
+		return errors.Wrapf(ErrIncompatibleSiaFile, "siad does not support erasure code %q", m.Code.Name)
+	case m.MinShards == len(m.Hosts):
+		return errors.Wrap(ErrIncompatibleSiaFile, "siad requires at least one parity shard")
+	case len(m.Hosts) > 256:
+		return errors.Wrap(ErrIncompatibleSiaFile, "siad supports at most 256 shards")
+	case len(m.Shards[0]) != numChunks:
+		return errors.Wrapf(ErrIncompatibleSiaFile, "file has %v chunks; siad requires each chunk to span a full sector on each host", len(m.Shards[0]))
+	}
+	for j, shard := range m.Shards {
+		for i, s := range shard {
+			if s.SegmentIndex != 0 || s.NumSegments != merkle.SegmentsPerSector {
+				return errors.Wrapf(ErrIncompatibleSiaFile, "slice %v of shard %v does not span a full sector", i, j)
+			} else if s.Nonce != siadPieceNonce(nonce, uint64(i), uint64(j)) {
+				return errors.Wrapf(ErrIncompatibleSiaFile, "slice %v of shard %v was not encrypted by siad", i, j)
+			}
+		}
+	}
+
+	// encode host table
+	var table []byte
+	for _, h := range m.Hosts {
+		spk := h.SiaPublicKey()
+		table = append(table, spk.Algorithm[:]...)
+		table = append(table, make([]byte, 8)...)
+		binary.LittleEndian.PutUint64(table[len(table)-8:], uint64(len(spk.Key)))
+		table = append(table, spk.Key...)
+		table = append(table, 1) // used
+	}
+
+	// encode metadata; the header must fit within the pages preceding the
+	// chunks
+	md := siadMetadata{
+		UniqueID:            hex.EncodeToString(frand.Bytes(siadUniqueIDSize)),
+		PagesPerChunk:       uint8((siadChunkOverhead + siadPieceSize*len(m.Hosts) + siadPageSize - 1) / siadPageSize),
+		FileSize:            m.Filesize,
+		PieceSize:           renterhost.SectorSize,
+		MasterKey:           append(append([]byte(nil), m.MasterKey[:]...), nonce[:]...),
+		MasterKeyType:       siadCipherXChaCha20,
+		DisablePartialChunk: true,
+		ModTime:             m.ModTime,
+		ChangeTime:          m.ModTime,
+		AccessTime:          m.ModTime,
+		CreateTime:          m.ModTime,
+		Mode:                m.Mode,
+		ErasureCodeType:     siadECReedSolomonSeg,
+	}
+	binary.LittleEndian.PutUint32(md.ErasureCodeParams[:4], uint32(m.MinShards))
+	binary.LittleEndian.PutUint32(md.ErasureCodeParams[4:], uint32(len(m.Hosts)-m.MinShards))
+	var header []byte
+	for md.ChunkOffset = siadPageSize; ; md.ChunkOffset += siadPageSize {
+		md.PubKeyTableOffset = md.ChunkOffset - int64(len(table))
+		header, _ = json.Marshal(md)
+		if int64(len(header)) <= md.PubKeyTableOffset {
+			break
+		}
+	}
+
+	// siad stores a single empty chunk for empty files
+	if numChunks == 0 {
+		numChunks = 1
+	}
+	recordSize := int(md.PagesPerChunk) * siadPageSize
+	buf := make([]byte, int(md.ChunkOffset)+numChunks*recordSize)
+	copy(buf, header)
+	copy(buf[md.PubKeyTableOffset:], table)
+	for i := 0; i < len(m.Shards[0]); i++ {
+		rec := buf[int(md.ChunkOffset)+i*recordSize:]
+		binary.LittleEndian.PutUint16(rec[17:19], uint16(len(m.Shards)))
+		rec = rec[siadChunkOverhead:]
+		for j := range m.Shards {
+			binary.LittleEndian.PutUint32(rec[0:4], uint32(j))
+			binary.LittleEndian.PutUint32(rec[4:8], uint32(j))
+			copy(rec[8:40], m.Shards[j][i].MerkleRoot[:])
+			rec = rec[siadPieceSize:]
+		}
+	}
+
+	f, err := os.Create(filename + "_tmp")
+	if err != nil {
+		return errors.Wrap(err, "could not create siafile")
+	}
+	defer f.Close()
+	if _, err := f.Write(buf); err != nil {
+		return errors.Wrap(err, "could not write siafile")
+	} else if err := f.Sync(); err != nil {
+		return errors.Wrap(err, "could not sync siafile")
+	} else if err := f.Close(); err != nil {
+		return errors.Wrap(err, "could not close siafile")
+	} else if err := os.Rename(filename+"_tmp", filename); err != nil {
+		return errors.Wrap(err, "could not atomically replace siafile")
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package renter
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/errors"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renterhost"
+)
+
+func TestSiaFile(t *testing.T) {
+	hosts := make([]hostdb.HostPublicKey, 3)
+	for i := range hosts {
+		hosts[i] = hostdb.HostKeyFromPublicKey(frand.Bytes(32))
+	}
+	m := NewMetaFile(0640, 3*renterhost.SectorSize+100, hosts, 2)
+	nonce := frand.Entropy192()
+	for j := range m.Shards {
+		m.Shards[j] = make([]SectorSlice, 2)
+		for i := range m.Shards[j] {
+			m.Shards[j][i] = SectorSlice{
+				MerkleRoot:  frand.Entropy256(),
+				NumSegments: merkle.SegmentsPerSector,
+				Nonce:       siadPieceNonce(nonce, uint64(i), uint64(j)),
+			}
+		}
+	}
+
+	path := filepath.Join(os.TempDir(), t.Name()+".sia")
+	defer os.RemoveAll(path)
+	if err := WriteSiaFile(path, m, nonce); err != nil {
+		t.Fatal(err)
+	}
+	m2, nonce2, err := ReadSiaFile(path)
+	if err != nil {
+		t.Fatal(err)
+	} else if nonce2 != nonce {
+		t.Fatal("nonce was not preserved")
+	} else if m2.Filesize != m.Filesize || m2.Mode != m.Mode || m2.MasterKey != m.MasterKey || m2.MinShards != m.MinShards {
+		t.Fatal("index was not preserved")
+	}
+	for j := range m.Shards {
+		if m2.Hosts[j] != m.Hosts[j] {
+			t.Fatal("hosts were not preserved")
+		}
+		for i := range m.Shards[j] {
+			if m2.Shards[j][i] != m.Shards[j][i] {
+				t.Fatal("shards were not preserved")
+			}
+		}
+	}
+	if err := m2.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// unsupported siad features should be reported
+	b, _ := ioutil.ReadFile(path)
+	threefish := bytes.Replace(b, []byte(`"masterkeytype":[0,0,0,0,0,0,0,4]`), []byte(`"masterkeytype":[0,0,0,0,0,0,0,3]`), 1)
+	if bytes.Equal(threefish, b) {
+		t.Fatal("could not modify cipher type")
+	} else if err := ioutil.WriteFile(path, threefish, 0666); err != nil {
+		t.Fatal(err)
+	} else if _, _, err := ReadSiaFile(path); errors.Cause(err) != ErrIncompatibleSiaFile {
+		t.Fatal("expected ErrIncompatibleSiaFile, got", err)
+	}
+
+	// MetaFiles that were not imported from siad cannot be exported
+	m.Shards[1][1].Nonce = RandomNonce()
+	if err := WriteSiaFile(path, m, nonce); errors.Cause(err) != ErrIncompatibleSiaFile {
+		t.Fatal("expected ErrIncompatibleSiaFile, got", err)
+	}
+	m.Shards[1][1].Nonce = siadPieceNonce(nonce, 1, 1)
+	// siad requires pieces to be padded to a full sector
+	for j := range m.Shards {
+		m.Shards[j][1].NumSegments /= 2
+	}
+	if err := WriteSiaFile(path, m, nonce); errors.Cause(err) != ErrIncompatibleSiaFile {
+		t.Fatal("expected ErrIncompatibleSiaFile, got", err)
+	}
+}
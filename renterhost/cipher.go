@@ -0,0 +1,583 @@
+package renterhost
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"sync"
+
+	"github.com/aead/chacha20/chacha"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/poly1305"
+	"golang.org/x/sys/cpu"
+)
+
+// Cipher suites
+var (
+	CipherChaCha20Poly1305 = newSpecifier("ChaCha20Poly1305")
+	CipherAES256GCM        = newSpecifier("AES256GCM")
+
+	// sent by the host if it does not support any of the renter's ciphers
+	cipherNoOverlap = newSpecifier("NoOverlap")
+)
+
+var cipherRegistry = struct {
+	sync.RWMutex
+	suites map[Specifier]func(key []byte) (cipher.AEAD, error)
+	order  []Specifier
+}{
+	suites: make(map[Specifier]func(key []byte) (cipher.AEAD, error)),
+}
+
+// RegisterCipher registers an AEAD cipher suite, allowing it to be negotiated
+// during the renter-host handshake. newAEAD is called with a 32-byte key
+// derived from the handshake, and must return an AEAD whose nonces are at most
+// 256 bytes long. Since nonces are chosen randomly, the nonce size should be
+// large enough that collisions are unlikely. RegisterCipher panics if a suite
+// with the same ID has already been registered.
+//
+// Sessions stream large messages instead of buffering them. If the AEAD
+// implements StreamAEAD, each message is sealed as a single AEAD message, and
+// streamed using its NewSealer and NewOpener methods. Otherwise, each message
+// is split into chunks of up to 64 KiB, which are sealed separately.
+func RegisterCipher(id Specifier, newAEAD func(key []byte) (cipher.AEAD, error)) {
+	cipherRegistry.Lock()
+	defer cipherRegistry.Unlock()
+	if _, ok := cipherRegistry.suites[id]; ok {
+		panic("cipher suite " + id.String() + " is already registered")
+	}
+	cipherRegistry.suites[id] = newAEAD
+	cipherRegistry.order = append(cipherRegistry.order, id)
+}
+
+// SupportedCiphers returns the IDs of all registered cipher suites, in the
+// order they were registered.
+func SupportedCiphers() []Specifier {
+	cipherRegistry.RLock()
+	defer cipherRegistry.RUnlock()
+	return append([]Specifier(nil), cipherRegistry.order...)
+}
+
+func newCipher(id Specifier, key []byte) (messageCipher, bool, error) {
+	cipherRegistry.RLock()
+	fn, ok := cipherRegistry.suites[id]
+	cipherRegistry.RUnlock()
+	if !ok {
+		return nil, false, nil
+	}
+	aead, err := fn(key)
+	if err != nil {
+		return nil, true, err
+	}
+	return newMessageCipher(aead), true, nil
+}
+
+// selectCipher returns the first cipher in proposed that is also present in
+// supported, or cipherNoOverlap if there is no such cipher. Thus the renter's
+// preferences take priority over the host's.
+func selectCipher(proposed, supported []Specifier) Specifier {
+	for _, p := range proposed {
+		for _, s := range supported {
+			if p == s {
+				return p
+			}
+		}
+	}
+	return cipherNoOverlap
+}
+
+func hasAESGCMHardwareSupport() bool {
+	switch runtime.GOARCH {
+	case "amd64":
+		return cpu.X86.HasAES && cpu.X86.HasPCLMULQDQ
+	case "arm64":
+		return cpu.ARM64.HasAES && cpu.ARM64.HasPMULL
+	case "s390x":
+		return cpu.S390X.HasAES && cpu.S390X.HasAESGCM
+	}
+	return false
+}
+
+// RenterCipherPreference is the order in which NewRenterSession and
+// NewRenterMux propose cipher suites to the host. By default, it prefers
+// AES-256-GCM on platforms with hardware support for AES, and
+// ChaCha20-Poly1305 elsewhere. Since most hosts only support
+// ChaCha20-Poly1305, it should always be included. RenterCipherPreference
+// should not be modified while sessions are being established.
+var RenterCipherPreference = func() []Specifier {
+	if hasAESGCMHardwareSupport() {
+		return []Specifier{CipherAES256GCM, CipherChaCha20Poly1305}
+	}
+	return []Specifier{CipherChaCha20Poly1305, CipherAES256GCM}
+}()
+
+func init() {
+	RegisterCipher(CipherChaCha20Poly1305, newStreamChaCha20Poly1305)
+	RegisterCipher(CipherAES256GCM, func(key []byte) (cipher.AEAD, error) {
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		return cipher.NewGCM(block)
+	})
+}
+
+// A StreamAEAD is a cipher.AEAD that can also seal and open a message
+// incrementally. The ciphertext must be identical to that of Seal and Open
+// with no additional data.
+type StreamAEAD interface {
+	cipher.AEAD
+	// NewSealer returns a WriteCloser that encrypts exactly n bytes of
+	// plaintext, writing the ciphertext to w. Close writes the authentication
+	// tag; it does not close w.
+	NewSealer(w io.Writer, nonce []byte, n int) io.WriteCloser
+	// NewOpener returns a MessageOpener that decrypts a message of n bytes
+	// (including the authentication tag) read from r. n is at least
+	// Overhead().
+	NewOpener(r io.Reader, nonce []byte, n int) MessageOpener
+}
+
+// A MessageOpener decrypts a message as it is read. The plaintext is not
+// authenticated until Verify returns nil.
+type MessageOpener interface {
+	io.Reader
+	// Verify reads any remaining ciphertext, then authenticates the message.
+	Verify() error
+}
+
+var errSealLength = errors.New("plaintext length does not match the length of the sealed message")
+
+// A messageCipher seals and opens the messages of a Session, either all at
+// once or incrementally.
+type messageCipher interface {
+	NonceSize() int
+	// sealedSize returns the size of a sealed n-byte plaintext.
+	sealedSize(n int) int
+	// seal encrypts the first n bytes of msg in place; len(msg) must be
+	// sealedSize(n).
+	seal(msg, nonce []byte, n int)
+	// open decrypts msg in place, returning the plaintext.
+	open(msg, nonce []byte) ([]byte, error)
+	newSealer(w io.Writer, nonce []byte, n int) io.WriteCloser
+	newOpener(r io.Reader, nonce []byte, size int) (MessageOpener, error)
+}
+
+func newMessageCipher(aead cipher.AEAD) messageCipher {
+	if sa, ok := aead.(StreamAEAD); ok {
+		return singleCipher{sa}
+	}
+	return chunkedCipher{aead}
+}
+
+// singleCipher seals each message as a single AEAD message.
+type singleCipher struct {
+	StreamAEAD
+}
+
+func (c singleCipher) sealedSize(n int) int { return n + c.Overhead() }
+
+func (c singleCipher) seal(msg, nonce []byte, n int) {
+	c.Seal(msg[:0], nonce, msg[:n], nil)
+}
+
+func (c singleCipher) open(msg, nonce []byte) ([]byte, error) {
+	return c.Open(msg[:0], nonce, msg, nil)
+}
+
+func (c singleCipher) newSealer(w io.Writer, nonce []byte, n int) io.WriteCloser {
+	return c.NewSealer(w, nonce, n)
+}
+
+func (c singleCipher) newOpener(r io.Reader, nonce []byte, size int) (MessageOpener, error) {
+	return c.NewOpener(r, nonce, size), nil
+}
+
+// chunkSize is the maximum plaintext size of each chunk of a chunked message.
+// It exceeds MinMessageSize, so short messages are sealed as a single chunk.
+const chunkSize = 1 << 16
+
+// chunkedCipher seals each message as a sequence of chunks. Each chunk is
+// sealed separately, with a nonce derived from the message nonce and the index
+// of the chunk, and the final chunk is marked in its additional data so that a
+// message cannot be truncated at a chunk boundary. This allows any AEAD to be
+// streamed, at the cost of one tag per chunk. Each chunk consumes a nonce;
+// peers that negotiate suites other than ChaCha20-Poly1305 always support
+// rekeying, which bounds the number of chunks sealed with each key.
+type chunkedCipher struct {
+	aead cipher.AEAD
+}
+
+// numChunks returns the number of chunks in an n-byte plaintext. An empty
+// plaintext is sealed as a single empty chunk.
+func numChunks(n int) int {
+	if n == 0 {
+		return 1
+	}
+	return (n + chunkSize - 1) / chunkSize
+}
+
+// chunkNonce sets buf to the nonce for chunk i of a message.
+func chunkNonce(buf, nonce []byte, i int) []byte {
+	buf = append(buf[:0], nonce...)
+	for j := 0; j < 8 && j < len(buf); j++ {
+		buf[j] ^= byte(i >> (8 * j))
+	}
+	return buf
+}
+
+// chunkAD returns the additional data for a chunk.
+func chunkAD(final bool) []byte {
+	if final {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+func (c chunkedCipher) NonceSize() int { return c.aead.NonceSize() }
+
+func (c chunkedCipher) sealedSize(n int) int {
+	return n + numChunks(n)*c.aead.Overhead()
+}
+
+// sealedChunks returns the number of chunks in a sealed message of the
+// specified size, and the sealed size of the final chunk.
+func (c chunkedCipher) sealedChunks(size int) (chunks, last int, err error) {
+	sealedChunk := chunkSize + c.aead.Overhead()
+	chunks = (size + sealedChunk - 1) / sealedChunk
+	last = size - (chunks-1)*sealedChunk
+	if chunks == 0 || last < c.aead.Overhead() {
+		return 0, 0, errors.Errorf("invalid chunked message size (%v bytes)", size)
+	}
+	return chunks, last, nil
+}
+
+func (c chunkedCipher) seal(msg, nonce []byte, n int) {
+	sealedChunk := chunkSize + c.aead.Overhead()
+	chunks := numChunks(n)
+	buf := make([]byte, 0, len(nonce))
+	// seal the chunks in reverse order, so that moving each chunk to its
+	// final position does not overwrite the plaintext of the chunks before it
+	for i := chunks - 1; i >= 0; i-- {
+		start, end := i*chunkSize, (i+1)*chunkSize
+		if end > n {
+			end = n
+		}
+		chunk := msg[i*sealedChunk:]
+		copy(chunk, msg[start:end])
+		c.aead.Seal(chunk[:0], chunkNonce(buf, nonce, i), chunk[:end-start], chunkAD(i == chunks-1))
+	}
+}
+
+func (c chunkedCipher) open(msg, nonce []byte) ([]byte, error) {
+	chunks, _, err := c.sealedChunks(len(msg))
+	if err != nil {
+		return nil, err
+	}
+	sealedChunk := chunkSize + c.aead.Overhead()
+	buf := make([]byte, 0, len(nonce))
+	var n int
+	for i := 0; i < chunks; i++ {
+		start, end := i*sealedChunk, (i+1)*sealedChunk
+		if end > len(msg) {
+			end = len(msg)
+		}
+		chunk, err := c.aead.Open(msg[start:start], chunkNonce(buf, nonce, i), msg[start:end], chunkAD(i == chunks-1))
+		if err != nil {
+			return nil, err
+		}
+		n += copy(msg[n:], chunk)
+	}
+	return msg[:n], nil
+}
+
+func (c chunkedCipher) newSealer(w io.Writer, nonce []byte, n int) io.WriteCloser {
+	return &chunkedSealer{
+		aead:  c.aead,
+		w:     w,
+		nonce: append([]byte(nil), nonce...),
+		buf:   make([]byte, 0, chunkSize+c.aead.Overhead()),
+		rem:   n,
+	}
+}
+
+func (c chunkedCipher) newOpener(r io.Reader, nonce []byte, size int) (MessageOpener, error) {
+	chunks, last, err := c.sealedChunks(size)
+	if err != nil {
+		return nil, err
+	}
+	return &chunkedOpener{
+		aead:   c.aead,
+		r:      r,
+		nonce:  append([]byte(nil), nonce...),
+		chunks: chunks,
+		last:   last,
+		buf:    make([]byte, chunkSize+c.aead.Overhead()),
+	}, nil
+}
+
+// chunkedSealer seals a chunked message as it is written.
+type chunkedSealer struct {
+	aead     cipher.AEAD
+	w        io.Writer
+	nonce    []byte
+	nonceBuf []byte
+	buf      []byte // plaintext of the current chunk
+	rem      int    // plaintext bytes not yet written
+	index    int
+	err      error
+}
+
+func (cs *chunkedSealer) flush(final bool) error {
+	cs.nonceBuf = chunkNonce(cs.nonceBuf, cs.nonce, cs.index)
+	chunk := cs.aead.Seal(cs.buf[:0], cs.nonceBuf, cs.buf, chunkAD(final))
+	if _, err := cs.w.Write(chunk); err != nil {
+		cs.err = err
+		return err
+	}
+	cs.buf = cs.buf[:0]
+	cs.index++
+	return nil
+}
+
+// Write implements io.Writer.
+func (cs *chunkedSealer) Write(p []byte) (int, error) {
+	if cs.err != nil {
+		return 0, cs.err
+	} else if len(p) > cs.rem {
+		cs.err = errSealLength
+		return 0, cs.err
+	}
+	var written int
+	for len(p) > 0 {
+		n := copy(cs.buf[len(cs.buf):chunkSize], p)
+		cs.buf = cs.buf[:len(cs.buf)+n]
+		p = p[n:]
+		written += n
+		cs.rem -= n
+		// the final chunk is sealed by Close
+		if len(cs.buf) == chunkSize && cs.rem > 0 {
+			if err := cs.flush(false); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// Close implements io.Closer.
+func (cs *chunkedSealer) Close() error {
+	if cs.err != nil {
+		return cs.err
+	} else if cs.rem != 0 {
+		cs.err = errSealLength
+		return cs.err
+	}
+	return cs.flush(true)
+}
+
+// chunkedOpener opens a chunked message as it is read. Each chunk is
+// authenticated before any of its plaintext is returned.
+type chunkedOpener struct {
+	aead     cipher.AEAD
+	r        io.Reader
+	nonce    []byte
+	nonceBuf []byte
+	chunks   int
+	last     int // sealed size of the final chunk
+	index    int
+	buf      []byte
+	pt       []byte // unread plaintext of the current chunk
+	err      error
+}
+
+func (co *chunkedOpener) next() error {
+	final := co.index == co.chunks-1
+	chunk := co.buf
+	if final {
+		chunk = co.buf[:co.last]
+	}
+	if _, err := io.ReadFull(co.r, chunk); err == io.EOF {
+		return io.ErrUnexpectedEOF
+	} else if err != nil {
+		return err
+	}
+	co.nonceBuf = chunkNonce(co.nonceBuf, co.nonce, co.index)
+	pt, err := co.aead.Open(chunk[:0], co.nonceBuf, chunk, chunkAD(final))
+	if err != nil {
+		return err
+	}
+	co.pt = pt
+	co.index++
+	return nil
+}
+
+// Read implements io.Reader.
+func (co *chunkedOpener) Read(p []byte) (int, error) {
+	for len(co.pt) == 0 {
+		if co.err != nil {
+			return 0, co.err
+		} else if co.index == co.chunks {
+			return 0, io.EOF
+		}
+		co.err = co.next()
+	}
+	n := copy(p, co.pt)
+	co.pt = co.pt[n:]
+	return n, nil
+}
+
+// Verify implements MessageOpener.
+func (co *chunkedOpener) Verify() error {
+	_, err := io.Copy(ioutil.Discard, co)
+	return err
+}
+
+// streamChaCha20Poly1305 is the ChaCha20-Poly1305 AEAD of RFC 8439. The Sia
+// protocol seals each message as a single AEAD message, so it implements
+// StreamAEAD by computing the same keystream and MAC incrementally.
+type streamChaCha20Poly1305 struct {
+	cipher.AEAD
+	key []byte
+}
+
+func newStreamChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	return streamChaCha20Poly1305{aead, append([]byte(nil), key...)}, nil
+}
+
+// stream returns the keystream and MAC for a message sealed with nonce.
+func (c streamChaCha20Poly1305) stream(nonce []byte) (*chacha.Cipher, *poly1305.MAC) {
+	s, _ := chacha.NewCipher(nonce, c.key, 20)
+	var polyKey [32]byte
+	s.XORKeyStream(polyKey[:], polyKey[:])
+	s.SetCounter(1)
+	return s, poly1305.New(&polyKey)
+}
+
+// macTail returns the input to the MAC that follows an n-byte ciphertext:
+// padding to a multiple of 16 bytes, followed by the lengths of the additional
+// data (always empty) and the ciphertext.
+func macTail(n uint64) []byte {
+	tail := make([]byte, (16-n%16)%16+16)
+	binary.LittleEndian.PutUint64(tail[len(tail)-8:], n)
+	return tail
+}
+
+// NewSealer implements StreamAEAD.
+func (c streamChaCha20Poly1305) NewSealer(w io.Writer, nonce []byte, n int) io.WriteCloser {
+	s, mac := c.stream(nonce)
+	return &chachaSealer{
+		w:   w,
+		s:   s,
+		mac: mac,
+		buf: make([]byte, 1<<16),
+		rem: n,
+	}
+}
+
+// NewOpener implements StreamAEAD.
+func (c streamChaCha20Poly1305) NewOpener(r io.Reader, nonce []byte, n int) MessageOpener {
+	s, mac := c.stream(nonce)
+	clen := n - poly1305.TagSize
+	return &chachaOpener{
+		ct:   io.LimitedReader{R: r, N: int64(clen)},
+		s:    s,
+		mac:  mac,
+		clen: uint64(clen),
+	}
+}
+
+// chachaSealer seals a ChaCha20-Poly1305 message as it is written.
+type chachaSealer struct {
+	w    io.Writer
+	s    *chacha.Cipher
+	mac  *poly1305.MAC
+	buf  []byte
+	clen uint64 // ciphertext bytes written
+	rem  int    // plaintext bytes not yet written
+	err  error
+}
+
+// Write implements io.Writer.
+func (cs *chachaSealer) Write(p []byte) (int, error) {
+	if cs.err != nil {
+		return 0, cs.err
+	} else if len(p) > cs.rem {
+		cs.err = errSealLength
+		return 0, cs.err
+	}
+	var written int
+	for len(p) > 0 {
+		chunk := cs.buf[:copy(cs.buf, p)]
+		p = p[len(chunk):]
+		cs.s.XORKeyStream(chunk, chunk)
+		cs.mac.Write(chunk)
+		if _, err := cs.w.Write(chunk); err != nil {
+			cs.err = err
+			return written, err
+		}
+		written += len(chunk)
+		cs.clen += uint64(len(chunk))
+		cs.rem -= len(chunk)
+	}
+	return written, nil
+}
+
+// Close implements io.Closer.
+func (cs *chachaSealer) Close() error {
+	if cs.err != nil {
+		return cs.err
+	} else if cs.rem != 0 {
+		cs.err = errSealLength
+		return cs.err
+	}
+	cs.mac.Write(macTail(cs.clen))
+	var tag [poly1305.TagSize]byte
+	cs.mac.Sum(tag[:0])
+	_, cs.err = cs.w.Write(tag[:])
+	return cs.err
+}
+
+// chachaOpener opens a ChaCha20-Poly1305 message as it is read.
+type chachaOpener struct {
+	ct   io.LimitedReader
+	s    *chacha.Cipher
+	mac  *poly1305.MAC
+	clen uint64
+}
+
+// Read implements io.Reader.
+func (co *chachaOpener) Read(p []byte) (int, error) {
+	n, err := co.ct.Read(p)
+	co.mac.Write(p[:n])
+	co.s.XORKeyStream(p[:n], p[:n])
+	return n, err
+}
+
+// Verify implements MessageOpener.
+func (co *chachaOpener) Verify() error {
+	if _, err := io.Copy(ioutil.Discard, co); err != nil {
+		return err
+	} else if co.ct.N > 0 {
+		return io.ErrUnexpectedEOF
+	}
+	var tag [poly1305.TagSize]byte
+	if _, err := io.ReadFull(co.ct.R, tag[:]); err != nil {
+		return err
+	}
+	co.mac.Write(macTail(co.clen))
+	var ourTag [poly1305.TagSize]byte
+	co.mac.Sum(ourTag[:0])
+	if subtle.ConstantTimeCompare(tag[:], ourTag[:]) != 1 {
+		return errors.New("chacha20poly1305: message authentication failed")
+	}
+	return nil
+}
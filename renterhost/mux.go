@@ -0,0 +1,638 @@
+package renterhost
+
+import (
+	"crypto/ed25519"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+	"lukechampine.com/frand"
+)
+
+// Stream multiplexing
+//
+// A renter may propose stream multiplexing by including extStreamMux in the
+// Ciphers of its loopKeyExchangeRequest, and a host that supports it
+// acknowledges by appending extStreamMux to its challenge message. Thereafter,
+// the connection carries frames, each comprising a 4-byte stream ID, 2 bytes
+// of flags, a 2-byte payload length, and the payload itself. The renter opens
+// a stream by sending a frame with flagOpen set, and either party closes it by
+// sending a frame with flagClose set.
+//
+// Each stream is subject to flow control: a party may not send more than
+// maxStreamBuffer bytes of stream data that its peer has not acknowledged. The
+// peer acknowledges data as it is read by sending a frame with flagWindow set,
+// whose 4-byte payload is the number of bytes read. If a party exceeds the
+// window, its peer closes the stream. Thus, a stream that is not being read
+// cannot prevent data from being delivered to other streams.
+//
+// Each stream carries an independent Session. The host begins each stream by
+// sending a fresh challenge, and messages are encrypted with a key derived
+// from the handshake key and the stream ID, so that an attacker cannot move a
+// message from one stream to another.
+
+const (
+	frameHeaderSize = 8
+	maxFramePayload = 1 << 15
+
+	// maxStreamBuffer is the size of each stream's flow control window, i.e.
+	// the amount of unacknowledged data that may be sent on a stream.
+	maxStreamBuffer = 1 << 20
+
+	// maxStreams is the number of streams that a host will allow to be open at
+	// once. Further streams are closed immediately.
+	maxStreams = 64
+
+	flagOpen   = 1 << 0
+	flagClose  = 1 << 1
+	flagWindow = 1 << 2
+)
+
+// ErrMuxClosed is returned when using a closed Mux, or a Stream belonging to a
+// closed Mux.
+var ErrMuxClosed = errors.New("mux has been closed")
+
+// ErrMuxUnsupported is returned by (*Mux).OpenStream if the host does not
+// support multiplexing and the Mux's only stream has already been opened.
+var ErrMuxUnsupported = errors.New("host does not support stream multiplexing")
+
+// errWindowExceeded is returned when reading from a Stream whose peer sent more
+// data than the Stream's flow control window allowed.
+var errWindowExceeded = errors.New("peer exceeded stream flow control window")
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "stream deadline exceeded" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+// notify performs a non-blocking send on ch, which must be buffered.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// A Mux carries multiple Sessions over a single connection, allowing their
+// RPCs to run concurrently. If the peer does not support multiplexing, the Mux
+// carries exactly one Session over the connection, as if the connection were
+// not multiplexed at all.
+type Mux struct {
+	conn     net.Conn
+	cipher   Specifier
+	key      []byte
+	isRenter bool
+	rekey    bool     // whether the peer supports rekeying
+	sess     *Session // non-nil if the connection is not multiplexed
+	taken    bool     // whether sess has been handed out
+
+	wmu  sync.Mutex // serializes frame writes
+	wbuf []byte
+
+	mu      sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32 // lowest ID that may be opened
+	accept  chan *Stream
+	err     error // set when the Mux is closed
+	done    chan struct{}
+}
+
+// Multiplexed returns whether the peer supports multiplexing. If it does not,
+// the Mux carries only one stream.
+func (m *Mux) Multiplexed() bool { return m.sess == nil }
+
+func (m *Mux) setErr(err error) {
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return
+	}
+	m.err = err
+	streams := m.streams
+	m.streams = nil
+	m.mu.Unlock()
+	close(m.done)
+	m.conn.Close()
+	for _, st := range streams {
+		st.setErr(err)
+	}
+}
+
+func (m *Mux) getErr() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+func (m *Mux) writeFrame(id uint32, flags uint16, p []byte, deadline time.Time) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	if err := m.getErr(); err != nil {
+		return err
+	}
+	m.wbuf = append(m.wbuf[:0], make([]byte, frameHeaderSize)...)
+	binary.LittleEndian.PutUint32(m.wbuf[0:], id)
+	binary.LittleEndian.PutUint16(m.wbuf[4:], flags)
+	binary.LittleEndian.PutUint16(m.wbuf[6:], uint16(len(p)))
+	m.wbuf = append(m.wbuf, p...)
+	m.conn.SetWriteDeadline(deadline)
+	if _, err := m.conn.Write(m.wbuf); err != nil {
+		// a partially-written frame cannot be recovered from
+		m.setErr(err)
+		return err
+	}
+	return nil
+}
+
+// stream returns the stream with the specified ID, opening it if the frame
+// requests it.
+func (m *Mux) stream(id uint32, flags uint16) *Stream {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if st, ok := m.streams[id]; ok || m.err != nil {
+		return st
+	}
+	if m.isRenter || flags&flagOpen == 0 || id < m.nextID {
+		// stream was already closed (or never existed); discard the frame
+		return nil
+	}
+	m.nextID = id + 1
+	if len(m.streams) >= maxStreams {
+		go m.writeFrame(id, flagClose, nil, time.Now().Add(time.Minute))
+		return nil
+	}
+	st := newStream(m, id)
+	m.streams[id] = st
+	m.accept <- st // never blocks, since len(m.accept) <= len(m.streams)
+	return st
+}
+
+// reset closes a stream whose peer has violated the multiplexing protocol.
+func (m *Mux) reset(st *Stream, err error) {
+	m.mu.Lock()
+	delete(m.streams, st.id)
+	m.mu.Unlock()
+	st.mu.Lock()
+	st.buf = nil
+	st.err = err
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+	go m.writeFrame(st.id, flagClose, nil, time.Now().Add(time.Minute))
+}
+
+func (m *Mux) readLoop() {
+	header := make([]byte, frameHeaderSize)
+	for {
+		if _, err := io.ReadFull(m.conn, header); err != nil {
+			m.setErr(err)
+			return
+		}
+		id := binary.LittleEndian.Uint32(header[0:])
+		flags := binary.LittleEndian.Uint16(header[4:])
+		n := binary.LittleEndian.Uint16(header[6:])
+		if n > maxFramePayload {
+			m.setErr(errors.Errorf("peer sent oversized frame (%v bytes)", n))
+			return
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(m.conn, payload); err != nil {
+			m.setErr(err)
+			return
+		}
+		st := m.stream(id, flags)
+		if st == nil {
+			continue
+		}
+		if flags&flagWindow != 0 {
+			if len(payload) != 4 {
+				m.setErr(errors.Errorf("peer sent invalid window update (%v bytes)", len(payload)))
+				return
+			}
+			st.grow(binary.LittleEndian.Uint32(payload))
+		} else if len(payload) > 0 && !st.push(payload) {
+			m.reset(st, errWindowExceeded)
+			continue
+		}
+		if flags&flagClose != 0 {
+			st.setErr(io.EOF)
+		}
+	}
+}
+
+// newSession returns a Session for the specified stream, keyed to its ID.
+func (m *Mux) newSession(id uint32, conn io.ReadWriteCloser) *Session {
+	buf := make([]byte, len(m.key)+4)
+	copy(buf, m.key)
+	binary.LittleEndian.PutUint32(buf[len(m.key):], id)
+	key := blake2b.Sum256(buf)
+	// no error possible, since the cipher was already initialized with a key
+	// of the same size
+	aead, _, _ := newCipher(m.cipher, key[:])
+	return &Session{
+		conn:     conn,
+		cipher:   m.cipher,
+		send:     sessionKey{key: key[:], aead: aead},
+		recv:     sessionKey{key: key[:], aead: aead},
+		isRenter: m.isRenter,
+		rekey:    m.rekey,
+	}
+}
+
+// OpenStream opens a new stream. It is only valid for renters. Use
+// (*Stream).RenterSession to begin a Session on the stream.
+func (m *Mux) OpenStream() (_ *Stream, err error) {
+	defer wrapErr(&err, "OpenStream")
+	m.mu.Lock()
+	if m.err != nil {
+		m.mu.Unlock()
+		return nil, m.err
+	} else if m.sess != nil {
+		defer m.mu.Unlock()
+		if m.taken {
+			return nil, ErrMuxUnsupported
+		}
+		m.taken = true
+		return &Stream{m: m}, nil
+	} else if m.nextID == 0 {
+		m.mu.Unlock()
+		return nil, errors.New("stream IDs exhausted")
+	}
+	st := newStream(m, m.nextID)
+	m.streams[st.id] = st
+	m.nextID++
+	m.mu.Unlock()
+
+	if err := m.writeFrame(st.id, flagOpen, nil, time.Now().Add(time.Minute)); err != nil {
+		st.Close()
+		return nil, err
+	}
+	return st, nil
+}
+
+// AcceptStream waits for the renter to open a new stream. It is only valid for
+// hosts. Use (*Stream).HostSession to begin a Session on the stream.
+func (m *Mux) AcceptStream() (*Stream, error) {
+	if m.sess != nil {
+		m.mu.Lock()
+		if !m.taken && m.err == nil {
+			m.taken = true
+			m.mu.Unlock()
+			return &Stream{m: m}, nil
+		}
+		m.mu.Unlock()
+		// the connection can only carry one stream; wait for it to close
+		<-m.done
+		return nil, m.getErr()
+	}
+	select {
+	case st := <-m.accept:
+		return st, nil
+	case <-m.done:
+		return nil, m.getErr()
+	}
+}
+
+// Close closes the Mux and all of its streams. Sessions should be closed
+// beforehand in order to terminate them gracefully.
+func (m *Mux) Close() error {
+	m.setErr(ErrMuxClosed)
+	return nil
+}
+
+func newMux(conn net.Conn, s *Session, multiplexed bool) *Mux {
+	m := &Mux{
+		conn:     conn,
+		cipher:   s.cipher,
+		key:      s.send.key,
+		isRenter: s.isRenter,
+		rekey:    s.rekey,
+		done:     make(chan struct{}),
+	}
+	if !multiplexed {
+		m.sess = s
+		return m
+	}
+	m.streams = make(map[uint32]*Stream)
+	m.nextID = 1
+	m.accept = make(chan *Stream, maxStreams)
+	// the Mux manages deadlines on a per-stream basis
+	conn.SetDeadline(time.Time{})
+	go m.readLoop()
+	return m
+}
+
+// NewHostMux conducts the host's half of the renter-host protocol handshake,
+// returning a Mux that can be used to accept streams from the renter. If the
+// renter did not propose multiplexing, the Mux will yield a single stream.
+func NewHostMux(conn net.Conn, priv ed25519.PrivateKey) (_ *Mux, err error) {
+	defer wrapErr(&err, "NewHostMux")
+	s, multiplexed, err := newHostSession(conn, priv, SupportedCiphers(), true)
+	if err != nil {
+		return nil, err
+	}
+	return newMux(conn, s, multiplexed), nil
+}
+
+// NewRenterMux conducts the renter's half of the renter-host protocol
+// handshake, proposing stream multiplexing, and returns a Mux that can be used
+// to open streams to the host. If the host does not support multiplexing, the
+// Mux will yield a single stream.
+func NewRenterMux(conn net.Conn, pub ed25519.PublicKey) (_ *Mux, err error) {
+	defer wrapErr(&err, "NewRenterMux")
+	s, multiplexed, err := newRenterSession(conn, pub, RenterCipherPreference, true)
+	if err != nil {
+		return nil, err
+	}
+	return newMux(conn, s, multiplexed), nil
+}
+
+// A Stream is a logical connection carried by a Mux. It implements net.Conn.
+type Stream struct {
+	m  *Mux
+	id uint32
+
+	mu         sync.Mutex
+	buf        []byte
+	err        error // returned by Read once buf is empty
+	closed     bool
+	rdeadline  time.Time
+	wdeadline  time.Time
+	sendWindow int // bytes we may send before the peer acknowledges them
+	recvWindow int // bytes the peer may send before we acknowledge them
+	unacked    int // bytes read, but not yet acknowledged
+	readable   chan struct{}
+	writable   chan struct{}
+}
+
+func newStream(m *Mux, id uint32) *Stream {
+	return &Stream{
+		m:          m,
+		id:         id,
+		sendWindow: maxStreamBuffer,
+		recvWindow: maxStreamBuffer,
+		readable:   make(chan struct{}, 1),
+		writable:   make(chan struct{}, 1),
+	}
+}
+
+// fallback returns whether the Stream is the Mux's underlying connection.
+func (st *Stream) fallback() bool { return st.m.sess != nil }
+
+func (st *Stream) setErr(err error) {
+	st.mu.Lock()
+	if st.err == nil {
+		st.err = err
+	}
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+}
+
+// push appends p to the stream's buffer. It returns false if p exceeds the
+// stream's flow control window.
+func (st *Stream) push(p []byte) bool {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if len(p) > st.recvWindow {
+		return false
+	}
+	st.recvWindow -= len(p)
+	if st.closed || st.err != nil {
+		return true
+	}
+	st.buf = append(st.buf, p...)
+	notify(st.readable)
+	return true
+}
+
+// grow increases the stream's send window by n bytes.
+func (st *Stream) grow(n uint32) {
+	st.mu.Lock()
+	st.sendWindow += int(n)
+	st.mu.Unlock()
+	notify(st.writable)
+}
+
+// wait blocks until ch is notified or the deadline is reached, returning false
+// in the latter case.
+func wait(ch chan struct{}, deadline time.Time) bool {
+	if deadline.IsZero() {
+		<-ch
+		return true
+	} else if !time.Now().Before(deadline) {
+		return false
+	}
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+	select {
+	case <-ch:
+		return true
+	case <-t.C:
+		return false
+	}
+}
+
+// Read implements net.Conn.
+func (st *Stream) Read(p []byte) (int, error) {
+	if st.fallback() {
+		return st.m.conn.Read(p)
+	}
+	for {
+		st.mu.Lock()
+		if st.closed {
+			st.mu.Unlock()
+			return 0, io.ErrClosedPipe
+		} else if len(st.buf) > 0 {
+			n := copy(p, st.buf)
+			st.buf = st.buf[n:]
+			// acknowledge the data once half of the window has been read, so
+			// that the peer can continue sending while we read the rest
+			var ack int
+			st.unacked += n
+			if st.unacked >= maxStreamBuffer/2 {
+				ack, st.unacked = st.unacked, 0
+				st.recvWindow += ack
+			}
+			deadline := st.wdeadline
+			st.mu.Unlock()
+			if ack > 0 {
+				if deadline.IsZero() {
+					deadline = time.Now().Add(time.Minute)
+				}
+				var buf [4]byte
+				binary.LittleEndian.PutUint32(buf[:], uint32(ack))
+				st.m.writeFrame(st.id, flagWindow, buf[:], deadline) // errors are handled by the Mux
+			}
+			return n, nil
+		} else if st.err != nil {
+			err := st.err
+			st.mu.Unlock()
+			return 0, err
+		}
+		deadline := st.rdeadline
+		st.mu.Unlock()
+
+		if !wait(st.readable, deadline) {
+			return 0, timeoutError{}
+		}
+	}
+}
+
+// Write implements net.Conn.
+func (st *Stream) Write(p []byte) (int, error) {
+	if st.fallback() {
+		return st.m.conn.Write(p)
+	}
+	var n int
+	for len(p) > 0 {
+		st.mu.Lock()
+		closed, err, deadline, window := st.closed, st.err, st.wdeadline, st.sendWindow
+		if closed || err == io.EOF {
+			st.mu.Unlock()
+			return n, io.ErrClosedPipe
+		} else if err != nil {
+			st.mu.Unlock()
+			return n, err
+		} else if !deadline.IsZero() && !time.Now().Before(deadline) {
+			st.mu.Unlock()
+			return n, timeoutError{}
+		} else if window == 0 {
+			st.mu.Unlock()
+			// wait for the peer to acknowledge some data
+			if !wait(st.writable, deadline) {
+				return n, timeoutError{}
+			}
+			continue
+		}
+		if window > len(p) {
+			window = len(p)
+		}
+		if window > maxFramePayload {
+			window = maxFramePayload
+		}
+		st.sendWindow -= window
+		st.mu.Unlock()
+
+		chunk := p[:window]
+		if err := st.m.writeFrame(st.id, 0, chunk, deadline); err != nil {
+			return n, err
+		}
+		n += len(chunk)
+		p = p[len(chunk):]
+	}
+	return n, nil
+}
+
+// Close implements net.Conn. If the Mux is not multiplexed, closing its stream
+// closes the Mux.
+func (st *Stream) Close() error {
+	if st.fallback() {
+		st.m.setErr(ErrMuxClosed)
+		return nil
+	}
+	st.mu.Lock()
+	if st.closed {
+		st.mu.Unlock()
+		return nil
+	}
+	st.closed = true
+	st.buf = nil
+	deadline := st.wdeadline
+	st.mu.Unlock()
+	notify(st.readable)
+	notify(st.writable)
+
+	st.m.mu.Lock()
+	delete(st.m.streams, st.id)
+	st.m.mu.Unlock()
+	if deadline.IsZero() {
+		deadline = time.Now().Add(time.Minute)
+	}
+	st.m.writeFrame(st.id, flagClose, nil, deadline) // best effort
+	return nil
+}
+
+// LocalAddr implements net.Conn.
+func (st *Stream) LocalAddr() net.Addr { return st.m.conn.LocalAddr() }
+
+// RemoteAddr implements net.Conn.
+func (st *Stream) RemoteAddr() net.Addr { return st.m.conn.RemoteAddr() }
+
+// SetDeadline implements net.Conn.
+func (st *Stream) SetDeadline(t time.Time) error {
+	if st.fallback() {
+		return st.m.conn.SetDeadline(t)
+	}
+	st.SetReadDeadline(t)
+	st.SetWriteDeadline(t)
+	return nil
+}
+
+// SetReadDeadline implements net.Conn.
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	if st.fallback() {
+		return st.m.conn.SetReadDeadline(t)
+	}
+	st.mu.Lock()
+	st.rdeadline = t
+	st.mu.Unlock()
+	notify(st.readable) // wake any blocked Read so that it sees the new deadline
+	return nil
+}
+
+// SetWriteDeadline implements net.Conn. Since all streams share the Mux's
+// connection, a Write that exceeds its deadline while writing to the
+// connection closes the Mux. (A Write that exceeds its deadline while waiting
+// for the peer to read the stream does not.)
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	if st.fallback() {
+		return st.m.conn.SetWriteDeadline(t)
+	}
+	st.mu.Lock()
+	st.wdeadline = t
+	st.mu.Unlock()
+	notify(st.writable) // wake any blocked Write so that it sees the new deadline
+	return nil
+}
+
+// RenterSession returns a Session for making RPC requests on the stream. conn
+// is used for all I/O on the Session; it must be st itself, or wrap st (e.g.
+// to track bandwidth usage).
+func (st *Stream) RenterSession(conn io.ReadWriteCloser) (_ *Session, err error) {
+	defer wrapErr(&err, "RenterSession")
+	if st.fallback() {
+		st.m.sess.conn = conn
+		return st.m.sess, nil
+	}
+	s := st.m.newSession(st.id, conn)
+	var challenge loopChallenge
+	if err := s.readMessage(&challenge, MinMessageSize); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	s.challenge = challenge.Challenge
+	return s, nil
+}
+
+// HostSession returns a Session for handling RPC requests on the stream. conn
+// is used for all I/O on the Session; it must be st itself, or wrap st.
+func (st *Stream) HostSession(conn io.ReadWriteCloser) (_ *Session, err error) {
+	defer wrapErr(&err, "HostSession")
+	if st.fallback() {
+		st.m.sess.conn = conn
+		return st.m.sess, nil
+	}
+	s := st.m.newSession(st.id, conn)
+	s.challenge = frand.Entropy128()
+	if err := s.writeMessage(&loopChallenge{Challenge: s.challenge}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return s, nil
+}
@@ -0,0 +1,160 @@
+package renterhost
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/blake2b"
+	"lukechampine.com/frand"
+)
+
+// Rekeying
+//
+// A renter may propose rekeying by including extRekey in the Ciphers of its
+// loopKeyExchangeRequest, and a host that supports it acknowledges by
+// including extRekey in its challenge message. Thereafter, each party
+// independently replaces the key used to encrypt its outgoing messages after
+// sending a certain number of bytes or messages. To do so, it sends a rekey
+// message: a message whose length prefix has rekeyFlag set, and whose
+// plaintext is rekeyMarker. The rekey message is encrypted with the old key;
+// all subsequent messages are encrypted with the new key, which is derived
+// from the old key. Rekey messages are handled transparently, and are not
+// recorded in transcripts.
+//
+// Since nonces are chosen at random, a key can only be used for a limited
+// number of messages before the probability of a nonce collision becomes
+// unacceptable. A Session will not exceed this limit; if it is reached and the
+// peer does not support rekeying, the Session is closed with
+// ErrNonceExhausted.
+
+const (
+	// DefaultRekeyBytes is the default number of bytes that a Session sends
+	// before rekeying.
+	DefaultRekeyBytes = 1 << 36 // 64 GiB
+
+	// DefaultRekeyMessages is the default number of messages that a Session
+	// sends before rekeying.
+	DefaultRekeyMessages = 1 << 24
+
+	// maxKeyMessages is the number of messages that may be encrypted with a
+	// single key. With random 96-bit nonces, this keeps the probability of a
+	// collision below 2^-32.
+	maxKeyMessages = 1 << 32
+
+	rekeyFlag = 1 << 63
+)
+
+var rekeyMarker = newSpecifier("Rekey")
+
+// ErrNonceExhausted is returned when a Session key has been used for the
+// maximum number of messages, and the peer does not support rekeying.
+var ErrNonceExhausted = errors.New("session key has been used for the maximum number of messages")
+
+// A sessionKey encrypts or decrypts the messages sent in one direction.
+type sessionKey struct {
+	key   []byte // from which derived keys are computed
+	aead  messageCipher
+	msgs  uint64 // messages sealed or opened with the key
+	bytes uint64 // bytes sealed with the key
+}
+
+// ratchet replaces k with a new key derived from it.
+func (k *sessionKey) ratchet(cipherID Specifier) {
+	buf := make([]byte, len(k.key)+len(rekeyMarker))
+	copy(buf, k.key)
+	copy(buf[len(k.key):], rekeyMarker[:])
+	key := blake2b.Sum256(buf)
+	// no error possible, since the cipher was already initialized with a key
+	// of the same size
+	aead, _, _ := newCipher(cipherID, key[:])
+	*k = sessionKey{
+		key:  key[:],
+		aead: aead,
+	}
+}
+
+// SetRekeyInterval sets the number of bytes and messages that the Session may
+// send before replacing its key. A value of zero selects the default. Rekeying
+// only occurs if the peer supports it.
+func (s *Session) SetRekeyInterval(bytes, messages uint64) {
+	s.rekeyBytes, s.rekeyMsgs = bytes, messages
+}
+
+// rekeyDue returns whether the Session should rekey before sending another
+// message.
+func (s *Session) rekeyDue() bool {
+	maxBytes, maxMsgs := s.rekeyBytes, s.rekeyMsgs
+	if maxBytes == 0 {
+		maxBytes = DefaultRekeyBytes
+	}
+	if maxMsgs == 0 {
+		maxMsgs = DefaultRekeyMessages
+	} else if maxMsgs > maxKeyMessages-1 {
+		maxMsgs = maxKeyMessages - 1 // leave room for the rekey message itself
+	}
+	return s.send.bytes >= maxBytes || s.send.msgs >= maxMsgs
+}
+
+// prepareSend must be called before sending a message of size n. It rekeys if
+// necessary, and closes the Session if the key is exhausted.
+func (s *Session) prepareSend(n int) error {
+	if s.rekey && s.rekeyDue() {
+		if err := s.writeRekey(); err != nil {
+			return err
+		}
+	}
+	if s.send.msgs >= maxKeyMessages {
+		s.setErr(ErrNonceExhausted)
+		return ErrNonceExhausted
+	}
+	s.send.msgs++
+	s.send.bytes += uint64(n)
+	return nil
+}
+
+// writeRekey sends a rekey message and replaces the outgoing key.
+func (s *Session) writeRekey() error {
+	nonceSize := s.send.aead.NonceSize()
+	msg := make([]byte, 8+nonceSize+s.send.aead.sealedSize(len(rekeyMarker)))
+	binary.LittleEndian.PutUint64(msg, uint64(len(msg)-8)|rekeyFlag)
+	nonce := msg[8:][:nonceSize]
+	frand.Read(nonce)
+	copy(msg[8+nonceSize:], rekeyMarker[:])
+	s.send.aead.seal(msg[8+nonceSize:], nonce, len(rekeyMarker))
+	_, err := s.conn.Write(msg)
+	s.setErr(err)
+	if err != nil {
+		return err
+	}
+	s.send.ratchet(s.cipher)
+	return nil
+}
+
+// readRekey reads the remainder of a rekey message, whose length prefix
+// indicated the specified size, and replaces the incoming key.
+func (s *Session) readRekey(size uint64) error {
+	nonceSize := s.recv.aead.NonceSize()
+	if size != uint64(nonceSize+s.recv.aead.sealedSize(len(rekeyMarker))) {
+		err := errors.Errorf("rekey message has invalid size (%v bytes)", size)
+		s.setErr(err)
+		return err
+	}
+	s.inbuf.reset()
+	if err := s.inbuf.copyN(s.conn, size); err != nil {
+		s.setErr(err)
+		return err
+	}
+	nonce := s.inbuf.next(nonceSize)
+	payload := s.inbuf.bytes()
+	plaintext, err := s.recv.aead.open(payload, nonce)
+	if err == nil && !bytes.Equal(plaintext, rekeyMarker[:]) {
+		err = errors.New("rekey message has invalid contents")
+	}
+	if err != nil {
+		s.setErr(err) // not an I/O error, but still fatal
+		return err
+	}
+	s.recv.ratchet(s.cipher)
+	return nil
+}
@@ -0,0 +1,138 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"math"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/ed25519hash"
+	"lukechampine.com/us/renterhost"
+)
+
+// ReviseContract returns a revision of current with the revision number and
+// output values requested by the renter. The unlock hashes of the outputs are
+// unchanged.
+func ReviseContract(current types.FileContractRevision, revisionNumber uint64, valid, missed []types.Currency) (types.FileContractRevision, error) {
+	if len(valid) != len(current.NewValidProofOutputs) {
+		return types.FileContractRevision{}, errors.New("wrong number of valid proof values")
+	} else if len(missed) != len(current.NewMissedProofOutputs) {
+		return types.FileContractRevision{}, errors.New("wrong number of missed proof values")
+	}
+	rev := current
+	rev.NewRevisionNumber = revisionNumber
+	rev.NewValidProofOutputs = make([]types.SiacoinOutput, len(valid))
+	for i := range rev.NewValidProofOutputs {
+		rev.NewValidProofOutputs[i] = types.SiacoinOutput{
+			Value:      valid[i],
+			UnlockHash: current.NewValidProofOutputs[i].UnlockHash,
+		}
+	}
+	rev.NewMissedProofOutputs = make([]types.SiacoinOutput, len(missed))
+	for i := range rev.NewMissedProofOutputs {
+		rev.NewMissedProofOutputs[i] = types.SiacoinOutput{
+			Value:      missed[i],
+			UnlockHash: current.NewMissedProofOutputs[i].UnlockHash,
+		}
+	}
+	return rev, nil
+}
+
+func sumOutputs(outputs []types.SiacoinOutput) (sum types.Currency) {
+	for _, o := range outputs {
+		sum = sum.Add(o.Value)
+	}
+	return
+}
+
+// ValidateRevision checks that rev is an acceptable revision of current. In
+// particular, rev must transfer at least cost from the renter's valid output to
+// the host's valid output, and may move at most collateral from the host's
+// missed output to the void output. ValidateRevision does not check the
+// renter's signature; see VerifyRevisionSignature.
+func ValidateRevision(current, rev types.FileContractRevision, cost, collateral types.Currency) error {
+	switch {
+	case rev.ParentID != current.ParentID:
+		return errors.New("revision has wrong parent ID")
+	case current.NewRevisionNumber == math.MaxUint64:
+		return errors.New("contract cannot be revised further")
+	case rev.NewRevisionNumber <= current.NewRevisionNumber:
+		return errors.New("revision number must increase")
+	case len(current.NewValidProofOutputs) != 2 || len(current.NewMissedProofOutputs) != 3:
+		return errors.New("contract has wrong number of outputs")
+	case len(rev.NewValidProofOutputs) != 2 || len(rev.NewMissedProofOutputs) != 3:
+		return errors.New("revision has wrong number of outputs")
+	case !sumOutputs(rev.NewValidProofOutputs).Equals(sumOutputs(current.NewValidProofOutputs)):
+		return errors.New("revision changes total valid payout")
+	case !sumOutputs(rev.NewMissedProofOutputs).Equals(sumOutputs(current.NewMissedProofOutputs)):
+		return errors.New("revision changes total missed payout")
+	}
+
+	oldValid, newValid := current.NewValidProofOutputs, rev.NewValidProofOutputs
+	oldMissed, newMissed := current.NewMissedProofOutputs, rev.NewMissedProofOutputs
+	switch {
+	case newValid[1].Value.Cmp(oldValid[1].Value.Add(cost)) < 0:
+		return errors.Errorf("revision pays host %v H (previously %v H), expected an increase of at least %v H", newValid[1].Value, oldValid[1].Value, cost)
+	case newMissed[0].Value.Cmp(oldMissed[0].Value) > 0:
+		return errors.New("revision increases renter's missed payout")
+	case newMissed[2].Value.Cmp(oldMissed[2].Value) < 0:
+		return errors.New("revision decreases void payout")
+	case newMissed[1].Value.Add(collateral).Cmp(oldMissed[1].Value) < 0:
+		return errors.Errorf("revision risks %v H of host collateral, expected at most %v H", oldMissed[1].Value.Sub(newMissed[1].Value), collateral)
+	}
+	return nil
+}
+
+// VerifyRevisionSignature checks that sig is the renter's signature of rev.
+func VerifyRevisionSignature(rev types.FileContractRevision, sig []byte) error {
+	if len(rev.UnlockConditions.PublicKeys) == 0 {
+		return errors.New("revision has no renter key")
+	}
+	renterKey := rev.UnlockConditions.PublicKeys[0]
+	if renterKey.Algorithm != types.SignatureEd25519 || len(renterKey.Key) != ed25519.PublicKeySize {
+		return errors.New("renter key is not an ed25519 key")
+	} else if !ed25519hash.Verify(renterKey.Key, renterhost.HashRevision(rev), sig) {
+		return errors.New("renter's signature is invalid")
+	}
+	return nil
+}
+
+// finalRevision returns the final revision of current, which is cleared when
+// the contract is renewed. Both the valid and missed payouts of the final
+// revision are set to the values in valid, which must transfer at least price
+// (or the renter's remaining funds, if less) to the host.
+func finalRevision(current types.FileContractRevision, valid, missed []types.Currency, price types.Currency) (types.FileContractRevision, error) {
+	if current.NewRevisionNumber == math.MaxUint64 {
+		return types.FileContractRevision{}, errors.New("contract cannot be revised further")
+	} else if len(valid) != len(current.NewValidProofOutputs) || len(missed) != len(valid) {
+		return types.FileContractRevision{}, errors.New("wrong number of final proof values")
+	}
+	for i := range valid {
+		if !valid[i].Equals(missed[i]) {
+			return types.FileContractRevision{}, errors.New("final valid and missed proof values must be identical")
+		}
+	}
+	rev := current
+	rev.NewRevisionNumber = math.MaxUint64
+	rev.NewFileSize = 0
+	rev.NewFileMerkleRoot = crypto.Hash{}
+	rev.NewValidProofOutputs = make([]types.SiacoinOutput, len(valid))
+	for i := range rev.NewValidProofOutputs {
+		rev.NewValidProofOutputs[i] = types.SiacoinOutput{
+			Value:      valid[i],
+			UnlockHash: current.NewValidProofOutputs[i].UnlockHash,
+		}
+	}
+	rev.NewMissedProofOutputs = rev.NewValidProofOutputs
+
+	if price.Cmp(current.ValidRenterPayout()) > 0 {
+		price = current.ValidRenterPayout()
+	}
+	if !sumOutputs(rev.NewValidProofOutputs).Equals(sumOutputs(current.NewValidProofOutputs)) {
+		return types.FileContractRevision{}, errors.New("final revision changes total valid payout")
+	} else if rev.ValidHostPayout().Cmp(current.ValidHostPayout().Add(price)) < 0 {
+		return types.FileContractRevision{}, errors.Errorf("final revision pays host %v H (previously %v H), expected an increase of at least %v H", rev.ValidHostPayout(), current.ValidHostPayout(), price)
+	}
+	return rev, nil
+}
@@ -0,0 +1,672 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math/bits"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519hash"
+	"lukechampine.com/us/merkle"
+	"lukechampine.com/us/renterhost"
+)
+
+// storageDuration returns the number of blocks for which data added to the
+// contract must be stored.
+func (srv *Server) storageDuration(rev types.FileContractRevision) uint64 {
+	height := srv.BlockHeight()
+	if rev.NewWindowEnd <= height {
+		return 0
+	}
+	return uint64(rev.NewWindowEnd - height)
+}
+
+func (srv *Server) signRevision(rev types.FileContractRevision) []byte {
+	return ed25519hash.Sign(srv.key, renterhost.HashRevision(rev))
+}
+
+// initialRevision returns the initial (no-op) revision of the contract in txn,
+// along with the host's signature of it.
+func (srv *Server) initialRevision(txn types.Transaction, uc types.UnlockConditions) (types.FileContractRevision, types.TransactionSignature) {
+	fc := txn.FileContracts[0]
+	rev := types.FileContractRevision{
+		ParentID:          txn.FileContractID(0),
+		UnlockConditions:  uc,
+		NewRevisionNumber: 1,
+
+		NewFileSize:           fc.FileSize,
+		NewFileMerkleRoot:     fc.FileMerkleRoot,
+		NewWindowStart:        fc.WindowStart,
+		NewWindowEnd:          fc.WindowEnd,
+		NewValidProofOutputs:  fc.ValidProofOutputs,
+		NewMissedProofOutputs: fc.MissedProofOutputs,
+		NewUnlockHash:         fc.UnlockHash,
+	}
+	sig := types.TransactionSignature{
+		ParentID:       crypto.Hash(rev.ParentID),
+		CoveredFields:  types.CoveredFields{FileContractRevisions: []uint64{0}},
+		PublicKeyIndex: 1,
+		Signature:      srv.signRevision(rev),
+	}
+	return rev, sig
+}
+
+func checkContractTransaction(txns []types.Transaction) error {
+	if len(txns) == 0 {
+		return errors.New("transaction set is empty")
+	}
+	txn := txns[len(txns)-1]
+	if len(txn.FileContracts) == 0 {
+		return errors.New("transaction does not contain a file contract")
+	}
+	fc := txn.FileContracts[0]
+	if len(fc.ValidProofOutputs) != 2 || len(fc.MissedProofOutputs) != 3 {
+		return errors.New("file contract has wrong number of outputs")
+	}
+	return nil
+}
+
+func (srv *Server) rpcSettings(s *Session) error {
+	s.ExtendDeadline(60 * time.Second)
+	hs := srv.settings()
+	if hs.Capabilities == nil {
+		hs.Capabilities = srv.Capabilities()
+	}
+	settings, _ := json.Marshal(hs)
+	resp := &renterhost.RPCSettingsResponse{
+		Settings: settings,
+	}
+	return s.WriteResponse(resp, nil)
+}
+
+func (srv *Server) rpcFormContract(s *Session) error {
+	s.ExtendDeadline(120 * time.Second)
+
+	var req renterhost.RPCFormContractRequest
+	if err := s.ReadRequest(&req, 4096); err != nil {
+		return err
+	}
+	if err := checkContractTransaction(req.Transactions); err != nil {
+		s.WriteResponse(nil, err)
+		return err
+	}
+	txn := req.Transactions[len(req.Transactions)-1]
+
+	resp := &renterhost.RPCFormContractAdditions{
+		Parents: nil,
+		Inputs:  nil,
+		Outputs: nil,
+	}
+	if err := s.WriteResponse(resp, nil); err != nil {
+		return err
+	}
+
+	initRevision, hostRevisionSig := srv.initialRevision(txn, types.UnlockConditions{
+		PublicKeys: []types.SiaPublicKey{
+			req.RenterKey,
+			srv.PublicKey().SiaPublicKey(),
+		},
+		SignaturesRequired: 2,
+	})
+
+	var renterSigs renterhost.RPCFormContractSignatures
+	if err := s.ReadResponse(&renterSigs, 4096); err != nil {
+		return err
+	}
+	if err := VerifyRevisionSignature(initRevision, renterSigs.RevisionSignature.Signature); err != nil {
+		s.WriteResponse(nil, err)
+		return err
+	}
+
+	err := srv.contracts.AddContract(Contract{
+		Revision: initRevision,
+		Signatures: [2]types.TransactionSignature{
+			renterSigs.RevisionSignature,
+			hostRevisionSig,
+		},
+	})
+	if err != nil {
+		s.WriteResponse(nil, errors.New("internal error"))
+		return err
+	}
+
+	hostSigs := &renterhost.RPCFormContractSignatures{
+		ContractSignatures: nil,
+		RevisionSignature:  hostRevisionSig,
+	}
+	return s.WriteResponse(hostSigs, nil)
+}
+
+func (srv *Server) rpcRenewAndClearContract(s *Session) error {
+	s.ExtendDeadline(120 * time.Second)
+
+	var req renterhost.RPCRenewAndClearContractRequest
+	if err := s.ReadRequest(&req, 4096); err != nil {
+		return err
+	}
+
+	c := s.Contract()
+	if c == nil {
+		err := errors.New("no contract locked")
+		s.WriteResponse(nil, err)
+		return err
+	} else if err := checkContractTransaction(req.Transactions); err != nil {
+		s.WriteResponse(nil, err)
+		return err
+	}
+	txn := req.Transactions[len(req.Transactions)-1]
+
+	// construct and validate the final revision of the old contract
+	current := c.Revision
+	finalRev, err := finalRevision(current, req.FinalValidProofValues, req.FinalMissedProofValues, srv.settings().BaseRPCPrice)
+	if err != nil {
+		s.WriteResponse(nil, err)
+		return err
+	}
+
+	resp := &renterhost.RPCFormContractAdditions{
+		Parents: nil,
+		Inputs:  nil,
+		Outputs: nil,
+	}
+	if err := s.WriteResponse(resp, nil); err != nil {
+		return err
+	}
+
+	initRevision, hostRevisionSig := srv.initialRevision(txn, current.UnlockConditions)
+
+	var renterSigs renterhost.RPCRenewAndClearContractSignatures
+	if err := s.ReadResponse(&renterSigs, 4096); err != nil {
+		return err
+	}
+	if err := VerifyRevisionSignature(initRevision, renterSigs.RevisionSignature.Signature); err != nil {
+		s.WriteResponse(nil, err)
+		return err
+	} else if err := VerifyRevisionSignature(finalRev, renterSigs.FinalRevisionSignature); err != nil {
+		s.WriteResponse(nil, err)
+		return err
+	}
+
+	// move the sectors of the old contract to the new contract
+	hostFinalSig := srv.signRevision(finalRev)
+	err = srv.contracts.AddContract(Contract{
+		Revision: initRevision,
+		Signatures: [2]types.TransactionSignature{
+			renterSigs.RevisionSignature,
+			hostRevisionSig,
+		},
+		SectorRoots: c.SectorRoots,
+	})
+	if err == nil {
+		final := *c
+		final.Revision = finalRev
+		final.Signatures[0].Signature = renterSigs.FinalRevisionSignature
+		final.Signatures[1].Signature = hostFinalSig
+		final.SectorRoots = nil
+		err = s.UpdateContract(final)
+	}
+	if err != nil {
+		s.WriteResponse(nil, errors.New("internal error"))
+		return err
+	}
+
+	hostSigs := &renterhost.RPCRenewAndClearContractSignatures{
+		ContractSignatures:     nil,
+		RevisionSignature:      hostRevisionSig,
+		FinalRevisionSignature: hostFinalSig,
+	}
+	return s.WriteResponse(hostSigs, nil)
+}
+
+func (srv *Server) rpcLock(s *Session) error {
+	s.ExtendDeadline(60 * time.Second)
+
+	var req renterhost.RPCLockRequest
+	if err := s.ReadRequest(&req, 4096); err != nil {
+		return err
+	}
+
+	if s.Contract() != nil {
+		err := errors.New("another contract is already locked")
+		s.WriteResponse(nil, err)
+		return err
+	}
+	c, err := srv.contracts.Contract(req.ContractID)
+	if err != nil || !s.VerifyChallenge(req.Signature, c.RenterKey().Key) {
+		err := errors.New("bad signature or no such contract")
+		s.WriteResponse(nil, err)
+		return err
+	}
+
+	timeout := time.Duration(req.Timeout) * time.Millisecond
+	if timeout > time.Minute {
+		timeout = time.Minute
+	}
+	s.ExtendDeadline(60*time.Second + timeout)
+	lc, err := s.LockContract(req.ContractID, timeout)
+	if err == ErrContractLocked {
+		// the renter still expects the latest revision
+		lc = &c
+	} else if err != nil {
+		s.WriteResponse(nil, errors.New("internal error"))
+		return err
+	}
+
+	var newChallenge [16]byte
+	frand.Read(newChallenge[:])
+	s.SetChallenge(newChallenge)
+	resp := &renterhost.RPCLockResponse{
+		Acquired:     err == nil,
+		NewChallenge: newChallenge,
+		Revision:     lc.Revision,
+		Signatures:   lc.Signatures[:],
+	}
+	return s.WriteResponse(resp, nil)
+}
+
+func (srv *Server) rpcUnlock(s *Session) error {
+	s.UnlockContract()
+	return nil
+}
+
+// updateInBounds reports whether an Update action that writes length bytes at
+// offset stays within a sector. The check must not overflow, since both values
+// are chosen by the renter.
+func updateInBounds(offset, length uint64) bool {
+	return offset <= renterhost.SectorSize && length <= renterhost.SectorSize-offset
+}
+
+func (srv *Server) rpcWrite(s *Session) error {
+	s.ExtendDeadline(120 * time.Second)
+	wr, err := s.ReadWriteRequest(renterhost.MaxWriteRequestSize)
+	if err != nil {
+		return err
+	}
+
+	// Process each action as it arrives. If an action is invalid, we still
+	// need to consume the rest of the request before responding, so the error
+	// is saved and the remaining actions are skipped.
+	c := s.Contract()
+	settings := srv.settings()
+	var newRoots []crypto.Hash
+	var bandwidthCost types.Currency
+	gainedSectors := make(map[crypto.Hash]*[renterhost.SectorSize]byte)
+	var newFileSize uint64
+	var actionErr error
+	if c == nil {
+		actionErr = errors.New("no contract locked")
+	} else {
+		newRoots = append([]crypto.Hash(nil), c.SectorRoots...)
+		newFileSize = c.Revision.NewFileSize
+	}
+	applyAction := func(action renterhost.RPCWriteAction, data io.Reader) error {
+		switch action.Type {
+		case renterhost.RPCWriteActionAppend:
+			// compute the sector root while the data is being read
+			sector := new([renterhost.SectorSize]byte)
+			buf := bytes.NewBuffer(sector[:0])
+			newRoot, err := merkle.ReaderRoot(io.TeeReader(data, buf))
+			if err != nil {
+				return err
+			} else if buf.Len() != renterhost.SectorSize {
+				return errors.New("invalid sector size")
+			}
+			newRoots = append(newRoots, newRoot)
+			gainedSectors[newRoot] = sector
+			newFileSize += renterhost.SectorSize
+			bandwidthCost = bandwidthCost.Add(settings.UploadBandwidthPrice.Mul64(renterhost.SectorSize))
+
+		case renterhost.RPCWriteActionTrim:
+			numSectors := action.A
+			if uint64(len(newRoots)) < numSectors {
+				return errors.New("trim size exceeds number of sectors")
+			}
+			newRoots = newRoots[:uint64(len(newRoots))-numSectors]
+			newFileSize -= renterhost.SectorSize * numSectors
+
+		case renterhost.RPCWriteActionSwap:
+			i, j := action.A, action.B
+			if i >= uint64(len(newRoots)) || j >= uint64(len(newRoots)) {
+				return errors.New("illegal sector index")
+			}
+			newRoots[i], newRoots[j] = newRoots[j], newRoots[i]
+
+		case renterhost.RPCWriteActionUpdate:
+			data, err := ioutil.ReadAll(data)
+			if err != nil {
+				return err
+			}
+			sectorIndex, offset := action.A, action.B
+			if sectorIndex >= uint64(len(newRoots)) {
+				return errors.New("illegal sector index or offset")
+			} else if !updateInBounds(offset, uint64(len(data))) {
+				return errors.New("illegal offset or length")
+			}
+			sector, ok := gainedSectors[newRoots[sectorIndex]]
+			if !ok {
+				var err error
+				sector, err = srv.sectors.Sector(newRoots[sectorIndex])
+				if err != nil {
+					return err
+				}
+			} else {
+				sectorCopy := *sector
+				sector = &sectorCopy
+			}
+			copy(sector[offset:], data)
+			newRoot := merkle.SectorRoot(sector)
+			gainedSectors[newRoot] = sector
+			newRoots[sectorIndex] = newRoot
+			bandwidthCost = bandwidthCost.Add(settings.UploadBandwidthPrice.Mul64(uint64(len(data))))
+
+		default:
+			return errors.New("unknown action type " + action.Type.String())
+		}
+		return nil
+	}
+	var actions []renterhost.RPCWriteAction
+	for {
+		action, data, err := wr.NextAction()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+		actions = append(actions, action)
+		if actionErr == nil {
+			actionErr = applyAction(action, data)
+		}
+	}
+	var req renterhost.RPCWriteRequest
+	if err := wr.Finish(&req); err != nil {
+		return err
+	}
+	req.Actions = actions
+
+	// if no Merkle proof was requested, the renter's signature should be sent
+	// immediately
+	var sigResponse renterhost.RPCWriteResponse
+	if !req.MerkleProof {
+		if err := s.ReadResponse(&sigResponse, 4096); err != nil {
+			return err
+		}
+	}
+	if actionErr != nil {
+		s.WriteResponse(nil, actionErr)
+		return actionErr
+	}
+
+	var storageCost, collateral types.Currency
+	if newFileSize > c.Revision.NewFileSize {
+		bytesAdded := newFileSize - c.Revision.NewFileSize
+		blockBytes := types.NewCurrency64(srv.storageDuration(c.Revision)).Mul64(bytesAdded)
+		storageCost = settings.StoragePrice.Mul(blockBytes)
+		collateral = settings.Collateral.Mul(blockBytes)
+	}
+	proofSize := merkle.DiffProofSize(req.Actions, len(c.SectorRoots))
+	bandwidthCost = bandwidthCost.Add(settings.DownloadBandwidthPrice.Mul64(uint64(proofSize) * crypto.HashSize))
+	cost := settings.BaseRPCPrice.Add(storageCost).Add(bandwidthCost)
+
+	// construct and validate the new revision
+	newMerkleRoot := merkle.MetaRoot(newRoots)
+	newRevision, err := ReviseContract(c.Revision, req.NewRevisionNumber, req.NewValidProofValues, req.NewMissedProofValues)
+	if err == nil {
+		newRevision.NewFileSize = newFileSize
+		newRevision.NewFileMerkleRoot = newMerkleRoot
+		err = ValidateRevision(c.Revision, newRevision, cost, collateral)
+	}
+	if err != nil {
+		s.WriteResponse(nil, err)
+		return err
+	}
+
+	// If a Merkle proof was requested, send it and wait for the renter's signature.
+	if req.MerkleProof {
+		treeHashes, leafHashes := merkle.BuildDiffProof(req.Actions, c.SectorRoots)
+		merkleResp := &renterhost.RPCWriteMerkleProof{
+			OldSubtreeHashes: treeHashes,
+			OldLeafHashes:    leafHashes,
+			NewMerkleRoot:    newMerkleRoot,
+		}
+		if err := s.WriteResponse(merkleResp, nil); err != nil {
+			return err
+		} else if err := s.ReadResponse(&sigResponse, 4096); err != nil {
+			return err
+		}
+	}
+	if err := VerifyRevisionSignature(newRevision, sigResponse.Signature); err != nil {
+		s.WriteResponse(nil, err)
+		return err
+	}
+
+	// store the new sectors, then commit the new revision
+	for root, sector := range gainedSectors {
+		if err := srv.sectors.AddSector(root, sector); err != nil {
+			s.WriteResponse(nil, errors.New("internal error"))
+			return err
+		}
+	}
+	updated := *c
+	updated.Revision = newRevision
+	updated.Signatures[0].Signature = sigResponse.Signature
+	updated.Signatures[1].Signature = srv.signRevision(newRevision)
+	updated.SectorRoots = newRoots
+	if err := s.UpdateContract(updated); err != nil {
+		s.WriteResponse(nil, errors.New("internal error"))
+		return err
+	}
+
+	resp := &renterhost.RPCWriteResponse{
+		Signature: updated.Signatures[1].Signature,
+	}
+	return s.WriteResponse(resp, nil)
+}
+
+func (srv *Server) rpcSectorRoots(s *Session) error {
+	s.ExtendDeadline(120 * time.Second)
+
+	var req renterhost.RPCSectorRootsRequest
+	if err := s.ReadRequest(&req, 4096); err != nil {
+		return err
+	}
+
+	c := s.Contract()
+	if c == nil {
+		err := errors.New("no contract locked")
+		s.WriteResponse(nil, err)
+		return err
+	} else if req.RootOffset > uint64(len(c.SectorRoots)) || req.RootOffset+req.NumRoots > uint64(len(c.SectorRoots)) {
+		err := errors.New("request is out-of-bounds")
+		s.WriteResponse(nil, err)
+		return err
+	}
+
+	contractRoots := c.SectorRoots[req.RootOffset:][:req.NumRoots]
+	proofStart := int(req.RootOffset)
+	proofEnd := int(req.RootOffset + req.NumRoots)
+	proof := merkle.BuildSectorRangeProof(c.SectorRoots, proofStart, proofEnd)
+
+	// calculate expected cost and validate the renter's revision
+	responseSize := (req.NumRoots + uint64(len(proof))) * crypto.HashSize
+	if responseSize < renterhost.MinMessageSize {
+		responseSize = renterhost.MinMessageSize
+	}
+	settings := srv.settings()
+	cost := settings.BaseRPCPrice.Add(settings.DownloadBandwidthPrice.Mul64(responseSize))
+	newRevision, err := ReviseContract(c.Revision, req.NewRevisionNumber, req.NewValidProofValues, req.NewMissedProofValues)
+	if err == nil {
+		err = ValidateRevision(c.Revision, newRevision, cost, types.ZeroCurrency)
+	}
+	if err == nil {
+		err = VerifyRevisionSignature(newRevision, req.Signature)
+	}
+	if err != nil {
+		s.WriteResponse(nil, err)
+		return err
+	}
+
+	// commit the new revision
+	updated := *c
+	updated.Revision = newRevision
+	updated.Signatures[0].Signature = req.Signature
+	updated.Signatures[1].Signature = srv.signRevision(newRevision)
+	if err := s.UpdateContract(updated); err != nil {
+		s.WriteResponse(nil, errors.New("internal error"))
+		return err
+	}
+
+	resp := &renterhost.RPCSectorRootsResponse{
+		Signature:   updated.Signatures[1].Signature,
+		SectorRoots: contractRoots,
+		MerkleProof: proof,
+	}
+	return s.WriteResponse(resp, nil)
+}
+
+func (srv *Server) rpcRead(s *Session) error {
+	s.ExtendDeadline(120 * time.Second)
+
+	var req renterhost.RPCReadRequest
+	if err := s.ReadRequest(&req, 4096); err != nil {
+		return err
+	}
+
+	// As soon as we finish reading the request, we must begin listening for
+	// RPCLoopReadStop, which may arrive at any time, and must arrive before the
+	// RPC is considered complete.
+	stopSignal := make(chan error, 1)
+	go func() {
+		var id renterhost.Specifier
+		err := s.ReadResponse(&id, 4096)
+		if err != nil {
+			stopSignal <- err
+		} else if id != renterhost.RPCReadStop {
+			stopSignal <- errors.New("expected 'stop' from renter, got " + id.String())
+		} else {
+			stopSignal <- nil
+		}
+	}()
+	reject := func(err error) error {
+		s.WriteResponse(nil, err)
+		<-stopSignal
+		return err
+	}
+
+	c := s.Contract()
+	free := c == nil && srv.FreeReads()
+	if c == nil && !free {
+		return reject(errors.New("no contract locked"))
+	}
+	for _, sec := range req.Sections {
+		switch {
+		case uint64(sec.Offset)+uint64(sec.Length) > renterhost.SectorSize:
+			return reject(errors.New("request is out-of-bounds"))
+		case sec.Length == 0:
+			return reject(errors.New("length cannot be zero"))
+		case req.MerkleProof && (sec.Offset%merkle.SegmentSize != 0 || sec.Length%merkle.SegmentSize != 0):
+			return reject(errors.New("offset and length must be multiples of SegmentSize when requesting a Merkle proof"))
+		}
+	}
+
+	// calculate expected cost and validate the renter's revision; free reads
+	// are not paid for, so no revision is signed
+	var hostSig []byte
+	if !free {
+		var err error
+		if hostSig, err = srv.chargeRead(s, c, &req); err != nil {
+			return reject(err)
+		}
+	}
+
+	// enter response loop
+	for i, sec := range req.Sections {
+		sector, err := srv.sectors.Sector(sec.MerkleRoot)
+		if err != nil {
+			err = errors.Wrapf(err, "could not read sector %v", sec.MerkleRoot)
+			s.WriteResponse(nil, err)
+			return err
+		}
+		data := sector[sec.Offset : sec.Offset+sec.Length]
+
+		var proof []crypto.Hash
+		if req.MerkleProof {
+			proofStart := int(sec.Offset) / merkle.SegmentSize
+			proofEnd := int(sec.Offset+sec.Length) / merkle.SegmentSize
+			proof = merkle.BuildProof(sector, proofStart, proofEnd, nil)
+		}
+
+		// Send the response. If the renter sent a stop signal, or this is the
+		// final response, include our signature in the response.
+		resp := &renterhost.RPCReadResponse{
+			Signature:   nil,
+			Data:        data,
+			MerkleProof: proof,
+		}
+		select {
+		case err := <-stopSignal:
+			if err != nil {
+				return err
+			}
+			resp.Signature = hostSig
+			return s.WriteResponse(resp, nil)
+		default:
+		}
+		if i == len(req.Sections)-1 {
+			resp.Signature = hostSig
+		}
+		if err := s.WriteResponse(resp, nil); err != nil {
+			return err
+		}
+	}
+	// The stop signal must arrive before RPC is complete.
+	return <-stopSignal
+}
+
+// chargeRead validates the revision accompanying a Read request against the
+// cost of the request, then signs and commits it, returning the host's
+// signature.
+func (srv *Server) chargeRead(s *Session, c *Contract, req *renterhost.RPCReadRequest) ([]byte, error) {
+	var estBandwidth uint64
+	sectorAccesses := make(map[crypto.Hash]struct{})
+	for _, sec := range req.Sections {
+		// use the worst-case proof size of 2*tree depth (this occurs when
+		// proving across the two leaves in the center of the tree)
+		estHashesPerProof := 2 * bits.Len64(renterhost.SectorSize/merkle.SegmentSize)
+		estBandwidth += uint64(sec.Length) + uint64(estHashesPerProof*crypto.HashSize)
+		sectorAccesses[sec.MerkleRoot] = struct{}{}
+	}
+	if estBandwidth < renterhost.MinMessageSize {
+		estBandwidth = renterhost.MinMessageSize
+	}
+	settings := srv.settings()
+	bandwidthCost := settings.DownloadBandwidthPrice.Mul64(estBandwidth)
+	sectorAccessCost := settings.SectorAccessPrice.Mul64(uint64(len(sectorAccesses)))
+	cost := settings.BaseRPCPrice.Add(bandwidthCost).Add(sectorAccessCost)
+	newRevision, err := ReviseContract(c.Revision, req.NewRevisionNumber, req.NewValidProofValues, req.NewMissedProofValues)
+	if err == nil {
+		err = ValidateRevision(c.Revision, newRevision, cost, types.ZeroCurrency)
+	}
+	if err == nil {
+		err = VerifyRevisionSignature(newRevision, req.Signature)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// commit the new revision
+	hostSig := srv.signRevision(newRevision)
+	updated := *c
+	updated.Revision = newRevision
+	updated.Signatures[0].Signature = req.Signature
+	updated.Signatures[1].Signature = hostSig
+	if err := s.UpdateContract(updated); err != nil {
+		return nil, errors.New("internal error")
+	}
+	return hostSig, nil
+}
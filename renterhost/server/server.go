@@ -0,0 +1,343 @@
+// Package server provides a framework for implementing the host side of the
+// renter-host protocol.
+//
+// A Server accepts renter connections, performs the protocol handshake, and
+// dispatches each RPC to a Handler. The default Handlers implement the
+// standard RPCs on top of a ContractStore and a SectorStore, validating each
+// revision signed by the renter. Any of them can be replaced (or new RPCs
+// added) via Handle.
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/ed25519hash"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renterhost"
+)
+
+// A Handler responds to an RPC. ServeRPC is called after the RPC ID has been
+// read; it should read the request and write the response. If ServeRPC returns
+// an error, the Session is terminated. Thus, errors that the renter can
+// recover from should be written to the renter (via WriteResponse), but not
+// returned.
+type Handler interface {
+	ServeRPC(s *Session) error
+}
+
+// The HandlerFunc type is an adapter to allow the use of ordinary functions as
+// Handlers.
+type HandlerFunc func(s *Session) error
+
+// ServeRPC implements Handler.
+func (fn HandlerFunc) ServeRPC(s *Session) error { return fn(s) }
+
+// An RPCMux dispatches RPCs to Handlers according to their ID.
+type RPCMux struct {
+	mu       sync.RWMutex
+	handlers map[renterhost.Specifier]Handler
+}
+
+// Handle registers the handler for the specified RPC, replacing any existing
+// handler.
+func (m *RPCMux) Handle(id renterhost.Specifier, h Handler) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.handlers[id] = h
+}
+
+// HandleFunc registers the handler function for the specified RPC.
+func (m *RPCMux) HandleFunc(id renterhost.Specifier, fn func(*Session) error) {
+	m.Handle(id, HandlerFunc(fn))
+}
+
+// Handler returns the handler for the specified RPC, if one is registered.
+func (m *RPCMux) Handler(id renterhost.Specifier) (Handler, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	h, ok := m.handlers[id]
+	return h, ok
+}
+
+// Specifiers returns the IDs of all registered RPCs, in sorted order.
+func (m *RPCMux) Specifiers() []renterhost.Specifier {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	ids := make([]renterhost.Specifier, 0, len(m.handlers))
+	for id := range m.handlers {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return bytes.Compare(ids[i][:], ids[j][:]) < 0
+	})
+	return ids
+}
+
+// ServeSession reads RPC IDs from the Session and dispatches them to the
+// appropriate handlers until the renter closes the Session or an error
+// occurs. Unknown RPCs are rejected, terminating the Session.
+func (m *RPCMux) ServeSession(s *Session) error {
+	for {
+		s.ExtendDeadline(time.Hour)
+		id, err := s.ReadID()
+		if errors.Cause(err) == renterhost.ErrRenterClosed {
+			return nil
+		} else if err != nil {
+			return errors.Wrap(err, "could not read RPC ID")
+		}
+		h, ok := m.Handler(id)
+		if !ok {
+			err = errors.Errorf("invalid or unknown RPC %q", id.String())
+			s.WriteResponse(nil, err) // best effort
+			return err
+		} else if err := h.ServeRPC(s); err != nil {
+			return errors.Wrapf(err, "RPC %q failed", id.String())
+		}
+	}
+}
+
+// NewRPCMux returns an RPCMux with no registered handlers.
+func NewRPCMux() *RPCMux {
+	return &RPCMux{
+		handlers: make(map[renterhost.Specifier]Handler),
+	}
+}
+
+// A Session is a host-side renter-host protocol session, optionally holding the
+// lock on a contract.
+type Session struct {
+	*renterhost.Session
+	conn      net.Conn
+	contracts ContractStore
+	contract  *Contract
+}
+
+// ExtendDeadline sets the deadline of the Session's underlying connection to
+// d from now.
+func (s *Session) ExtendDeadline(d time.Duration) {
+	_ = s.conn.SetDeadline(time.Now().Add(d))
+}
+
+// Contract returns the contract currently locked by the Session, or nil if no
+// contract is locked. Modifications to the contract are not persisted until
+// UpdateContract is called.
+func (s *Session) Contract() *Contract {
+	return s.contract
+}
+
+// LockContract locks the specified contract, waiting up to timeout for the
+// lock to become available. The Session must not already hold a lock.
+func (s *Session) LockContract(id types.FileContractID, timeout time.Duration) (*Contract, error) {
+	if s.contract != nil {
+		return nil, errors.New("another contract is already locked")
+	} else if err := s.contracts.LockContract(id, timeout); err != nil {
+		return nil, err
+	}
+	c, err := s.contracts.Contract(id)
+	if err != nil {
+		s.contracts.UnlockContract(id)
+		return nil, err
+	}
+	s.contract = &c
+	return s.contract, nil
+}
+
+// UnlockContract unlocks the contract currently locked by the Session, if any.
+func (s *Session) UnlockContract() {
+	if s.contract != nil {
+		s.contracts.UnlockContract(s.contract.ID())
+		s.contract = nil
+	}
+}
+
+// UpdateContract stores c, which must be the contract currently locked by the
+// Session.
+func (s *Session) UpdateContract(c Contract) error {
+	if s.contract == nil || s.contract.ID() != c.ID() {
+		return errors.New("contract is not locked")
+	} else if err := s.contracts.SetContract(c); err != nil {
+		return err
+	}
+	*s.contract = c
+	return nil
+}
+
+// NewSession wraps a host-side renterhost.Session. conn must be the Session's
+// underlying connection, and contracts must be the store from which the
+// Session will lock contracts.
+func NewSession(sess *renterhost.Session, conn net.Conn, contracts ContractStore) *Session {
+	return &Session{
+		Session:   sess,
+		conn:      conn,
+		contracts: contracts,
+	}
+}
+
+// A Server serves the renter-host protocol.
+type Server struct {
+	rpcs      *RPCMux
+	key       ed25519.PrivateKey
+	settings  func() hostdb.HostSettings
+	contracts ContractStore
+	sectors   SectorStore
+
+	mu        sync.Mutex
+	height    types.BlockHeight
+	freeReads bool
+
+	// ErrorLog, if non-nil, is used to log errors that terminate a Session.
+	ErrorLog *log.Logger
+}
+
+// PublicKey returns the host's public key.
+func (srv *Server) PublicKey() hostdb.HostPublicKey {
+	return hostdb.HostKeyFromPublicKey(ed25519hash.ExtractPublicKey(srv.key))
+}
+
+// Handle registers the handler for the specified RPC, replacing any existing
+// handler (including the default handlers).
+func (srv *Server) Handle(id renterhost.Specifier, h Handler) {
+	srv.rpcs.Handle(id, h)
+}
+
+// HandleFunc registers the handler function for the specified RPC.
+func (srv *Server) HandleFunc(id renterhost.Specifier, fn func(*Session) error) {
+	srv.rpcs.HandleFunc(id, fn)
+}
+
+// Capabilities returns the protocol features supported by the Server, which
+// are reported in its settings unless the settings function supplies its own.
+func (srv *Server) Capabilities() *hostdb.HostCapabilities {
+	return &hostdb.HostCapabilities{
+		RPCs: srv.rpcs.Specifiers(),
+		WriteActions: []renterhost.Specifier{
+			renterhost.RPCWriteActionAppend,
+			renterhost.RPCWriteActionTrim,
+			renterhost.RPCWriteActionSwap,
+			renterhost.RPCWriteActionUpdate,
+		},
+		Ciphers:   renterhost.SupportedCiphers(),
+		FreeReads: srv.FreeReads(),
+	}
+}
+
+// FreeReads returns whether the Server serves Read RPCs without a contract,
+// as set by SetFreeReads.
+func (srv *Server) FreeReads() bool {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.freeReads
+}
+
+// SetFreeReads sets whether the Server serves Read RPCs without a contract.
+// If enabled, a renter that has not locked a contract may read any sector
+// without payment, and the host does not sign a revision. Renters that have
+// locked a contract still pay for their reads.
+func (srv *Server) SetFreeReads(free bool) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.freeReads = free
+}
+
+// BlockHeight returns the current block height, as reported by
+// SetBlockHeight.
+func (srv *Server) BlockHeight() types.BlockHeight {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	return srv.height
+}
+
+// SetBlockHeight sets the current block height, which is used to calculate
+// storage costs.
+func (srv *Server) SetBlockHeight(height types.BlockHeight) {
+	srv.mu.Lock()
+	defer srv.mu.Unlock()
+	srv.height = height
+}
+
+func (srv *Server) logf(format string, args ...interface{}) {
+	if srv.ErrorLog != nil {
+		srv.ErrorLog.Printf(format, args...)
+	}
+}
+
+// Serve accepts incoming connections on l, serving each in a separate
+// goroutine. It returns when l.Accept returns an error.
+func (srv *Server) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			if err := srv.ServeConn(conn); err != nil {
+				srv.logf("server: %v", err)
+			}
+		}()
+	}
+}
+
+// ServeConn performs the protocol handshake on conn and serves the resulting
+// Sessions until the renter closes the connection.
+func (srv *Server) ServeConn(conn net.Conn) error {
+	conn.SetDeadline(time.Now().Add(60 * time.Second))
+	mux, err := renterhost.NewHostMux(conn, srv.key)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer mux.Close()
+	for {
+		st, err := mux.AcceptStream()
+		if err != nil {
+			return nil
+		}
+		go func() {
+			if err := srv.serveStream(st); err != nil {
+				srv.logf("server: %v", err)
+			}
+		}()
+	}
+}
+
+func (srv *Server) serveStream(st *renterhost.Stream) error {
+	defer st.Close()
+	st.SetDeadline(time.Now().Add(60 * time.Second))
+	hs, err := st.HostSession(st)
+	if err != nil {
+		return err
+	}
+	s := NewSession(hs, st, srv.contracts)
+	defer s.UnlockContract()
+	return srv.rpcs.ServeSession(s)
+}
+
+// New returns a Server that signs with key, advertises the settings returned by
+// settings, and stores contracts and sectors in the provided stores. The
+// standard RPCs are registered with their default handlers.
+func New(key ed25519.PrivateKey, settings func() hostdb.HostSettings, contracts ContractStore, sectors SectorStore) *Server {
+	srv := &Server{
+		rpcs:      NewRPCMux(),
+		key:       key,
+		settings:  settings,
+		contracts: contracts,
+		sectors:   sectors,
+	}
+	srv.HandleFunc(renterhost.RPCFormContractID, srv.rpcFormContract)
+	srv.HandleFunc(renterhost.RPCLockID, srv.rpcLock)
+	srv.HandleFunc(renterhost.RPCReadID, srv.rpcRead)
+	srv.HandleFunc(renterhost.RPCRenewClearContractID, srv.rpcRenewAndClearContract)
+	srv.HandleFunc(renterhost.RPCSectorRootsID, srv.rpcSectorRoots)
+	srv.HandleFunc(renterhost.RPCSettingsID, srv.rpcSettings)
+	srv.HandleFunc(renterhost.RPCUnlockID, srv.rpcUnlock)
+	srv.HandleFunc(renterhost.RPCWriteID, srv.rpcWrite)
+	return srv
+}
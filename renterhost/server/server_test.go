@@ -0,0 +1,365 @@
+package server
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"io/ioutil"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/modules"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/frand"
+	"lukechampine.com/us/ed25519hash"
+	"lukechampine.com/us/hostdb"
+	"lukechampine.com/us/renter/proto"
+	"lukechampine.com/us/renterhost"
+)
+
+type stubWallet struct{}
+
+func (stubWallet) Address() (_ types.UnlockHash, _ error) { return }
+func (stubWallet) FundTransaction(*types.Transaction, types.Currency) (_ []crypto.Hash, _ error) {
+	return
+}
+func (stubWallet) SignTransaction(txn *types.Transaction, toSign []crypto.Hash) error {
+	txn.TransactionSignatures = append(txn.TransactionSignatures, make([]types.TransactionSignature, len(toSign))...)
+	return nil
+}
+
+type stubTpool struct{}
+
+func (stubTpool) AcceptTransactionSet([]types.Transaction) (_ error)                    { return }
+func (stubTpool) UnconfirmedParents(types.Transaction) (_ []types.Transaction, _ error) { return }
+func (stubTpool) FeeEstimate() (_, _ types.Currency, _ error)                           { return }
+
+func specifier(str string) (id renterhost.Specifier) {
+	copy(id[:], str)
+	return
+}
+
+// startServer starts a Server with nonzero prices and ephemeral stores.
+func startServer(tb testing.TB) (*Server, modules.NetAddress) {
+	return startServerWithCapabilities(tb, nil)
+}
+
+// startServerWithCapabilities is like startServer, but advertises caps instead
+// of the Server's actual capabilities.
+func startServerWithCapabilities(tb testing.TB, caps *hostdb.HostCapabilities) (*Server, modules.NetAddress) {
+	l, err := net.Listen("tcp", ":0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { l.Close() })
+	addr := modules.NetAddress(l.Addr().String())
+	settings := func() hostdb.HostSettings {
+		return hostdb.HostSettings{
+			NetAddress:             addr,
+			AcceptingContracts:     true,
+			WindowSize:             144,
+			MaxCollateral:          types.SiacoinPrecision.Mul64(1000),
+			Collateral:             types.NewCurrency64(2),
+			StoragePrice:           types.NewCurrency64(1),
+			BaseRPCPrice:           types.NewCurrency64(1e6),
+			SectorAccessPrice:      types.NewCurrency64(1e6),
+			UploadBandwidthPrice:   types.NewCurrency64(10),
+			DownloadBandwidthPrice: types.NewCurrency64(10),
+			Capabilities:           caps,
+		}
+	}
+	key := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+	srv := New(key, settings, NewEphemeralContractStore(), NewEphemeralSectorStore())
+	srv.SetBlockHeight(10)
+	go srv.Serve(l)
+	return srv, addr
+}
+
+func TestServer(t *testing.T) {
+	srv, addr := startServer(t)
+	s, err := proto.NewUnlockedSession(addr, srv.PublicKey(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Settings(); err != nil {
+		t.Fatal(err)
+	}
+	key := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+	rev, _, err := s.FormContract(stubWallet{}, stubTpool{}, key, types.SiacoinPrecision, 10, 100)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := s.Lock(rev.ID(), key, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// upload and download a sector; all revisions should be accepted
+	var sector [renterhost.SectorSize]byte
+	frand.Read(sector[:])
+	root, err := s.Append(&sector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	err = s.Read(&buf, []renterhost.RPCReadRequestSection{{
+		MerkleRoot: root,
+		Offset:     0,
+		Length:     renterhost.SectorSize,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	} else if !bytes.Equal(buf.Bytes(), sector[:]) {
+		t.Fatal("downloaded data does not match uploaded data")
+	}
+	if roots, err := s.SectorRoots(0, 1); err != nil {
+		t.Fatal(err)
+	} else if roots[0] != root {
+		t.Fatal("wrong sector root")
+	}
+	if s.Revision().Revision.ValidHostPayout().Cmp(rev.Revision.ValidHostPayout()) <= 0 {
+		t.Fatal("host was not paid")
+	}
+
+	// the contract should be locked
+	s2, err := proto.NewUnlockedSession(addr, srv.PublicKey(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s2.Close()
+	if err := s2.Lock(rev.ID(), key, 10*time.Millisecond); errors.Cause(err) != proto.ErrContractLocked {
+		t.Fatal("expected ErrContractLocked, got", err)
+	}
+
+	// after unlocking, the latest revision should be returned
+	latest := s.Revision().Revision
+	if err := s.Unlock(); err != nil {
+		t.Fatal(err)
+	} else if err := s2.Lock(rev.ID(), key, time.Second); err != nil {
+		t.Fatal(err)
+	} else if s2.Revision().Revision.NewRevisionNumber != latest.NewRevisionNumber {
+		t.Fatal("host returned outdated revision")
+	}
+}
+
+func TestCapabilities(t *testing.T) {
+	srv, addr := startServer(t)
+	s, err := proto.NewUnlockedSession(addr, srv.PublicKey(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	settings, err := s.Settings()
+	if err != nil {
+		t.Fatal(err)
+	} else if settings.Capabilities == nil || s.Capabilities() != settings.Capabilities {
+		t.Fatal("server did not report its capabilities")
+	} else if !settings.SupportsRPC(renterhost.RPCWriteID) || !settings.SupportsWriteAction(renterhost.RPCWriteActionSwap) {
+		t.Fatal("server should support Write and Swap")
+	} else if settings.SupportsRPC(renterhost.RPCRenewContractID) {
+		t.Fatal("server should not support RenewContract")
+	} else if len(settings.Capabilities.Ciphers) == 0 || !settings.SupportsCipher(renterhost.SupportedCiphers()[0]) {
+		t.Fatal("server should report its cipher suites")
+	}
+
+	// hosts that do not report capabilities are assumed to support everything
+	if !(hostdb.HostSettings{}).SupportsRPC(renterhost.RPCRenewContractID) {
+		t.Fatal("unknown capabilities should not restrict RPCs")
+	}
+
+	// unsupported operations should be refused without contacting the host
+	srv, addr = startServerWithCapabilities(t, &hostdb.HostCapabilities{
+		RPCs: []renterhost.Specifier{
+			renterhost.RPCFormContractID,
+			renterhost.RPCLockID,
+			renterhost.RPCSettingsID,
+			renterhost.RPCWriteID,
+		},
+		WriteActions: []renterhost.Specifier{renterhost.RPCWriteActionAppend},
+	})
+	s, err = proto.NewUnlockedSession(addr, srv.PublicKey(), 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if _, err := s.Settings(); err != nil {
+		t.Fatal(err)
+	}
+	key := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+	rev, _, err := s.FormContract(stubWallet{}, stubTpool{}, key, types.SiacoinPrecision, 10, 100)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := s.Lock(rev.ID(), key, 0); err != nil {
+		t.Fatal(err)
+	}
+	var sector [renterhost.SectorSize]byte
+	root, err := s.Append(&sector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.SectorRoots(0, 1); errors.Cause(err) != proto.ErrUnsupportedRPC {
+		t.Fatal("expected ErrUnsupportedRPC, got", err)
+	}
+	err = s.Read(ioutil.Discard, []renterhost.RPCReadRequestSection{{MerkleRoot: root, Length: renterhost.SectorSize}})
+	if errors.Cause(err) != proto.ErrUnsupportedRPC {
+		t.Fatal("expected ErrUnsupportedRPC, got", err)
+	}
+	swap := []renterhost.RPCWriteAction{{Type: renterhost.RPCWriteActionSwap, A: 0, B: 0}}
+	if err := s.Write(swap); errors.Cause(err) != proto.ErrUnsupportedWriteAction {
+		t.Fatal("expected ErrUnsupportedWriteAction, got", err)
+	}
+	// the session should still be usable
+	if _, err := s.Append(&sector); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHandle(t *testing.T) {
+	srv, addr := startServer(t)
+	echoID := specifier("Echo")
+	srv.HandleFunc(echoID, func(s *Session) error {
+		var req renterhost.Specifier
+		if err := s.ReadRequest(&req, 4096); err != nil {
+			return err
+		}
+		return s.WriteResponse(&req, nil)
+	})
+	var foundEcho bool
+	for _, id := range srv.rpcs.Specifiers() {
+		foundEcho = foundEcho || id == echoID
+	}
+	if !foundEcho {
+		t.Fatal("Echo RPC not registered")
+	}
+
+	conn, err := net.Dial("tcp", string(addr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rs, err := renterhost.NewRenterSession(conn, srv.PublicKey().Ed25519())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rs.Close()
+
+	req := specifier("foo")
+	var resp renterhost.Specifier
+	if err := rs.WriteRequest(echoID, &req); err != nil {
+		t.Fatal(err)
+	} else if err := rs.ReadResponse(&resp, 4096); err != nil {
+		t.Fatal(err)
+	} else if resp != req {
+		t.Fatal("wrong response:", resp)
+	}
+
+	// unknown RPCs should be rejected
+	if err := rs.WriteRequest(specifier("Bogus"), &req); err != nil {
+		t.Fatal(err)
+	} else if err := rs.ReadResponse(&resp, 4096); err == nil || !strings.Contains(err.Error(), "unknown RPC") {
+		t.Fatal("expected unknown RPC error, got", err)
+	}
+}
+
+func TestValidateRevision(t *testing.T) {
+	renterKey := ed25519.NewKeyFromSeed(frand.Bytes(ed25519.SeedSize))
+	outputs := func(values ...uint64) []types.SiacoinOutput {
+		var os []types.SiacoinOutput
+		for _, v := range values {
+			os = append(os, types.SiacoinOutput{Value: types.NewCurrency64(v)})
+		}
+		return os
+	}
+	current := types.FileContractRevision{
+		ParentID: types.FileContractID(frand.Entropy256()),
+		UnlockConditions: types.UnlockConditions{
+			PublicKeys: []types.SiaPublicKey{{
+				Algorithm: types.SignatureEd25519,
+				Key:       []byte(ed25519hash.ExtractPublicKey(renterKey)),
+			}},
+		},
+		NewRevisionNumber:     1,
+		NewValidProofOutputs:  outputs(100, 50),
+		NewMissedProofOutputs: outputs(90, 50, 10),
+	}
+	cost, collateral := types.NewCurrency64(10), types.NewCurrency64(5)
+	revise := func(valid, missed []types.SiacoinOutput) types.FileContractRevision {
+		rev := current
+		rev.NewRevisionNumber++
+		rev.NewValidProofOutputs = valid
+		rev.NewMissedProofOutputs = missed
+		return rev
+	}
+
+	good := revise(outputs(90, 60), outputs(80, 45, 25))
+	if err := ValidateRevision(current, good, cost, collateral); err != nil {
+		t.Fatal(err)
+	}
+	sig := ed25519hash.Sign(renterKey, renterhost.HashRevision(good))
+	if err := VerifyRevisionSignature(good, sig); err != nil {
+		t.Fatal(err)
+	} else if err := VerifyRevisionSignature(current, sig); err == nil {
+		t.Fatal("expected signature of different revision to be rejected")
+	}
+	badKey := good
+	badKey.UnlockConditions.PublicKeys = []types.SiaPublicKey{{Algorithm: types.SignatureEd25519, Key: []byte{1, 2, 3}}}
+	if err := VerifyRevisionSignature(badKey, sig); err == nil {
+		t.Fatal("expected malformed key to be rejected")
+	}
+	if _, err := ReviseContract(current, 2, nil, nil); err == nil {
+		t.Fatal("expected wrong number of outputs to be rejected")
+	}
+
+	wrongParent := good
+	wrongParent.ParentID = types.FileContractID(frand.Entropy256())
+	sameNumber := good
+	sameNumber.NewRevisionNumber = current.NewRevisionNumber
+	tests := []struct {
+		desc string
+		rev  types.FileContractRevision
+	}{
+		{"underpays host", revise(outputs(95, 55), outputs(85, 45, 20))},
+		{"decreases host payout", revise(outputs(110, 40), outputs(80, 45, 25))},
+		{"creates money", revise(outputs(90, 70), outputs(80, 45, 25))},
+		{"risks too much collateral", revise(outputs(90, 60), outputs(80, 40, 30))},
+		{"increases renter's missed payout", revise(outputs(90, 60), outputs(95, 45, 10))},
+		{"decreases void payout", revise(outputs(90, 60), outputs(85, 60, 5))},
+		{"has wrong parent", wrongParent},
+		{"does not increase revision number", sameNumber},
+	}
+	for _, test := range tests {
+		if err := ValidateRevision(current, test.rev, cost, collateral); err == nil {
+			t.Errorf("expected revision that %v to be rejected", test.desc)
+		}
+	}
+
+	// a final revision that decreases the host's payout should be rejected
+	_, err := finalRevision(current, []types.Currency{types.NewCurrency64(110), types.NewCurrency64(40)},
+		[]types.Currency{types.NewCurrency64(110), types.NewCurrency64(40)}, cost)
+	if err == nil {
+		t.Fatal("expected final revision that decreases host payout to be rejected")
+	}
+}
+
+func TestUpdateInBounds(t *testing.T) {
+	tests := []struct {
+		offset, length uint64
+		valid          bool
+	}{
+		{0, renterhost.SectorSize, true},
+		{100, 1000, true},
+		{renterhost.SectorSize, 0, true},
+		{renterhost.SectorSize - 10, 1000, false},
+		{renterhost.SectorSize + 1, 0, false},
+		{math.MaxUint64, 1000, false},
+		{1000, math.MaxUint64, false},
+	}
+	for _, test := range tests {
+		if updateInBounds(test.offset, test.length) != test.valid {
+			t.Errorf("updateInBounds(%v, %v) should be %v", test.offset, test.length, test.valid)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"gitlab.com/NebulousLabs/Sia/crypto"
+	"gitlab.com/NebulousLabs/Sia/types"
+	"lukechampine.com/us/renterhost"
+)
+
+var (
+	// ErrContractNotFound is returned by ContractStores when the requested
+	// contract does not exist.
+	ErrContractNotFound = errors.New("no record of that contract")
+
+	// ErrContractLocked is returned by ContractStores when the requested
+	// contract could not be locked before the timeout expired.
+	ErrContractLocked = errors.New("contract is locked by another party")
+
+	// ErrSectorNotFound is returned by SectorStores when the requested sector
+	// does not exist.
+	ErrSectorNotFound = errors.New("no sector with that Merkle root")
+)
+
+// A Contract is a file contract, as stored by the host.
+type Contract struct {
+	Revision    types.FileContractRevision
+	Signatures  [2]types.TransactionSignature
+	SectorRoots []crypto.Hash
+}
+
+// ID returns the ID of the contract.
+func (c *Contract) ID() types.FileContractID {
+	return c.Revision.ParentID
+}
+
+// RenterKey returns the renter's public key.
+func (c *Contract) RenterKey() types.SiaPublicKey {
+	return c.Revision.UnlockConditions.PublicKeys[0]
+}
+
+// A ContractStore stores the host's contracts and arbitrates access to them.
+// While a contract is locked, only the locker may modify it.
+type ContractStore interface {
+	// AddContract stores a new contract.
+	AddContract(c Contract) error
+	// Contract returns the contract with the specified ID.
+	Contract(id types.FileContractID) (Contract, error)
+	// SetContract updates a previously-stored contract.
+	SetContract(c Contract) error
+	// LockContract locks the contract with the specified ID, waiting up to
+	// timeout for the lock to become available.
+	LockContract(id types.FileContractID, timeout time.Duration) error
+	// UnlockContract unlocks the contract with the specified ID.
+	UnlockContract(id types.FileContractID)
+}
+
+// A SectorStore stores sector data, indexed by Merkle root.
+type SectorStore interface {
+	// AddSector stores a sector.
+	AddSector(root crypto.Hash, sector *[renterhost.SectorSize]byte) error
+	// Sector returns the sector with the specified Merkle root.
+	Sector(root crypto.Hash) (*[renterhost.SectorSize]byte, error)
+}
+
+// EphemeralContractStore implements ContractStore in memory.
+type EphemeralContractStore struct {
+	mu        sync.Mutex
+	contracts map[types.FileContractID]Contract
+	locks     map[types.FileContractID]chan struct{}
+}
+
+// AddContract implements ContractStore.
+func (cs *EphemeralContractStore) AddContract(c Contract) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if _, ok := cs.contracts[c.ID()]; ok {
+		return errors.New("contract already exists")
+	}
+	cs.contracts[c.ID()] = copyContract(c)
+	cs.locks[c.ID()] = make(chan struct{}, 1)
+	return nil
+}
+
+// Contract implements ContractStore.
+func (cs *EphemeralContractStore) Contract(id types.FileContractID) (Contract, error) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	c, ok := cs.contracts[id]
+	if !ok {
+		return Contract{}, ErrContractNotFound
+	}
+	return copyContract(c), nil
+}
+
+// SetContract implements ContractStore.
+func (cs *EphemeralContractStore) SetContract(c Contract) error {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if _, ok := cs.contracts[c.ID()]; !ok {
+		return ErrContractNotFound
+	}
+	cs.contracts[c.ID()] = copyContract(c)
+	return nil
+}
+
+// LockContract implements ContractStore.
+func (cs *EphemeralContractStore) LockContract(id types.FileContractID, timeout time.Duration) error {
+	cs.mu.Lock()
+	lock, ok := cs.locks[id]
+	cs.mu.Unlock()
+	if !ok {
+		return ErrContractNotFound
+	}
+	select {
+	case lock <- struct{}{}:
+		return nil
+	default:
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case lock <- struct{}{}:
+		return nil
+	case <-t.C:
+		return ErrContractLocked
+	}
+}
+
+// UnlockContract implements ContractStore.
+func (cs *EphemeralContractStore) UnlockContract(id types.FileContractID) {
+	cs.mu.Lock()
+	lock, ok := cs.locks[id]
+	cs.mu.Unlock()
+	if ok {
+		select {
+		case <-lock:
+		default:
+		}
+	}
+}
+
+func copyContract(c Contract) Contract {
+	c.SectorRoots = append([]crypto.Hash(nil), c.SectorRoots...)
+	return c
+}
+
+// NewEphemeralContractStore returns a new EphemeralContractStore.
+func NewEphemeralContractStore() *EphemeralContractStore {
+	return &EphemeralContractStore{
+		contracts: make(map[types.FileContractID]Contract),
+		locks:     make(map[types.FileContractID]chan struct{}),
+	}
+}
+
+// EphemeralSectorStore implements SectorStore in memory.
+type EphemeralSectorStore struct {
+	mu      sync.Mutex
+	sectors map[crypto.Hash]*[renterhost.SectorSize]byte
+}
+
+// AddSector implements SectorStore.
+func (ss *EphemeralSectorStore) AddSector(root crypto.Hash, sector *[renterhost.SectorSize]byte) error {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	s := *sector
+	ss.sectors[root] = &s
+	return nil
+}
+
+// Sector implements SectorStore.
+func (ss *EphemeralSectorStore) Sector(root crypto.Hash) (*[renterhost.SectorSize]byte, error) {
+	ss.mu.Lock()
+	defer ss.mu.Unlock()
+	sector, ok := ss.sectors[root]
+	if !ok {
+		return nil, ErrSectorNotFound
+	}
+	s := *sector
+	return &s, nil
+}
+
+// NewEphemeralSectorStore returns a new EphemeralSectorStore.
+func NewEphemeralSectorStore() *EphemeralSectorStore {
+	return &EphemeralSectorStore{
+		sectors: make(map[crypto.Hash]*[renterhost.SectorSize]byte),
+	}
+}
+
+// ensure that the ephemeral stores satisfy their intended interfaces
+var (
+	_ ContractStore = (*EphemeralContractStore)(nil)
+	_ SectorStore   = (*EphemeralSectorStore)(nil)
+)
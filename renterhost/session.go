@@ -3,23 +3,20 @@
 package renterhost // import "lukechampine.com/us/renterhost"
 
 import (
+	"bufio"
 	"bytes"
-	"crypto/cipher"
 	"crypto/ed25519"
-	"crypto/subtle"
 	"encoding/binary"
 	"io"
 	"io/ioutil"
 	"net"
 	"strings"
+	"sync"
 
-	"github.com/aead/chacha20/chacha"
 	"github.com/pkg/errors"
 	"gitlab.com/NebulousLabs/Sia/crypto"
 	"gitlab.com/NebulousLabs/Sia/types"
 	"golang.org/x/crypto/blake2b"
-	"golang.org/x/crypto/chacha20poly1305"
-	"golang.org/x/crypto/poly1305"
 	"lukechampine.com/frand"
 	"lukechampine.com/us/ed25519hash"
 )
@@ -33,6 +30,11 @@ func wrapErr(err *error, fnName string) {
 // This hinders traffic analysis by obscuring the true sizes of messages.
 const MinMessageSize = 4096
 
+// MaxWriteRequestSize is the maximum size of an encrypted RPCWriteRequest
+// message that hosts are expected to accept. It matches the limit enforced by
+// siad hosts.
+const MaxWriteRequestSize = 5 * SectorSize
+
 // An RPCError may be sent instead of a response object to any RPC.
 type RPCError struct {
 	Type        Specifier
@@ -60,17 +62,30 @@ type rpcResponse struct {
 // A Session is an ongoing exchange of RPCs via the renter-host protocol.
 type Session struct {
 	conn      io.ReadWriteCloser
-	aead      cipher.AEAD
-	key       []byte // for RawResponse
+	cipher    Specifier
+	send      sessionKey // encrypts outgoing messages
+	recv      sessionKey // decrypts incoming messages
 	inbuf     objBuffer
 	outbuf    objBuffer
 	challenge [16]byte
-	err       error // set when Session is prematurely closed
 	closed    bool
 	isRenter  bool
+
+	rekey      bool // whether the peer supports rekeying
+	rekeyBytes uint64
+	rekeyMsgs  uint64
+
+	// the host may read and write concurrently (e.g. during RPCRead), so
+	// the premature close error must be synchronized
+	errMu sync.Mutex
+	err   error // set when Session is prematurely closed
+
+	transcript *Transcript
 }
 
 func (s *Session) setErr(err error) {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
 	if err != nil && s.err == nil {
 		if ne, ok := err.(net.Error); !ok || !ne.Temporary() {
 			s.conn.Close()
@@ -81,11 +96,18 @@ func (s *Session) setErr(err error) {
 
 // PrematureCloseErr returns the error that resulted in the Session being closed
 // prematurely.
-func (s *Session) PrematureCloseErr() error { return s.err }
+func (s *Session) PrematureCloseErr() error {
+	s.errMu.Lock()
+	defer s.errMu.Unlock()
+	return s.err
+}
 
 // IsClosed returns whether the Session is closed. Check PrematureCloseErr to
 // determine whether the Session was closed gracefully.
-func (s *Session) IsClosed() bool { return s.closed || s.err != nil }
+func (s *Session) IsClosed() bool { return s.closed || s.PrematureCloseErr() != nil }
+
+// Cipher returns the ID of the cipher suite negotiated during the handshake.
+func (s *Session) Cipher() Specifier { return s.cipher }
 
 // SetChallenge sets the current session challenge.
 func (s *Session) SetChallenge(challenge [16]byte) {
@@ -110,18 +132,25 @@ func (s *Session) VerifyChallenge(sig []byte, pub ed25519.PublicKey) bool {
 }
 
 func (s *Session) writeMessage(obj ProtocolObject) error {
-	if s.err != nil {
-		return s.err
+	if err := s.PrematureCloseErr(); err != nil {
+		return err
 	}
-	// generate random nonce
-	nonce := make([]byte, 256)[:s.aead.NonceSize()] // avoid heap alloc
-	frand.Read(nonce)
-
-	// pad short messages to MinMessageSize
-	msgSize := 8 + s.aead.NonceSize() + obj.marshalledSize() + s.aead.Overhead()
+	// pad short messages to MinMessageSize; the sealing overhead of a message
+	// this short does not depend on its length
+	nonceSize := s.send.aead.NonceSize()
+	plaintextSize := obj.marshalledSize()
+	msgSize := 8 + nonceSize + s.send.aead.sealedSize(plaintextSize)
 	if msgSize < MinMessageSize {
+		plaintextSize += MinMessageSize - msgSize
 		msgSize = MinMessageSize
 	}
+	if err := s.prepareSend(msgSize); err != nil {
+		return err
+	}
+
+	// generate random nonce
+	nonce := make([]byte, 256)[:nonceSize] // avoid heap alloc
+	frand.Read(nonce)
 
 	// write length prefix, nonce, and object directly into buffer
 	s.outbuf.reset()
@@ -132,32 +161,61 @@ func (s *Session) writeMessage(obj ProtocolObject) error {
 
 	// encrypt the object in-place
 	msg := s.outbuf.bytes()[:msgSize]
-	msgNonce := msg[8:][:len(nonce)]
-	payload := msg[8+len(nonce) : msgSize-s.aead.Overhead()]
-	s.aead.Seal(payload[:0], msgNonce, payload, nil)
+	msgNonce := msg[8:][:nonceSize]
+	payload := msg[8+nonceSize:]
+	if s.transcript != nil {
+		s.transcript.record(true, obj, msgSize, payload[:obj.marshalledSize()])
+	}
+	s.send.aead.seal(payload, msgNonce, plaintextSize)
 
 	_, err := s.conn.Write(msg)
 	s.setErr(err)
 	return err
 }
 
-func (s *Session) readMessage(obj ProtocolObject, maxLen uint64) error {
-	if s.err != nil {
-		return s.err
-	}
+// readPrefix reads the length prefix of the next message, handling any rekey
+// messages that precede it.
+func (s *Session) readPrefix(maxLen uint64) (uint64, error) {
 	if maxLen < MinMessageSize {
 		maxLen = MinMessageSize
 	}
-	s.inbuf.reset()
-	if err := s.inbuf.copyN(s.conn, 8); err != nil {
-		s.setErr(err)
+	// maxLen allows for the overhead of sealing the message as a single AEAD
+	// message; allow for any additional overhead of the negotiated cipher
+	maxLen += uint64(s.recv.aead.sealedSize(int(maxLen)) - int(maxLen) - s.recv.aead.sealedSize(0))
+	minLen := uint64(s.recv.aead.NonceSize() + s.recv.aead.sealedSize(0))
+	for {
+		s.inbuf.reset()
+		if err := s.inbuf.copyN(s.conn, 8); err != nil {
+			s.setErr(err)
+			return 0, err
+		}
+		msgSize := s.inbuf.readUint64()
+		if s.rekey && msgSize&rekeyFlag != 0 {
+			if err := s.readRekey(msgSize &^ rekeyFlag); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		if msgSize > maxLen {
+			return 0, errors.Errorf("message size (%v bytes) exceeds maxLen of %v bytes", msgSize, maxLen)
+		} else if msgSize < minLen {
+			return 0, errors.Errorf("message size (%v bytes) is too small (nonce + MAC is %v bytes)", msgSize, minLen)
+		} else if s.recv.msgs >= maxKeyMessages {
+			s.setErr(ErrNonceExhausted)
+			return 0, ErrNonceExhausted
+		}
+		s.recv.msgs++
+		return msgSize, nil
+	}
+}
+
+func (s *Session) readMessage(obj ProtocolObject, maxLen uint64) error {
+	if err := s.PrematureCloseErr(); err != nil {
 		return err
 	}
-	msgSize := s.inbuf.readUint64()
-	if msgSize > maxLen {
-		return errors.Errorf("message size (%v bytes) exceeds maxLen of %v bytes", msgSize, maxLen)
-	} else if msgSize < uint64(s.aead.NonceSize()+s.aead.Overhead()) {
-		return errors.Errorf("message size (%v bytes) is too small (nonce + MAC is %v bytes)", msgSize, s.aead.NonceSize()+s.aead.Overhead())
+	msgSize, err := s.readPrefix(maxLen)
+	if err != nil {
+		return err
 	}
 
 	s.inbuf.reset()
@@ -167,14 +225,23 @@ func (s *Session) readMessage(obj ProtocolObject, maxLen uint64) error {
 		return err
 	}
 
-	nonce := s.inbuf.next(s.aead.NonceSize())
+	nonce := s.inbuf.next(s.recv.aead.NonceSize())
 	paddedPayload := s.inbuf.bytes()
-	_, err := s.aead.Open(paddedPayload[:0], nonce, paddedPayload, nil)
+	plaintext, err := s.recv.aead.open(paddedPayload, nonce)
 	if err != nil {
 		s.setErr(err) // not an I/O error, but still fatal
 		return err
 	}
-	return obj.unmarshalBuffer(&s.inbuf)
+	err = obj.unmarshalBuffer(&s.inbuf)
+	if s.transcript != nil {
+		// record only the bytes consumed by obj, unless it was malformed
+		consumed := len(paddedPayload) - s.inbuf.buf.Len()
+		if err == nil && consumed <= len(plaintext) {
+			plaintext = plaintext[:consumed]
+		}
+		s.transcript.record(false, obj, 8+int(msgSize), plaintext)
+	}
+	return err
 }
 
 // WriteRequest sends an encrypted RPC request, comprising an RPC ID and a
@@ -187,6 +254,85 @@ func (s *Session) WriteRequest(rpcID Specifier, req ProtocolObject) (err error)
 	return
 }
 
+// WriteAppendRequest sends an encrypted Write RPC request containing n Append
+// actions. Unlike WriteRequest, WriteAppendRequest does not buffer the entire
+// request in memory; instead, it calls next to obtain the data for each
+// action immediately before writing it. next is called exactly n times, and
+// the sector it returns may be reused as soon as next is called again.
+// req.Actions must be empty.
+func (s *Session) WriteAppendRequest(req *RPCWriteRequest, n int, next func() *[SectorSize]byte) (err error) {
+	defer wrapErr(&err, "WriteAppendRequest")
+	if len(req.Actions) != 0 {
+		panic("WriteAppendRequest: req.Actions must be empty")
+	}
+	rpcID := RPCWriteID
+	if err := s.writeMessage(&rpcID); err != nil {
+		return errors.Wrap(err, "WriteRequestID")
+	}
+
+	// Since req.Actions is empty, req marshals as an empty prefix followed by
+	// the remaining fields. We can therefore marshal it once, then overwrite
+	// the prefix and insert the actions after it.
+	s.outbuf.reset()
+	req.marshalBuffer(&s.outbuf)
+	fields := s.outbuf.bytes()[8:]
+	nonceSize := s.send.aead.NonceSize()
+	actionSize := len(RPCWriteActionAppend) + 8 + 8 + 8 + SectorSize
+	plaintextSize := 8 + n*actionSize + len(fields)
+	msgSize := 8 + nonceSize + s.send.aead.sealedSize(plaintextSize)
+	var padding int
+	if msgSize < MinMessageSize {
+		padding = MinMessageSize - msgSize
+		msgSize = MinMessageSize
+	}
+	if err := s.prepareSend(msgSize); err != nil {
+		return errors.Wrap(err, "WriteRequest")
+	}
+
+	// write length prefix and nonce
+	w := bufio.NewWriterSize(s.conn, 1<<16)
+	nonce := frand.Bytes(nonceSize)
+	prefix := make([]byte, 8)
+	binary.LittleEndian.PutUint64(prefix, uint64(msgSize-8))
+	w.Write(prefix)
+	w.Write(nonce)
+
+	// encrypt the payload as we go
+	sealer := s.send.aead.newSealer(w, nonce, plaintextSize+padding)
+	var plaintext []byte
+	writeEnc := func(p []byte) {
+		if s.transcript != nil {
+			plaintext = append(plaintext, p...)
+		}
+		sealer.Write(p)
+	}
+	header := make([]byte, actionSize-SectorSize)
+	binary.LittleEndian.PutUint64(header[:8], uint64(n))
+	writeEnc(header[:8])
+	copy(header, RPCWriteActionAppend[:])
+	binary.LittleEndian.PutUint64(header[16:], 0)
+	binary.LittleEndian.PutUint64(header[24:], 0)
+	binary.LittleEndian.PutUint64(header[32:], SectorSize)
+	for i := 0; i < n; i++ {
+		writeEnc(header)
+		writeEnc(next()[:])
+	}
+	writeEnc(fields)
+	if s.transcript != nil {
+		s.transcript.record(true, req, msgSize, plaintext)
+	}
+	writeEnc(make([]byte, padding))
+
+	// write the authentication tag
+	if err := sealer.Close(); err != nil {
+		s.setErr(err)
+		return errors.Wrap(err, "WriteRequest")
+	}
+	err = w.Flush()
+	s.setErr(err)
+	return errors.Wrap(err, "WriteRequest")
+}
+
 // ReadID reads an RPC request ID. If the renter sends the session termination
 // signal, ReadID returns ErrRenterClosed.
 func (s *Session) ReadID() (rpcID Specifier, err error) {
@@ -229,14 +375,13 @@ func (s *Session) ReadResponse(resp ProtocolObject, maxLen uint64) (err error) {
 	return nil
 }
 
-// A ResponseReader contains an unencrypted, unauthenticated RPC response
-// message.
+// A ResponseReader contains an RPC response message, which is decrypted as it
+// is read. The plaintext is not authenticated until VerifyTag returns nil.
 type ResponseReader struct {
 	msgR   io.Reader
-	tagR   io.Reader
-	mac    *poly1305.MAC
-	clen   uint64
+	opener MessageOpener
 	setErr func(error)
+	record func() // called after the message is authenticated
 }
 
 // Read implements io.Reader.
@@ -254,27 +399,15 @@ func (rr *ResponseReader) Read(p []byte) (int, error) {
 // if VerifyTag returns a non-nil error.
 func (rr *ResponseReader) VerifyTag() error {
 	// the caller may not have consumed the full message (e.g. if it was padded
-	// to MinMessageSize), so make sure the whole thing is written to the MAC
+	// to MinMessageSize), so make sure the whole thing is authenticated
 	if _, err := io.Copy(ioutil.Discard, rr); err != nil {
 		return err
-	}
-
-	var tag [poly1305.TagSize]byte
-	if _, err := io.ReadFull(rr.tagR, tag[:]); err != nil {
-		rr.setErr(err)
+	} else if err := rr.opener.Verify(); err != nil {
+		rr.setErr(err) // not necessarily an I/O error, but still fatal
 		return err
 	}
-	// MAC is padded to 16 bytes, and covers the length of AD (0 in this case)
-	// and ciphertext
-	tail := make([]byte, 0, 32)[:32-(rr.clen%16)]
-	binary.LittleEndian.PutUint64(tail[len(tail)-8:], rr.clen)
-	rr.mac.Write(tail)
-	var ourTag [poly1305.TagSize]byte
-	rr.mac.Sum(ourTag[:0])
-	if subtle.ConstantTimeCompare(tag[:], ourTag[:]) != 1 {
-		err := errors.New("chacha20poly1305: message authentication failed")
-		rr.setErr(err) // not an I/O error, but still fatal
-		return err
+	if rr.record != nil {
+		rr.record()
 	}
 	return nil
 }
@@ -284,53 +417,18 @@ func (rr *ResponseReader) VerifyTag() error {
 // after which the caller should call VerifyTag to authenticate the message. If
 // the response was an RPCError, it is authenticated and returned immediately.
 func (s *Session) RawResponse(maxLen uint64) (*ResponseReader, error) {
-	if maxLen < MinMessageSize {
-		maxLen = MinMessageSize
-	}
-	s.inbuf.reset()
-	if err := s.inbuf.copyN(s.conn, 8); err != nil {
-		s.setErr(err)
-		return nil, err
-	}
-	msgSize := s.inbuf.readUint64()
-	if msgSize > maxLen {
-		return nil, errors.Errorf("message size (%v bytes) exceeds maxLen of %v bytes", msgSize, maxLen)
-	} else if msgSize < uint64(s.aead.NonceSize()+s.aead.Overhead()) {
-		return nil, errors.Errorf("message size (%v bytes) is too small (nonce + MAC is %v bytes)", msgSize, s.aead.NonceSize()+s.aead.Overhead())
-	}
-	msgSize -= uint64(s.aead.NonceSize() + s.aead.Overhead())
-
-	s.inbuf.reset()
-	s.inbuf.grow(s.aead.NonceSize())
-	if err := s.inbuf.copyN(s.conn, uint64(s.aead.NonceSize())); err != nil {
-		s.setErr(err)
+	rr, err := s.streamMessage(maxLen)
+	if err != nil {
 		return nil, err
 	}
-	nonce := s.inbuf.next(s.aead.NonceSize())
-
-	// construct reader
-	c, _ := chacha.NewCipher(nonce, s.key, 20)
-	var polyKey [32]byte
-	c.XORKeyStream(polyKey[:], polyKey[:])
-	mac := poly1305.New(&polyKey)
-	c.SetCounter(1)
-	rr := &ResponseReader{
-		msgR: cipher.StreamReader{
-			R: io.TeeReader(io.LimitReader(s.conn, int64(msgSize)), mac),
-			S: c,
-		},
-		tagR:   io.LimitReader(s.conn, poly1305.TagSize),
-		mac:    mac,
-		clen:   msgSize,
-		setErr: s.setErr,
-	}
 
 	// check if response is an RPCError
+	s.inbuf.reset()
 	if err := s.inbuf.copyN(rr, 1); err != nil {
 		return nil, err
 	}
 	if isErr := s.inbuf.readBool(); isErr {
-		if err := s.inbuf.copyN(rr, msgSize-1); err != nil {
+		if _, err := s.inbuf.buf.ReadFrom(rr); err != nil {
 			return nil, err
 		}
 		err := new(RPCError)
@@ -344,10 +442,143 @@ func (s *Session) RawResponse(maxLen uint64) (*ResponseReader, error) {
 	return rr, nil
 }
 
+// streamMessage returns a ResponseReader that decrypts the next message as it
+// is read.
+func (s *Session) streamMessage(maxLen uint64) (*ResponseReader, error) {
+	msgSize, err := s.readPrefix(maxLen)
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := s.recv.aead.NonceSize()
+
+	s.inbuf.reset()
+	s.inbuf.grow(nonceSize)
+	if err := s.inbuf.copyN(s.conn, uint64(nonceSize)); err != nil {
+		s.setErr(err)
+		return nil, err
+	}
+	nonce := s.inbuf.next(nonceSize)
+	opener, err := s.recv.aead.newOpener(s.conn, nonce, int(msgSize)-nonceSize)
+	if err != nil {
+		s.setErr(err)
+		return nil, err
+	}
+	rr := &ResponseReader{
+		msgR:   opener,
+		opener: opener,
+		setErr: s.setErr,
+	}
+	if t := s.transcript; t != nil {
+		var plaintext bytes.Buffer
+		rr.msgR = io.TeeReader(rr.msgR, &plaintext)
+		rr.record = func() { t.record(false, nil, 8+int(msgSize), plaintext.Bytes()) }
+	}
+	return rr, nil
+}
+
+// A WriteRequestReader reads an RPCWriteRequest one action at a time. See
+// ReadWriteRequest.
+type WriteRequestReader struct {
+	rr        *ResponseReader
+	br        *bufio.Reader
+	remaining uint64 // actions not yet returned by NextAction
+	data      io.LimitedReader
+	header    [len(RPCWriteActionAppend) + 8 + 8 + 8]byte
+}
+
+// fail marks the Session as closed, since a malformed request leaves the
+// stream in an unknown state.
+func (wr *WriteRequestReader) fail(err error) error {
+	wr.rr.setErr(err)
+	return err
+}
+
+// NextAction returns the next action in the request. The Data field of the
+// action is always nil; instead, the data is read from the returned Reader,
+// which yields at most SectorSize bytes. The Reader is only valid until the
+// next call to NextAction, and any data not read from it is discarded. If all
+// actions have been read, NextAction returns io.EOF.
+//
+// The request is not authenticated until Finish returns successfully, so the
+// caller must not act on an action irrevocably before then.
+func (wr *WriteRequestReader) NextAction() (RPCWriteAction, io.Reader, error) {
+	if wr.data.N > 0 {
+		if _, err := io.Copy(ioutil.Discard, &wr.data); err != nil {
+			return RPCWriteAction{}, nil, err
+		} else if wr.data.N > 0 {
+			return RPCWriteAction{}, nil, wr.fail(io.ErrUnexpectedEOF)
+		}
+	}
+	if wr.remaining == 0 {
+		return RPCWriteAction{}, nil, io.EOF
+	}
+	wr.remaining--
+	if _, err := io.ReadFull(wr.br, wr.header[:]); err != nil {
+		return RPCWriteAction{}, nil, wr.fail(err)
+	}
+	var action RPCWriteAction
+	copy(action.Type[:], wr.header[:16])
+	action.A = binary.LittleEndian.Uint64(wr.header[16:])
+	action.B = binary.LittleEndian.Uint64(wr.header[24:])
+	dataLen := binary.LittleEndian.Uint64(wr.header[32:])
+	if dataLen > SectorSize {
+		return RPCWriteAction{}, nil, wr.fail(errors.Errorf("action data (%v bytes) exceeds SectorSize", dataLen))
+	}
+	wr.data = io.LimitedReader{R: wr.br, N: int64(dataLen)}
+	return action, &wr.data, nil
+}
+
+// Finish discards any unread actions, reads the remaining fields of the
+// request into req, and authenticates the message. req.Actions is left empty.
+func (wr *WriteRequestReader) Finish(req *RPCWriteRequest) error {
+	for {
+		if _, _, err := wr.NextAction(); err == io.EOF {
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+	// The remaining fields are small, but may be followed by padding. Since
+	// req.Actions is empty, the fields are preceded by an empty prefix.
+	var b objBuffer
+	b.writePrefix(0)
+	if _, err := b.buf.ReadFrom(io.LimitReader(wr.br, MinMessageSize)); err != nil {
+		return wr.fail(err)
+	} else if err := req.unmarshalBuffer(&b); err != nil {
+		return wr.fail(err)
+	}
+	return wr.rr.VerifyTag()
+}
+
+// ReadWriteRequest reads the beginning of an RPCWriteRequest, returning a
+// WriteRequestReader from which its actions can be read one at a time. Unlike
+// ReadRequest, ReadWriteRequest does not buffer the entire request in memory,
+// so data can be processed as it arrives. The caller must call Finish before
+// reading another message.
+func (s *Session) ReadWriteRequest(maxLen uint64) (_ *WriteRequestReader, err error) {
+	defer wrapErr(&err, "ReadWriteRequest")
+	if err := s.PrematureCloseErr(); err != nil {
+		return nil, err
+	}
+	rr, err := s.streamMessage(maxLen)
+	if err != nil {
+		return nil, err
+	}
+	wr := &WriteRequestReader{
+		rr: rr,
+		br: bufio.NewReaderSize(rr, 1<<16),
+	}
+	if _, err := io.ReadFull(wr.br, wr.header[:8]); err != nil {
+		return nil, wr.fail(err)
+	}
+	wr.remaining = binary.LittleEndian.Uint64(wr.header[:8])
+	return wr, nil
+}
+
 // Close gracefully terminates the RPC loop and closes the connection.
 func (s *Session) Close() (err error) {
 	defer wrapErr(&err, "Close")
-	if s.closed || s.err != nil {
+	if s.IsClosed() {
 		return nil
 	}
 	s.closed = true
@@ -365,88 +596,165 @@ func hashKeys(k1, k2 [32]byte) crypto.Hash {
 // handshake, returning a Session that can be used to handle RPC requests.
 func NewHostSession(conn io.ReadWriteCloser, priv ed25519.PrivateKey) (_ *Session, err error) {
 	defer wrapErr(&err, "NewHostSession")
+	s, _, err := newHostSession(conn, priv, SupportedCiphers(), false)
+	return s, err
+}
+
+// NewHostSessionWithCiphers is like NewHostSession, but only accepts the
+// specified cipher suites, which must be registered. The host selects the
+// renter's most-preferred cipher among those it accepts.
+func NewHostSessionWithCiphers(conn io.ReadWriteCloser, priv ed25519.PrivateKey, ciphers []Specifier) (_ *Session, err error) {
+	defer wrapErr(&err, "NewHostSessionWithCiphers")
+	s, _, err := newHostSession(conn, priv, ciphers, false)
+	return s, err
+}
+
+// newHostSession conducts the host's half of the handshake. If allowMux is
+// true and the renter proposed stream multiplexing, the host acknowledges it,
+// and newHostSession reports that the connection is multiplexed.
+func newHostSession(conn io.ReadWriteCloser, priv ed25519.PrivateKey, ciphers []Specifier, allowMux bool) (_ *Session, mux bool, err error) {
 	var req loopKeyExchangeRequest
 	if err := req.readFrom(conn); err != nil {
-		return nil, err
+		return nil, false, err
 	}
-
-	var supportsChaCha bool
+	var rekey bool
 	for _, c := range req.Ciphers {
-		if c == cipherChaCha20Poly1305 {
-			supportsChaCha = true
+		switch c {
+		case extStreamMux:
+			mux = allowMux
+		case extRekey:
+			rekey = true
 		}
 	}
-	if !supportsChaCha {
+
+	xsk, xpk := crypto.GenerateX25519KeyPair()
+	cipherKey := crypto.DeriveSharedSecret(xsk, req.PublicKey)
+	cipherID := selectCipher(req.Ciphers, ciphers)
+	aead, ok, err := newCipher(cipherID, cipherKey[:])
+	if !ok || err != nil {
 		(&loopKeyExchangeResponse{Cipher: cipherNoOverlap}).writeTo(conn)
-		return nil, errors.New("no supported ciphers")
+		if err != nil {
+			return nil, false, errors.Wrapf(err, "could not initialize %v cipher", cipherID)
+		}
+		return nil, false, errors.New("no supported ciphers")
 	}
 
-	xsk, xpk := crypto.GenerateX25519KeyPair()
 	resp := loopKeyExchangeResponse{
-		Cipher:    cipherChaCha20Poly1305,
+		Cipher:    cipherID,
 		PublicKey: xpk,
 		Signature: ed25519hash.Sign(priv, hashKeys(req.PublicKey, xpk)),
 	}
 	if err := resp.writeTo(conn); err != nil {
-		return nil, err
+		return nil, false, err
 	}
 
-	cipherKey := crypto.DeriveSharedSecret(xsk, req.PublicKey)
-	aead, _ := chacha20poly1305.New(cipherKey[:]) // no error possible
 	s := &Session{
 		conn:      conn,
-		aead:      aead,
-		key:       cipherKey[:],
+		cipher:    cipherID,
+		send:      sessionKey{key: cipherKey[:], aead: aead},
+		recv:      sessionKey{key: cipherKey[:], aead: aead},
 		challenge: frand.Entropy128(),
 		isRenter:  false,
+		rekey:     rekey,
 	}
-	// hack: cast challenge to Specifier to make it a ProtocolObject
-	if err := s.writeMessage((*Specifier)(&s.challenge)); err != nil {
-		return nil, err
+	challenge := loopChallenge{Challenge: s.challenge}
+	if mux {
+		challenge.Extensions = append(challenge.Extensions, extStreamMux)
+	}
+	if rekey {
+		challenge.Extensions = append(challenge.Extensions, extRekey)
+	}
+	if err := s.writeMessage(&challenge); err != nil {
+		return nil, false, err
 	}
-	return s, nil
+	return s, mux, nil
 }
 
 // NewRenterSession conducts the renter's half of the renter-host protocol
 // handshake, returning a Session that can be used to make RPC requests.
 func NewRenterSession(conn io.ReadWriteCloser, pub ed25519.PublicKey) (_ *Session, err error) {
 	defer wrapErr(&err, "NewRenterSession")
+	s, _, err := newRenterSession(conn, pub, RenterCipherPreference, false)
+	return s, err
+}
+
+// NewRenterSessionWithCiphers is like NewRenterSession, but proposes the
+// specified cipher suites, in order of preference, instead of
+// RenterCipherPreference. The ciphers must be registered.
+func NewRenterSessionWithCiphers(conn io.ReadWriteCloser, pub ed25519.PublicKey, ciphers []Specifier) (_ *Session, err error) {
+	defer wrapErr(&err, "NewRenterSessionWithCiphers")
+	s, _, err := newRenterSession(conn, pub, ciphers, false)
+	return s, err
+}
 
+// newRenterSession conducts the renter's half of the handshake. If proposeMux
+// is true, the renter proposes stream multiplexing, and newRenterSession
+// reports whether the host acknowledged it.
+func newRenterSession(conn io.ReadWriteCloser, pub ed25519.PublicKey, ciphers []Specifier, proposeMux bool) (_ *Session, mux bool, err error) {
+	if len(ciphers) == 0 {
+		return nil, false, errors.New("no ciphers specified")
+	}
 	xsk, xpk := crypto.GenerateX25519KeyPair()
 	req := &loopKeyExchangeRequest{
 		PublicKey: xpk,
-		Ciphers:   []Specifier{cipherChaCha20Poly1305},
+		Ciphers:   append([]Specifier(nil), ciphers...),
+	}
+	proposed := []Specifier{extRekey}
+	if proposeMux {
+		proposed = append(proposed, extStreamMux)
 	}
+	req.Ciphers = append(req.Ciphers, proposed...)
 	if err := req.writeTo(conn); err != nil {
-		return nil, errors.Wrap(err, "couldn't write handshake")
+		return nil, false, errors.Wrap(err, "couldn't write handshake")
 	}
 	var resp loopKeyExchangeResponse
 	if err := resp.readFrom(conn); err != nil {
-		return nil, errors.Wrap(err, "couldn't read host's handshake")
+		return nil, false, errors.Wrap(err, "couldn't read host's handshake")
 	}
 	// validate the signature before doing anything else
 	if !ed25519hash.Verify(pub, hashKeys(req.PublicKey, resp.PublicKey), resp.Signature) {
-		return nil, errors.New("host's handshake signature was invalid")
+		return nil, false, errors.New("host's handshake signature was invalid")
 	}
 	if resp.Cipher == cipherNoOverlap {
-		return nil, errors.New("host does not support any of our proposed ciphers")
-	} else if resp.Cipher != cipherChaCha20Poly1305 {
-		return nil, errors.New("host selected unsupported cipher")
+		return nil, false, errors.New("host does not support any of our proposed ciphers")
+	} else if selectCipher([]Specifier{resp.Cipher}, ciphers) != resp.Cipher {
+		return nil, false, errors.New("host selected unsupported cipher")
 	}
 
 	cipherKey := crypto.DeriveSharedSecret(xsk, resp.PublicKey)
-	aead, _ := chacha20poly1305.New(cipherKey[:]) // no error possible
+	aead, ok, err := newCipher(resp.Cipher, cipherKey[:])
+	if !ok {
+		return nil, false, errors.Errorf("cipher %v is not registered", resp.Cipher)
+	} else if err != nil {
+		return nil, false, errors.Wrapf(err, "could not initialize %v cipher", resp.Cipher)
+	}
 	s := &Session{
 		conn:     conn,
-		aead:     aead,
-		key:      cipherKey[:],
+		cipher:   resp.Cipher,
+		send:     sessionKey{key: cipherKey[:], aead: aead},
+		recv:     sessionKey{key: cipherKey[:], aead: aead},
 		isRenter: true,
 	}
-	// hack: cast challenge to Specifier to make it a ProtocolObject
-	if err := s.readMessage((*Specifier)(&s.challenge), MinMessageSize); err != nil {
-		return nil, err
+	var challenge loopChallenge
+	if err := s.readMessage(&challenge, MinMessageSize); err != nil {
+		return nil, false, err
+	}
+	s.challenge = challenge.Challenge
+	// only extensions that we proposed can have been acknowledged; anything
+	// beyond them is padding
+	acked := challenge.Extensions
+	if len(acked) > len(proposed) {
+		acked = acked[:len(proposed)]
+	}
+	for _, ext := range acked {
+		switch ext {
+		case extStreamMux:
+			mux = proposeMux
+		case extRekey:
+			s.rekey = true
+		}
 	}
-	return s, nil
+	return s, mux, nil
 }
 
 // Handshake objects
@@ -461,6 +769,16 @@ type (
 		Signature []byte
 		Cipher    Specifier
 	}
+
+	// loopChallenge is the first encrypted message sent by the host,
+	// followed by any handshake extensions that the host acknowledges. Hosts
+	// that do not acknowledge any extension send only the challenge; since
+	// messages are padded with random data, a renter will not mistake the
+	// padding for an extension except with negligible probability.
+	loopChallenge struct {
+		Challenge  [16]byte
+		Extensions []Specifier
+	}
 )
 
 // A Specifier is a generic identification tag.
@@ -470,6 +788,21 @@ func (s Specifier) String() string {
 	return string(bytes.Trim(s[:], "\x00"))
 }
 
+// MarshalText implements encoding.TextMarshaler.
+func (s Specifier) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements encoding.TextUnmarshaler.
+func (s *Specifier) UnmarshalText(b []byte) error {
+	if len(b) > len(s) {
+		return errors.Errorf("specifier %q is too long", b)
+	}
+	*s = Specifier{}
+	copy(s[:], b)
+	return nil
+}
+
 func newSpecifier(str string) Specifier {
 	if len(str) > 16 {
 		panic("specifier is too long")
@@ -489,10 +822,11 @@ var (
 // session termination signal.
 var ErrRenterClosed = errors.New("renter has terminated session")
 
-// RPC ciphers
+// Handshake extensions; these are proposed alongside the renter's ciphers,
+// which hosts that don't recognize them will ignore.
 var (
-	cipherChaCha20Poly1305 = newSpecifier("ChaCha20Poly1305")
-	cipherNoOverlap        = newSpecifier("NoOverlap")
+	extStreamMux = newSpecifier("StreamMux")
+	extRekey     = newSpecifier("Rekey")
 )
 
 // RPC IDs
@@ -597,8 +931,10 @@ type (
 
 	// RPCReadResponse contains the response data for the Read RPC.
 	RPCReadResponse struct {
-		Signature   []byte
-		Data        []byte
+		Signature []byte
+		// Data will typically be large (4 MiB), so its existing capacity is
+		// reused when unmarshalling, if possible.
+		Data        []byte `renterhost:"reuse"`
 		MerkleProof []crypto.Hash
 	}
 
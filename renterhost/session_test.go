@@ -3,16 +3,19 @@ package renterhost
 import (
 	"bytes"
 	"crypto/ed25519"
+	"encoding/binary"
 	"io"
 	"io/ioutil"
+	"net"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/pkg/errors"
 	"gitlab.com/NebulousLabs/Sia/crypto"
 	"gitlab.com/NebulousLabs/Sia/types"
 	"gitlab.com/NebulousLabs/encoding"
-	"golang.org/x/crypto/chacha20poly1305"
 	"lukechampine.com/frand"
 )
 
@@ -137,6 +140,47 @@ func (o arb) unmarshalBuffer(b *objBuffer) error {
 	return encoding.Unmarshal(b.buf.Bytes(), o.data)
 }
 
+func greetHost(hs *Session) error {
+	defer hs.Close()
+	for {
+		id, err := hs.ReadID()
+		if errors.Cause(err) == ErrRenterClosed {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		switch id {
+		case newSpecifier("Greet"):
+			var name string
+			if err := hs.ReadRequest(arb{&name}, 1<<20); err != nil {
+				return err
+			}
+			if name == "" {
+				err = hs.WriteResponse(nil, ErrInvalidName)
+			} else {
+				err = hs.WriteResponse(arb{"Hello, " + name}, nil)
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			return errors.New("unknown specifier")
+		}
+	}
+}
+
+func greetRenter(rs *Session, name string) error {
+	var resp string
+	if err := rs.WriteRequest(newSpecifier("Greet"), arb{name}); err != nil {
+		return err
+	} else if err := rs.ReadResponse(arb{&resp}, 1<<20); err != nil {
+		return err
+	} else if resp != "Hello, "+name {
+		return errors.Errorf("unexpected response: %q", resp)
+	}
+	return nil
+}
+
 func TestSession(t *testing.T) {
 	renter, host := newFakeConns()
 	pubkey, privkey, _ := ed25519.GenerateKey(nil)
@@ -147,32 +191,7 @@ func TestSession(t *testing.T) {
 			if err != nil {
 				return err
 			}
-			defer hs.Close()
-			for {
-				id, err := hs.ReadID()
-				if errors.Cause(err) == ErrRenterClosed {
-					return nil
-				} else if err != nil {
-					return err
-				}
-				switch id {
-				case newSpecifier("Greet"):
-					var name string
-					if err := hs.ReadRequest(arb{&name}, 0); err != nil {
-						return err
-					}
-					if name == "" {
-						err = hs.WriteResponse(nil, ErrInvalidName)
-					} else {
-						err = hs.WriteResponse(arb{"Hello, " + name}, nil)
-					}
-					if err != nil {
-						return err
-					}
-				default:
-					return errors.New("unknown specifier")
-				}
-			}
+			return greetHost(hs)
 		}()
 	}()
 
@@ -201,6 +220,313 @@ func TestSession(t *testing.T) {
 	}
 }
 
+func TestMux(t *testing.T) {
+	renter, host := net.Pipe()
+	pubkey, privkey, _ := ed25519.GenerateKey(nil)
+	hostErr := make(chan error, 1)
+	go func() {
+		hostErr <- func() error {
+			hm, err := NewHostMux(host, privkey)
+			if err != nil {
+				return err
+			}
+			defer hm.Close()
+			for {
+				st, err := hm.AcceptStream()
+				if err != nil {
+					return nil
+				}
+				go func() {
+					if hs, err := st.HostSession(st); err == nil {
+						greetHost(hs)
+					}
+				}()
+			}
+		}()
+	}()
+
+	rm, err := NewRenterMux(renter, pubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rm.Close()
+	if !rm.Multiplexed() {
+		t.Fatal("expected host to support multiplexing")
+	}
+
+	// run many RPCs concurrently, with messages large enough to span many
+	// frames
+	errs := make(chan error, 8)
+	for i := 0; i < cap(errs); i++ {
+		go func(i int) {
+			errs <- func() error {
+				st, err := rm.OpenStream()
+				if err != nil {
+					return err
+				}
+				rs, err := st.RenterSession(st)
+				if err != nil {
+					return err
+				}
+				defer rs.Close()
+				for j := 0; j < 3; j++ {
+					if err := greetRenter(rs, strings.Repeat(string(rune('A'+i)), 100000)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}()
+		}(i)
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// an error should only affect its own stream
+	st1, err := rm.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs1, err := st1.RenterSession(st1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	st2, err := rm.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs2, err := st2.RenterSession(st2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := rs1.WriteRequest(newSpecifier("Bogus"), nil); err != nil {
+		t.Fatal(err)
+	} else if err := rs1.ReadResponse(nil, 0); err == nil {
+		t.Fatal("expected error after host closed stream")
+	}
+	if err := greetRenter(rs2, "Foo"); err != nil {
+		t.Fatal(err)
+	}
+	rs2.Close()
+
+	// closing the Mux should close the host's Mux as well
+	rm.Close()
+	if _, err := rm.OpenStream(); errors.Cause(err) != ErrMuxClosed {
+		t.Fatal("expected ErrMuxClosed, got", err)
+	}
+	if err := <-hostErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMuxFallback(t *testing.T) {
+	pubkey, privkey, _ := ed25519.GenerateKey(nil)
+
+	// renter proposes multiplexing, host doesn't support it
+	renter, host := net.Pipe()
+	go func() {
+		if hs, err := NewHostSession(host, privkey); err == nil {
+			greetHost(hs)
+		}
+	}()
+	rm, err := NewRenterMux(renter, pubkey)
+	if err != nil {
+		t.Fatal(err)
+	} else if rm.Multiplexed() {
+		t.Fatal("expected host not to support multiplexing")
+	}
+	st, err := rm.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rs, err := st.RenterSession(st)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := greetRenter(rs, "Foo"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := rm.OpenStream(); errors.Cause(err) != ErrMuxUnsupported {
+		t.Fatal("expected ErrMuxUnsupported, got", err)
+	}
+	rs.Close()
+
+	// host supports multiplexing, renter doesn't propose it
+	renter, host = net.Pipe()
+	hostErr := make(chan error, 1)
+	go func() {
+		hostErr <- func() error {
+			hm, err := NewHostMux(host, privkey)
+			if err != nil {
+				return err
+			} else if hm.Multiplexed() {
+				return errors.New("expected renter not to propose multiplexing")
+			}
+			st, err := hm.AcceptStream()
+			if err != nil {
+				return err
+			}
+			hs, err := st.HostSession(st)
+			if err != nil {
+				return err
+			} else if err := greetHost(hs); err != nil {
+				return err
+			}
+			// the Mux only carries one stream
+			if _, err := hm.AcceptStream(); err == nil {
+				return errors.New("expected error when accepting second stream")
+			}
+			return nil
+		}()
+	}()
+	rs, err = NewRenterSession(renter, pubkey)
+	if err != nil {
+		t.Fatal(err)
+	} else if err := greetRenter(rs, "Bar"); err != nil {
+		t.Fatal(err)
+	}
+	rs.Close()
+	if err := <-hostErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMuxFlowControl(t *testing.T) {
+	renter, host := net.Pipe()
+	pubkey, privkey, _ := ed25519.GenerateKey(nil)
+	hostStreams := make(chan *Stream, 2)
+	go func() {
+		hm, err := NewHostMux(host, privkey)
+		if err != nil {
+			return
+		}
+		defer hm.Close()
+		for {
+			st, err := hm.AcceptStream()
+			if err != nil {
+				return
+			}
+			hostStreams <- st
+		}
+	}()
+	rm, err := NewRenterMux(renter, pubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rm.Close()
+	rst1, err := rm.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rst2, err := rm.OpenStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hst1, hst2 := <-hostStreams, <-hostStreams
+
+	// the host isn't reading stream 1, so writes should stall once the window
+	// is exhausted
+	rst1.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := rst1.Write(make([]byte, 2*maxStreamBuffer))
+	if ne, ok := err.(net.Error); !ok || !ne.Timeout() {
+		t.Fatal("expected timeout, got", err)
+	} else if n != maxStreamBuffer {
+		t.Fatalf("expected %v bytes to be written, got %v", maxStreamBuffer, n)
+	}
+
+	// stream 2 should be unaffected
+	if _, err := rst2.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	hst2.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(hst2, buf); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "hello" {
+		t.Fatalf("unexpected data: %q", buf)
+	}
+
+	// once the host reads stream 1, the renter can continue writing
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(hst1, make([]byte, 2*maxStreamBuffer))
+		readErr <- err
+	}()
+	rst1.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := rst1.Write(make([]byte, maxStreamBuffer)); err != nil {
+		t.Fatal(err)
+	} else if err := <-readErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMuxWindowExceeded(t *testing.T) {
+	renter, host := net.Pipe()
+	s := &Session{
+		cipher: CipherChaCha20Poly1305,
+		send:   sessionKey{key: make([]byte, 32)},
+	}
+	hm := newMux(host, s, true)
+	defer hm.Close()
+
+	// read frames sent by the host, reporting which streams it closes
+	closed := make(chan uint32, 1)
+	go func() {
+		header := make([]byte, frameHeaderSize)
+		for {
+			if _, err := io.ReadFull(renter, header); err != nil {
+				return
+			}
+			payload := make([]byte, binary.LittleEndian.Uint16(header[6:]))
+			if _, err := io.ReadFull(renter, payload); err != nil {
+				return
+			}
+			if binary.LittleEndian.Uint16(header[4:])&flagClose != 0 {
+				closed <- binary.LittleEndian.Uint32(header[0:])
+			}
+		}
+	}()
+	writeFrame := func(id uint32, flags uint16, p []byte) {
+		frame := make([]byte, frameHeaderSize+len(p))
+		binary.LittleEndian.PutUint32(frame[0:], id)
+		binary.LittleEndian.PutUint16(frame[4:], flags)
+		binary.LittleEndian.PutUint16(frame[6:], uint16(len(p)))
+		copy(frame[frameHeaderSize:], p)
+		if _, err := renter.Write(frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// ignore flow control on stream 1
+	writeFrame(1, flagOpen, nil)
+	for i := 0; i <= maxStreamBuffer/maxFramePayload; i++ {
+		writeFrame(1, 0, make([]byte, maxFramePayload))
+	}
+	writeFrame(2, flagOpen, []byte("hello"))
+
+	// stream 1 should be reset, while stream 2 is unaffected
+	st1, err := hm.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st2, err := hm.AcceptStream()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st1.Read(make([]byte, 1)); err != errWindowExceeded {
+		t.Fatal("expected errWindowExceeded, got", err)
+	} else if id := <-closed; id != 1 {
+		t.Fatal("expected stream 1 to be closed, got", id)
+	}
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(st2, buf); err != nil {
+		t.Fatal(err)
+	} else if string(buf) != "hello" {
+		t.Fatalf("unexpected data: %q", buf)
+	}
+}
+
 func TestFormContract(t *testing.T) {
 	renterReq := &RPCFormContractRequest{
 		Transactions: []types.Transaction{randomTxn, randomTxn},
@@ -363,6 +689,557 @@ func TestRawMessage(t *testing.T) {
 	}
 }
 
+func TestWriteAppendRequest(t *testing.T) {
+	renter, host := newFakeConns()
+	pubkey, privkey, _ := ed25519.GenerateKey(nil)
+	sectors := make([][SectorSize]byte, 3)
+	for i := range sectors {
+		frand.Read(sectors[i][:])
+	}
+	req := &RPCWriteRequest{
+		MerkleProof:          true,
+		NewRevisionNumber:    7,
+		NewValidProofValues:  []types.Currency{types.SiacoinPrecision, types.NewCurrency64(1)},
+		NewMissedProofValues: []types.Currency{types.NewCurrency64(2)},
+	}
+
+	hostErr := make(chan error, 1)
+	go func() {
+		hostErr <- func() error {
+			hs, err := NewHostSession(host, privkey)
+			if err != nil {
+				return err
+			}
+			defer hs.Close()
+			if id, err := hs.ReadID(); err != nil {
+				return err
+			} else if id != RPCWriteID {
+				return errors.New("wrong RPC ID")
+			}
+			var hostReq RPCWriteRequest
+			if err := hs.ReadRequest(&hostReq, SectorSize*5); err != nil {
+				return err
+			}
+			if len(hostReq.Actions) != len(sectors) {
+				return errors.New("wrong number of actions")
+			}
+			for i, action := range hostReq.Actions {
+				if action.Type != RPCWriteActionAppend || !bytes.Equal(action.Data, sectors[i][:]) {
+					return errors.New("wrong action")
+				}
+			}
+			hostReq.Actions = nil
+			if !deepEqual(hostReq, *req) {
+				return errors.New("wrong request fields")
+			}
+			_, err = hs.ReadID()
+			if errors.Cause(err) != ErrRenterClosed {
+				return err
+			}
+			return nil
+		}()
+	}()
+
+	rs, err := NewRenterSession(renter, pubkey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var i int
+	err = rs.WriteAppendRequest(req, len(sectors), func() *[SectorSize]byte {
+		i++
+		return &sectors[i-1]
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if i != len(sectors) {
+		t.Fatal("next was called", i, "times; expected", len(sectors))
+	}
+	if err := rs.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-hostErr; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadWriteRequest(t *testing.T) {
+	pubkey, privkey, _ := ed25519.GenerateKey(nil)
+	req := &RPCWriteRequest{
+		Actions: []RPCWriteAction{
+			{Type: RPCWriteActionAppend, Data: frand.Bytes(SectorSize)},
+			{Type: RPCWriteActionUpdate, A: 1, B: 64, Data: frand.Bytes(100)},
+			{Type: RPCWriteActionAppend, Data: frand.Bytes(SectorSize)},
+			{Type: RPCWriteActionSwap, A: 3, B: 4},
+			{Type: RPCWriteActionTrim, A: 2},
+		},
+		MerkleProof:          true,
+		NewRevisionNumber:    7,
+		NewValidProofValues:  []types.Currency{types.SiacoinPrecision, types.NewCurrency64(1)},
+		NewMissedProofValues: []types.Currency{types.NewCurrency64(2)},
+	}
+
+	for _, c := range []Specifier{CipherChaCha20Poly1305, CipherAES256GCM} {
+		renter, host := newFakeConns()
+		hostErr := make(chan error, 1)
+		go func() {
+			hostErr <- func() error {
+				hs, err := NewHostSession(host, privkey)
+				if err != nil {
+					return err
+				}
+				defer hs.Close()
+				if _, err := hs.ReadID(); err != nil {
+					return err
+				}
+				wr, err := hs.ReadWriteRequest(SectorSize * 5)
+				if err != nil {
+					return err
+				}
+				for i := 0; ; i++ {
+					action, data, err := wr.NextAction()
+					if err == io.EOF {
+						if i != len(req.Actions) {
+							return errors.New("wrong number of actions")
+						}
+						break
+					} else if err != nil {
+						return err
+					}
+					exp := req.Actions[i]
+					if action.Type != exp.Type || action.A != exp.A || action.B != exp.B || action.Data != nil {
+						return errors.New("wrong action")
+					}
+					// leave the second Append unread; it should be discarded
+					if i == 2 {
+						continue
+					}
+					if p, err := ioutil.ReadAll(data); err != nil {
+						return err
+					} else if !bytes.Equal(p, exp.Data) {
+						return errors.New("wrong action data")
+					}
+				}
+				var hostReq RPCWriteRequest
+				if err := wr.Finish(&hostReq); err != nil {
+					return err
+				}
+				exp := *req
+				exp.Actions = nil
+				if !deepEqual(hostReq, exp) {
+					return errors.New("wrong request fields")
+				}
+				_, err = hs.ReadID()
+				if errors.Cause(err) != ErrRenterClosed {
+					return err
+				}
+				return nil
+			}()
+		}()
+
+		rs, err := NewRenterSessionWithCiphers(renter, pubkey, []Specifier{c})
+		if err != nil {
+			t.Fatal(err)
+		} else if err := rs.WriteRequest(RPCWriteID, req); err != nil {
+			t.Fatal(err)
+		} else if err := rs.Close(); err != nil {
+			t.Fatal(err)
+		} else if err := <-hostErr; err != nil {
+			t.Fatal(c, err)
+		}
+	}
+}
+
+func TestRekey(t *testing.T) {
+	pubkey, privkey, _ := ed25519.GenerateKey(nil)
+	for _, c := range []Specifier{CipherChaCha20Poly1305, CipherAES256GCM} {
+		renter, host := newFakeConns()
+		hostErr := make(chan error, 1)
+		go func() {
+			hostErr <- func() error {
+				hs, err := NewHostSession(host, privkey)
+				if err != nil {
+					return err
+				}
+				hs.SetRekeyInterval(0, 3)
+				return greetHost(hs)
+			}()
+		}()
+
+		rs, err := NewRenterSessionWithCiphers(renter, pubkey, []Specifier{c})
+		if err != nil {
+			t.Fatal(err)
+		} else if !rs.rekey {
+			t.Fatal("host did not acknowledge rekeying")
+		}
+		rs.SetRekeyInterval(MinMessageSize*2, 0)
+		sendKey := append([]byte(nil), rs.send.key...)
+		recvKey := append([]byte(nil), rs.recv.key...)
+		for i := 0; i < 10; i++ {
+			if err := greetRenter(rs, "Foo"); err != nil {
+				t.Fatal(c, err)
+			}
+		}
+		if bytes.Equal(rs.send.key, sendKey) || bytes.Equal(rs.recv.key, recvKey) {
+			t.Fatal("session was not rekeyed")
+		}
+		if err := rs.Close(); err != nil {
+			t.Fatal(err)
+		} else if err := <-hostErr; err != nil {
+			t.Fatal(c, err)
+		}
+	}
+}
+
+func TestNonceExhausted(t *testing.T) {
+	aead, _, _ := newCipher(CipherChaCha20Poly1305, make([]byte, 32))
+	newSession := func(rekey bool) *Session {
+		return &Session{
+			conn: struct {
+				io.Writer
+				io.ReadCloser
+			}{ioutil.Discard, ioutil.NopCloser(nil)},
+			cipher: CipherChaCha20Poly1305,
+			send:   sessionKey{key: make([]byte, 32), aead: aead, msgs: maxKeyMessages},
+			rekey:  rekey,
+		}
+	}
+
+	// without rekeying, the Session must refuse to reuse the key
+	obj := newSpecifier("Hello, World!")
+	s := newSession(false)
+	if err := s.writeMessage(&obj); err != ErrNonceExhausted {
+		t.Fatal("expected ErrNonceExhausted, got", err)
+	} else if !s.IsClosed() {
+		t.Fatal("session should be closed")
+	}
+
+	// with rekeying, a fresh key should be used
+	s = newSession(true)
+	s.SetRekeyInterval(0, maxKeyMessages*2)
+	if err := s.writeMessage(&obj); err != nil {
+		t.Fatal(err)
+	} else if s.send.msgs != 1 {
+		t.Fatal("session was not rekeyed")
+	}
+}
+
+func TestCiphers(t *testing.T) {
+	pubkey, privkey, _ := ed25519.GenerateKey(nil)
+	tests := []struct {
+		renter []Specifier
+		host   []Specifier
+		exp    Specifier
+	}{
+		{[]Specifier{CipherAES256GCM, CipherChaCha20Poly1305}, SupportedCiphers(), CipherAES256GCM},
+		{[]Specifier{CipherChaCha20Poly1305, CipherAES256GCM}, SupportedCiphers(), CipherChaCha20Poly1305},
+		{[]Specifier{CipherAES256GCM, CipherChaCha20Poly1305}, []Specifier{CipherChaCha20Poly1305}, CipherChaCha20Poly1305},
+		{[]Specifier{newSpecifier("Foo"), CipherAES256GCM}, SupportedCiphers(), CipherAES256GCM},
+		{[]Specifier{CipherAES256GCM}, []Specifier{CipherChaCha20Poly1305}, cipherNoOverlap},
+	}
+	for _, test := range tests {
+		renter, host := newFakeConns()
+		hostErr := make(chan error, 1)
+		go func() {
+			hostErr <- func() error {
+				hs, err := NewHostSessionWithCiphers(host, privkey, test.host)
+				if err != nil {
+					host.Close()
+					return err
+				}
+				defer hs.Close()
+				// echo the data of the first Append action
+				if id, err := hs.ReadID(); err != nil {
+					return err
+				} else if id != RPCWriteID {
+					return errors.New("wrong RPC ID")
+				}
+				var req RPCWriteRequest
+				if err := hs.ReadRequest(&req, SectorSize*2); err != nil {
+					return err
+				} else if len(req.Actions) != 1 {
+					return errors.New("wrong number of actions")
+				}
+				if err := hs.WriteResponse(&RPCReadResponse{Data: req.Actions[0].Data}, nil); err != nil {
+					return err
+				}
+				_, err = hs.ReadID()
+				if errors.Cause(err) != ErrRenterClosed {
+					return err
+				}
+				return nil
+			}()
+		}()
+
+		rs, err := NewRenterSessionWithCiphers(renter, pubkey, test.renter)
+		if test.exp == cipherNoOverlap {
+			if err == nil {
+				t.Error("expected handshake to fail")
+			} else if <-hostErr == nil {
+				t.Error("expected host handshake to fail")
+			}
+			continue
+		} else if err != nil {
+			t.Fatal(err)
+		} else if rs.Cipher() != test.exp {
+			t.Fatalf("expected %v to be selected, got %v", test.exp, rs.Cipher())
+		}
+
+		// exercise the streaming (or buffered) paths
+		var sector [SectorSize]byte
+		frand.Read(sector[:])
+		err = rs.WriteAppendRequest(&RPCWriteRequest{}, 1, func() *[SectorSize]byte { return &sector })
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr, err := rs.RawResponse(SectorSize * 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(rr)
+		if err != nil {
+			t.Fatal(err)
+		} else if err := rr.VerifyTag(); err != nil {
+			t.Fatal(err)
+		}
+		var b objBuffer
+		b.write(data)
+		var resp RPCReadResponse
+		if err := resp.unmarshalBuffer(&b); err != nil {
+			t.Fatal(err)
+		} else if !bytes.Equal(resp.Data, sector[:]) {
+			t.Fatal("response data does not match")
+		}
+		if err := rs.Close(); err != nil {
+			t.Fatal(err)
+		} else if err := <-hostErr; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMessageCiphers(t *testing.T) {
+	key := frand.Bytes(32)
+	for _, id := range SupportedCiphers() {
+		c, _, err := newCipher(id, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nonce := frand.Bytes(c.NonceSize())
+		for _, n := range []int{0, 1, 16, MinMessageSize, chunkSize - 1, chunkSize, chunkSize + 1, 3*chunkSize + 100} {
+			msg := frand.Bytes(n)
+
+			// sealing in place and streaming should produce the same message
+			sealed := make([]byte, c.sealedSize(n))
+			copy(sealed, msg)
+			c.seal(sealed, nonce, n)
+			var buf bytes.Buffer
+			sealer := c.newSealer(&buf, nonce, n)
+			for p := msg; len(p) > 0; {
+				w := frand.Intn(len(p)) + 1
+				if _, err := sealer.Write(p[:w]); err != nil {
+					t.Fatal(err)
+				}
+				p = p[w:]
+			}
+			if err := sealer.Close(); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(buf.Bytes(), sealed) {
+				t.Fatalf("%v: streamed %v-byte message does not match sealed message", id, n)
+			}
+
+			// likewise for opening
+			opener, err := c.newOpener(bytes.NewReader(sealed), nonce, len(sealed))
+			if err != nil {
+				t.Fatal(err)
+			}
+			streamed, err := ioutil.ReadAll(opener)
+			if err != nil {
+				t.Fatal(err)
+			} else if err := opener.Verify(); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(streamed, msg) {
+				t.Fatalf("%v: streamed %v-byte message was not opened correctly", id, n)
+			}
+			opened, err := c.open(append([]byte(nil), sealed...), nonce)
+			if err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(opened, msg) {
+				t.Fatalf("%v: %v-byte message was not opened correctly", id, n)
+			}
+
+			// a corrupted message should be rejected
+			sealed[frand.Intn(len(sealed))] ^= 1
+			if _, err := c.open(append([]byte(nil), sealed...), nonce); err == nil {
+				t.Fatalf("%v: corrupted %v-byte message was accepted", id, n)
+			}
+			opener, err = c.newOpener(bytes.NewReader(sealed), nonce, len(sealed))
+			if err == nil {
+				_, err = ioutil.ReadAll(opener)
+				if err == nil {
+					err = opener.Verify()
+				}
+			}
+			if err == nil {
+				t.Fatalf("%v: corrupted %v-byte message was accepted by opener", id, n)
+			}
+		}
+	}
+
+	// a chunked message should not be truncatable at a chunk boundary
+	c, _, _ := newCipher(CipherAES256GCM, key)
+	nonce := frand.Bytes(c.NonceSize())
+	sealed := make([]byte, c.sealedSize(2*chunkSize))
+	c.seal(sealed, nonce, 2*chunkSize)
+	if _, err := c.open(sealed[:c.sealedSize(chunkSize)], nonce); err == nil {
+		t.Fatal("truncated message was accepted")
+	}
+}
+
+func TestTranscript(t *testing.T) {
+	renter, host := newFakeConns()
+	pubkey, privkey, _ := ed25519.GenerateKey(nil)
+	var sector [SectorSize]byte
+	frand.Read(sector[:])
+	lockResp := &RPCLockResponse{
+		Acquired:     true,
+		NewChallenge: frand.Entropy128(),
+		Revision:     randomTxn.FileContractRevisions[0],
+	}
+	writeResp := &RPCWriteResponse{Signature: frand.Bytes(64)}
+	settingsResp := &RPCSettingsResponse{Settings: []byte(`{"foo":1}`)}
+
+	ht := new(Transcript)
+	hostErr := make(chan error, 1)
+	go func() {
+		hostErr <- func() error {
+			hs, err := NewHostSession(host, privkey)
+			if err != nil {
+				return err
+			}
+			defer hs.Close()
+			hs.SetTranscript(ht)
+			for {
+				id, err := hs.ReadID()
+				if errors.Cause(err) == ErrRenterClosed {
+					return nil
+				} else if err != nil {
+					return err
+				}
+				switch id {
+				case RPCLockID:
+					var req RPCLockRequest
+					if err := hs.ReadRequest(&req, 4096); err != nil {
+						return err
+					}
+					err = hs.WriteResponse(lockResp, nil)
+				case RPCWriteID:
+					var req RPCWriteRequest
+					if err := hs.ReadRequest(&req, SectorSize*2); err != nil {
+						return err
+					}
+					err = hs.WriteResponse(writeResp, nil)
+				case RPCSettingsID:
+					err = hs.WriteResponse(settingsResp, nil)
+				default:
+					err = errors.New("unknown specifier")
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}()
+	}()
+
+	// run a few RPCs, using the streaming APIs where possible
+	runRPCs := func(rs *Session) error {
+		var lr RPCLockResponse
+		var wr RPCWriteResponse
+		var sr RPCSettingsResponse
+		lockReq := &RPCLockRequest{Signature: frand.Bytes(64)}
+		if err := rs.WriteRequest(RPCLockID, lockReq); err != nil {
+			return err
+		} else if err := rs.ReadResponse(&lr, 4096); err != nil {
+			return err
+		} else if !deepEqual(lr, *lockResp) {
+			return errors.New("wrong lock response")
+		}
+		writeReq := &RPCWriteRequest{NewRevisionNumber: 2}
+		if err := rs.WriteAppendRequest(writeReq, 1, func() *[SectorSize]byte { return &sector }); err != nil {
+			return err
+		} else if err := rs.ReadResponse(&wr, 4096); err != nil {
+			return err
+		} else if !bytes.Equal(wr.Signature, writeResp.Signature) {
+			return errors.New("wrong write response")
+		}
+		if err := rs.WriteRequest(RPCSettingsID, nil); err != nil {
+			return err
+		}
+		rr, err := rs.RawResponse(4096)
+		if err != nil {
+			return err
+		}
+		var b objBuffer
+		if err := b.copyN(rr, uint64(settingsResp.marshalledSize())); err != nil {
+			return err
+		} else if err := rr.VerifyTag(); err != nil {
+			return err
+		} else if err := sr.unmarshalBuffer(&b); err != nil {
+			return err
+		} else if !bytes.Equal(sr.Settings, settingsResp.Settings) {
+			return errors.New("wrong settings response")
+		}
+		return rs.Close()
+	}
+
+	rs, err := NewRenterSessionWithCiphers(renter, pubkey, []Specifier{CipherChaCha20Poly1305})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rt := new(Transcript)
+	rs.SetTranscript(rt)
+	if err := runRPCs(rs); err != nil {
+		t.Fatal(err)
+	} else if err := <-hostErr; err != nil {
+		t.Fatal(err)
+	}
+
+	// the renter and host should have recorded the same messages
+	if !rt.Renter || ht.Renter {
+		t.Fatal("transcripts have wrong roles")
+	} else if len(rt.Entries) != len(ht.Entries) || len(rt.Entries) != 9 {
+		t.Fatalf("expected 9 entries in each transcript, got %v and %v", len(rt.Entries), len(ht.Entries))
+	}
+	for i := range rt.Entries {
+		re, he := rt.Entries[i], ht.Entries[i]
+		if re.Sent == he.Sent || re.RPC != he.RPC || re.ID != he.ID || re.Size != he.Size {
+			t.Fatalf("entry %v differs: %+v vs %+v", i, re, he)
+		} else if !bytes.HasPrefix(re.Data, he.Data) && !bytes.HasPrefix(he.Data, re.Data) {
+			t.Fatalf("entry %v has different data", i)
+		}
+	}
+	var sb strings.Builder
+	if err := rt.PrettyPrint(&sb); err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range []string{"ID LoopLock", "RPCLockResponse{Acquired:true", "RPCWriteRequest{Actions:[RPCWriteAction{Type:Append", "<4194304 bytes>", "RPCWriteResponse{Signature:<64 bytes>}", `{"foo":1}`, "ID LoopExit"} {
+		if !strings.Contains(sb.String(), s) {
+			t.Fatalf("pretty-printed transcript does not contain %q:\n%v", s, sb.String())
+		}
+	}
+
+	// replay the host's messages, using either transcript
+	for _, tr := range []*Transcript{rt, ht} {
+		if err := runRPCs(NewReplaySession(tr)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// deviating from the transcript should fail
+	rs = NewReplaySession(ht)
+	if err := rs.WriteRequest(RPCSettingsID, nil); err == nil || !strings.Contains(err.Error(), "transcript contains LoopLock") {
+		t.Fatal("expected replay to fail, got", err)
+	}
+}
+
 func TestChallenge(t *testing.T) {
 	s := Session{
 		challenge: frand.Entropy128(),
@@ -493,13 +1370,13 @@ func BenchmarkEncodeTransaction(b *testing.B) {
 }
 
 func BenchmarkWriteMessage(b *testing.B) {
-	aead, _ := chacha20poly1305.New(make([]byte, 32))
+	aead, _, _ := newCipher(CipherChaCha20Poly1305, make([]byte, 32))
 	s := &Session{
 		conn: struct {
 			io.Writer
 			io.ReadCloser
 		}{ioutil.Discard, nil},
-		aead: aead,
+		send: sessionKey{aead: aead},
 	}
 	obj := newSpecifier("Hello, World!")
 	b.ReportAllocs()
@@ -516,13 +1393,13 @@ func BenchmarkReadMessage(b *testing.B) {
 		obj := Specifier(frand.Entropy128())
 
 		var buf bytes.Buffer
-		aead, _ := chacha20poly1305.New(make([]byte, 32))
+		aead, _, _ := newCipher(CipherChaCha20Poly1305, make([]byte, 32))
 		(&Session{
 			conn: struct {
 				io.Writer
 				io.ReadCloser
 			}{&buf, nil},
-			aead: aead,
+			send: sessionKey{aead: aead},
 		}).writeMessage(&obj)
 
 		var rwc struct {
@@ -531,7 +1408,7 @@ func BenchmarkReadMessage(b *testing.B) {
 		}
 		s := &Session{
 			conn: &rwc,
-			aead: aead,
+			recv: sessionKey{aead: aead},
 		}
 
 		b.ResetTimer()
@@ -555,13 +1432,13 @@ func BenchmarkReadMessage(b *testing.B) {
 		}
 
 		var buf bytes.Buffer
-		aead, _ := chacha20poly1305.New(make([]byte, 32))
+		aead, _, _ := newCipher(CipherChaCha20Poly1305, make([]byte, 32))
 		(&Session{
 			conn: struct {
 				io.Writer
 				io.ReadCloser
 			}{&buf, nil},
-			aead: aead,
+			send: sessionKey{aead: aead},
 		}).writeMessage(resp)
 
 		var rwc struct {
@@ -570,7 +1447,7 @@ func BenchmarkReadMessage(b *testing.B) {
 		}
 		s := &Session{
 			conn: &rwc,
-			aead: aead,
+			recv: sessionKey{aead: aead},
 		}
 
 		b.ResetTimer()
@@ -0,0 +1,384 @@
+package renterhost
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// A TranscriptEntry records a single message sent or received by a Session.
+type TranscriptEntry struct {
+	Timestamp time.Time
+	Sent      bool      // whether the recording Session sent the message
+	RPC       Specifier // the RPC in progress
+	ID        bool      // whether the message is the RPC ID itself
+	Size      int       // size of the encrypted message, including padding
+	Data      []byte    // plaintext of the message, excluding padding
+}
+
+// A Transcript is a record of the plaintext messages exchanged in a Session.
+// Messages exchanged during the handshake are not recorded.
+type Transcript struct {
+	Renter  bool // whether the transcript was recorded by the renter
+	Entries []TranscriptEntry
+
+	mu  sync.Mutex
+	rpc Specifier
+}
+
+func (t *Transcript) record(sent bool, obj ProtocolObject, size int, plaintext []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id, isID := obj.(*Specifier)
+	if isID {
+		t.rpc = *id
+	}
+	t.Entries = append(t.Entries, TranscriptEntry{
+		Timestamp: time.Now(),
+		Sent:      sent,
+		RPC:       t.rpc,
+		ID:        isID,
+		Size:      size,
+		Data:      append([]byte(nil), plaintext...),
+	})
+}
+
+// SetTranscript causes the Session to record each message it sends or
+// receives in t. Only one Session may record to a given Transcript, and its
+// Entries should not be accessed while the Session is in use. If t is nil,
+// recording stops.
+func (s *Session) SetTranscript(t *Transcript) {
+	if t != nil {
+		t.Renter = s.isRenter
+	}
+	s.transcript = t
+}
+
+// transcriptObjects lists, for each RPC, the types of the messages sent by the
+// renter and host after the RPC ID. The renter's first message is the request
+// (if the RPC has one); all others are responses. If an RPC has more messages
+// than types, the last type is used for the excess.
+var transcriptObjects = map[Specifier]struct {
+	hasRequest bool
+	renter     []func() ProtocolObject
+	host       []func() ProtocolObject
+}{
+	RPCFormContractID: {
+		true,
+		[]func() ProtocolObject{
+			func() ProtocolObject { return new(RPCFormContractRequest) },
+			func() ProtocolObject { return new(RPCFormContractSignatures) },
+		},
+		[]func() ProtocolObject{
+			func() ProtocolObject { return new(RPCFormContractAdditions) },
+			func() ProtocolObject { return new(RPCFormContractSignatures) },
+		},
+	},
+	RPCRenewClearContractID: {
+		true,
+		[]func() ProtocolObject{
+			func() ProtocolObject { return new(RPCRenewAndClearContractRequest) },
+			func() ProtocolObject { return new(RPCRenewAndClearContractSignatures) },
+		},
+		[]func() ProtocolObject{
+			func() ProtocolObject { return new(RPCFormContractAdditions) },
+			func() ProtocolObject { return new(RPCRenewAndClearContractSignatures) },
+		},
+	},
+	RPCLockID: {
+		true,
+		[]func() ProtocolObject{func() ProtocolObject { return new(RPCLockRequest) }},
+		[]func() ProtocolObject{func() ProtocolObject { return new(RPCLockResponse) }},
+	},
+	RPCReadID: {
+		true,
+		[]func() ProtocolObject{
+			func() ProtocolObject { return new(RPCReadRequest) },
+			func() ProtocolObject { return new(Specifier) },
+		},
+		[]func() ProtocolObject{func() ProtocolObject { return new(RPCReadResponse) }},
+	},
+	RPCSectorRootsID: {
+		true,
+		[]func() ProtocolObject{func() ProtocolObject { return new(RPCSectorRootsRequest) }},
+		[]func() ProtocolObject{func() ProtocolObject { return new(RPCSectorRootsResponse) }},
+	},
+	RPCSettingsID: {
+		false,
+		nil,
+		[]func() ProtocolObject{func() ProtocolObject { return new(RPCSettingsResponse) }},
+	},
+	RPCWriteID: {
+		true,
+		[]func() ProtocolObject{
+			func() ProtocolObject { return new(RPCWriteRequest) },
+			func() ProtocolObject { return new(RPCWriteResponse) },
+		},
+		[]func() ProtocolObject{
+			func() ProtocolObject { return new(RPCWriteMerkleProof) },
+			func() ProtocolObject { return new(RPCWriteResponse) },
+		},
+	},
+}
+
+// decodeEntry decodes the plaintext of e, which is the nth message (after the
+// RPC ID) sent by its sender during the RPC. If decoding succeeds, the decoded
+// object is returned alongside its description.
+func decodeEntry(e TranscriptEntry, fromRenter bool, n int) (string, ProtocolObject) {
+	if e.ID {
+		return "ID " + e.RPC.String(), nil
+	}
+	objs, ok := transcriptObjects[e.RPC]
+	newObjs := objs.host
+	if fromRenter {
+		newObjs = objs.renter
+	}
+	if !ok || len(newObjs) == 0 {
+		return "unknown message " + formatBytes(e.Data), nil
+	}
+	if n >= len(newObjs) {
+		n = len(newObjs) - 1
+	}
+	obj := newObjs[n]()
+
+	var b objBuffer
+	b.write(e.Data)
+	if fromRenter && n == 0 && objs.hasRequest {
+		if err := obj.unmarshalBuffer(&b); err != nil {
+			return fmt.Sprintf("malformed %T (%v) %v", obj, err, formatBytes(e.Data)), nil
+		}
+		return formatObject(obj), obj
+	}
+	resp := rpcResponse{data: obj}
+	if err := resp.unmarshalBuffer(&b); err != nil {
+		return fmt.Sprintf("malformed %T (%v) %v", obj, err, formatBytes(e.Data)), nil
+	} else if resp.err != nil {
+		return fmt.Sprintf("error %q", resp.err.Description), nil
+	} else if r, ok := obj.(*RPCSettingsResponse); ok {
+		return "RPCSettingsResponse{Settings:" + string(r.Settings) + "}", obj
+	}
+	return formatObject(obj), obj
+}
+
+// PrettyPrint writes a human-readable representation of each message in the
+// transcript to w, decoding the message according to its RPC.
+func (t *Transcript) PrettyPrint(w io.Writer) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var renterMsgs, hostMsgs int
+	for _, e := range t.Entries {
+		fromRenter := e.Sent == t.Renter
+		dir := "host -> renter"
+		if fromRenter {
+			dir = "renter -> host"
+		}
+		var desc string
+		var obj ProtocolObject
+		if e.ID {
+			renterMsgs, hostMsgs = 0, 0
+			desc, _ = decodeEntry(e, fromRenter, 0)
+		} else if fromRenter {
+			desc, obj = decodeEntry(e, fromRenter, renterMsgs)
+			renterMsgs++
+		} else {
+			desc, _ = decodeEntry(e, fromRenter, hostMsgs)
+			hostMsgs++
+		}
+		if req, ok := obj.(*RPCWriteRequest); ok && !req.MerkleProof {
+			// the host skips the Merkle proof response
+			hostMsgs++
+		}
+		_, err := fmt.Fprintf(w, "%v  %v  %-16v %8d bytes  %v\n", e.Timestamp.Format("15:04:05.000"), dir, e.RPC, e.Size, desc)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatBytes(p []byte) string {
+	if len(p) > 32 {
+		return fmt.Sprintf("<%v bytes>", len(p))
+	}
+	return hex.EncodeToString(p)
+}
+
+// formatObject formats a decoded protocol object, abbreviating large byte
+// slices.
+func formatObject(obj interface{}) string {
+	var sb strings.Builder
+	formatValue(&sb, reflect.ValueOf(obj))
+	return sb.String()
+}
+
+func formatValue(sb *strings.Builder, v reflect.Value) {
+	stringer := reflect.TypeOf((*fmt.Stringer)(nil)).Elem()
+	if v.Kind() != reflect.Ptr && v.Type().Implements(stringer) && v.CanInterface() {
+		sb.WriteString(v.Interface().(fmt.Stringer).String())
+		return
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			sb.WriteString("nil")
+			return
+		}
+		formatValue(sb, v.Elem())
+	case reflect.Struct:
+		sb.WriteString(v.Type().Name() + "{")
+		for i := 0; i < v.NumField(); i++ {
+			if i > 0 {
+				sb.WriteString(" ")
+			}
+			sb.WriteString(v.Type().Field(i).Name + ":")
+			formatValue(sb, v.Field(i))
+		}
+		sb.WriteString("}")
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			p := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(p), v)
+			sb.WriteString(formatBytes(p))
+			return
+		}
+		sb.WriteString("[")
+		for i := 0; i < v.Len(); i++ {
+			if i > 0 {
+				sb.WriteString(" ")
+			}
+			if i == 8 {
+				fmt.Fprintf(sb, "...(%v total)", v.Len())
+				break
+			}
+			formatValue(sb, v.Index(i))
+		}
+		sb.WriteString("]")
+	default:
+		if v.CanInterface() {
+			fmt.Fprint(sb, v.Interface())
+		} else {
+			sb.WriteString("?")
+		}
+	}
+}
+
+// plaintextAEAD is a StreamAEAD that does not encrypt or authenticate.
+type plaintextAEAD struct{}
+
+func (plaintextAEAD) NonceSize() int { return 0 }
+func (plaintextAEAD) Overhead() int  { return 0 }
+func (plaintextAEAD) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	return append(dst, plaintext...)
+}
+func (plaintextAEAD) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	return append(dst, ciphertext...), nil
+}
+
+func (plaintextAEAD) NewSealer(w io.Writer, nonce []byte, n int) io.WriteCloser {
+	return nopWriteCloser{w}
+}
+func (plaintextAEAD) NewOpener(r io.Reader, nonce []byte, n int) MessageOpener {
+	return plaintextOpener{io.LimitReader(r, int64(n))}
+}
+
+var _ StreamAEAD = plaintextAEAD{}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+type plaintextOpener struct{ io.Reader }
+
+func (o plaintextOpener) Verify() error {
+	_, err := io.Copy(ioutil.Discard, o)
+	return err
+}
+
+// replayConn is the transport of a replayed Session. It supplies the host's
+// messages from a Transcript, and checks that the renter's RPC IDs match those
+// in the Transcript.
+type replayConn struct {
+	mu     sync.Mutex
+	renter []TranscriptEntry
+	host   []TranscriptEntry
+	buf    bytes.Buffer
+	rem    int // unwritten bytes of a streamed renter message
+}
+
+func (c *replayConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.buf.Len() == 0 {
+		if len(c.host) == 0 {
+			return 0, io.EOF
+		}
+		e := c.host[0]
+		c.host = c.host[1:]
+		prefix := make([]byte, 8)
+		binary.LittleEndian.PutUint64(prefix, uint64(len(e.Data)))
+		c.buf.Write(prefix)
+		c.buf.Write(e.Data)
+	}
+	return c.buf.Read(p)
+}
+
+func (c *replayConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.rem > 0 {
+		// a streamed message may span multiple writes
+		c.rem -= len(p)
+		return len(p), nil
+	} else if len(c.renter) == 0 {
+		return 0, errors.New("renter sent more messages than the transcript contains")
+	}
+	e := c.renter[0]
+	c.renter = c.renter[1:]
+	if e.ID && (len(p) < 8+len(e.Data) || !bytes.Equal(p[8:][:len(e.Data)], e.Data)) {
+		var id Specifier
+		copy(id[:], p[8:])
+		return 0, errors.Errorf("renter sent RPC %v, but transcript contains %v", id, e.RPC)
+	}
+	if len(p) >= 8 {
+		c.rem = 8 + int(binary.LittleEndian.Uint64(p)) - len(p)
+	}
+	return len(p), nil
+}
+
+func (c *replayConn) Close() error { return nil }
+
+// NewReplaySession returns a renter Session that replays the host's messages
+// from t. t may have been recorded by either the renter or the host. The
+// Session does not perform a handshake, and its messages are not encrypted;
+// the renter's messages are discarded after checking that their RPC IDs match
+// those in t. Since the host's messages are replayed verbatim, the challenge
+// and any signatures they contain are those of the original Session.
+func NewReplaySession(t *Transcript) *Session {
+	c := new(replayConn)
+	for _, e := range t.Entries {
+		if fromRenter := e.Sent == t.Renter; fromRenter {
+			c.renter = append(c.renter, e)
+		} else {
+			c.host = append(c.host, e)
+		}
+	}
+	return &Session{
+		conn:     c,
+		cipher:   cipherReplay,
+		send:     sessionKey{aead: newMessageCipher(plaintextAEAD{})},
+		recv:     sessionKey{aead: newMessageCipher(plaintextAEAD{})},
+		isRenter: true,
+	}
+}
+
+// cipherReplay identifies replayed Sessions.
+var cipherReplay = newSpecifier("Replay")